@@ -1,25 +1,33 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/certs"
 	"github.com/mumumio1/wproxy/internal/config"
 	"github.com/mumumio1/wproxy/internal/log"
 	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/proxy"
+	"github.com/mumumio1/wproxy/internal/proxyproto"
 	"github.com/mumumio1/wproxy/internal/ratelimit"
+	"github.com/mumumio1/wproxy/internal/redis"
+	"github.com/mumumio1/wproxy/internal/tenant"
+	"github.com/mumumio1/wproxy/internal/upstream"
+	"github.com/quic-go/quic-go/http3"
 )
 
 var (
@@ -29,8 +37,12 @@ var (
 
 func main() {
 	// Parse command-line flags
-	configPath := flag.String("config", "", "Path to configuration file")
+	var configPaths pathList
+	flag.Var(&configPaths, "config", "Path to configuration file; repeat or separate with commas to merge overlays in order")
 	showVersion := flag.Bool("version", false, "Show version information")
+	checkOnly := flag.Bool("check-config", false, "Validate the configuration and exit without starting the server")
+	printSchema := flag.Bool("print-config-schema", false, "Print every configuration key with its default and description, then exit")
+	schemaFormat := flag.String("schema-format", "yaml", "Format of -print-config-schema: yaml (a commented config file) or json (a JSON Schema)")
 	flag.Parse()
 
 	if *showVersion {
@@ -38,19 +50,32 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *printSchema {
+		if err := config.WriteTemplate(os.Stdout, *schemaFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print configuration schema: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *checkOnly {
+		if err := checkConfig(configPaths); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+
 	// Load configuration
-	cfg, err := config.Load(*configPath)
+	cfg, err := config.Load(configPaths...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Initialize logger
-	logger, err := log.NewLogger(log.Config{
-		Level:      cfg.Logging.Level,
-		Format:     cfg.Logging.Format,
-		OutputPath: cfg.Logging.OutputPath,
-	})
+	logger, err := log.NewLogger(loggerConfig(cfg))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
 		os.Exit(1)
@@ -60,106 +85,219 @@ func main() {
 		log.String("version", version),
 		log.String("build_time", buildTime),
 	)
+	for _, w := range cfg.Warnings() {
+		logger.Warn("Configuration warning", log.String("warning", w))
+	}
 
-	// Initialize metrics
+	// Initialize metrics. The middlewares only see the Recorder, which stays
+	// nil when metrics are disabled.
 	var m *metrics.Metrics
+	var recorder metrics.Recorder
 	if cfg.Metrics.Enabled {
-		m = metrics.NewMetrics()
+		m = metrics.NewMetrics(version, buildTime)
+		recorder = m
 		logger.Info("Metrics enabled",
 			log.Int("port", cfg.Metrics.Port),
 			log.String("path", cfg.Metrics.Path),
 		)
 	}
 
-	// Initialize cache
-	var c cache.Cache
+	// Initialize cache. Only the memory cache is cleared on shutdown; a
+	// Redis store is shared with other instances.
+	var c, local cache.Cache
 	if cfg.Cache.Enabled {
-		c = cache.NewMemoryCache(cfg.Cache.MaxSize, cfg.Cache.DefaultTTL)
+		if cfg.Cache.Type != "redis" {
+			local = cache.NewMemoryCacheWithObserver(cfg.Cache.MaxSize, cfg.Cache.DefaultTTL, cache.Watermarks{
+				High: cfg.Cache.EvictionHighWatermark,
+				Low:  cfg.Cache.EvictionLowWatermark,
+			}, recorder)
+			c = local
+		}
+		if cfg.Cache.Type == "redis" || cfg.Cache.Type == "tiered" {
+			client := newRedisClient(cfg.Cache.Redis)
+			defer client.Close()
+			c = cache.NewRedisCache(client, "wproxy:cache:", cfg.Cache.MaxSize)
+			if local != nil {
+				c = cache.NewTieredCache(local, c)
+			}
+		}
 		logger.Info("Cache enabled",
+			log.String("type", cfg.Cache.Type),
 			log.Int64("max_size", cfg.Cache.MaxSize),
 			log.Duration("default_ttl", cfg.Cache.DefaultTTL),
+			log.String("disk_dir", cfg.Cache.DiskDir),
+		)
+
+		// Body files from a previous run belong to entries that are gone
+		if cfg.Cache.DiskDir != "" {
+			if err := cache.RemoveDiskBodies(cfg.Cache.DiskDir); err != nil {
+				logger.Warn("Failed to remove stale cache bodies", log.Error(err))
+			}
+		}
+	}
+
+	// Initialize tenant resolver
+	var resolver *tenant.Resolver
+	if cfg.Tenant.Enabled {
+		resolver, err = tenant.NewResolver(tenantConfig(cfg))
+		if err != nil {
+			logger.Fatal("Invalid tenant configuration", log.Error(err))
+		}
+		logger.Info("Tenant resolution enabled",
+			log.String("source", cfg.Tenant.Source),
 		)
 	}
 
+	// Parse trusted proxies for client IP resolution
+	trustedProxies, err := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		logger.Fatal("Invalid trusted proxies", log.Error(err))
+	}
+
 	// Initialize rate limiter
 	var limiter ratelimit.Limiter
 	var keyExtractor ratelimit.KeyExtractor
 	if cfg.RateLimit.Enabled {
-		limiter = ratelimit.NewTokenBucket(
-			cfg.RateLimit.RequestsPerSecond,
-			cfg.RateLimit.Burst,
-		)
-
-		if cfg.RateLimit.ByAPIKey {
-			keyExtractor = ratelimit.APIKeyExtractor(cfg.RateLimit.APIKeyHeader)
+		if cfg.RateLimit.Quota > 0 {
+			store := ratelimit.NewMemoryQuotaStore(cfg.RateLimit.MaxBuckets)
+			if cfg.RateLimit.QuotaStore == "redis" {
+				client := newRedisClient(cfg.RateLimit.Redis)
+				defer client.Close()
+				store = ratelimit.NewRedisQuotaStore(client, "wproxy:quota:")
+			}
+			limiter = ratelimit.NewQuotaLimiterWithStore(cfg.RateLimit.Quota, cfg.RateLimit.QuotaWindow, store)
 		} else {
-			keyExtractor = ratelimit.IPKeyExtractor
+			limiter = newRateLimiter(cfg.RateLimit, cfg.RateLimit.RequestsPerSecond, cfg.RateLimit.Burst)
 		}
+		if len(cfg.RateLimit.Tiers) > 0 {
+			tiers := make(map[string]ratelimit.Limiter, len(cfg.RateLimit.Tiers))
+			for name, tier := range cfg.RateLimit.Tiers {
+				tiers[name] = newRateLimiter(cfg.RateLimit, tier.RequestsPerSecond, tier.Burst)
+			}
+			limiter = ratelimit.NewTieredLimiter(limiter, tiers, ratelimit.APIKeyTier(cfg.RateLimit.APIKeyTiers))
+		}
+
+		keyExtractor = rateLimitKeyExtractor(cfg.RateLimit, ratelimit.TrustedIPKeyExtractor(trustedProxies))
 
 		logger.Info("Rate limiting enabled",
+			log.String("algorithm", cfg.RateLimit.Algorithm),
 			log.Int("requests_per_second", cfg.RateLimit.RequestsPerSecond),
 			log.Int("burst", cfg.RateLimit.Burst),
+			log.Int("quota", cfg.RateLimit.Quota),
+			log.Duration("quota_window", cfg.RateLimit.QuotaWindow),
+			log.String("quota_store", cfg.RateLimit.QuotaStore),
+			log.Int("tiers", len(cfg.RateLimit.Tiers)),
 			log.Bool("by_ip", cfg.RateLimit.ByIP),
 			log.Bool("by_api_key", cfg.RateLimit.ByAPIKey),
 		)
 	}
 
-	// Parse upstream URL
-	upstreamURL, err := url.Parse(cfg.Upstream.URL)
+	// Build the proxy: upstream pools, mirror and the middleware chain
+	lc := &proxy.Lifecycle{}
+	deps := proxy.Deps{
+		Logger:       logger,
+		Metrics:      recorder,
+		Cache:        c,
+		Limiter:      limiter,
+		KeyExtractor: keyExtractor,
+		Resolver:     resolver,
+		Lifecycle:    lc,
+		Version:      version,
+	}
+	if m != nil {
+		deps.MetricsHandler = m.Handler()
+	}
+	proxyHandler, err := proxy.New(cfg, deps)
 	if err != nil {
-		logger.Fatal("Invalid upstream URL", log.Error(err))
+		logger.Fatal("Invalid proxy configuration", log.Error(err))
 	}
-
-	// Create reverse proxy
-	proxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = upstreamURL.Scheme
-			req.URL.Host = upstreamURL.Host
-			req.Host = upstreamURL.Host
-
-			// Remove forbidden headers
-			for _, header := range cfg.Upstream.ForbiddenHeaders {
-				req.Header.Del(header)
-			}
-		},
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			MaxIdleConns:          cfg.Upstream.MaxIdleConns,
-			MaxIdleConnsPerHost:   cfg.Upstream.MaxConnsPerHost,
-			IdleConnTimeout:       cfg.Upstream.IdleConnTimeout,
-			TLSHandshakeTimeout:   cfg.Upstream.TLSHandshakeTimeout,
-			ResponseHeaderTimeout: cfg.Upstream.Timeout,
-		},
+	if cfg.Upstream.StartupCheck {
+		checkUpstreams(proxyHandler.Backends(), cfg.Upstream.StartupCheckTimeout, logger)
+	}
+	if cfg.Mirror.Enabled {
+		logger.Info("Traffic mirroring enabled",
+			log.String("url", cfg.Redacted().Mirror.URL),
+			log.Float64("sample_rate", cfg.Mirror.SampleRate),
+		)
 	}
-
-	// Create proxy handler with middleware
-	handler := createProxyHandler(proxy, cfg, logger, m, c, limiter, keyExtractor)
 
 	// Create HTTP server
 	serverAddr := fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Server.Port)
 	srv := &http.Server{
 		Addr:         serverAddr,
-		Handler:      handler,
+		Handler:      proxyHandler,
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
+	// Load the server certificate and reload it on SIGHUP
+	var certReloader *certs.Reloader
+	if cfg.Server.TLS.Enabled() {
+		certReloader, err = certs.New(certsConfig(cfg))
+		if err != nil {
+			logger.Fatal("Invalid TLS configuration", log.Error(err))
+		}
+		srv.TLSConfig = certReloader.TLSConfig()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go reloadOnSignal(hup, certReloader, logger)
+	}
+
+	// Reload the upstream backends from the config files on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go reloadUpstreamOnSignal(reload, configPaths, proxyHandler, logger)
+
+	// Start HTTP/3 server if enabled, sharing the same handler
+	var h3Srv *http3.Server
+	if cfg.Server.HTTP3 {
+		h3Srv = newHTTP3Server(cfg, proxyHandler, certReloader)
+		srv.Handler = altSvcMiddleware(proxyHandler, h3Srv)
+
+		go func() {
+			logger.Info("Starting HTTP/3 server", log.String("address", serverAddr))
+			if err := h3Srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("HTTP/3 server error", log.Error(err))
+			}
+		}()
+	}
+
+	// Start the HTTP to HTTPS redirect listener if enabled
+	var redirectSrv *http.Server
+	if cfg.Server.TLS.RedirectPort != 0 {
+		redirectAddr := fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Server.TLS.RedirectPort)
+		redirectSrv = &http.Server{
+			Addr:         redirectAddr,
+			Handler:      httpsRedirectHandler(cfg.Server.Port),
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+
+		go func() {
+			logger.Info("Starting HTTPS redirect server", log.String("address", redirectAddr))
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("HTTPS redirect server error", log.Error(err))
+			}
+		}()
+	}
+
 	// Start metrics server if enabled
 	var metricsSrv *http.Server
-	if cfg.Metrics.Enabled {
+	if cfg.Metrics.Enabled && (!cfg.Metrics.SamePort || cfg.Debug.Pprof) {
 		metricsAddr := fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Metrics.Port)
 		metricsSrv = &http.Server{
 			Addr:    metricsAddr,
-			Handler: m.Handler(),
+			Handler: proxy.MetricsHandler(cfg, m),
 		}
 
 		go func() {
-			logger.Info("Starting metrics server", log.String("address", metricsAddr))
+			logger.Info("Starting metrics server",
+				log.String("address", metricsAddr),
+				log.Bool("pprof", cfg.Debug.Pprof),
+			)
 			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				logger.Error("Metrics server error", log.Error(err))
 			}
@@ -168,333 +306,406 @@ func main() {
 
 	// Start main server
 	go func() {
+		upstreams := make([]string, 0, len(proxyHandler.Backends()))
+		for _, b := range proxyHandler.Backends() {
+			upstreams = append(upstreams, b.URL.Redacted())
+		}
 		logger.Info("Starting proxy server",
 			log.String("address", serverAddr),
-			log.String("upstream", cfg.Upstream.URL),
+			log.Bool("tls", cfg.Server.TLS.Enabled()),
+			log.Bool("proxy_protocol", cfg.Server.ProxyProtocol.Enabled),
+			log.Any("upstreams", upstreams),
 		)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		ln, err := listen(cfg)
+		if err != nil {
+			logger.Fatal("Failed to listen", log.Error(err))
+		}
+		if cfg.Server.TLS.Enabled() {
+			// The certificate comes from srv.TLSConfig
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Server error", log.Error(err))
 		}
 	}()
 
-	// Wait for interrupt signal
+	// Fill the cache with the configured paths in the background
+	warmupCtx, stopWarmup := context.WithCancel(context.Background())
+	defer stopWarmup()
+	if c != nil && len(cfg.Cache.WarmupURLs) > 0 {
+		logger.Info("Starting cache warmup", log.Int("urls", len(cfg.Cache.WarmupURLs)))
+		go proxyHandler.WarmCache(warmupCtx, cfg.Cache.WarmupURLs)
+	}
+
+	// Wait for interrupt signal, then stop reporting ready and give load
+	// balancers time to notice before refusing connections
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	drainOnSignal(quit, lc, cfg.Server.DrainDelay, logger)
+	stopWarmup()
 
-	logger.Info("Shutting down server...")
+	logger.Info("Shutting down server...",
+		log.Int64("in_flight", lc.InFlight()),
+	)
 
 	// Graceful shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		logger.Error("Server shutdown error", log.Error(err))
+	servers := &Server{}
+	servers.addTraffic("proxy", srv)
+	if h3Srv != nil {
+		servers.addTraffic("HTTP/3", h3Srv)
+	}
+	if redirectSrv != nil {
+		servers.addTraffic("HTTPS redirect", redirectSrv)
 	}
-
 	if metricsSrv != nil {
-		if err := metricsSrv.Shutdown(ctx); err != nil {
-			logger.Error("Metrics server shutdown error", log.Error(err))
-		}
+		servers.metrics = metricsSrv
 	}
 
-	logger.Info("Server stopped")
-}
+	stopLogging := logInFlight(lc, time.Second, logger)
+	if err := servers.Shutdown(ctx); err != nil {
+		logger.Error("Server shutdown error",
+			log.Error(err),
+			log.Int64("in_flight", lc.InFlight()),
+		)
+	}
+	stopLogging()
 
-// createProxyHandler creates the main HTTP handler with all middleware
-func createProxyHandler(
-	proxy *httputil.ReverseProxy,
-	cfg *config.Config,
-	logger log.Logger,
-	m *metrics.Metrics,
-	c cache.Cache,
-	limiter ratelimit.Limiter,
-	keyExtractor ratelimit.KeyExtractor,
-) http.Handler {
-	mux := http.NewServeMux()
-
-	// Health check endpoint
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"healthy"}`)
-	})
+	proxyHandler.Close()
 
-	// Readiness check endpoint
-	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"ready"}`)
-	})
+	if local != nil {
+		local.Clear()
+	}
 
-	// Proxy handler
-	proxyHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handleProxy(w, r, proxy, cfg, m, c)
-	})
+	logger.Info("Server stopped")
+}
 
-	mux.Handle("/", proxyHandler)
+// shutdowner is a listener that can stop gracefully
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
 
-	// Apply middleware chain
-	var handler http.Handler = mux
+// namedServer is a traffic listener, named for shutdown errors
+type namedServer struct {
+	name string
+	srv  shutdowner
+}
 
-	// Request ID middleware
-	handler = requestIDMiddleware(handler)
+// Server groups the listeners of the proxy so they stop in order. The
+// traffic listeners stop accepting together and drain their in-flight
+// requests; the metrics server goes last so scrapes during the drain still
+// succeed.
+type Server struct {
+	traffic []namedServer
+	metrics shutdowner
+}
 
-	// Logging middleware
-	handler = loggingMiddleware(handler, logger)
+// addTraffic registers a listener that serves client traffic
+func (s *Server) addTraffic(name string, srv shutdowner) {
+	s.traffic = append(s.traffic, namedServer{name: name, srv: srv})
+}
 
-	// Metrics middleware
-	if m != nil {
-		handler = metricsMiddleware(handler, m)
+// Shutdown stops the traffic listeners, waits for them to drain within ctx
+// and then stops the metrics server
+func (s *Server) Shutdown(ctx context.Context) error {
+	errs := make([]error, len(s.traffic))
+	var wg sync.WaitGroup
+	for i, t := range s.traffic {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := t.srv.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s server: %w", t.name, err)
+			}
+		}()
 	}
+	wg.Wait()
 
-	// Rate limiting middleware
-	if limiter != nil {
-		handler = rateLimitMiddleware(handler, limiter, keyExtractor, m, logger)
+	if s.metrics != nil {
+		if err := s.metrics.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("metrics server: %w", err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	return handler
+// listen opens the main TCP listener. Behind an L4 load balancer it reads
+// the PROXY protocol header so RemoteAddr is the real client.
+func listen(cfg *config.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Server.Port))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server.ProxyProtocol.Enabled {
+		return proxyproto.NewListener(ln, cfg.Server.ProxyProtocol.HeaderTimeout), nil
+	}
+	return ln, nil
 }
 
-// handleProxy handles the main proxy logic with caching
-func handleProxy(
-	w http.ResponseWriter,
-	r *http.Request,
-	proxy *httputil.ReverseProxy,
-	cfg *config.Config,
-	m *metrics.Metrics,
-	c cache.Cache,
-) {
-	// Check cache if enabled
-	if c != nil && cache.IsCacheable(r, 0, nil) {
-		cacheKey := cache.CacheKey(r, nil)
-
-		// Check If-None-Match (ETag)
-		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
-			if entry, ok := c.Get(cacheKey); ok && entry.ETag == ifNoneMatch {
-				if m != nil {
-					m.RecordCacheHit(r.Method, r.URL.Path)
-				}
-				w.WriteHeader(http.StatusNotModified)
-				return
-			}
-		}
+// certsConfig maps the server TLS settings to a certificate reloader
+func certsConfig(cfg *config.Config) certs.Config {
+	return certs.Config{
+		CertFile:     cfg.Server.TLS.CertFile,
+		KeyFile:      cfg.Server.TLS.KeyFile,
+		MinVersion:   cfg.Server.TLS.MinVersion,
+		CipherSuites: cfg.Server.TLS.CipherSuites,
+	}
+}
 
-		// Try to get from cache
-		if entry, ok := c.Get(cacheKey); ok {
-			if m != nil {
-				m.RecordCacheHit(r.Method, r.URL.Path)
-			}
+// rateLimitKeyExtractor selects what a rate limit budget belongs to: the
+// API key (or the IP for requests without one) with by_api_key, the API
+// key and client IP together when by_ip is set as well, and otherwise the
+// client IP
+func rateLimitKeyExtractor(cfg config.RateLimitConfig, ip ratelimit.KeyExtractor) ratelimit.KeyExtractor {
+	switch {
+	case cfg.ByAPIKey && cfg.ByIP:
+		return ratelimit.APIKeyAndIPKeyExtractor(cfg.APIKeyHeader, ip)
+	case cfg.ByAPIKey:
+		return ratelimit.APIKeyExtractor(cfg.APIKeyHeader, ip)
+	default:
+		return ip
+	}
+}
 
-			// Write cached response
-			for key, values := range entry.Headers {
-				for _, value := range values {
-					w.Header().Add(key, value)
-				}
-			}
-			w.Header().Set("X-Cache", "HIT")
-			if entry.ETag != "" {
-				w.Header().Set("ETag", entry.ETag)
-			}
-			w.WriteHeader(entry.StatusCode)
-			w.Write(entry.Body)
-			return
+// checkConfig loads the configuration and builds everything startup builds
+// from it, without opening listeners, so a broken configuration is caught
+// before deployment. It returns the first problem found.
+func checkConfig(paths []string) error {
+	cfg, err := config.Load(paths...)
+	if err != nil {
+		return err
+	}
+	if _, err := log.NewLogger(loggerConfig(cfg)); err != nil {
+		return fmt.Errorf("invalid logging configuration: %w", err)
+	}
+	if _, err := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	if cfg.Tenant.Enabled {
+		if _, err := tenant.NewResolver(tenantConfig(cfg)); err != nil {
+			return fmt.Errorf("invalid tenant configuration: %w", err)
 		}
-
-		if m != nil {
-			m.RecordCacheMiss(r.Method, r.URL.Path)
+	}
+	deps := proxy.Deps{Logger: log.NewNopLogger()}
+	if cfg.Metrics.Enabled {
+		deps.MetricsHandler = metrics.NewMetrics(version, buildTime).Handler()
+	}
+	p, err := proxy.New(cfg, deps)
+	if err != nil {
+		return fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+	p.Close()
+	if cfg.Server.TLS.Enabled() {
+		if _, err := certs.New(certsConfig(cfg)); err != nil {
+			return fmt.Errorf("invalid TLS configuration: %w", err)
 		}
 	}
+	return nil
+}
 
-	// Cache miss or caching disabled - proxy to upstream
-	// Wrap response writer to capture response
-	rec := &responseRecorder{
-		ResponseWriter: w,
-		statusCode:     http.StatusOK,
-		body:           &[]byte{},
+// loggerConfig converts the logging settings for the logger
+func loggerConfig(cfg *config.Config) log.Config {
+	return log.Config{
+		Level:      cfg.Logging.Level,
+		Format:     cfg.Logging.Format,
+		OutputPath: cfg.Logging.OutputPath,
+		Rotate: log.RotateConfig{
+			MaxSizeMB:  cfg.Logging.MaxSizeMB,
+			MaxAgeDays: cfg.Logging.MaxAgeDays,
+			MaxBackups: cfg.Logging.MaxBackups,
+			Compress:   cfg.Logging.Compress,
+			Daily:      cfg.Logging.RotateDaily,
+		},
 	}
+}
 
-	proxy.ServeHTTP(rec, r)
-
-	// Cache response if applicable
-	if c != nil && cache.IsCacheable(r, rec.statusCode, rec.Header()) {
-		cacheKey := cache.CacheKey(r, nil)
-		ttl := cache.ParseTTL(rec.Header(), cfg.Cache.DefaultTTL)
-		etag := cache.GenerateETag(*rec.body)
-
-		entry := &cache.Entry{
-			StatusCode: rec.statusCode,
-			Headers:    rec.Header().Clone(),
-			Body:       *rec.body,
-			ETag:       etag,
-			ExpiresAt:  time.Now().Add(ttl),
-			CreatedAt:  time.Now(),
-			Size:       int64(len(*rec.body)),
-		}
+// tenantConfig converts the tenant settings for the resolver
+func tenantConfig(cfg *config.Config) tenant.Config {
+	return tenant.Config{
+		Source:          cfg.Tenant.Source,
+		Header:          cfg.Tenant.Header,
+		Claim:           cfg.Tenant.Claim,
+		BaseDomain:      cfg.Tenant.BaseDomain,
+		Default:         cfg.Tenant.Default,
+		MaxMetricLabels: cfg.Tenant.MaxMetricLabels,
+	}
+}
 
-		c.Set(cacheKey, entry)
+// pathList is a flag holding file paths from comma-separated values and
+// repeated uses of the flag, in order
+type pathList []string
 
-		// Set cache headers
-		rec.Header().Set("X-Cache", "MISS")
-		rec.Header().Set("ETag", etag)
-	}
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
 }
 
-// responseRecorder wraps http.ResponseWriter to capture the response
-type responseRecorder struct {
-	http.ResponseWriter
-	statusCode int
-	body       *[]byte
-	written    bool
+func (p *pathList) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			*p = append(*p, path)
+		}
+	}
+	return nil
 }
 
-func (rec *responseRecorder) WriteHeader(code int) {
-	if !rec.written {
-		rec.statusCode = code
-		rec.ResponseWriter.WriteHeader(code)
-		rec.written = true
+// reloadUpstreamOnSignal loads the config files each time a signal arrives
+// and points the proxy at their upstream backends. Other settings need a
+// restart. A failed reload keeps the previous backends.
+func reloadUpstreamOnSignal(sig <-chan os.Signal, configPaths []string, p *proxy.Proxy, logger log.Logger) {
+	for range sig {
+		cfg, err := config.Load(configPaths...)
+		if err == nil {
+			err = p.UpdateUpstream(cfg)
+		}
+		if err != nil {
+			logger.Error("Upstream reload failed", log.Error(err))
+			continue
+		}
+		logger.Info("Upstream reloaded", log.Int("backends", len(p.Backends())))
 	}
 }
 
-func (rec *responseRecorder) Write(b []byte) (int, error) {
-	if !rec.written {
-		rec.WriteHeader(http.StatusOK)
+// reloadOnSignal reloads the server certificate each time a signal
+// arrives. A failed reload keeps serving the previous certificate.
+func reloadOnSignal(sig <-chan os.Signal, r *certs.Reloader, logger log.Logger) {
+	for range sig {
+		if err := r.Reload(); err != nil {
+			logger.Error("TLS certificate reload failed", log.Error(err))
+			continue
+		}
+		logger.Info("TLS certificate reloaded")
 	}
-	*rec.body = append(*rec.body, b...)
-	return rec.ResponseWriter.Write(b)
 }
 
-// requestIDMiddleware adds a unique request ID to each request
-func requestIDMiddleware(next http.Handler) http.Handler {
+// httpsRedirectHandler permanently redirects every request to the same
+// host and path on the HTTPS port
+func httpsRedirectHandler(port int) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Header.Get("X-Request-ID")
-		if requestID == "" {
-			requestID = uuid.New().String()
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
 		}
-
-		ctx := context.WithValue(r.Context(), log.RequestIDKey, requestID)
-		w.Header().Set("X-Request-ID", requestID)
-
-		next.ServeHTTP(w, r.WithContext(ctx))
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		// 308 keeps the method and body, unlike 301
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
 	})
 }
 
-// loggingMiddleware logs HTTP requests
-func loggingMiddleware(next http.Handler, logger log.Logger) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Wrap response writer to capture status code
-		ww := &wrappedWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(ww, r)
-
-		duration := time.Since(start)
-
-		logger.Info("HTTP request",
-			log.String("method", r.Method),
-			log.String("path", r.URL.Path),
-			log.String("remote_addr", r.RemoteAddr),
-			log.Int("status", ww.statusCode),
-			log.Duration("duration", duration),
-		)
-	})
+// newHTTP3Server creates an HTTP/3 server on the main address serving the
+// listener's certificate
+func newHTTP3Server(cfg *config.Config, handler http.Handler, certReloader *certs.Reloader) *http3.Server {
+	return &http3.Server{
+		Addr:        fmt.Sprintf("%s:%d", cfg.Server.Address, cfg.Server.Port),
+		Handler:     handler,
+		TLSConfig:   http3.ConfigureTLSConfig(certReloader.TLSConfig()),
+		IdleTimeout: cfg.Server.IdleTimeout,
+	}
 }
 
-// metricsMiddleware records request metrics
-func metricsMiddleware(next http.Handler, m *metrics.Metrics) http.Handler {
+// altSvcMiddleware advertises the HTTP/3 endpoint to HTTP/1.1 and HTTP/2
+// clients so they can upgrade on subsequent requests
+func altSvcMiddleware(next http.Handler, h3 *http3.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		m.IncActiveConnections()
-		defer m.DecActiveConnections()
-
-		ww := &wrappedWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(ww, r)
-
-		duration := time.Since(start)
-
-		// Get request/response sizes
-		requestSize := r.ContentLength
-		if requestSize < 0 {
-			requestSize = 0
-		}
-
-		responseSize := ww.bytesWritten
-
-		m.RecordRequest(
-			r.Method,
-			r.URL.Path,
-			ww.statusCode,
-			duration,
-			requestSize,
-			responseSize,
-		)
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
 	})
 }
 
-// rateLimitMiddleware applies rate limiting
-func rateLimitMiddleware(
-	next http.Handler,
-	limiter ratelimit.Limiter,
-	keyExtractor ratelimit.KeyExtractor,
-	m *metrics.Metrics,
-	logger log.Logger,
-) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := keyExtractor(r)
-
-		if !limiter.Allow(key) {
-			if m != nil {
-				m.RecordRateLimitDrop()
-			}
-
-			logger.Warn("Rate limit exceeded",
-				log.String("key", key),
-				log.String("path", r.URL.Path),
-			)
-
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", limiter.Wait(key).Seconds()))
-			w.WriteHeader(http.StatusTooManyRequests)
-			fmt.Fprintf(w, `{"error":"rate limit exceeded"}`)
-			return
-		}
+// drainOnSignal blocks until a signal arrives, flips readiness and waits
+// for the drain delay while logging the in-flight request count. New
+// requests are refused from then on, while the servers shut down.
+func drainOnSignal(quit <-chan os.Signal, lc *proxy.Lifecycle, delay time.Duration, logger log.Logger) {
+	sig := <-quit
+	lc.StartDrain()
+
+	logger.Info("Draining connections",
+		log.String("signal", sig.String()),
+		log.Duration("drain_delay", delay),
+		log.Int64("in_flight", lc.InFlight()),
+	)
 
-		next.ServeHTTP(w, r)
-	})
+	if delay > 0 {
+		stop := logInFlight(lc, time.Second, logger)
+		time.Sleep(delay)
+		stop()
+	}
+	lc.StartShutdown()
 }
 
-// wrappedWriter wraps http.ResponseWriter to capture status code and bytes written
-type wrappedWriter struct {
-	http.ResponseWriter
-	statusCode   int
-	bytesWritten int64
-	written      bool
+// logInFlight periodically logs the in-flight request count until stopped
+func logInFlight(lc *proxy.Lifecycle, interval time.Duration, logger log.Logger) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logger.Info("Waiting for in-flight requests",
+					log.Int64("in_flight", lc.InFlight()),
+				)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
 }
 
-func (ww *wrappedWriter) WriteHeader(code int) {
-	if !ww.written {
-		ww.statusCode = code
-		ww.ResponseWriter.WriteHeader(code)
-		ww.written = true
+// checkUpstreams dials every backend and logs a warning for each one that
+// can't be reached, returning how many failed. It only warns: a backend
+// may come up after the proxy does.
+func checkUpstreams(backends []*upstream.Backend, timeout time.Duration, logger log.Logger) int {
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for _, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", b.Addr(), timeout)
+			if err != nil {
+				failed.Add(1)
+				logger.Warn("Upstream backend unreachable at startup",
+					log.String("url", b.URL.Redacted()),
+					log.Error(err),
+				)
+				return
+			}
+			conn.Close()
+		}()
 	}
+	wg.Wait()
+	return int(failed.Load())
 }
 
-func (ww *wrappedWriter) Write(b []byte) (int, error) {
-	if !ww.written {
-		ww.WriteHeader(http.StatusOK)
+// newRateLimiter creates a limiter using the configured algorithm and
+// cleanup schedule
+func newRateLimiter(cfg config.RateLimitConfig, requestsPerSecond, burst int) ratelimit.Limiter {
+	cleanup := ratelimit.Cleanup{
+		Interval:    cfg.CleanupInterval,
+		Jitter:      cfg.CleanupJitter,
+		IdleTimeout: cfg.IdleTimeout,
+		MaxBuckets:  cfg.MaxBuckets,
+	}
+	if cfg.Algorithm == "gcra" {
+		return ratelimit.NewGCRAWithCleanup(requestsPerSecond, burst, cleanup)
 	}
-	n, err := ww.ResponseWriter.Write(b)
-	ww.bytesWritten += int64(n)
-	return n, err
+	return ratelimit.NewTokenBucketWithCleanup(requestsPerSecond, burst, cleanup)
 }
 
-func (ww *wrappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	h, ok := ww.ResponseWriter.(http.Hijacker)
-	if !ok {
-		return nil, nil, fmt.Errorf("hijack not supported")
-	}
-	return h.Hijack()
+// newRedisClient creates a client for the configured Redis server
+func newRedisClient(cfg config.RedisConfig) *redis.Client {
+	return redis.NewClient(redis.Options{
+		Address:  cfg.Address,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
 }
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/mumumio1/wproxy/internal/certs"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/proxy"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+)
+
+// newTestUpstream starts an upstream server using the given handler
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestConfig returns a default configuration pointing at the given upstream
+func newTestConfig(t *testing.T, upstreamURL string) *config.Config {
+	t.Helper()
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Upstream.URL = upstreamURL
+	return cfg
+}
+
+// newTestHandler builds the full proxy chain for cfg
+func newTestHandler(t *testing.T, cfg *config.Config, deps proxy.Deps) *proxy.Proxy {
+	t.Helper()
+	p, err := proxy.New(cfg, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestReadyFlipsOnDrainSignal(t *testing.T) {
+	release := make(chan struct{})
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	lc := &proxy.Lifecycle{}
+	handler := newTestHandler(t, cfg, proxy.Deps{Logger: log.NewNopLogger(), Lifecycle: lc})
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected ready before signal, got %d", code)
+	}
+
+	// Start a slow request so it is in flight during the drain
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	for lc.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	quit := make(chan os.Signal, 1)
+	quit <- syscall.SIGTERM
+	start := time.Now()
+	drainOnSignal(quit, lc, 50*time.Millisecond, log.NewNopLogger())
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected drain delay to be honored, returned after %v", elapsed)
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after signal, got %d", code)
+	}
+	if n := lc.InFlight(); n != 1 {
+		t.Errorf("expected 1 in-flight request during drain, got %d", n)
+	}
+
+	close(release)
+	<-done
+	if n := lc.InFlight(); n != 0 {
+		t.Errorf("expected no in-flight requests after completion, got %d", n)
+	}
+}
+
+func TestRequestsRefusedAfterDrain(t *testing.T) {
+	release := make(chan struct{})
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.ShutdownTimeout = 1500 * time.Millisecond
+	lc := &proxy.Lifecycle{}
+	handler := newTestHandler(t, cfg, proxy.Deps{Logger: log.NewNopLogger(), Lifecycle: lc})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	// A request in flight when shutdown begins completes normally
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- get("/slow") }()
+	for lc.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// During the drain delay load balancers may still send traffic
+	quit := make(chan os.Signal, 1)
+	quit <- syscall.SIGTERM
+	drained := make(chan struct{})
+	go func() {
+		drainOnSignal(quit, lc, 100*time.Millisecond, log.NewNopLogger())
+		close(drained)
+	}()
+	for !lc.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	if rec := get("/api"); rec.Code != http.StatusOK {
+		t.Errorf("expected requests to be served during the drain delay, got %d", rec.Code)
+	}
+
+	<-drained
+	rec := get("/api")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once shutdown begins, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Connection"); got != "close" {
+		t.Errorf("expected Connection: close, got %q", got)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After to cover the shutdown timeout, got %q", got)
+	}
+
+	close(release)
+	if rec := <-slow; rec.Code != http.StatusOK {
+		t.Errorf("expected the in-flight request to complete, got %d", rec.Code)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// returns the cert and key paths along with a pool trusting it
+func writeTestCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wproxy-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+func TestTLSListenerReloadsCertificate(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	})
+
+	certFile, keyFile, roots := writeTestCertificate(t)
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.TLS.CertFile = certFile
+	cfg.Server.TLS.KeyFile = keyFile
+	cfg.Server.TLS.MinVersion = "1.3"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	certReloader, err := certs.New(certsConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, cfg, proxy.Deps{Logger: log.NewNopLogger()})
+	// Serve the way main does, with the certificate coming from TLSConfig
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler, TLSConfig: certReloader.TLSConfig()}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	target := "https://" + ln.Addr().String()
+
+	get := func(roots *x509.CertPool, maxVersion uint16) (*http.Response, error) {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: maxVersion}}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get(target)
+		if err != nil {
+			return nil, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	resp, err := get(roots, 0)
+	if err != nil {
+		t.Fatalf("TLS request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("expected 200 over TLS 1.3, got %d version %x", resp.StatusCode, resp.TLS.Version)
+	}
+	if _, err := get(roots, tls.VersionTLS12); err == nil {
+		t.Error("expected TLS 1.2 to be rejected by min_version 1.3")
+	}
+
+	// Rotate the files on disk; the listener keeps the old certificate
+	// until it is reloaded
+	newCert, newKey, newRoots := writeTestCertificate(t)
+	for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := get(roots, 0); err != nil {
+		t.Fatalf("expected old certificate before reload: %v", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	hup <- syscall.SIGHUP
+	close(hup)
+	reloadOnSignal(hup, certReloader, log.NewNopLogger())
+
+	if _, err := get(newRoots, 0); err != nil {
+		t.Errorf("expected rotated certificate after reload: %v", err)
+	}
+	if _, err := get(roots, 0); err == nil {
+		t.Error("expected old certificate to be replaced")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		port       int
+		host, want string
+	}{
+		{8443, "example.com:8080", "https://example.com:8443/a/b?c=d"},
+		{443, "example.com", "https://example.com/a/b?c=d"},
+		{443, "[::1]:80", "https://[::1]/a/b?c=d"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/a/b?c=d", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		httpsRedirectHandler(tt.port).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: expected 308, got %d", tt.host, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s: expected Location %q, got %q", tt.host, tt.want, got)
+		}
+	}
+}
+
+func TestHTTP3RequestThroughProxy(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	})
+
+	certFile, keyFile, roots := writeTestCertificate(t)
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.Address = "127.0.0.1"
+	cfg.Server.HTTP3 = true
+	cfg.Server.TLS = config.ServerTLSConfig{CertFile: certFile, KeyFile: keyFile}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newTestHandler(t, cfg, proxy.Deps{Logger: log.NewNopLogger()})
+	certReloader, err := certs.New(certsConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3Srv := newHTTP3Server(cfg, handler, certReloader)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h3Srv.Serve(conn)
+	t.Cleanup(func() { h3Srv.Close() })
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	t.Cleanup(func() { tr.Close() })
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("https://" + conn.LocalAddr().String() + "/quic")
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.ProtoMajor != 3 {
+		t.Errorf("expected HTTP/3, got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello /quic" {
+		t.Errorf("expected proxied upstream response, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Error("expected the shared middleware chain to set X-Request-ID")
+	}
+
+	// TCP clients learn about the QUIC endpoint through Alt-Svc
+	rec := httptest.NewRecorder()
+	altSvcMiddleware(handler, h3Srv).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Header().Get("Alt-Svc"), "h3=") {
+		t.Errorf("expected Alt-Svc to advertise h3, got %q", rec.Header().Get("Alt-Svc"))
+	}
+}
+
+func TestProxyProtocolClientAddress(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.Address = "127.0.0.1"
+	cfg.Server.Port = 0
+	cfg.Server.ProxyProtocol.Enabled = true
+	core, logs := observer.New(zapcore.InfoLevel)
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	handler := newTestHandler(t, cfg, proxy.Deps{
+		Logger:       log.NewWithCore(core),
+		Limiter:      limiter,
+		KeyExtractor: ratelimit.IPKeyExtractor,
+	})
+
+	ln, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	send := func(header []byte) int {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(header)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	v1 := []byte("PROXY TCP4 192.0.2.1 127.0.0.1 40000 80\r\n")
+	// v2 PROXY command for TCP over IPv4 from 198.51.100.2:40000
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"),
+		198, 51, 100, 2, 127, 0, 0, 1, 0x9c, 0x40, 0x00, 0x50)
+
+	// The limiter keys on the address from the header, not the loopback peer
+	if code := send(v1); code != http.StatusOK {
+		t.Errorf("expected first v1 request to pass, got %d", code)
+	}
+	if code := send(v1); code != http.StatusTooManyRequests {
+		t.Errorf("expected second v1 request to be limited, got %d", code)
+	}
+	if code := send(v2); code != http.StatusOK {
+		t.Errorf("expected v2 client to have its own bucket, got %d", code)
+	}
+
+	var addrs []interface{}
+	for _, entry := range logs.FilterMessage("HTTP request").All() {
+		addrs = append(addrs, entry.ContextMap()["remote_addr"])
+	}
+	// The limited request is rejected before the logging middleware
+	if len(addrs) != 2 || addrs[0] != "192.0.2.1:40000" || addrs[1] != "198.51.100.2:40000" {
+		t.Errorf("expected logs to show the client addresses from the headers, got %v", addrs)
+	}
+}
+
+func TestCheckUpstreams(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	cfg := newTestConfig(t, "")
+	cfg.Upstream.Backends = []config.BackendConfig{{URL: up.URL}, {URL: down}}
+	p := newTestHandler(t, cfg, proxy.Deps{Logger: log.NewNopLogger()})
+
+	if failed := checkUpstreams(p.Backends(), time.Second, log.NewNopLogger()); failed != 1 {
+		t.Errorf("expected 1 unreachable backend, got %d", failed)
+	}
+}
+
+// orderedShutdowner records when it was shut down, optionally blocking
+// until released to simulate draining requests
+type orderedShutdowner struct {
+	name    string
+	events  chan<- string
+	release <-chan struct{}
+	err     error
+}
+
+func (s *orderedShutdowner) Shutdown(ctx context.Context) error {
+	s.events <- s.name + " start"
+	if s.release != nil {
+		<-s.release
+	}
+	s.events <- s.name + " done"
+	return s.err
+}
+
+func TestServerShutdownOrder(t *testing.T) {
+	events := make(chan string, 10)
+	release := make(chan struct{})
+
+	s := &Server{}
+	s.addTraffic("proxy", &orderedShutdowner{name: "proxy", events: events, release: release})
+	s.addTraffic("HTTP/3", &orderedShutdowner{name: "h3", events: events})
+	s.metrics = &orderedShutdowner{name: "metrics", events: events}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	// Both traffic listeners stop at once, and metrics waits for the drain
+	seen := map[string]bool{}
+	for len(seen) < 3 {
+		select {
+		case e := <-events:
+			seen[e] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected traffic listeners to stop concurrently, saw %v", seen)
+		}
+	}
+	if !seen["proxy start"] || !seen["h3 start"] || !seen["h3 done"] {
+		t.Fatalf("unexpected events before the drain finished: %v", seen)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("expected nothing before the proxy drained, got %q", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	var order []string
+	for i := 0; i < 3; i++ {
+		order = append(order, <-events)
+	}
+	if order[0] != "proxy done" || order[1] != "metrics start" || order[2] != "metrics done" {
+		t.Errorf("expected the metrics server to stop after the drain, got %v", order)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+}
+
+func TestServerShutdownErrors(t *testing.T) {
+	events := make(chan string, 10)
+	s := &Server{}
+	s.addTraffic("proxy", &orderedShutdowner{name: "proxy", events: events, err: context.DeadlineExceeded})
+	s.metrics = &orderedShutdowner{name: "metrics", events: events, err: errors.New("boom")}
+
+	err := s.Shutdown(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the proxy error to be reported, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "metrics server: boom") {
+		t.Errorf("expected the metrics error to be reported, got %v", err)
+	}
+}
+
+func TestPathListFlag(t *testing.T) {
+	var paths pathList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&paths, "config", "")
+	if err := fs.Parse([]string{"-config", "base.yaml, prod.yaml", "-config", "local.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(paths, pathList{"base.yaml", "prod.yaml", "local.yaml"}) {
+		t.Errorf("unexpected paths %v", paths)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	valid := write("valid.yaml", "upstream:\n  url: http://localhost:9000\n")
+	if err := checkConfig([]string{valid}); err != nil {
+		t.Errorf("expected valid config, got %v", err)
+	}
+
+	invalid := write("invalid.yaml", "upstream:\n  url: \"ftp://localhost:9000\"\n")
+	if err := checkConfig([]string{invalid}); err == nil {
+		t.Error("expected error for an unsupported upstream scheme")
+	}
+
+	// Passes Validate but fails when the certificate is loaded at startup
+	missingCert := write("tls.yaml", "server:\n  tls:\n    cert_file: "+filepath.Join(dir, "missing.crt")+
+		"\n    key_file: "+filepath.Join(dir, "missing.key")+"\n")
+	if err := checkConfig([]string{valid, missingCert}); err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Errorf("expected TLS error, got %v", err)
+	}
+
+	// Fails when the logger opens its output at startup
+	badLog := write("log.yaml", "logging:\n  output_path: "+filepath.Join(dir, "missing", "proxy.log")+"\n")
+	if err := checkConfig([]string{valid, badLog}); err == nil || !strings.Contains(err.Error(), "logging") {
+		t.Errorf("expected logging error, got %v", err)
+	}
+}
+
+func TestRateLimitKeyExtractor(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-API-Key", "k1")
+
+	tests := []struct {
+		byIP, byAPIKey bool
+		want           string
+	}{
+		{true, false, "192.0.2.1"},
+		{false, true, "apikey:k1"},
+		{true, true, "192.0.2.1:apikey:k1"},
+		{false, false, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		cfg := config.RateLimitConfig{ByIP: tt.byIP, ByAPIKey: tt.byAPIKey, APIKeyHeader: "X-API-Key"}
+		if got := rateLimitKeyExtractor(cfg, ratelimit.IPKeyExtractor)(req); got != tt.want {
+			t.Errorf("by_ip=%v by_api_key=%v: key %q, want %q", tt.byIP, tt.byAPIKey, got, tt.want)
+		}
+	}
+
+	// Turning on by_api_key alone keys on the API key
+	defaults, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults.RateLimit.ByAPIKey = true
+	if got := rateLimitKeyExtractor(defaults.RateLimit, ratelimit.IPKeyExtractor)(req); got != "apikey:k1" {
+		t.Errorf("expected by_api_key alone to key on the API key, got %q", got)
+	}
+
+	// With both, one API key used from two addresses gets two budgets
+	cfg := config.RateLimitConfig{ByIP: true, ByAPIKey: true, APIKeyHeader: "X-API-Key"}
+	extractor := rateLimitKeyExtractor(cfg, ratelimit.IPKeyExtractor)
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	for _, addr := range []string{"192.0.2.1:1234", "192.0.2.2:1234"} {
+		req.RemoteAddr = addr
+		if !limiter.Allow(extractor(req)) {
+			t.Errorf("%s: expected its own budget for the shared key", addr)
+		}
+	}
+	if limiter.Allow(extractor(req)) {
+		t.Error("expected the key and address pair to be limited")
+	}
+}
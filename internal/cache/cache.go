@@ -1,11 +1,20 @@
 package cache
 
 import (
+	"bytes"
 	"container/list"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,13 +29,95 @@ type Entry struct {
 	ETag       string
 	ExpiresAt  time.Time
 	CreatedAt  time.Time
-	Size       int64
+	// Size is what the entry counts toward the cache's max size, usually
+	// from EntrySize. Set computes it when left zero.
+	Size int64
+	// BodyFile is the path of a body kept on disk by a DiskStore instead
+	// of in Body. The cache removes the file when the entry is dropped.
+	BodyFile string
+	// InitialAge is how old the response already was when stored, from
+	// the upstream's Age header. The Age served on hits adds the time
+	// since CreatedAt to it.
+	InitialAge time.Duration
+	// Compressed marks a body gzipped by Compress to save memory, which is
+	// served as is to clients that accept gzip. OriginalSize is the length
+	// of the body before compression.
+	Compressed   bool
+	OriginalSize int64
+	// Method and URL are the request the entry was stored for, the URL as
+	// a path and query. Keys are hashes, so this is what identifies the
+	// entry when listing the cache.
+	Method string
+	URL    string
+}
+
+// Age returns how old the response is at now, as sent in the Age header
+func (e *Entry) Age(now time.Time) time.Duration {
+	return e.InitialAge + max(now.Sub(e.CreatedAt), 0)
+}
+
+// OpenBody returns a reader over the entry's body as stored, wherever it
+// is, and still gzipped when Compressed
+func (e *Entry) OpenBody() (io.ReadSeekCloser, error) {
+	if e.BodyFile == "" {
+		return nopCloser{bytes.NewReader(e.Body)}, nil
+	}
+	return os.Open(e.BodyFile)
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// releaseBody removes the body file of an entry leaving the cache unless
+// its replacement still refers to the same file
+func releaseBody(old, replacement *Entry) {
+	if old.BodyFile == "" || (replacement != nil && replacement.BodyFile == old.BodyFile) {
+		return
+	}
+	os.Remove(old.BodyFile)
+}
+
+// entryOverhead estimates the memory an entry costs beyond its body and
+// headers: the Entry itself, its list element, map slot and key
+const entryOverhead = 256
+
+// EntrySize estimates the bytes an entry occupies: the body, the headers
+// as they would be serialized on the wire, the ETag and a fixed overhead
+func EntrySize(headers http.Header, etag string, bodySize int64) int64 {
+	size := bodySize + int64(len(etag)) + entryOverhead
+	for key, values := range headers {
+		for _, value := range values {
+			// "Key: value\r\n"
+			size += int64(len(key) + len(value) + 4)
+		}
+	}
+	return size
+}
+
+// Validators returns the upstream ETag and Last-Modified values stored
+// with the entry, used to revalidate it once it expires
+func (e *Entry) Validators() (etag, lastModified string) {
+	return e.Headers.Get("ETag"), e.Headers.Get("Last-Modified")
+}
+
+// Revalidatable reports whether the entry carries an upstream validator
+func (e *Entry) Revalidatable() bool {
+	etag, lastModified := e.Validators()
+	return etag != "" || lastModified != ""
 }
 
 // Cache is the interface for cache implementations
 type Cache interface {
 	Get(key string) (*Entry, bool)
-	Set(key string, entry *Entry)
+	// GetStale returns an entry even if it has expired, so it can be
+	// revalidated with the upstream
+	GetStale(key string) (*Entry, bool)
+	// Set stores the entry and reports whether it was kept. An entry too
+	// large for the cache is rejected, leaving its body file to the caller.
+	Set(key string, entry *Entry) bool
 	Delete(key string)
 	Clear()
 	Size() int64
@@ -41,8 +132,65 @@ type memoryCache struct {
 	items    map[string]*list.Element
 	lru      *list.List
 	defaultTTL time.Duration
+
+	// Eviction starts above highWater and frees space down to lowWater
+	highWater      int64
+	lowWater       int64
+	evictionPasses uint64
+
+	observer Observer
 }
 
+// KeyInfo describes a cached entry for inspection
+type KeyInfo struct {
+	Key        string
+	Method     string
+	URL        string
+	StatusCode int
+	Size       int64
+	Age        time.Duration
+	// TTL is the time left until the entry expires, negative once it has
+	TTL  time.Duration
+	ETag string
+	// OriginalSize is the length of a compressed body before compression,
+	// 0 for entries stored uncompressed
+	OriginalSize int64
+}
+
+// Lister is implemented by caches that can enumerate their entries
+type Lister interface {
+	// Keys returns up to limit entries, most recently used first, after
+	// skipping offset of them, along with the total number of entries
+	Keys(offset, limit int) ([]KeyInfo, int)
+}
+
+// Checker is implemented by caches that depend on something outside the
+// process, e.g. a directory or a shared server, so readiness probes can
+// report when it is unavailable
+type Checker interface {
+	Check() error
+}
+
+// Observer is told about evictions, expirations and the cache's fill level,
+// e.g. to export them as metrics. Its methods are called with the cache
+// locked and must not call back into it.
+type Observer interface {
+	RecordCacheEviction()
+	RecordCacheExpiration()
+	SetCacheUtilization(ratio float64)
+}
+
+// Watermarks control batched eviction as fractions of the max size. Once
+// the cache grows past High, entries are evicted until it is below Low, so
+// eviction runs in occasional batches instead of on every insert.
+type Watermarks struct {
+	High float64
+	Low  float64
+}
+
+// DefaultWatermarks evict one entry at a time, as soon as the cache is full
+var DefaultWatermarks = Watermarks{High: 1, Low: 1}
+
 type cacheItem struct {
 	key   string
 	entry *Entry
@@ -50,11 +198,29 @@ type cacheItem struct {
 
 // NewMemoryCache creates a new in-memory LRU cache
 func NewMemoryCache(maxSize int64, defaultTTL time.Duration) Cache {
+	return NewMemoryCacheWithWatermarks(maxSize, defaultTTL, DefaultWatermarks)
+}
+
+// NewMemoryCacheWithWatermarks creates an in-memory LRU cache that evicts
+// in batches between the given watermarks. Out of range values are clamped
+// so the cache never grows past maxSize.
+func NewMemoryCacheWithWatermarks(maxSize int64, defaultTTL time.Duration, w Watermarks) Cache {
+	return NewMemoryCacheWithObserver(maxSize, defaultTTL, w, nil)
+}
+
+// NewMemoryCacheWithObserver creates an in-memory LRU cache like
+// NewMemoryCacheWithWatermarks that reports to observer, which may be nil
+func NewMemoryCacheWithObserver(maxSize int64, defaultTTL time.Duration, w Watermarks, observer Observer) Cache {
+	high := min(max(w.High, 0), 1)
+	low := min(max(w.Low, 0), high)
 	return &memoryCache{
 		maxSize:    maxSize,
 		items:      make(map[string]*list.Element),
 		lru:        list.New(),
 		defaultTTL: defaultTTL,
+		highWater:  int64(float64(maxSize) * high),
+		lowWater:   int64(float64(maxSize) * low),
+		observer:   observer,
 	}
 }
 
@@ -70,9 +236,15 @@ func (c *memoryCache) Get(key string) (*Entry, bool) {
 
 	item := elem.Value.(*cacheItem)
 	
-	// Check if entry has expired
+	// Check if entry has expired. Entries with validators are kept so they
+	// can be revalidated; the LRU evicts them if they are never refreshed.
 	if time.Now().After(item.entry.ExpiresAt) {
-		c.deleteElement(elem)
+		if !item.entry.Revalidatable() {
+			c.deleteElement(elem)
+			if c.observer != nil {
+				c.observer.RecordCacheExpiration()
+			}
+		}
 		return nil, false
 	}
 
@@ -81,15 +253,40 @@ func (c *memoryCache) Get(key string) (*Entry, bool) {
 	return item.entry, true
 }
 
-// Set adds an entry to the cache
-func (c *memoryCache) Set(key string, entry *Entry) {
+// GetStale retrieves an entry regardless of expiry
+func (c *memoryCache) GetStale(key string) (*Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*cacheItem).entry, true
+}
+
+// Set adds an entry to the cache. An entry larger than the whole cache is
+// rejected rather than evicting everything else, and any older entry under
+// the key is dropped since it is outdated.
+func (c *memoryCache) Set(key string, entry *Entry) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if entry.Size == 0 {
+		entry.Size = EntrySize(entry.Headers, entry.ETag, int64(len(entry.Body)))
+	}
+	if entry.Size > c.maxSize {
+		if elem, ok := c.items[key]; ok {
+			c.removeElement(elem, entry)
+		}
+		return false
+	}
+
 	// Update existing entry
 	if elem, ok := c.items[key]; ok {
 		item := elem.Value.(*cacheItem)
 		c.size -= item.entry.Size
+		releaseBody(item.entry, entry)
 		item.entry = entry
 		c.size += entry.Size
 		c.lru.MoveToFront(elem)
@@ -101,13 +298,21 @@ func (c *memoryCache) Set(key string, entry *Entry) {
 		c.size += entry.Size
 	}
 
-	// Evict if over size limit
-	for c.size > c.maxSize && c.lru.Len() > 0 {
-		elem := c.lru.Back()
-		if elem != nil {
-			c.deleteElement(elem)
+	// Evict down to the low watermark once over the high watermark
+	if c.size > c.highWater {
+		c.evictionPasses++
+		for c.size > c.lowWater && c.lru.Len() > 0 {
+			c.deleteElement(c.lru.Back())
+			if c.observer != nil {
+				c.observer.RecordCacheEviction()
+			}
 		}
 	}
+	c.observeSize()
+
+	// A batch eviction may have taken the new entry too
+	_, kept := c.items[key]
+	return kept
 }
 
 // Delete removes an entry from the cache
@@ -125,9 +330,13 @@ func (c *memoryCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	for _, elem := range c.items {
+		releaseBody(elem.Value.(*cacheItem).entry, nil)
+	}
 	c.items = make(map[string]*list.Element)
 	c.lru = list.New()
 	c.size = 0
+	c.observeSize()
 }
 
 // Size returns the total size of cached data in bytes
@@ -144,22 +353,78 @@ func (c *memoryCache) Len() int {
 	return c.lru.Len()
 }
 
+// Keys lists entries in LRU order. The lock is only held to copy the page
+// of entries, which are never modified once stored; their metadata is
+// read after it is released.
+func (c *memoryCache) Keys(offset, limit int) ([]KeyInfo, int) {
+	c.mu.RLock()
+	total := c.lru.Len()
+	page := make([]*cacheItem, 0, min(max(total-offset, 0), max(limit, 0)))
+	i := 0
+	for elem := c.lru.Front(); elem != nil && len(page) < limit; elem = elem.Next() {
+		if i >= offset {
+			item := elem.Value.(*cacheItem)
+			page = append(page, &cacheItem{key: item.key, entry: item.entry})
+		}
+		i++
+	}
+	c.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]KeyInfo, len(page))
+	for i, item := range page {
+		keys[i] = KeyInfo{
+			Key:          item.key,
+			Method:       item.entry.Method,
+			URL:          item.entry.URL,
+			StatusCode:   item.entry.StatusCode,
+			Size:         item.entry.Size,
+			Age:          item.entry.Age(now),
+			TTL:          item.entry.ExpiresAt.Sub(now),
+			ETag:         item.entry.ETag,
+			OriginalSize: item.entry.OriginalSize,
+		}
+	}
+	return keys, total
+}
+
 // deleteElement removes an element from the cache (must be called with lock held)
 func (c *memoryCache) deleteElement(elem *list.Element) {
+	c.removeElement(elem, nil)
+}
+
+// removeElement removes an element, keeping its body file if replacement
+// still refers to it (must be called with lock held)
+func (c *memoryCache) removeElement(elem *list.Element, replacement *Entry) {
 	item := elem.Value.(*cacheItem)
 	delete(c.items, item.key)
 	c.lru.Remove(elem)
 	c.size -= item.entry.Size
+	releaseBody(item.entry, replacement)
+	c.observeSize()
+}
+
+// observeSize reports the cache's fill level (must be called with lock held)
+func (c *memoryCache) observeSize() {
+	if c.observer != nil && c.maxSize > 0 {
+		c.observer.SetCacheUtilization(float64(c.size) / float64(c.maxSize))
+	}
 }
 
-// CacheKey generates a cache key for a request
-func CacheKey(r *http.Request, varyHeaders []string) string {
-	// Start with method and URL
-	parts := []string{r.Method, r.URL.Path}
+// CacheKey generates a cache key for a request. A non-nil query filter
+// decides which query parameters the key includes; nil uses the raw query.
+func CacheKey(r *http.Request, varyHeaders []string, queries *QueryFilter) string {
+	// Start with method and URL. HEAD shares GET's entries: it is answered
+	// with the stored headers and no body.
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	parts := []string{method, r.URL.Path}
 	
 	// Add normalized query parameters (sorted)
-	if r.URL.RawQuery != "" {
-		parts = append(parts, r.URL.RawQuery)
+	if query := queries.Apply(r.URL.RawQuery); query != "" {
+		parts = append(parts, query)
 	}
 
 	// Add varying headers if specified
@@ -175,70 +440,382 @@ func CacheKey(r *http.Request, varyHeaders []string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// IsCacheable determines if a request/response is cacheable
-func IsCacheable(r *http.Request, statusCode int, headers http.Header) bool {
-	// Only cache GET and HEAD requests
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+// IsCacheable determines if a request/response is cacheable under the
+// default rules. Error statuses are cacheable only when listed in
+// negativeStatuses.
+func IsCacheable(r *http.Request, statusCode int, headers http.Header, negativeStatuses []int) bool {
+	return Rules{NegativeStatuses: negativeStatuses}.IsCacheable(r, statusCode, headers)
+}
+
+// Rules decide which requests and responses may be cached
+type Rules struct {
+	// Methods are the cacheable request methods; empty means GET and HEAD.
+	// Methods with a body, such as POST, are keyed on the body too.
+	Methods []string
+	// StatusCodes are the cacheable statuses below 400; empty allows all
+	// of them except 206
+	StatusCodes []int
+	// NegativeStatuses are the error statuses that may be cached
+	NegativeStatuses []int
+	// AllowCookies caches responses that set cookies or vary on them,
+	// which are otherwise specific to one client
+	AllowCookies bool
+	// ContentTypes are the cacheable response media types, e.g.
+	// "application/json" or "image/*"; empty allows all of them
+	ContentTypes []string
+}
+
+// defaultMethods are cached when Rules.Methods is empty
+var defaultMethods = []string{http.MethodGet, http.MethodHead}
+
+// AllowsMethod reports whether requests with the method may be cached
+func (rules Rules) AllowsMethod(method string) bool {
+	if len(rules.Methods) == 0 {
+		return slices.Contains(defaultMethods, method)
+	}
+	return slices.Contains(rules.Methods, method)
+}
+
+// IsCacheable determines if a request/response is cacheable under the
+// rules. A zero statusCode checks the request alone.
+func (rules Rules) IsCacheable(r *http.Request, statusCode int, headers http.Header) bool {
+	if !rules.AllowsMethod(r.Method) {
+		return false
+	}
+
+	// Error responses are only cached when negative caching covers them
+	if statusCode >= 400 && !slices.Contains(rules.NegativeStatuses, statusCode) {
 		return false
 	}
 
-	// Don't cache error responses (except 404)
-	if statusCode >= 500 || (statusCode >= 400 && statusCode != 404) {
+	// A partial response to a Range request is not the full entry; ranges
+	// are served from a cached full response instead
+	if statusCode == http.StatusPartialContent {
+		return false
+	}
+
+	if statusCode > 0 && statusCode < 400 && len(rules.StatusCodes) > 0 && !slices.Contains(rules.StatusCodes, statusCode) {
+		return false
+	}
+
+	if statusCode > 0 && !rules.allowsContentType(headers.Get("Content-Type")) {
+		return false
+	}
+
+	// Vary: * depends on more than the request, so no stored response
+	// can be known to match a later one
+	if varies(headers, "*") {
+		return false
+	}
+
+	// A response setting or varying on cookies belongs to one client
+	if !rules.AllowCookies && (headers.Get("Set-Cookie") != "" || varies(headers, "Cookie")) {
 		return false
 	}
 
 	// Check Cache-Control header
-	cacheControl := headers.Get("Cache-Control")
-	if cacheControl != "" {
-		directives := strings.Split(cacheControl, ",")
-		for _, directive := range directives {
-			directive = strings.TrimSpace(strings.ToLower(directive))
-			if directive == "no-store" || directive == "no-cache" || directive == "private" {
-				return false
+	if hasDirective(headers, "no-store") || hasDirective(headers, "private") {
+		return false
+	}
+
+	// no-cache responses may be stored only if they can be revalidated
+	// before every use
+	if RequiresRevalidation(headers) {
+		return headers.Get("ETag") != "" || headers.Get("Last-Modified") != ""
+	}
+
+	return true
+}
+
+// allowsContentType reports whether a response media type matches
+// ContentTypes, exactly or by a "type/*" wildcard
+func (rules Rules) allowsContentType(contentType string) bool {
+	if len(rules.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	// ParseMediaType lower-cases the media type
+	for _, allowed := range rules.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType || allowed == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// varies reports whether the Vary header lists the named request header
+func varies(headers http.Header, name string) bool {
+	for _, value := range headers.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	return true
+// RequiresRevalidation reports whether a response carries Cache-Control:
+// no-cache, which allows storing it but not serving it without first
+// revalidating with the upstream
+func RequiresRevalidation(headers http.Header) bool {
+	return hasDirective(headers, "no-cache")
+}
+
+// hasDirective reports whether the Cache-Control header contains the
+// directive. Arguments such as no-cache="Set-Cookie" are ignored, so the
+// directive applies to the whole response.
+func hasDirective(headers http.Header, name string) bool {
+	for _, value := range headers.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive, _, _ = strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(directive, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxDeltaSeconds caps delta-seconds values such as Age and max-age, as
+// RFC 9111 recommends, so that they cannot overflow a time.Duration
+const maxDeltaSeconds = 1 << 31
+
+// parseDeltaSeconds parses a non-negative number of seconds, capping
+// values too large to represent. It reports false for invalid values.
+func parseDeltaSeconds(s string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && seconds > 0 {
+		seconds = maxDeltaSeconds
+	} else if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(min(seconds, maxDeltaSeconds)) * time.Second, true
+}
+
+// ParseAge returns the age an upstream (or a cache in front of it) reports
+// in the Age header, or 0 if it is missing or invalid
+func ParseAge(headers http.Header) time.Duration {
+	age, _ := parseDeltaSeconds(strings.TrimSpace(headers.Get("Age")))
+	return age
 }
 
-// ParseTTL extracts TTL from Cache-Control header
+// ParseTTL extracts the TTL from the Cache-Control and Expires headers.
+// As a shared cache, s-maxage takes precedence over max-age.
 func ParseTTL(headers http.Header, defaultTTL time.Duration) time.Duration {
-	cacheControl := headers.Get("Cache-Control")
-	if cacheControl == "" {
-		return defaultTTL
-	}
-
-	directives := strings.Split(cacheControl, ",")
-	for _, directive := range directives {
-		directive = strings.TrimSpace(directive)
-		if strings.HasPrefix(strings.ToLower(directive), "max-age=") {
-			parts := strings.SplitN(directive, "=", 2)
-			if len(parts) == 2 {
-				if seconds, err := strconv.Atoi(parts[1]); err == nil {
-					return time.Duration(seconds) * time.Second
+	ttl, _ := parseTTL(headers, defaultTTL)
+	return ttl
+}
+
+// FreshFor is ParseTTL for a response that is already age old. A max-age,
+// s-maxage or default lifetime counts from when the upstream generated the
+// response, so the age is taken off it; an Expires date is absolute. The
+// result is 0 once the response is stale.
+func FreshFor(headers http.Header, age, defaultTTL time.Duration) time.Duration {
+	ttl, absolute := parseTTL(headers, defaultTTL)
+	if !absolute {
+		ttl = max(ttl-age, 0)
+	}
+	return ttl
+}
+
+// parseTTL implements ParseTTL, also reporting whether the TTL comes from
+// an Expires date rather than a lifetime
+func parseTTL(headers http.Header, defaultTTL time.Duration) (time.Duration, bool) {
+	maxAge, sMaxAge := time.Duration(-1), time.Duration(-1)
+	for _, value := range headers.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "max-age":
+				if d, ok := parseDeltaSeconds(arg); ok && maxAge < 0 {
+					maxAge = d
+				}
+			case "s-maxage":
+				if d, ok := parseDeltaSeconds(arg); ok && sMaxAge < 0 {
+					sMaxAge = d
 				}
 			}
 		}
 	}
 
+	switch {
+	case sMaxAge >= 0:
+		return sMaxAge, false
+	case maxAge >= 0:
+		return maxAge, false
+	}
+
 	// Check Expires header
 	if expires := headers.Get("Expires"); expires != "" {
 		if t, err := http.ParseTime(expires); err == nil {
 			ttl := time.Until(t)
 			if ttl > 0 {
-				return ttl
+				return ttl, true
 			}
 		}
 	}
 
-	return defaultTTL
+	return defaultTTL, false
+}
+
+// JitterTTL shortens ttl by a random delay in [0, jitter) so entries
+// stored together don't all expire at once. The result is never longer
+// than ttl, so the upstream's max-age is still respected, and never zero
+// or negative for a positive ttl.
+func JitterTTL(ttl, jitter time.Duration) time.Duration {
+	if ttl <= 0 || jitter <= 0 {
+		return ttl
+	}
+	return ttl - rand.N(min(jitter, ttl))
+}
+
+// DefaultExcludedHeaders are response headers that are never stored with a
+// cached entry because they describe a single connection or transfer, or
+// must be recomputed for every response
+var DefaultExcludedHeaders = []string{
+	"Age",
+	"Connection",
+	"Date",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"X-Request-Id",
+	"X-Variant",
+}
+
+// HeaderFilter removes excluded headers from responses before they are stored
+type HeaderFilter struct {
+	excluded map[string]bool
+}
+
+// NewHeaderFilter creates a filter for the default excluded headers plus
+// any extra ones
+func NewHeaderFilter(extra []string) *HeaderFilter {
+	f := &HeaderFilter{excluded: make(map[string]bool, len(DefaultExcludedHeaders)+len(extra))}
+	for _, name := range DefaultExcludedHeaders {
+		f.excluded[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range extra {
+		f.excluded[http.CanonicalHeaderKey(name)] = true
+	}
+	return f
+}
+
+// Excluded reports whether a header is never stored
+func (f *HeaderFilter) Excluded(name string) bool {
+	return f.excluded[http.CanonicalHeaderKey(name)]
+}
+
+// Storable returns a copy of the headers without the excluded ones
+func (f *HeaderFilter) Storable(h http.Header) http.Header {
+	stored := make(http.Header, len(h))
+	for key, values := range h {
+		if !f.excluded[http.CanonicalHeaderKey(key)] {
+			stored[key] = append([]string(nil), values...)
+		}
+	}
+	return stored
+}
+
+// QueryFilter selects the query parameters that go into cache keys, so
+// parameters that don't change the response, such as utm_* tracking
+// parameters, don't fragment the cache. Names ending in "*" match by prefix.
+type QueryFilter struct {
+	ignore    []string
+	only      []string
+	ignoreAll bool
+}
+
+// NewQueryFilter creates a filter that drops the ignored parameters, keeps
+// only the listed ones when only is not empty, or drops the whole query
+// when ignoreAll is set. It returns nil, which keeps the raw query, when
+// nothing is configured.
+func NewQueryFilter(ignore, only []string, ignoreAll bool) *QueryFilter {
+	if len(ignore) == 0 && len(only) == 0 && !ignoreAll {
+		return nil
+	}
+	return &QueryFilter{ignore: ignore, only: only, ignoreAll: ignoreAll}
+}
+
+// Apply returns the query to key on: the selected parameters, sorted by
+// name. A query that doesn't parse is kept as is.
+func (f *QueryFilter) Apply(rawQuery string) string {
+	if f == nil || rawQuery == "" {
+		return rawQuery
+	}
+	if f.ignoreAll {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	for name := range values {
+		if matchParam(f.ignore, name) || (len(f.only) > 0 && !matchParam(f.only, name)) {
+			delete(values, name)
+		}
+	}
+	return values.Encode()
+}
+
+// matchParam reports whether a query parameter matches any of the patterns
+func matchParam(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ETagMatch reports whether an If-None-Match header value matches the ETag
+// using the weak comparison function from RFC 7232
+func ETagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // GenerateETag generates an ETag for response body
 func GenerateETag(body []byte) string {
-	h := md5.New()
+	h := NewETagHash()
 	h.Write(body)
+	return ETagFromHash(h)
+}
+
+// NewETagHash returns a hash for computing an ETag over a body written in
+// pieces, for bodies that are never held in memory as a whole
+func NewETagHash() hash.Hash {
+	return md5.New()
+}
+
+// ETagFromHash formats the ETag for a hash from NewETagHash
+func ETagFromHash(h hash.Hash) string {
 	return fmt.Sprintf(`"%s"`, hex.EncodeToString(h.Sum(nil)))
 }
 
@@ -3,6 +3,8 @@ package cache
 import (
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -54,6 +56,29 @@ func TestMemoryCache(t *testing.T) {
 	}
 }
 
+func TestCacheSizeIncludesHeaders(t *testing.T) {
+	cache := NewMemoryCache(1024*1024, 5*time.Minute)
+	body := []byte("tiny")
+	headers := http.Header{"Set-Policy": []string{strings.Repeat("x", 2000)}}
+
+	cache.Set("key", &Entry{
+		Headers:   headers,
+		Body:      body,
+		ExpiresAt: time.Now().Add(5 * time.Minute),
+	})
+	if cache.Size() <= 2000+int64(len(body)) {
+		t.Errorf("expected header bytes to count toward size, got %d", cache.Size())
+	}
+	if want := EntrySize(headers, "", int64(len(body))); cache.Size() != want {
+		t.Errorf("expected computed size %d, got %d", want, cache.Size())
+	}
+
+	// Headers shared by both entries leave only the body difference
+	if diff := EntrySize(headers, "", 100) - EntrySize(headers, "", 10); diff != 90 {
+		t.Errorf("expected body bytes to count one for one, got %d", diff)
+	}
+}
+
 func TestCacheExpiration(t *testing.T) {
 	cache := NewMemoryCache(1024*1024, 5*time.Minute)
 
@@ -94,6 +119,162 @@ func TestCacheLRU(t *testing.T) {
 	}
 }
 
+func TestMemoryCacheKeys(t *testing.T) {
+	c := NewMemoryCache(1024*1024, time.Minute)
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c"} {
+		c.Set(key, &Entry{
+			StatusCode: 200 + i,
+			Body:       []byte("body"),
+			ETag:       `"` + key + `"`,
+			CreatedAt:  now.Add(-10 * time.Second),
+			ExpiresAt:  now.Add(time.Minute),
+			InitialAge: 5 * time.Second,
+			Method:     "GET",
+			URL:        "/" + key,
+		})
+	}
+
+	keys, total := c.(Lister).Keys(0, 10)
+	if total != 3 || len(keys) != 3 {
+		t.Fatalf("expected 3 of 3 keys, got %d of %d", len(keys), total)
+	}
+	if keys[0].Key != "c" || keys[2].Key != "a" {
+		t.Errorf("expected most recently used first, got %v", keys)
+	}
+	first := keys[0]
+	if first.StatusCode != 202 || first.ETag != `"c"` || first.Size != EntrySize(nil, `"c"`, 4) || first.Method != "GET" || first.URL != "/c" {
+		t.Errorf("unexpected metadata %+v", first)
+	}
+	if first.Age < 15*time.Second || first.Age > 16*time.Second {
+		t.Errorf("expected an age of about 15s, got %v", first.Age)
+	}
+	if first.TTL <= 59*time.Second || first.TTL > time.Minute {
+		t.Errorf("expected about a minute left, got %v", first.TTL)
+	}
+
+	page, total := c.(Lister).Keys(1, 1)
+	if total != 3 || len(page) != 1 || page[0].Key != "b" {
+		t.Errorf("expected the second key alone, got %v of %d", page, total)
+	}
+	if page, _ := c.(Lister).Keys(5, 10); len(page) != 0 {
+		t.Errorf("expected no keys past the end, got %v", page)
+	}
+}
+
+// countingObserver records what a cache reports
+type countingObserver struct {
+	evictions   int
+	expirations int
+	utilization float64
+}
+
+func (o *countingObserver) RecordCacheEviction() {
+	o.evictions++
+}
+
+func (o *countingObserver) RecordCacheExpiration() {
+	o.expirations++
+}
+
+func (o *countingObserver) SetCacheUtilization(ratio float64) {
+	o.utilization = ratio
+}
+
+func TestCacheObserver(t *testing.T) {
+	observer := &countingObserver{}
+	c := NewMemoryCacheWithObserver(1000, time.Minute, DefaultWatermarks, observer)
+	expires := time.Now().Add(time.Minute)
+
+	for i := 0; i < 4; i++ {
+		c.Set(strconv.Itoa(i), &Entry{ExpiresAt: expires, Size: 300})
+	}
+	if observer.evictions != 1 {
+		t.Errorf("expected filling past the max size to evict 1 entry, got %d", observer.evictions)
+	}
+	if observer.utilization != 0.9 {
+		t.Errorf("expected utilization 0.9, got %v", observer.utilization)
+	}
+
+	c.Delete("3")
+	if observer.utilization != 0.6 {
+		t.Errorf("expected utilization to drop to 0.6 after a delete, got %v", observer.utilization)
+	}
+
+	c.Set("old", &Entry{ExpiresAt: time.Now().Add(-time.Second), Size: 100})
+	if _, ok := c.Get("old"); ok {
+		t.Fatal("expected the expired entry to miss")
+	}
+	if observer.expirations != 1 || observer.evictions != 1 {
+		t.Errorf("expected 1 expiration and no further evictions, got %d and %d", observer.expirations, observer.evictions)
+	}
+}
+
+func TestCacheRejectsOversizedEntry(t *testing.T) {
+	cache := NewMemoryCache(50, 5*time.Minute)
+	for _, key := range []string{"a", "b"} {
+		if !cache.Set(key, &Entry{Body: []byte("small"), ExpiresAt: time.Now().Add(time.Minute), Size: 10}) {
+			t.Fatalf("expected %s to be stored", key)
+		}
+	}
+
+	big := &Entry{Body: make([]byte, 60), ExpiresAt: time.Now().Add(time.Minute), Size: 60}
+	if cache.Set("big", big) {
+		t.Error("expected entry larger than the cache to be rejected")
+	}
+	if _, ok := cache.Get("big"); ok {
+		t.Error("expected oversized entry not to be cached")
+	}
+	if cache.Len() != 2 || cache.Size() != 20 {
+		t.Errorf("expected smaller entries to survive, got %d entries of %d bytes", cache.Len(), cache.Size())
+	}
+
+	// Replacing a key with an oversized entry drops the outdated one
+	if cache.Set("a", big) {
+		t.Error("expected oversized replacement to be rejected")
+	}
+	if _, ok := cache.Get("a"); ok || cache.Len() != 1 {
+		t.Errorf("expected outdated entry to be dropped, got %d entries", cache.Len())
+	}
+}
+
+func TestCacheBatchedEviction(t *testing.T) {
+	cache := NewMemoryCacheWithWatermarks(100, 5*time.Minute, Watermarks{High: 1, Low: 0.5})
+	set := func(key string) {
+		cache.Set(key, &Entry{
+			Body:      []byte("0123456789"),
+			ExpiresAt: time.Now().Add(5 * time.Minute),
+			Size:      10,
+		})
+	}
+
+	for i := 0; i < 10; i++ {
+		set(strconv.Itoa(i))
+	}
+	if cache.Len() != 10 {
+		t.Fatalf("expected no eviction up to the high watermark, got %d entries", cache.Len())
+	}
+
+	// Crossing the high watermark evicts the oldest entries down to the low one
+	set("10")
+	if cache.Size() > 50 {
+		t.Errorf("expected size at most 50 after eviction, got %d", cache.Size())
+	}
+	if _, ok := cache.Get("0"); ok {
+		t.Error("expected oldest entry to be evicted")
+	}
+	if _, ok := cache.Get("10"); !ok {
+		t.Error("expected newest entry to be kept")
+	}
+
+	// Room freed by the batch absorbs further inserts without eviction
+	before := cache.Len()
+	set("11")
+	if cache.Len() != before+1 {
+		t.Errorf("expected insert below the high watermark not to evict, got %d entries", cache.Len())
+	}
+}
+
 func TestCacheKey(t *testing.T) {
 	req1 := &http.Request{
 		Method: "GET",
@@ -111,9 +292,9 @@ func TestCacheKey(t *testing.T) {
 		Header: http.Header{"Accept": []string{"application/json"}},
 	}
 
-	key1 := CacheKey(req1, []string{"Accept"})
-	key2 := CacheKey(req2, []string{"Accept"})
-	key3 := CacheKey(req3, []string{"Accept"})
+	key1 := CacheKey(req1, []string{"Accept"}, nil)
+	key2 := CacheKey(req2, []string{"Accept"}, nil)
+	key3 := CacheKey(req3, []string{"Accept"}, nil)
 
 	if key1 != key2 {
 		t.Error("expected same cache key for identical requests")
@@ -123,6 +304,85 @@ func TestCacheKey(t *testing.T) {
 	}
 }
 
+func TestCacheKeyHeadSharesGet(t *testing.T) {
+	get := &http.Request{Method: "GET", URL: &url.URL{Path: "/api/test"}}
+	head := &http.Request{Method: "HEAD", URL: &url.URL{Path: "/api/test"}}
+	post := &http.Request{Method: "POST", URL: &url.URL{Path: "/api/test"}}
+
+	if CacheKey(get, nil, nil) != CacheKey(head, nil, nil) {
+		t.Error("expected HEAD to share GET's cache key")
+	}
+	if CacheKey(get, nil, nil) == CacheKey(post, nil, nil) {
+		t.Error("expected other methods to keep their own cache key")
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *QueryFilter
+		query  string
+		want   string
+	}{
+		{"default keeps raw query", NewQueryFilter(nil, nil, false), "b=2&a=1", "b=2&a=1"},
+		{"ignore tracking", NewQueryFilter([]string{"utm_*", "fbclid"}, nil, false), "utm_source=x&page=2&fbclid=y", "page=2"},
+		{"only tracking", NewQueryFilter([]string{"utm_*"}, nil, false), "utm_source=x&utm_medium=y", ""},
+		{"only listed", NewQueryFilter(nil, []string{"page", "sort"}, false), "sort=asc&session=1&page=2", "page=2&sort=asc"},
+		{"ignore all", NewQueryFilter(nil, nil, true), "page=2", ""},
+		{"unparseable kept", NewQueryFilter([]string{"utm_*"}, nil, false), "a=%zz", "a=%zz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Apply(tt.query); got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheKeyIgnoresTrackingParams(t *testing.T) {
+	filter := NewQueryFilter([]string{"utm_*", "fbclid"}, nil, false)
+	plain := &http.Request{Method: "GET", URL: &url.URL{Path: "/page"}}
+	tracked := &http.Request{Method: "GET", URL: &url.URL{Path: "/page", RawQuery: "utm_source=x"}}
+	other := &http.Request{Method: "GET", URL: &url.URL{Path: "/page", RawQuery: "id=1&utm_source=x"}}
+
+	if CacheKey(plain, nil, filter) != CacheKey(tracked, nil, filter) {
+		t.Error("expected a tracking-only query to share the plain request's key")
+	}
+	if CacheKey(plain, nil, filter) == CacheKey(other, nil, filter) {
+		t.Error("expected other parameters to still vary the key")
+	}
+	if CacheKey(plain, nil, nil) == CacheKey(tracked, nil, nil) {
+		t.Error("expected tracking parameters to vary the key by default")
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{" 5 ", 5 * time.Second},
+		{"-3", 0},
+		{"soon", 0},
+		{"99999999999999999999", maxDeltaSeconds * time.Second},
+		{"9223372036854775807", maxDeltaSeconds * time.Second},
+	}
+	for _, tt := range tests {
+		if got := ParseAge(http.Header{"Age": []string{tt.value}}); got != tt.want {
+			t.Errorf("ParseAge(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	created := time.Now()
+	entry := &Entry{CreatedAt: created, InitialAge: 100 * time.Second}
+	if got := entry.Age(created.Add(20 * time.Second)); got != 120*time.Second {
+		t.Errorf("expected Age to add time in the cache to the initial age, got %v", got)
+	}
+}
+
 func TestIsCacheable(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -152,6 +412,34 @@ func TestIsCacheable(t *testing.T) {
 			headers:    http.Header{"Cache-Control": []string{"no-store"}},
 			want:       false,
 		},
+		{
+			name:       "GET with no-cache and validator",
+			method:     "GET",
+			statusCode: 200,
+			headers:    http.Header{"Cache-Control": []string{"no-cache"}, "Etag": []string{`"v1"`}},
+			want:       true,
+		},
+		{
+			name:       "GET with no-cache without validator",
+			method:     "GET",
+			statusCode: 200,
+			headers:    http.Header{"Cache-Control": []string{"no-cache"}},
+			want:       false,
+		},
+		{
+			name:       "GET with no-store and validator",
+			method:     "GET",
+			statusCode: 200,
+			headers:    http.Header{"Cache-Control": []string{"no-store"}, "Etag": []string{`"v1"`}},
+			want:       false,
+		},
+		{
+			name:       "GET with 206",
+			method:     "GET",
+			statusCode: 206,
+			headers:    http.Header{},
+			want:       false,
+		},
 		{
 			name:       "GET with 500",
 			method:     "GET",
@@ -159,12 +447,47 @@ func TestIsCacheable(t *testing.T) {
 			headers:    http.Header{},
 			want:       false,
 		},
+		{
+			name:       "GET with negatively cacheable 404",
+			method:     "GET",
+			statusCode: 404,
+			headers:    http.Header{},
+			want:       true,
+		},
+		{
+			name:       "GET with 503 not listed",
+			method:     "GET",
+			statusCode: 503,
+			headers:    http.Header{},
+			want:       false,
+		},
+		{
+			name:       "GET with Set-Cookie",
+			method:     "GET",
+			statusCode: 200,
+			headers:    http.Header{"Set-Cookie": []string{"session=abc"}, "Cache-Control": []string{"max-age=60"}},
+			want:       false,
+		},
+		{
+			name:       "GET varying on Cookie",
+			method:     "GET",
+			statusCode: 200,
+			headers:    http.Header{"Vary": []string{"Accept-Encoding, cookie"}},
+			want:       false,
+		},
+		{
+			name:       "GET varying on everything",
+			method:     "GET",
+			statusCode: 200,
+			headers:    http.Header{"Vary": []string{"*"}},
+			want:       false,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := &http.Request{Method: tt.method}
-			got := IsCacheable(req, tt.statusCode, tt.headers)
+			got := IsCacheable(req, tt.statusCode, tt.headers, []int{http.StatusNotFound})
 			if got != tt.want {
 				t.Errorf("IsCacheable() = %v, want %v", got, tt.want)
 			}
@@ -172,6 +495,128 @@ func TestIsCacheable(t *testing.T) {
 	}
 }
 
+func TestIsCacheableNegativeStatuses(t *testing.T) {
+	req := &http.Request{Method: "GET"}
+	negative := []int{http.StatusServiceUnavailable}
+
+	if !IsCacheable(req, http.StatusServiceUnavailable, http.Header{}, negative) {
+		t.Error("expected listed 503 to be cacheable")
+	}
+	if IsCacheable(req, http.StatusNotFound, http.Header{}, negative) {
+		t.Error("expected unlisted 404 not to be cacheable")
+	}
+	if IsCacheable(req, http.StatusNotFound, http.Header{}, nil) {
+		t.Error("expected no error status to be cacheable without negative caching")
+	}
+}
+
+func TestRulesAllowCookies(t *testing.T) {
+	req := &http.Request{Method: "GET"}
+	headers := http.Header{"Set-Cookie": []string{"theme=dark"}, "Vary": []string{"Cookie"}}
+
+	if (Rules{}).IsCacheable(req, 200, headers) {
+		t.Error("expected cookie responses not to be cacheable by default")
+	}
+	if !(Rules{AllowCookies: true}).IsCacheable(req, 200, headers) {
+		t.Error("expected AllowCookies to make cookie responses cacheable")
+	}
+}
+
+func TestRulesVaryStar(t *testing.T) {
+	req := &http.Request{Method: "GET"}
+	for _, vary := range []string{"*", "Accept-Encoding, *", " * "} {
+		headers := http.Header{"Vary": []string{vary}, "Cache-Control": []string{"public, max-age=60"}}
+		if (Rules{AllowCookies: true}).IsCacheable(req, 200, headers) {
+			t.Errorf("expected Vary %q not to be cacheable", vary)
+		}
+	}
+	if !(Rules{}).IsCacheable(req, 200, http.Header{"Vary": []string{"Accept-Encoding"}}) {
+		t.Error("expected Vary on a named header to stay cacheable")
+	}
+}
+
+func TestRulesContentTypes(t *testing.T) {
+	req := &http.Request{Method: "GET"}
+	rules := Rules{ContentTypes: []string{"application/json", "Image/*"}}
+	tests := map[string]bool{
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"image/png":                       true,
+		"IMAGE/WEBP":                      true,
+		"text/html":                       false,
+		"application/jsonp":               false,
+		"imagex/png":                      false,
+		"":                                false,
+	}
+	for contentType, want := range tests {
+		headers := http.Header{"Content-Type": []string{contentType}}
+		if got := rules.IsCacheable(req, 200, headers); got != want {
+			t.Errorf("Content-Type %q: IsCacheable() = %v, want %v", contentType, got, want)
+		}
+	}
+
+	if !rules.IsCacheable(req, 0, http.Header{}) {
+		t.Error("expected the request-only check to ignore content types")
+	}
+	if !(Rules{}).IsCacheable(req, 200, http.Header{"Content-Type": []string{"text/html"}}) {
+		t.Error("expected every content type to be cacheable by default")
+	}
+}
+
+func TestRulesCustomMethodsAndStatuses(t *testing.T) {
+	rules := Rules{
+		Methods:          []string{"GET", "POST"},
+		StatusCodes:      []int{200, 301},
+		NegativeStatuses: []int{404},
+	}
+	post := &http.Request{Method: "POST", URL: &url.URL{Path: "/search"}}
+	head := &http.Request{Method: "HEAD", URL: &url.URL{Path: "/search"}}
+
+	if !rules.IsCacheable(post, 200, http.Header{}) {
+		t.Error("expected a configured method to be cacheable")
+	}
+	if rules.IsCacheable(head, 200, http.Header{}) {
+		t.Error("expected a method missing from the list not to be cacheable")
+	}
+	if !rules.IsCacheable(post, 301, http.Header{}) {
+		t.Error("expected a listed status to be cacheable")
+	}
+	if rules.IsCacheable(post, 302, http.Header{}) {
+		t.Error("expected an unlisted status not to be cacheable")
+	}
+	if !rules.IsCacheable(post, 404, http.Header{}) {
+		t.Error("expected negative statuses to stay cacheable")
+	}
+
+	if (Rules{}).IsCacheable(post, 200, http.Header{}) {
+		t.Error("expected POST not to be cacheable by default")
+	}
+	if !(Rules{}).IsCacheable(head, 302, http.Header{}) {
+		t.Error("expected HEAD and any status below 400 to be cacheable by default")
+	}
+}
+
+func TestRequiresRevalidation(t *testing.T) {
+	tests := map[string]bool{
+		"":                            false,
+		"max-age=60":                  false,
+		"no-store":                    false,
+		"no-cache":                    true,
+		"public, No-Cache":            true,
+		`no-cache="Set-Cookie"`:       true,
+		"max-age=60, must-revalidate": false,
+	}
+	for value, want := range tests {
+		h := http.Header{}
+		if value != "" {
+			h.Set("Cache-Control", value)
+		}
+		if got := RequiresRevalidation(h); got != want {
+			t.Errorf("RequiresRevalidation(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
 func TestParseTTL(t *testing.T) {
 	defaultTTL := 5 * time.Minute
 
@@ -195,6 +640,21 @@ func TestParseTTL(t *testing.T) {
 			headers: http.Header{"Cache-Control": []string{"public, max-age=120"}},
 			want:    120 * time.Second,
 		},
+		{
+			name:    "s-maxage takes precedence over max-age",
+			headers: http.Header{"Cache-Control": []string{"max-age=600, s-maxage=30"}},
+			want:    30 * time.Second,
+		},
+		{
+			name:    "s-maxage before max-age",
+			headers: http.Header{"Cache-Control": []string{"s-maxage=0, max-age=600"}},
+			want:    0,
+		},
+		{
+			name:    "negative max-age ignored",
+			headers: http.Header{"Cache-Control": []string{"max-age=-5"}},
+			want:    defaultTTL,
+		},
 	}
 
 	for _, tt := range tests {
@@ -227,6 +687,83 @@ func TestGenerateETag(t *testing.T) {
 	}
 }
 
+func TestStaleEntryKeptForRevalidation(t *testing.T) {
+	cache := NewMemoryCache(1024*1024, 5*time.Minute)
+
+	validated := &Entry{
+		StatusCode: 200,
+		Headers:    http.Header{"Etag": []string{`"v1"`}},
+		Body:       []byte("test"),
+		ExpiresAt:  time.Now().Add(-time.Second),
+		Size:       4,
+	}
+	plain := &Entry{
+		StatusCode: 200,
+		Body:       []byte("test"),
+		ExpiresAt:  time.Now().Add(-time.Second),
+		Size:       4,
+	}
+	cache.Set("validated", validated)
+	cache.Set("plain", plain)
+
+	if _, ok := cache.Get("validated"); ok {
+		t.Error("expected miss for expired entry")
+	}
+	if entry, ok := cache.GetStale("validated"); !ok || entry != validated {
+		t.Error("expected expired entry with validator to be kept")
+	}
+
+	cache.Get("plain")
+	if _, ok := cache.GetStale("plain"); ok {
+		t.Error("expected expired entry without validator to be removed")
+	}
+}
+
+func TestHeaderFilter(t *testing.T) {
+	f := NewHeaderFilter([]string{"x-backend-node"})
+	h := http.Header{
+		"Content-Type":   []string{"text/plain"},
+		"Date":           []string{"Mon, 01 Jan 2024 00:00:00 GMT"},
+		"Age":            []string{"500"},
+		"Keep-Alive":     []string{"timeout=5"},
+		"X-Backend-Node": []string{"node-1"},
+	}
+
+	stored := f.Storable(h)
+	if len(stored) != 1 || stored.Get("Content-Type") != "text/plain" {
+		t.Errorf("unexpected stored headers %v", stored)
+	}
+	if h.Get("Date") == "" {
+		t.Error("Storable() should not modify the original headers")
+	}
+	if !f.Excluded("connection") || f.Excluded("Content-Type") {
+		t.Error("unexpected Excluded() result")
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`"x", "a"`, `"a"`, true},
+		{`*`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+		{``, `"a"`, false},
+		{`"a"`, ``, false},
+	}
+
+	for _, tt := range tests {
+		if got := ETagMatch(tt.ifNoneMatch, tt.etag); got != tt.want {
+			t.Errorf("ETagMatch(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+		}
+	}
+}
+
 func BenchmarkCacheGet(b *testing.B) {
 	cache := NewMemoryCache(10*1024*1024, 5*time.Minute)
 	entry := &Entry{
@@ -258,3 +795,58 @@ func BenchmarkCacheSet(b *testing.B) {
 	}
 }
 
+func BenchmarkCacheSetChurn(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		w    Watermarks
+	}{
+		{"one-at-a-time", DefaultWatermarks},
+		{"batched", Watermarks{High: 1, Low: 0.9}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			c := NewMemoryCacheWithWatermarks(1024*1024, 5*time.Minute, tc.w)
+			entry := &Entry{
+				Body:      make([]byte, 1024),
+				ExpiresAt: time.Now().Add(5 * time.Minute),
+				CreatedAt: time.Now(),
+				Size:      1024,
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Set(strconv.Itoa(i), entry)
+			}
+			b.ReportMetric(float64(c.(*memoryCache).evictionPasses)/float64(b.N), "evictions/op")
+		})
+	}
+}
+
+func TestJitterTTL(t *testing.T) {
+	ttl := 100 * time.Second
+	if got := JitterTTL(ttl, 0); got != ttl {
+		t.Errorf("expected no jitter to keep the TTL, got %v", got)
+	}
+	if got := JitterTTL(0, time.Second); got != 0 {
+		t.Errorf("expected a zero TTL to stay zero, got %v", got)
+	}
+
+	minSeen, maxSeen := ttl, time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		got := JitterTTL(ttl, 20*time.Second)
+		if got < 80*time.Second || got > ttl {
+			t.Fatalf("jittered TTL %v outside [80s, 100s]", got)
+		}
+		minSeen, maxSeen = min(minSeen, got), max(maxSeen, got)
+	}
+	if maxSeen-minSeen < 10*time.Second {
+		t.Errorf("expected TTLs spread across the band, got [%v, %v]", minSeen, maxSeen)
+	}
+
+	// Jitter longer than the TTL never yields an entry that is already expired
+	for i := 0; i < 1000; i++ {
+		if got := JitterTTL(time.Millisecond, time.Second); got <= 0 {
+			t.Fatalf("expected a positive TTL, got %v", got)
+		}
+	}
+}
+
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Compress gzips an in-memory body of at least minSize bytes, keeping the
+// result only when it is smaller. Bodies that are already encoded, kept on
+// disk, or of a media type that doesn't compress well are left alone. Size
+// is adjusted to the compressed body.
+func (e *Entry) Compress(minSize int64) bool {
+	if e.Compressed || e.BodyFile != "" || int64(len(e.Body)) < minSize || len(e.Body) == 0 {
+		return false
+	}
+	if e.Headers.Get("Content-Encoding") != "" || !compressibleType(e.Headers.Get("Content-Type")) {
+		return false
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(e.Body); err != nil {
+		return false
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(e.Body) {
+		return false
+	}
+
+	if e.Size != 0 {
+		e.Size -= int64(len(e.Body) - buf.Len())
+	}
+	e.OriginalSize = int64(len(e.Body))
+	e.Body = buf.Bytes()
+	e.Compressed = true
+	return true
+}
+
+// Decompress reads a body gzipped by Compress and returns a reader over
+// the original
+func Decompress(body io.Reader) (io.ReadSeekCloser, error) {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+// compressibleType reports whether a media type is text, which gzip
+// shrinks well, rather than already compressed data such as images
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestEntryCompress(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"id":1,"name":"item"},`), 200)
+	entry := &Entry{
+		Headers: http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		Body:    bytes.Clone(body),
+	}
+	entry.Size = EntrySize(entry.Headers, "", int64(len(body)))
+	size := entry.Size
+
+	if !entry.Compress(1024) {
+		t.Fatal("expected a large JSON body to be compressed")
+	}
+	if !entry.Compressed || entry.OriginalSize != int64(len(body)) || len(entry.Body) >= len(body) {
+		t.Fatalf("expected a smaller body and the original size, got %d bytes, original %d", len(entry.Body), entry.OriginalSize)
+	}
+	if want := size - int64(len(body)-len(entry.Body)); entry.Size != want {
+		t.Errorf("expected size %d to count the compressed body, got %d", want, entry.Size)
+	}
+	if entry.Compress(1024) {
+		t.Error("expected a compressed entry not to be compressed again")
+	}
+
+	stored, err := entry.OpenBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Decompress(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(plain)
+	if !bytes.Equal(got, body) {
+		t.Error("expected the decompressed body to match the original")
+	}
+}
+
+func TestEntryCompressSkips(t *testing.T) {
+	large := bytes.Repeat([]byte("text "), 1000)
+	tests := map[string]*Entry{
+		"small":          {Headers: http.Header{"Content-Type": {"text/plain"}}, Body: []byte("short")},
+		"image":          {Headers: http.Header{"Content-Type": {"image/png"}}, Body: large},
+		"no type":        {Headers: http.Header{}, Body: large},
+		"encoded":        {Headers: http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, Body: large},
+		"on disk":        {Headers: http.Header{"Content-Type": {"text/plain"}}, BodyFile: "body"},
+		"incompressible": {Headers: http.Header{"Content-Type": {"text/plain"}}, Body: []byte("abcdefghijklmnopqrstuvwxyz0123456789")},
+	}
+	for name, entry := range tests {
+		if entry.Compress(16) || entry.Compressed {
+			t.Errorf("%s: expected the body to be stored as is", name)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// diskBodyPattern names body files so stale ones can be found and removed
+const diskBodyPattern = "wproxy-body-*"
+
+// DiskStore keeps large cached bodies in files so they are streamed to
+// clients instead of being held in memory
+type DiskStore struct {
+	dir       string
+	threshold int64
+}
+
+// NewDiskStore creates a store writing bodies larger than threshold bytes
+// to dir. The directory is created on first use.
+func NewDiskStore(dir string, threshold int64) *DiskStore {
+	return &DiskStore{dir: dir, threshold: threshold}
+}
+
+// Threshold returns the body size above which bodies go to disk
+func (s *DiskStore) Threshold() int64 {
+	return s.threshold
+}
+
+// Create opens a new body file. The caller stores its name in
+// Entry.BodyFile, or removes it if the entry is not cached.
+func (s *DiskStore) Create() (*os.File, error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache body directory: %w", err)
+	}
+	return os.CreateTemp(s.dir, diskBodyPattern)
+}
+
+// Check verifies that body files can be created in the directory
+func (s *DiskStore) Check() error {
+	f, err := s.Create()
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// RemoveDiskBodies deletes body files left in dir, e.g. by a previous
+// process. Entries referring to them must no longer be served.
+func RemoveDiskBodies(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, diskBodyPattern))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// diskEntry writes body to a new file in the store and returns an entry
+// referring to it
+func diskEntry(t *testing.T, s *DiskStore, body string) *Entry {
+	t.Helper()
+	f, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &Entry{
+		StatusCode: 200,
+		ExpiresAt:  time.Now().Add(time.Minute),
+		CreatedAt:  time.Now(),
+		Size:       int64(len(body)),
+		BodyFile:   f.Name(),
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestOpenBody(t *testing.T) {
+	s := NewDiskStore(filepath.Join(t.TempDir(), "bodies"), 0)
+
+	for name, entry := range map[string]*Entry{
+		"memory": {Body: []byte("payload")},
+		"disk":   diskEntry(t, s, "payload"),
+	} {
+		body, err := entry.OpenBody()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := body.Seek(3, io.SeekStart); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, _ := io.ReadAll(body)
+		body.Close()
+		if string(got) != "load" {
+			t.Errorf("%s: expected seekable body, got %q", name, got)
+		}
+	}
+}
+
+func TestMemoryCacheRemovesBodyFiles(t *testing.T) {
+	s := NewDiskStore(t.TempDir(), 0)
+	c := NewMemoryCache(10, time.Minute)
+
+	// Replacing an entry removes the old file, but not when the replacement
+	// shares it, as a revalidated entry does
+	first := diskEntry(t, s, "aaaa")
+	c.Set("key", first)
+	refreshed := *first
+	c.Set("key", &refreshed)
+	if !exists(first.BodyFile) {
+		t.Fatal("expected a refreshed entry to keep its body file")
+	}
+	second := diskEntry(t, s, "bbbb")
+	c.Set("key", second)
+	if exists(first.BodyFile) {
+		t.Error("expected the replaced entry's file to be removed")
+	}
+
+	// Eviction and deletion remove files too
+	evicted := diskEntry(t, s, "cccc")
+	c.Set("other", evicted)
+	c.Set("third", diskEntry(t, s, "dddd"))
+	if exists(second.BodyFile) {
+		t.Error("expected the evicted entry's file to be removed")
+	}
+	c.Delete("other")
+	if exists(evicted.BodyFile) {
+		t.Error("expected the deleted entry's file to be removed")
+	}
+
+	c.Clear()
+	if files, _ := filepath.Glob(filepath.Join(s.dir, "*")); len(files) != 0 {
+		t.Errorf("expected Clear to remove all body files, got %v", files)
+	}
+}
+
+func TestRemoveDiskBodies(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDiskStore(dir, 0)
+	stale := diskEntry(t, s, "old")
+	other := filepath.Join(dir, "keep.txt")
+	if err := os.WriteFile(other, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveDiskBodies(dir); err != nil {
+		t.Fatal(err)
+	}
+	if exists(stale.BodyFile) {
+		t.Error("expected stale body file to be removed")
+	}
+	if !exists(other) {
+		t.Error("expected unrelated files to be kept")
+	}
+}
@@ -24,7 +24,7 @@ func FuzzCacheKey(f *testing.F) {
 		}
 
 		// Should not panic
-		key := CacheKey(req, []string{"Accept"})
+		key := CacheKey(req, []string{"Accept"}, nil)
 		if key == "" {
 			t.Error("CacheKey returned empty string")
 		}
@@ -36,6 +36,7 @@ func FuzzParseTTL(f *testing.F) {
 	f.Add("max-age=60")
 	f.Add("public, max-age=3600, must-revalidate")
 	f.Add("no-cache")
+	f.Add("max-age=60, s-maxage=-1")
 	f.Add("")
 
 	f.Fuzz(func(t *testing.T, cacheControl string) {
@@ -85,7 +86,7 @@ func FuzzIsCacheable(f *testing.F) {
 		}
 
 		// Should not panic
-		_ = IsCacheable(req, statusCode, headers)
+		_ = IsCacheable(req, statusCode, headers, []int{http.StatusNotFound})
 	})
 }
 
@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/redis"
+)
+
+// staleRetention is how long Redis keeps an expired entry that carries a
+// validator, so it can still be revalidated instead of fetched again
+const staleRetention = time.Hour
+
+// redisCache stores entries in Redis, shared by every instance using the
+// same server. Redis bounds the total size with its own maxmemory policy.
+type redisCache struct {
+	client       *redis.Client
+	prefix       string
+	maxEntrySize int64
+}
+
+var _ Checker = (*redisCache)(nil)
+
+// NewRedisCache creates a cache storing gob-encoded entries in Redis under
+// keys starting with prefix. Entries larger than maxEntrySize are rejected,
+// as are entries with a body file, which other instances could not read.
+// A failing server reads as a miss and rejects writes, so an outage costs
+// hits but not requests.
+func NewRedisCache(client *redis.Client, prefix string, maxEntrySize int64) Cache {
+	return &redisCache{client: client, prefix: prefix, maxEntrySize: maxEntrySize}
+}
+
+// Get returns the entry unless it has expired
+func (c *redisCache) Get(key string) (*Entry, bool) {
+	entry, ok := c.GetStale(key)
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// GetStale returns the entry regardless of expiry
+func (c *redisCache) GetStale(key string) (*Entry, bool) {
+	reply, err := c.client.Do(context.Background(), "GET", c.prefix+key)
+	data, ok := reply.(string)
+	if err != nil || !ok {
+		return nil, false
+	}
+	var entry Entry
+	if err := gob.NewDecoder(strings.NewReader(data)).Decode(&entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Set stores the entry until it expires, or staleRetention longer when it
+// can be revalidated. A rejected entry drops any older one under the key.
+func (c *redisCache) Set(key string, entry *Entry) bool {
+	if entry.Size == 0 {
+		entry.Size = EntrySize(entry.Headers, entry.ETag, int64(len(entry.Body)))
+	}
+	ttl := time.Until(entry.ExpiresAt)
+	if entry.Revalidatable() {
+		ttl += staleRetention
+	}
+	if entry.BodyFile != "" || entry.Size > c.maxEntrySize || ttl.Milliseconds() <= 0 {
+		c.Delete(key)
+		return false
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return false
+	}
+	_, err := c.client.Do(context.Background(), "SET", c.prefix+key, buf.String(),
+		"PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err == nil
+}
+
+// Delete removes the entry
+func (c *redisCache) Delete(key string) {
+	c.client.Do(context.Background(), "DEL", c.prefix+key)
+}
+
+// Clear removes every entry under the prefix
+func (c *redisCache) Clear() {
+	c.scan(func(keys []string) {
+		c.client.Do(context.Background(), append([]string{"DEL"}, keys...)...)
+	})
+}
+
+// Size returns the bytes the encoded entries take in Redis
+func (c *redisCache) Size() int64 {
+	var size int64
+	c.scan(func(keys []string) {
+		cmds := make([][]string, len(keys))
+		for i, key := range keys {
+			cmds[i] = []string{"STRLEN", key}
+		}
+		replies, err := c.client.Pipeline(context.Background(), cmds...)
+		if err != nil {
+			return
+		}
+		for _, reply := range replies {
+			if n, ok := reply.(int64); ok {
+				size += n
+			}
+		}
+	})
+	return size
+}
+
+// Len returns the number of entries
+func (c *redisCache) Len() int {
+	n := 0
+	c.scan(func(keys []string) {
+		n += len(keys)
+	})
+	return n
+}
+
+// Check reports whether the server answers
+func (c *redisCache) Check() error {
+	_, err := c.client.Do(context.Background(), "PING")
+	return err
+}
+
+// scan calls fn with each batch of keys under the prefix. It stops early
+// if the server fails.
+func (c *redisCache) scan(fn func(keys []string)) {
+	cursor := "0"
+	for {
+		reply, err := c.client.Do(context.Background(), "SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", "1000")
+		items, ok := reply.([]any)
+		if err != nil || !ok || len(items) != 2 {
+			return
+		}
+		cursor, _ = items[0].(string)
+		batch, _ := items[1].([]any)
+		keys := make([]string, 0, len(batch))
+		for _, item := range batch {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			fn(keys)
+		}
+		if cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/redis"
+	"github.com/mumumio1/wproxy/internal/redis/redistest"
+)
+
+// newTestRedisCache returns a Redis cache backed by srv
+func newTestRedisCache(t *testing.T, srv *redistest.Server, maxEntrySize int64) Cache {
+	client := redis.NewClient(redis.Options{Address: srv.Addr(), Timeout: time.Second})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisCache(client, "cache:", maxEntrySize)
+}
+
+func TestRedisCacheRoundTrip(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := newTestRedisCache(t, srv, 1024)
+
+	entry := &Entry{
+		StatusCode: http.StatusOK,
+		Headers:    http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       []byte("hello"),
+		ExpiresAt:  time.Now().Add(time.Minute),
+		CreatedAt:  time.Now(),
+		InitialAge: 5 * time.Second,
+		Method:     http.MethodGet,
+		URL:        "/hello?a=1",
+	}
+	if !c.Set("key", entry) {
+		t.Fatal("expected the entry to be stored")
+	}
+	if ttl := srv.TTL("cache:key"); ttl <= 55*time.Second || ttl > time.Minute {
+		t.Errorf("expected the key to expire with the entry, got TTL %v", ttl)
+	}
+
+	got, ok := c.Get("key")
+	if !ok {
+		t.Fatal("expected a hit")
+	}
+	if got.StatusCode != entry.StatusCode || string(got.Body) != "hello" || got.Headers.Get("Content-Type") != "text/plain" ||
+		!got.ExpiresAt.Equal(entry.ExpiresAt) || got.InitialAge != entry.InitialAge || got.URL != entry.URL || got.Size != entry.Size {
+		t.Errorf("expected the entry to survive the round trip, got %+v", got)
+	}
+	if c.Len() != 1 || c.Size() == 0 {
+		t.Errorf("expected one entry with a size, got %d and %d", c.Len(), c.Size())
+	}
+
+	c.Delete("key")
+	if _, ok := c.GetStale("key"); ok {
+		t.Error("expected Delete to remove the entry")
+	}
+}
+
+func TestRedisCacheClearKeepsOtherKeys(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := newTestRedisCache(t, srv, 1024)
+	client := redis.NewClient(redis.Options{Address: srv.Addr()})
+	defer client.Close()
+	if _, err := client.Do(context.Background(), "SET", "wproxy:quota:1:client", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("a", newTieredEntry("a"))
+	c.Set("b", newTieredEntry("b"))
+	c.Clear()
+	if c.Len() != 0 {
+		t.Errorf("expected Clear to remove the entries, %d left", c.Len())
+	}
+	if _, ok := srv.Get("wproxy:quota:1:client"); !ok {
+		t.Error("expected Clear to leave keys outside the prefix alone")
+	}
+}
+
+func TestRedisCacheStaleEntries(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := newTestRedisCache(t, srv, 1024)
+
+	expired := newTieredEntry("old")
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	if c.Set("plain", expired) {
+		t.Error("expected an expired entry without validators to be rejected")
+	}
+
+	stale := newTieredEntry("old")
+	stale.ExpiresAt = time.Now().Add(-time.Second)
+	stale.Headers = http.Header{"Etag": []string{`"v1"`}}
+	if !c.Set("key", stale) {
+		t.Fatal("expected an expired entry with a validator to be kept for revalidation")
+	}
+	if _, ok := c.Get("key"); ok {
+		t.Error("expected the expired entry to miss")
+	}
+	if entry, ok := c.GetStale("key"); !ok || string(entry.Body) != "old" {
+		t.Error("expected GetStale to return the expired entry")
+	}
+	if ttl := srv.TTL("cache:key"); ttl <= 0 || ttl > staleRetention {
+		t.Errorf("expected the entry to be kept up to staleRetention, got TTL %v", ttl)
+	}
+}
+
+func TestRedisCacheRejects(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := newTestRedisCache(t, srv, 8)
+
+	c.Set("key", newTieredEntry("v1"))
+	if c.Set("key", newTieredEntry("too large for the cache")) {
+		t.Error("expected an entry over the max entry size to be rejected")
+	}
+	if _, ok := c.GetStale("key"); ok {
+		t.Error("expected a rejected entry to drop the older one")
+	}
+
+	onDisk := newTieredEntry("")
+	onDisk.BodyFile = "/tmp/body"
+	if c.Set("disk", onDisk) {
+		t.Error("expected an entry with a body file to be rejected")
+	}
+}
+
+func TestRedisCacheDown(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := newTestRedisCache(t, srv, 1024)
+	c.Set("key", newTieredEntry("v1"))
+
+	srv.SetDown(true)
+	if _, ok := c.Get("key"); ok {
+		t.Error("expected a miss while Redis is down")
+	}
+	if c.Set("key", newTieredEntry("v2")) {
+		t.Error("expected writes to fail while Redis is down")
+	}
+	if err := c.(Checker).Check(); err == nil {
+		t.Error("expected Check to report the outage")
+	}
+
+	srv.SetDown(false)
+	if err := c.(Checker).Check(); err != nil {
+		t.Errorf("expected Check to pass once Redis is back, got %v", err)
+	}
+}
+
+func TestTieredCacheSharedRedis(t *testing.T) {
+	srv := redistest.NewServer(t)
+	a := NewTieredCache(NewMemoryCache(1024, time.Minute), newTestRedisCache(t, srv, 1024))
+	b := NewTieredCache(NewMemoryCache(1024, time.Minute), newTestRedisCache(t, srv, 1024))
+
+	a.Set("key", newTieredEntry("shared"))
+	if entry, ok := b.Get("key"); !ok || string(entry.Body) != "shared" {
+		t.Errorf("expected an entry stored by one instance to be served by another, got %v %v", entry, ok)
+	}
+}
@@ -0,0 +1,85 @@
+package cache
+
+// tieredCache serves reads from a fast first tier backed by a larger or
+// shared second tier
+type tieredCache struct {
+	l1 Cache
+	l2 Cache
+}
+
+// NewTieredCache layers l1 (typically a small in-memory cache) in front of
+// l2 (e.g. a cache shared between instances). Reads check l1 first and
+// promote l2 hits into l1. Writes go through to both tiers, and Delete and
+// Clear invalidate l2 before l1 so a concurrent read cannot promote an
+// entry that is being removed. Entries promoted into another instance's l1
+// are only dropped when they expire there, so l1 should use a short TTL.
+func NewTieredCache(l1, l2 Cache) Cache {
+	return &tieredCache{l1: l1, l2: l2}
+}
+
+// Get returns the entry from l1, or from l2 after promoting it into l1
+func (c *tieredCache) Get(key string) (*Entry, bool) {
+	if entry, ok := c.l1.Get(key); ok {
+		return entry, true
+	}
+	entry, ok := c.l2.Get(key)
+	if !ok {
+		return nil, false
+	}
+	c.l1.Set(key, entry)
+	return entry, true
+}
+
+// GetStale returns an entry from either tier regardless of expiry. Stale
+// entries are not promoted; a successful revalidation stores them again.
+func (c *tieredCache) GetStale(key string) (*Entry, bool) {
+	if entry, ok := c.l1.GetStale(key); ok {
+		return entry, true
+	}
+	return c.l2.GetStale(key)
+}
+
+// Set writes the entry through to both tiers. An entry l2 rejects is not
+// stored in l1 either, so l1 never holds what l2 cannot.
+func (c *tieredCache) Set(key string, entry *Entry) bool {
+	if !c.l2.Set(key, entry) {
+		c.l1.Delete(key)
+		return false
+	}
+	c.l1.Set(key, entry)
+	return true
+}
+
+// Delete removes the entry from both tiers
+func (c *tieredCache) Delete(key string) {
+	c.l2.Delete(key)
+	c.l1.Delete(key)
+}
+
+// Clear removes all entries from both tiers
+func (c *tieredCache) Clear() {
+	c.l2.Clear()
+	c.l1.Clear()
+}
+
+// Size returns the size of l2, which holds the full data set
+func (c *tieredCache) Size() int64 {
+	return c.l2.Size()
+}
+
+// Len returns the number of entries in l2
+func (c *tieredCache) Len() int {
+	return c.l2.Len()
+}
+
+// Check checks both tiers that implement Checker
+func (c *tieredCache) Check() error {
+	for _, tier := range []Cache{c.l1, c.l2} {
+		if checker, ok := tier.(Checker); ok {
+			if err := checker.Check(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTieredEntry(body string) *Entry {
+	return &Entry{
+		StatusCode: 200,
+		Body:       []byte(body),
+		ExpiresAt:  time.Now().Add(time.Minute),
+		CreatedAt:  time.Now(),
+		Size:       int64(len(body)),
+	}
+}
+
+func TestTieredCachePromotesL2Hits(t *testing.T) {
+	l1 := NewMemoryCache(1024, time.Minute)
+	l2 := NewMemoryCache(1024, time.Minute)
+	c := NewTieredCache(l1, l2)
+
+	l2.Set("key", newTieredEntry("shared"))
+	if l1.Len() != 0 {
+		t.Fatal("expected l1 to start empty")
+	}
+
+	entry, ok := c.Get("key")
+	if !ok || string(entry.Body) != "shared" {
+		t.Fatalf("expected hit from l2, got %v %v", entry, ok)
+	}
+	if promoted, ok := l1.Get("key"); !ok || string(promoted.Body) != "shared" {
+		t.Error("expected l2 hit to be promoted into l1")
+	}
+
+	// Later reads are served by l1 even if l2 loses the entry
+	l2.Delete("key")
+	if _, ok := c.Get("key"); !ok {
+		t.Error("expected l1 to serve the promoted entry")
+	}
+
+	if _, ok := c.Get("missing"); ok {
+		t.Error("expected miss when neither tier has the key")
+	}
+}
+
+func TestTieredCacheWritesThrough(t *testing.T) {
+	l1 := NewMemoryCache(1024, time.Minute)
+	l2 := NewMemoryCache(1024, time.Minute)
+	c := NewTieredCache(l1, l2)
+
+	c.Set("key", newTieredEntry("v1"))
+	for name, tier := range map[string]Cache{"l1": l1, "l2": l2} {
+		if entry, ok := tier.Get("key"); !ok || string(entry.Body) != "v1" {
+			t.Errorf("expected Set to write %s", name)
+		}
+	}
+	if c.Len() != 1 || c.Size() != 2 {
+		t.Errorf("expected len 1 and size 2 from l2, got %d and %d", c.Len(), c.Size())
+	}
+
+	c.Delete("key")
+	if l1.Len() != 0 || l2.Len() != 0 {
+		t.Errorf("expected Delete to remove the key from both tiers, got %d and %d", l1.Len(), l2.Len())
+	}
+
+	c.Set("a", newTieredEntry("a"))
+	c.Set("b", newTieredEntry("b"))
+	c.Clear()
+	if l1.Len() != 0 || l2.Len() != 0 {
+		t.Errorf("expected Clear to empty both tiers, got %d and %d", l1.Len(), l2.Len())
+	}
+}
+
+func TestTieredCacheGetStale(t *testing.T) {
+	l1 := NewMemoryCache(1024, time.Minute)
+	l2 := NewMemoryCache(1024, time.Minute)
+	c := NewTieredCache(l1, l2)
+
+	stale := newTieredEntry("old")
+	stale.ExpiresAt = time.Now().Add(-time.Minute)
+	// A validator keeps the expired entry around for revalidation
+	stale.Headers = http.Header{"Etag": []string{`"v1"`}}
+	l2.Set("key", stale)
+
+	if _, ok := c.Get("key"); ok {
+		t.Error("expected expired entry to miss")
+	}
+	if entry, ok := c.GetStale("key"); !ok || string(entry.Body) != "old" {
+		t.Error("expected GetStale to fall through to l2")
+	}
+	if l1.Len() != 0 {
+		t.Error("expected stale entries not to be promoted")
+	}
+}
+
+func TestTieredCacheSetRejectedByL2(t *testing.T) {
+	l1 := NewMemoryCache(1024, time.Minute)
+	l2 := NewMemoryCache(8, time.Minute)
+	c := NewTieredCache(l1, l2)
+
+	if c.Set("key", newTieredEntry("too large for l2")) {
+		t.Error("expected entry rejected by l2 to be reported")
+	}
+	if l1.Len() != 0 || l2.Len() != 0 {
+		t.Errorf("expected neither tier to store the entry, got %d and %d", l1.Len(), l2.Len())
+	}
+}
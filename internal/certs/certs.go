@@ -0,0 +1,119 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// versions maps configuration names to TLS protocol versions
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config holds the listener certificate and protocol settings
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is "1.0" to "1.3", Go's default when empty
+	MinVersion string
+	// CipherSuites are names from tls.CipherSuites, Go's default when
+	// empty. They only apply up to TLS 1.2.
+	CipherSuites []string
+}
+
+// Reloader serves a certificate that can be replaced while the listener
+// keeps running, so rotated certificates are picked up without downtime
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	minVersion   uint16
+	cipherSuites []uint16
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// New loads the certificate and validates the protocol settings
+func New(cfg Config) (*Reloader, error) {
+	r := &Reloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+
+	if cfg.MinVersion != "" {
+		v, ok := versions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", cfg.MinVersion)
+		}
+		r.minVersion = v
+	}
+
+	suites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	r.cipherSuites = suites
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseCipherSuites converts cipher suite names to their IDs. Insecure
+// suites are accepted so legacy clients can be supported deliberately.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Reload reads the certificate files again. On error the previous
+// certificate stays in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate for tls.Config
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server configuration that always presents the
+// current certificate
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     r.minVersion,
+		CipherSuites:   r.cipherSuites,
+		GetCertificate: r.GetCertificate,
+	}
+}
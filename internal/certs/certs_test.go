@@ -0,0 +1,138 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate with the given common
+// name to certFile and keyFile
+func writeCertificate(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, r *Reloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	r, err := New(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, r); got != "first" {
+		t.Fatalf("expected first certificate, got %q", got)
+	}
+
+	writeCertificate(t, certFile, keyFile, "second")
+	if got := commonName(t, r); got != "first" {
+		t.Errorf("expected certificate to change only on reload, got %q", got)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, r); got != "second" {
+		t.Errorf("expected second certificate after reload, got %q", got)
+	}
+
+	// A broken file keeps the previous certificate in use
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("expected reload of an invalid key to fail")
+	}
+	if got := commonName(t, r); got != "second" {
+		t.Errorf("expected second certificate to stay after failed reload, got %q", got)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "proxy")
+
+	r, err := New(Config{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := r.TLSConfig()
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 minimum, got %x", cfg.MinVersion)
+	}
+	if len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected cipher suites %v", cfg.CipherSuites)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "proxy")
+
+	tests := []Config{
+		{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.4"},
+		{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_MADE_UP"}},
+		{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+	}
+	for _, cfg := range tests {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
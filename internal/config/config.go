@@ -1,93 +1,539 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-// Config represents the application configuration
+// Config represents the application configuration. The desc tag of each
+// field is its documentation for operators, printed by
+// -print-config-schema; doc comments only add what a desc tag is too short
+// to say.
 type Config struct {
-	Server   ServerConfig   `json:"server" yaml:"server"`
-	Upstream UpstreamConfig `json:"upstream" yaml:"upstream"`
-	Cache    CacheConfig    `json:"cache" yaml:"cache"`
-	RateLimit RateLimitConfig `json:"ratelimit" yaml:"ratelimit"`
-	Logging  LoggingConfig  `json:"logging" yaml:"logging"`
-	Metrics  MetricsConfig  `json:"metrics" yaml:"metrics"`
+	Server      ServerConfig      `json:"server" yaml:"server" desc:"Listener settings"`
+	Upstream    UpstreamConfig    `json:"upstream" yaml:"upstream" desc:"Backends requests are proxied to"`
+	Cache       CacheConfig       `json:"cache" yaml:"cache" desc:"Response cache"`
+	RateLimit   RateLimitConfig   `json:"ratelimit" yaml:"ratelimit" desc:"Per-client rate limiting"`
+	Logging     LoggingConfig     `json:"logging" yaml:"logging" desc:"Logging and access log"`
+	Metrics     MetricsConfig     `json:"metrics" yaml:"metrics" desc:"Prometheus metrics"`
+	Tenant      TenantConfig      `json:"tenant" yaml:"tenant" desc:"Multi-tenant resolution"`
+	CORS        CORSConfig        `json:"cors" yaml:"cors" desc:"Cross-origin resource sharing"`
+	Routes      []RouteConfig     `json:"routes" yaml:"routes" desc:"Settings for requests matching a path prefix"`
+	Admin       AdminConfig       `json:"admin" yaml:"admin" desc:"Admin endpoints"`
+	Maintenance MaintenanceConfig `json:"maintenance" yaml:"maintenance" desc:"Maintenance mode"`
+	ErrorPages  ErrorPagesConfig  `json:"error_pages" yaml:"error_pages" desc:"Proxy-generated error responses"`
+	Mirror      MirrorConfig      `json:"mirror" yaml:"mirror" desc:"Traffic shadowing to a secondary upstream"`
+	Flags       FlagsConfig       `json:"flags" yaml:"flags" desc:"Per-request feature flags"`
+	Concurrency ConcurrencyConfig `json:"concurrency" yaml:"concurrency" desc:"Cap on proxied requests handled at once"`
+	Debug       DebugConfig       `json:"debug" yaml:"debug" desc:"Debugging the running proxy"`
+}
+
+// RouteConfig holds settings applied to requests matching a path prefix
+type RouteConfig struct {
+	PathPrefix string `json:"path_prefix" yaml:"path_prefix" desc:"Path prefix the route matches on whole segments, so /api does not match /apis"`
+	// ExpectContentType lists the content types the upstream may return
+	// for this route; other responses are replaced with a 502
+	ExpectContentType []string `json:"expect_content_type" yaml:"expect_content_type" desc:"Content types the upstream may return; others become a 502"`
+	// Split divides the route's traffic between upstream variants by
+	// weight, e.g. 90% stable and 10% canary
+	Split []VariantConfig `json:"split" yaml:"split" desc:"Upstream variants sharing the route's traffic by weight"`
+	// SplitBy is the request attribute that pins a client to a variant:
+	// "ip" (default), "header:<name>" or "cookie:<name>"
+	SplitBy string `json:"split_by" yaml:"split_by" desc:"Attribute pinning a client to a variant: ip, header:<name> or cookie:<name>"`
+
+	// Transport overrides the connection pool settings for the route's
+	// requests, which get connections of their own to every backend and
+	// split variant. Zero values inherit the backend's settings.
+	Transport TransportConfig `json:"transport" yaml:"transport" desc:"Connection pool settings for the route's requests; zero values inherit"`
+}
+
+// HasTransport reports whether the route overrides any connection setting
+func (r RouteConfig) HasTransport() bool {
+	return r.Transport != TransportConfig{}
+}
+
+// VariantConfig is an upstream version receiving a share of a route
+type VariantConfig struct {
+	Name   string `json:"name" yaml:"name" desc:"Variant name"`
+	URL    string `json:"url" yaml:"url" desc:"Variant upstream URL"`
+	Weight int    `json:"weight" yaml:"weight" desc:"Share of the route's traffic"`
 }
 
 // ServerConfig holds server-specific settings
 type ServerConfig struct {
-	Address         string        `json:"address" yaml:"address"`
-	Port            int           `json:"port" yaml:"port"`
-	ReadTimeout     time.Duration `json:"read_timeout" yaml:"read_timeout"`
-	WriteTimeout    time.Duration `json:"write_timeout" yaml:"write_timeout"`
-	IdleTimeout     time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
-	ShutdownTimeout time.Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	Address         string        `json:"address" yaml:"address" desc:"Address to listen on"`
+	Port            int           `json:"port" yaml:"port" desc:"Port to listen on"`
+	ReadTimeout     time.Duration `json:"read_timeout" yaml:"read_timeout" desc:"Maximum time to read a request"`
+	WriteTimeout    time.Duration `json:"write_timeout" yaml:"write_timeout" desc:"Maximum time to write a response"`
+	IdleTimeout     time.Duration `json:"idle_timeout" yaml:"idle_timeout" desc:"How long idle keep-alive connections stay open"`
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" yaml:"shutdown_timeout" desc:"How long shutdown waits for in-flight requests"`
+	// DrainDelay is how long /ready reports unavailable before shutdown
+	// begins, giving load balancers time to stop sending traffic
+	DrainDelay         time.Duration   `json:"drain_delay" yaml:"drain_delay" desc:"How long /ready reports unavailable before shutdown begins"`
+	Readiness          ReadinessConfig `json:"readiness" yaml:"readiness" desc:"Dependency checks behind /ready"`
+	TrustedProxies     []string        `json:"trusted_proxies" yaml:"trusted_proxies" desc:"CIDRs or IPs of proxies whose X-Forwarded-For and X-Real-IP headers are trusted"`
+	AnswerOptions      bool            `json:"answer_options" yaml:"answer_options" desc:"Reply to OPTIONS requests instead of forwarding them"`
+	AllowedMethods     []string        `json:"allowed_methods" yaml:"allowed_methods" desc:"Request methods accepted; empty allows all"`
+	MaxRequestBodySize int64           `json:"max_request_body_size" yaml:"max_request_body_size" desc:"Request body limit in bytes, 0 for unlimited"`
+	TLS                ServerTLSConfig `json:"tls" yaml:"tls" desc:"Server certificate; when set the listener serves HTTPS"`
+	// HTTP3 additionally serves HTTP/3 over QUIC on the same port (UDP)
+	// and advertises it with Alt-Svc. Requires TLS.
+	HTTP3 bool `json:"http3" yaml:"http3" desc:"Also serve HTTP/3 over QUIC on the same port; requires TLS"`
+	// ProxyProtocol reads the client address from a PROXY protocol header
+	// sent by an L4 load balancer in front of the listener
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol" yaml:"proxy_protocol" desc:"Read the client address from a PROXY protocol header"`
+}
+
+// ReadinessConfig controls the dependency checks behind /ready. /health
+// is a liveness probe and never checks dependencies.
+type ReadinessConfig struct {
+	// CheckUpstream requires at least one primary backend to accept a
+	// TCP connection. Off by default: an upstream outage would otherwise
+	// take every proxy instance out of the load balancer at once.
+	CheckUpstream bool          `json:"check_upstream" yaml:"check_upstream" desc:"Require a primary backend to accept a TCP connection"`
+	Timeout       time.Duration `json:"timeout" yaml:"timeout" desc:"Timeout for each check"`
+}
+
+// ProxyProtocolConfig holds PROXY protocol (v1 and v2) settings. When
+// enabled every TCP connection must start with a header.
+type ProxyProtocolConfig struct {
+	Enabled       bool          `json:"enabled" yaml:"enabled" desc:"Require a PROXY protocol header on every connection"`
+	HeaderTimeout time.Duration `json:"header_timeout" yaml:"header_timeout" desc:"Maximum time to read the header"`
+}
+
+// ServerTLSConfig holds the certificate served by the listener. The
+// certificate is reloaded from disk on SIGHUP.
+type ServerTLSConfig struct {
+	CertFile   string `json:"cert_file" yaml:"cert_file" desc:"PEM certificate file, reloaded on SIGHUP"`
+	KeyFile    string `json:"key_file" yaml:"key_file" desc:"PEM private key file, reloaded on SIGHUP"`
+	MinVersion string `json:"min_version" yaml:"min_version" desc:"Lowest accepted TLS version, 1.0 to 1.3"`
+	// CipherSuites restricts TLS 1.2 and lower to these suites (Go names,
+	// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); empty uses Go's defaults
+	CipherSuites []string `json:"cipher_suites" yaml:"cipher_suites" desc:"TLS 1.2 and lower cipher suites by Go name; empty uses Go's defaults"`
+	RedirectPort int      `json:"redirect_port" yaml:"redirect_port" desc:"Port redirecting plain HTTP to HTTPS, 0 to disable"`
+}
+
+// Enabled reports whether a certificate is configured
+func (t ServerTLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+func (t ServerTLSConfig) validate(port int) error {
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("invalid server TLS min version: %q", t.MinVersion)
+	}
+
+	known := make(map[string]bool)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = true
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = true
+	}
+	for _, name := range t.CipherSuites {
+		if !known[name] {
+			return fmt.Errorf("unknown server TLS cipher suite: %q", name)
+		}
+	}
+
+	if t.RedirectPort != 0 {
+		if !t.Enabled() {
+			return fmt.Errorf("server TLS redirect port requires a certificate")
+		}
+		if t.RedirectPort < 0 || t.RedirectPort > 65535 || t.RedirectPort == port {
+			return fmt.Errorf("invalid server TLS redirect port: %d", t.RedirectPort)
+		}
+	}
+	return nil
 }
 
 // UpstreamConfig holds upstream service settings
 type UpstreamConfig struct {
-	URL               string        `json:"url" yaml:"url"`
-	Timeout           time.Duration `json:"timeout" yaml:"timeout"`
-	MaxIdleConns      int           `json:"max_idle_conns" yaml:"max_idle_conns"`
-	MaxConnsPerHost   int           `json:"max_conns_per_host" yaml:"max_conns_per_host"`
-	IdleConnTimeout   time.Duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
-	TLSHandshakeTimeout time.Duration `json:"tls_handshake_timeout" yaml:"tls_handshake_timeout"`
-	ForbiddenHeaders  []string      `json:"forbidden_headers" yaml:"forbidden_headers"`
+	URL                 string        `json:"url" yaml:"url" desc:"Upstream URL, used when no backends are listed"`
+	Timeout             time.Duration `json:"timeout" yaml:"timeout" desc:"Maximum wait for upstream response headers"`
+	MaxIdleConns        int           `json:"max_idle_conns" yaml:"max_idle_conns" desc:"Idle connections kept per backend"`
+	MaxConnsPerHost     int           `json:"max_conns_per_host" yaml:"max_conns_per_host" desc:"Connection limit per backend, 0 for unlimited"`
+	IdleConnTimeout     time.Duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout" desc:"How long idle upstream connections stay open"`
+	TLSHandshakeTimeout time.Duration `json:"tls_handshake_timeout" yaml:"tls_handshake_timeout" desc:"Maximum time for the upstream TLS handshake"`
+	ForbiddenHeaders    []string      `json:"forbidden_headers" yaml:"forbidden_headers" desc:"Request headers stripped before forwarding"`
+	// ForbiddenHeaderPatterns are regular expressions matched against
+	// whole header names, ignoring case, e.g. "X-Internal-.*". Matching
+	// headers are stripped along with ForbiddenHeaders.
+	ForbiddenHeaderPatterns []string        `json:"forbidden_header_patterns" yaml:"forbidden_header_patterns" desc:"Regular expressions for request header names stripped before forwarding"`
+	Backends                []BackendConfig `json:"backends" yaml:"backends" desc:"Backends to load balance across"`
+	// Strategy selects the load balancer: round_robin, weighted, least_conn,
+	// ip_hash or cookie_hash
+	Strategy string `json:"strategy" yaml:"strategy" desc:"Load balancer: round_robin, weighted, least_conn, ip_hash or cookie_hash"`
+	// HashCookie names the session cookie used by cookie_hash; requests
+	// without it are hashed by client IP
+	HashCookie          string            `json:"hash_cookie" yaml:"hash_cookie" desc:"Session cookie hashed by cookie_hash"`
+	MaxResponseBodySize int64             `json:"max_response_body_size" yaml:"max_response_body_size" desc:"Upstream response body limit in bytes, 0 for unlimited"`
+	TLS                 UpstreamTLSConfig `json:"tls" yaml:"tls" desc:"Default TLS settings for backends"`
+	// EnableHTTP2 speaks HTTP/2 to every backend: h2 over TLS and h2c over
+	// plaintext. Backends must support it; there is no HTTP/1.1 fallback.
+	EnableHTTP2 bool `json:"enable_http2" yaml:"enable_http2" desc:"Speak HTTP/2 to every backend, h2 over TLS and h2c otherwise"`
+	// StartupCheck dials every backend at startup and logs a warning for
+	// those that can't be reached within StartupCheckTimeout. The proxy
+	// starts either way.
+	StartupCheck        bool             `json:"startup_check" yaml:"startup_check" desc:"Warn at startup about unreachable backends"`
+	StartupCheckTimeout time.Duration    `json:"startup_check_timeout" yaml:"startup_check_timeout" desc:"Dial timeout for the startup check"`
+	Forwarding          ForwardingConfig `json:"forwarding" yaml:"forwarding" desc:"Headers telling backends about the client"`
+	// Timeout only bounds the wait for the response headers. RequestTimeout
+	// bounds the whole upstream exchange, body included; requests still
+	// waiting for headers when it expires get a 504. 0 disables it.
+	RequestTimeout time.Duration `json:"request_timeout" yaml:"request_timeout" desc:"Bound on the whole upstream exchange, 0 to disable"`
+	// ExpectContinueTimeout is how long a request with "Expect:
+	// 100-continue" waits for the backend's 100 Continue before its body
+	// is sent anyway. The client gets the backend's 100 Continue, so it
+	// only starts uploading once the backend accepts. 0 sends bodies at
+	// once.
+	ExpectContinueTimeout time.Duration `json:"expect_continue_timeout" yaml:"expect_continue_timeout" desc:"Wait for a backend's 100 Continue before sending the body, 0 to send at once"`
+}
+
+// ForwardingConfig controls the forwarding headers added to upstream
+// requests. Forwarding headers a request already carries are kept and
+// extended only when it comes from one of the server's trusted proxies;
+// otherwise they are replaced.
+type ForwardingConfig struct {
+	XForwarded bool `json:"x_forwarded" yaml:"x_forwarded" desc:"Set X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host"`
+	Forwarded  bool `json:"forwarded" yaml:"forwarded" desc:"Set the RFC 7239 Forwarded header"`
+}
+
+// BackendConfig holds settings for a single upstream backend
+type BackendConfig struct {
+	URL       string          `json:"url" yaml:"url" desc:"Backend URL"`
+	Weight    int             `json:"weight" yaml:"weight" desc:"Weight for the weighted strategy, 0 means 1"` // used by the weighted strategy, 0 means 1
+	Transport TransportConfig `json:"transport" yaml:"transport" desc:"Connection pool settings overriding the upstream ones"`
+}
+
+// TransportConfig holds per-backend connection pool settings.
+// Zero values inherit the corresponding UpstreamConfig setting.
+type TransportConfig struct {
+	Timeout             time.Duration     `json:"timeout" yaml:"timeout" desc:"Maximum wait for response headers, 0 inherits"`
+	MaxIdleConns        int               `json:"max_idle_conns" yaml:"max_idle_conns" desc:"Idle connections kept, 0 inherits"`
+	MaxConnsPerHost     int               `json:"max_conns_per_host" yaml:"max_conns_per_host" desc:"Connection limit, 0 inherits"`
+	IdleConnTimeout     time.Duration     `json:"idle_conn_timeout" yaml:"idle_conn_timeout" desc:"How long idle connections stay open, 0 inherits"`
+	TLSHandshakeTimeout time.Duration     `json:"tls_handshake_timeout" yaml:"tls_handshake_timeout" desc:"Maximum time for the TLS handshake, 0 inherits"`
+	TLS                 UpstreamTLSConfig `json:"tls" yaml:"tls" desc:"TLS settings, empty inherits"`
+}
+
+// UpstreamTLSConfig holds TLS settings for connections to a backend
+type UpstreamTLSConfig struct {
+	ServerName         string `json:"server_name" yaml:"server_name" desc:"Server name sent and verified"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify" desc:"Skip backend certificate verification"`
+	SessionCacheSize   int    `json:"session_cache_size" yaml:"session_cache_size" desc:"TLS sessions kept for resumption, negative disables it"`
+	CertFile           string `json:"cert_file" yaml:"cert_file" desc:"Client certificate for mutual TLS"`
+	KeyFile            string `json:"key_file" yaml:"key_file" desc:"Client key for mutual TLS"`
+	CAFile             string `json:"ca_file" yaml:"ca_file" desc:"PEM bundle replacing the system roots when verifying backend certificates"`
 }
 
 // CacheConfig holds cache settings
 type CacheConfig struct {
-	Enabled         bool          `json:"enabled" yaml:"enabled"`
-	MaxSize         int64         `json:"max_size" yaml:"max_size"`
-	DefaultTTL      time.Duration `json:"default_ttl" yaml:"default_ttl"`
-	RespectCacheControl bool       `json:"respect_cache_control" yaml:"respect_cache_control"`
-	Type            string        `json:"type" yaml:"type"` // "memory" or "redis"
-	Redis           RedisConfig   `json:"redis" yaml:"redis"`
+	Enabled             bool          `json:"enabled" yaml:"enabled" desc:"Cache upstream responses"`
+	MaxSize             int64         `json:"max_size" yaml:"max_size" desc:"Cache size limit in bytes"`
+	DefaultTTL          time.Duration `json:"default_ttl" yaml:"default_ttl" desc:"Lifetime of responses that don't set their own"`
+	RespectCacheControl bool          `json:"respect_cache_control" yaml:"respect_cache_control" desc:"Honor Cache-Control from clients and the upstream"`
+	// Type selects the store: memory, per instance; redis, shared by every
+	// instance using the same server; or tiered, memory in front of redis
+	Type  string      `json:"type" yaml:"type" desc:"Cache store: memory, redis, or tiered for memory in front of redis"`
+	Redis RedisConfig `json:"redis" yaml:"redis" desc:"Redis store settings"`
+	// ExcludeHeaders are response headers never stored with cached entries,
+	// in addition to Date, Age and hop-by-hop headers
+	ExcludeHeaders []string `json:"exclude_headers" yaml:"exclude_headers" desc:"Response headers never stored with cached entries"`
+	// Eviction starts once the cache grows past the high watermark and
+	// frees space down to the low one, both fractions of MaxSize
+	EvictionHighWatermark float64 `json:"eviction_high_watermark" yaml:"eviction_high_watermark" desc:"Fraction of max_size that starts eviction"`
+	EvictionLowWatermark  float64 `json:"eviction_low_watermark" yaml:"eviction_low_watermark" desc:"Fraction of max_size eviction frees space down to"`
+	// DiskDir stores bodies larger than DiskThreshold bytes as files that
+	// are streamed to clients, with Range support. Empty keeps every body
+	// in memory. MaxSize still bounds memory and disk bodies together.
+	DiskDir       string `json:"disk_dir" yaml:"disk_dir" desc:"Directory for large bodies; empty keeps every body in memory"`
+	DiskThreshold int64  `json:"disk_threshold" yaml:"disk_threshold" desc:"Bodies larger than this many bytes are stored on disk"`
+	// TTLJitter shortens each entry's TTL by a random delay in
+	// [0, TTLJitter) so entries stored together expire at different times
+	// instead of stampeding the upstream
+	TTLJitter time.Duration `json:"ttl_jitter" yaml:"ttl_jitter" desc:"Random delay taken off each entry's TTL"`
+	// NegativeStatuses are the error statuses that may be cached, for
+	// NegativeTTL instead of DefaultTTL unless the response sets its own
+	// lifetime. Other 4xx and 5xx responses are never cached.
+	NegativeStatuses []int         `json:"negative_statuses" yaml:"negative_statuses" desc:"Error statuses that may be cached"`
+	NegativeTTL      time.Duration `json:"negative_ttl" yaml:"negative_ttl" desc:"Lifetime of cached error responses"`
+	// Query parameters left out of cache keys, so e.g. utm_* tracking
+	// parameters don't fragment the cache. Names ending in "*" match by
+	// prefix. OnlyQueryParams keys on the listed parameters alone, and
+	// IgnoreQuery on none; at most one of the three may be set.
+	IgnoreQueryParams []string `json:"ignore_query_params" yaml:"ignore_query_params" desc:"Query parameters left out of cache keys; a trailing * matches by prefix"`
+	OnlyQueryParams   []string `json:"only_query_params" yaml:"only_query_params" desc:"Query parameters cache keys are limited to"`
+	IgnoreQuery       bool     `json:"ignore_query" yaml:"ignore_query" desc:"Leave the query out of cache keys"`
+	// CacheableMethods are the request methods whose responses are cached:
+	// GET, HEAD and POST, which is keyed on the body as well. Successful
+	// requests with other methods drop the entry stored for their URL.
+	CacheableMethods []string `json:"cacheable_methods" yaml:"cacheable_methods" desc:"Request methods whose responses are cached"`
+	// CacheableStatusCodes limits the non-error statuses that are cached;
+	// empty caches every status below 400 except 206
+	CacheableStatusCodes []int `json:"cacheable_status_codes" yaml:"cacheable_status_codes" desc:"Non-error statuses cached; empty caches every status below 400 except 206"`
+	// CacheableContentTypes limits caching to responses whose Content-Type
+	// matches one of these media types, e.g. "application/json" or
+	// "image/*"; empty caches every type
+	CacheableContentTypes []string `json:"cacheable_content_types" yaml:"cacheable_content_types" desc:"Media types cached, e.g. image/*; empty caches every type"`
+	// CacheCookies stores responses that carry Set-Cookie or Vary: Cookie.
+	// Only enable it if the upstream sets the same cookies for everyone.
+	CacheCookies bool `json:"cache_cookies" yaml:"cache_cookies" desc:"Cache responses that carry Set-Cookie or Vary: Cookie"`
+	// RefreshQueryParam names a query parameter, e.g. "nocache", that
+	// makes a request skip cached entries and store a fresh response, as
+	// a client's Cache-Control: no-cache does. It is removed before the
+	// request is keyed and forwarded. Empty disables it.
+	RefreshQueryParam string `json:"refresh_query_param" yaml:"refresh_query_param" desc:"Query parameter forcing a fresh response, empty to disable"`
+
+	// WarmupURLs are paths, with optional query, requested through the
+	// proxy at startup so their responses are cached before clients ask.
+	// Warmup requests are rate limited like any client's.
+	WarmupURLs []string `json:"warmup_urls" yaml:"warmup_urls" desc:"Paths requested through the proxy at startup to fill the cache"`
+	// ControlHeader names a response header a backend sets to "bypass" to
+	// keep an otherwise cacheable response out of the cache, or to "force"
+	// to cache it despite its Cache-Control, cookies or content type. It
+	// is removed before the response reaches the client. Empty disables it.
+	ControlHeader string `json:"control_header" yaml:"control_header" desc:"Response header a backend sets to bypass or force caching, empty to disable"`
+	// CoalesceTimeout makes concurrent misses for the same key wait up to
+	// this long for the first GET's response and serve it from the cache,
+	// negatively cached errors included, instead of all reaching the
+	// upstream. Waiters that still miss take turns going upstream until
+	// the timeout passes. 0 disables it.
+	CoalesceTimeout time.Duration `json:"coalesce_timeout" yaml:"coalesce_timeout" desc:"How long concurrent misses for a key wait for the first one's response, 0 to disable"`
+	// CompressEntries gzips text bodies of at least CompressMinSize bytes
+	// kept in memory, serving them as stored to clients that accept gzip
+	// and decompressed to the others
+	CompressEntries bool  `json:"compress_entries" yaml:"compress_entries" desc:"Gzip text bodies kept in memory"`
+	CompressMinSize int64 `json:"compress_min_size" yaml:"compress_min_size" desc:"Smallest body in bytes that compress_entries compresses"`
 }
 
-// RedisConfig holds Redis-specific cache settings
+// RedisConfig holds the connection settings of a Redis server
 type RedisConfig struct {
-	Address  string `json:"address" yaml:"address"`
-	Password string `json:"password" yaml:"password"`
-	DB       int    `json:"db" yaml:"db"`
+	Address  string `json:"address" yaml:"address" desc:"Redis address"`
+	Password string `json:"password" yaml:"password" desc:"Redis password"`
+	DB       int    `json:"db" yaml:"db" desc:"Redis database number"`
 }
 
-// RateLimitConfig holds rate limiting settings
+// RateLimitConfig holds rate limiting settings. ByIP and ByAPIKey select
+// the budget a request counts against: with ByAPIKey alone, requests with
+// an API key are limited per key; setting ByIP as well opts into a budget
+// per key and client IP pair. Requests without a key, or with neither
+// option, are limited per client IP.
 type RateLimitConfig struct {
-	Enabled      bool          `json:"enabled" yaml:"enabled"`
-	RequestsPerSecond int      `json:"requests_per_second" yaml:"requests_per_second"`
-	Burst        int           `json:"burst" yaml:"burst"`
-	ByIP         bool          `json:"by_ip" yaml:"by_ip"`
-	ByAPIKey     bool          `json:"by_api_key" yaml:"by_api_key"`
-	APIKeyHeader string        `json:"api_key_header" yaml:"api_key_header"`
+	Enabled           bool   `json:"enabled" yaml:"enabled" desc:"Rate limit requests"`
+	RequestsPerSecond int    `json:"requests_per_second" yaml:"requests_per_second" desc:"Sustained requests per second per client"`
+	Burst             int    `json:"burst" yaml:"burst" desc:"Requests allowed at once above the sustained rate"`
+	ByIP              bool   `json:"by_ip" yaml:"by_ip" desc:"With by_api_key, limit per API key and client IP pair"`
+	ByAPIKey          bool   `json:"by_api_key" yaml:"by_api_key" desc:"Limit per API key"`
+	APIKeyHeader      string `json:"api_key_header" yaml:"api_key_header" desc:"Header carrying the API key"`
+	// Algorithm selects the limiter: token_bucket, or gcra for evenly
+	// paced requests once the burst is used
+	Algorithm string `json:"algorithm" yaml:"algorithm" desc:"Limiter: token_bucket or gcra"`
+	// RetryAfterJitter adds a random delay in [0, jitter) to Retry-After
+	// so throttled clients don't all retry at the same instant
+	RetryAfterJitter time.Duration `json:"retry_after_jitter" yaml:"retry_after_jitter" desc:"Random delay added to Retry-After"`
+	// MaxWait holds requests over the limit for up to this long until a
+	// token frees up instead of rejecting them at once; 0 rejects at once
+	MaxWait time.Duration `json:"max_wait" yaml:"max_wait" desc:"How long requests over the limit wait for a token, 0 rejects at once"`
+	// Quota, when positive, limits each client to this many requests per
+	// QuotaWindow instead of RequestsPerSecond. Windows are aligned in UTC,
+	// so a 24h window resets at midnight UTC.
+	Quota       int           `json:"quota" yaml:"quota" desc:"Requests per quota_window per client, replacing requests_per_second when positive"`
+	QuotaWindow time.Duration `json:"quota_window" yaml:"quota_window" desc:"Quota window, aligned in UTC"`
+	// QuotaStore keeps quota counts in memory, per instance, or in Redis,
+	// shared by every instance using the same server
+	QuotaStore string                `json:"quota_store" yaml:"quota_store" desc:"Where quota counts are kept: memory, or redis to share them between instances"`
+	Redis      RedisConfig           `json:"redis" yaml:"redis" desc:"Redis server for quota_store redis"`
+	Exempt     RateLimitExemptConfig `json:"exempt" yaml:"exempt" desc:"Requests never rate limited"`
+	// Tiers give API keys their own limits, e.g. a higher allowance for
+	// paid plans. APIKeyTiers maps each API key to a tier name; other
+	// clients use RequestsPerSecond and Burst.
+	Tiers       map[string]RateLimitTierConfig `json:"tiers" yaml:"tiers" desc:"Named limits for API key tiers"`
+	APIKeyTiers map[string]string              `json:"api_key_tiers" yaml:"api_key_tiers" desc:"Tier name of each API key"`
+	// Clients unseen for IdleTimeout are forgotten by a sweep that runs
+	// every CleanupInterval plus a random delay in [0, CleanupJitter), so
+	// replicas don't sweep in lockstep
+	CleanupInterval time.Duration `json:"cleanup_interval" yaml:"cleanup_interval" desc:"Interval between sweeps of idle clients"`
+	CleanupJitter   time.Duration `json:"cleanup_jitter" yaml:"cleanup_jitter" desc:"Random delay added to each sweep"`
+	IdleTimeout     time.Duration `json:"idle_timeout" yaml:"idle_timeout" desc:"How long an unseen client is remembered"`
+	// MaxBuckets caps the clients each limiter tracks; past it the least
+	// recently seen client is forgotten. 0 means no limit.
+	MaxBuckets int                     `json:"max_buckets" yaml:"max_buckets" desc:"Clients tracked per limiter, 0 for unlimited"`
+	Response   RateLimitResponseConfig `json:"response" yaml:"response" desc:"The 429 sent to limited clients"`
+}
+
+// RateLimitResponseConfig customizes the 429 sent to limited clients
+type RateLimitResponseConfig struct {
+	ContentType    string `json:"content_type" yaml:"content_type" desc:"Content type of the 429 body"`
+	Body           string `json:"body" yaml:"body" desc:"Template for the 429 body; {{.RetryAfter}} is the wait in seconds"`
+	RetryAfterDate bool   `json:"retry_after_date" yaml:"retry_after_date" desc:"Send Retry-After as an HTTP date instead of a number of seconds"`
+}
+
+// RateLimitTierConfig holds the limits of a rate limit tier
+type RateLimitTierConfig struct {
+	RequestsPerSecond int `json:"requests_per_second" yaml:"requests_per_second" desc:"Sustained requests per second"`
+	Burst             int `json:"burst" yaml:"burst" desc:"Requests allowed at once above the sustained rate"`
+}
+
+// RateLimitExemptConfig lists requests that are never rate limited
+type RateLimitExemptConfig struct {
+	IPs          []string `json:"ips" yaml:"ips" desc:"Client CIDRs or IPs, resolved through the server's trusted proxies"`
+	APIKeys      []string `json:"api_keys" yaml:"api_keys" desc:"API keys matched against the rate limit API key header"`
+	PathPrefixes []string `json:"path_prefixes" yaml:"path_prefixes" desc:"Request path prefixes, matched on whole path segments"`
+}
+
+// ConcurrencyConfig caps how many requests are forwarded upstream at once.
+// Cache hits are not counted.
+type ConcurrencyConfig struct {
+	Enabled     bool `json:"enabled" yaml:"enabled" desc:"Cap concurrent proxied requests"`
+	MaxInFlight int  `json:"max_in_flight" yaml:"max_in_flight" desc:"Requests handled at once"`
+	// QueueTimeout is how long a request over the cap waits for a slot
+	// before being rejected with a 503; 0 rejects it at once
+	QueueTimeout time.Duration `json:"queue_timeout" yaml:"queue_timeout" desc:"How long a request waits for a slot before a 503, 0 rejects at once"`
+}
+
+// DebugConfig holds settings for debugging the running proxy
+type DebugConfig struct {
+	// Pprof serves net/http/pprof under /debug/pprof/ on the metrics
+	// server, behind the admin token. Profiles expose internals, so it is
+	// off by default.
+	Pprof bool `json:"pprof" yaml:"pprof" desc:"Serve /debug/pprof/ on the metrics server behind the admin token"`
 }
 
 // LoggingConfig holds logging settings
 type LoggingConfig struct {
-	Level      string `json:"level" yaml:"level"`
-	Format     string `json:"format" yaml:"format"` // "json" or "console"
-	OutputPath string `json:"output_path" yaml:"output_path"`
+	Level      string `json:"level" yaml:"level" desc:"Log level: debug, info, warn or error"`
+	Format     string `json:"format" yaml:"format" desc:"Log format: json or console"` // "json" or "console"
+	OutputPath string `json:"output_path" yaml:"output_path" desc:"stdout or a file path"`
+	// SampleRate is the fraction of successful requests written to the
+	// access log. Errors and slow requests are always logged.
+	SampleRate float64 `json:"sample_rate" yaml:"sample_rate" desc:"Fraction of successful requests written to the access log"`
+	// SlowThreshold marks requests that take longer as slow; they are
+	// always logged and also get a warning. Zero disables it.
+	SlowThreshold time.Duration `json:"slow_threshold" yaml:"slow_threshold" desc:"Requests taking longer are always logged with a warning, 0 to disable"`
+	// Rotation of OutputPath when it is a file. Zero values disable each
+	// limit; stdout is never rotated.
+	MaxSizeMB   int  `json:"max_size_mb" yaml:"max_size_mb" desc:"Rotate the log file past this size, 0 to disable"`
+	MaxAgeDays  int  `json:"max_age_days" yaml:"max_age_days" desc:"Remove rotated files older than this, 0 to keep"`
+	MaxBackups  int  `json:"max_backups" yaml:"max_backups" desc:"Rotated files kept, 0 to keep all"`
+	Compress    bool `json:"compress" yaml:"compress" desc:"Gzip rotated files"`
+	RotateDaily bool `json:"rotate_daily" yaml:"rotate_daily" desc:"Also rotate on the first write of a new day"`
+	// Requests answered with one of ExcludeStatuses, e.g. 304, or under
+	// one of the ExcludePaths prefixes, e.g. a health check path, are left
+	// out of the access log. They are still counted in metrics.
+	ExcludeStatuses []int    `json:"exclude_statuses" yaml:"exclude_statuses" desc:"Response statuses left out of the access log"`
+	ExcludePaths    []string `json:"exclude_paths" yaml:"exclude_paths" desc:"Request path prefixes left out of the access log"`
 }
 
 // MetricsConfig holds metrics settings
 type MetricsConfig struct {
-	Enabled bool   `json:"enabled" yaml:"enabled"`
-	Path    string `json:"path" yaml:"path"`
-	Port    int    `json:"port" yaml:"port"`
+	Enabled  bool   `json:"enabled" yaml:"enabled" desc:"Serve Prometheus metrics"`
+	Path     string `json:"path" yaml:"path" desc:"Metrics path"`
+	Port     int    `json:"port" yaml:"port" desc:"Metrics server port"`
+	SamePort bool   `json:"same_port" yaml:"same_port" desc:"Serve metrics at path on the main server instead of a second listener"`
+}
+
+// TenantConfig holds multi-tenant resolution settings
+type TenantConfig struct {
+	Enabled         bool   `json:"enabled" yaml:"enabled" desc:"Resolve a tenant for each request"`
+	Source          string `json:"source" yaml:"source" desc:"Tenant source: header, subdomain or jwt"` // "header", "subdomain" or "jwt"
+	Header          string `json:"header" yaml:"header" desc:"Header carrying the tenant"`
+	Claim           string `json:"claim" yaml:"claim" desc:"JWT claim carrying the tenant"`
+	BaseDomain      string `json:"base_domain" yaml:"base_domain" desc:"Domain below which subdomains name tenants"`
+	Default         string `json:"default" yaml:"default" desc:"Tenant of requests without one"`
+	MaxMetricLabels int    `json:"max_metric_labels" yaml:"max_metric_labels" desc:"Distinct tenants labeled in metrics"`
+	// RateLimitTenants get rate limit budgets of their own. The tenant is
+	// taken from the request unverified, so other tenants share the
+	// budget of the IP address or API key to keep clients from minting
+	// fresh budgets by naming new tenants.
+	RateLimitTenants []string `json:"rate_limit_tenants" yaml:"rate_limit_tenants" desc:"Tenants given rate limit budgets of their own"`
+}
+
+// CORSConfig holds cross-origin resource sharing settings
+type CORSConfig struct {
+	Enabled          bool     `json:"enabled" yaml:"enabled" desc:"Handle CORS"`
+	AllowedOrigins   []string `json:"allowed_origins" yaml:"allowed_origins" desc:"Allowed origins; * matches a single subdomain label"`
+	AllowedMethods   []string `json:"allowed_methods" yaml:"allowed_methods" desc:"Allowed methods"`
+	AllowedHeaders   []string `json:"allowed_headers" yaml:"allowed_headers" desc:"Allowed request headers"`
+	ExposedHeaders   []string `json:"exposed_headers" yaml:"exposed_headers" desc:"Response headers exposed to scripts"`
+	AllowCredentials bool     `json:"allow_credentials" yaml:"allow_credentials" desc:"Allow credentials"`
+	MaxAge           int      `json:"max_age" yaml:"max_age" desc:"Preflight cache lifetime in seconds"` // seconds
+}
+
+// AdminConfig holds settings for the /admin endpoints
+type AdminConfig struct {
+	Enabled bool   `json:"enabled" yaml:"enabled" desc:"Serve the /admin endpoints"`
+	Token   string `json:"token" yaml:"token" desc:"Required bearer token"` // required bearer token
+}
+
+// MaintenanceConfig holds maintenance mode settings
+type MaintenanceConfig struct {
+	Enabled     bool     `json:"enabled" yaml:"enabled" desc:"Start in maintenance mode"` // initial state
+	StatusCode  int      `json:"status_code" yaml:"status_code" desc:"Status of maintenance responses"`
+	ContentType string   `json:"content_type" yaml:"content_type" desc:"Content type of maintenance responses"`
+	Body        string   `json:"body" yaml:"body" desc:"Body of maintenance responses"`
+	AllowPaths  []string `json:"allow_paths" yaml:"allow_paths" desc:"Path prefixes that bypass maintenance, matched on whole path segments"` // path prefixes that bypass maintenance
+}
+
+// ErrorPagesConfig holds settings for proxy-generated error responses
+type ErrorPagesConfig struct {
+	Format    string            `json:"format" yaml:"format" desc:"Error response format: json or html"` // json or html
+	Templates map[string]string `json:"templates" yaml:"templates" desc:"Template file for a status (502) or class (5xx)"`
+}
+
+// MirrorConfig holds settings for shadowing traffic to a secondary upstream.
+// Mirror responses are discarded and never affect the client.
+type MirrorConfig struct {
+	Enabled     bool          `json:"enabled" yaml:"enabled" desc:"Mirror requests"`
+	URL         string        `json:"url" yaml:"url" desc:"Mirror upstream URL"`
+	SampleRate  float64       `json:"sample_rate" yaml:"sample_rate" desc:"Fraction of requests mirrored, 0 to 1"` // fraction of requests mirrored, 0 to 1
+	Timeout     time.Duration `json:"timeout" yaml:"timeout" desc:"Mirror request timeout"`
+	MaxBodySize int64         `json:"max_body_size" yaml:"max_body_size" desc:"Larger requests are not mirrored"`   // larger requests are not mirrored
+	MaxInFlight int           `json:"max_in_flight" yaml:"max_in_flight" desc:"Excess mirror requests are dropped"` // excess mirror requests are dropped
 }
 
-// Load loads configuration from a file or environment variables
-func Load(filePath string) (*Config, error) {
+// FlagsConfig holds settings for per-request feature flags, e.g.
+// "X-Proxy-Flags: nocache,nolimit" to bypass the cache and rate limiter
+type FlagsConfig struct {
+	Enabled bool   `json:"enabled" yaml:"enabled" desc:"Honor feature flags"`
+	Header  string `json:"header" yaml:"header" desc:"Header carrying the flags"`
+	// AllowedSources lists the client CIDRs or IPs whose flags are honored.
+	// The client IP is resolved through the server's trusted proxies.
+	AllowedSources []string `json:"allowed_sources" yaml:"allowed_sources" desc:"Client CIDRs or IPs whose flags are honored"`
+}
+
+// Load loads configuration from files and environment variables. Files are
+// applied in order over the defaults, so a later file overrides only the
+// settings it sets: nested sections merge key by key, while a list or
+// scalar it sets replaces the earlier value. Empty paths are skipped.
+func Load(filePaths ...string) (*Config, error) {
 	cfg := defaultConfig()
 
-	if filePath != "" {
+	for _, filePath := range filePaths {
+		if filePath == "" {
+			continue
+		}
 		if err := loadFromFile(filePath, cfg); err != nil {
-			return nil, fmt.Errorf("failed to load config from file: %w", err)
+			return nil, fmt.Errorf("failed to load config from file %s: %w", filePath, err)
 		}
 	}
 
@@ -96,6 +542,8 @@ func Load(filePath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to load config from env: %w", err)
 	}
 
+	cfg.normalize()
+
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -111,44 +559,119 @@ func defaultConfig() *Config {
 			Address:         "0.0.0.0",
 			Port:            8080,
 			ReadTimeout:     10 * time.Second,
-			WriteTimeout:    10 * time.Second,
+			WriteTimeout:    60 * time.Second,
 			IdleTimeout:     120 * time.Second,
 			ShutdownTimeout: 30 * time.Second,
+			TLS:             ServerTLSConfig{MinVersion: "1.2"},
+			ProxyProtocol:   ProxyProtocolConfig{HeaderTimeout: 5 * time.Second},
+			Readiness:       ReadinessConfig{CheckUpstream: false, Timeout: 2 * time.Second},
+			AllowedMethods: []string{
+				http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+				http.MethodPatch, http.MethodDelete, http.MethodOptions,
+			},
 		},
 		Upstream: UpstreamConfig{
-			URL:                 "http://localhost:8081",
-			Timeout:             30 * time.Second,
-			MaxIdleConns:        100,
-			MaxConnsPerHost:     100,
-			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
-			ForbiddenHeaders:    []string{"Authorization", "Cookie", "Set-Cookie"},
+			URL:                   "http://localhost:8081",
+			Timeout:               30 * time.Second,
+			MaxIdleConns:          100,
+			MaxConnsPerHost:       100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			ForbiddenHeaders:      []string{"Authorization", "Cookie", "Set-Cookie"},
+			Strategy:              "round_robin",
+			HashCookie:            "session_id",
+			StartupCheckTimeout:   2 * time.Second,
+			TLS: UpstreamTLSConfig{
+				SessionCacheSize: 64,
+			},
+			Forwarding: ForwardingConfig{
+				XForwarded: true,
+			},
 		},
 		Cache: CacheConfig{
-			Enabled:             true,
-			MaxSize:             100 * 1024 * 1024, // 100 MB
-			DefaultTTL:          5 * time.Minute,
-			RespectCacheControl: true,
-			Type:                "memory",
+			Enabled:               true,
+			MaxSize:               100 * 1024 * 1024, // 100 MB
+			DefaultTTL:            5 * time.Minute,
+			RespectCacheControl:   true,
+			Type:                  "memory",
+			EvictionHighWatermark: 1,
+			EvictionLowWatermark:  0.9,
+			DiskThreshold:         1024 * 1024,
+			NegativeStatuses:      []int{404},
+			NegativeTTL:           30 * time.Second,
+			CacheableMethods:      []string{http.MethodGet, http.MethodHead},
+			ControlHeader:         "X-Proxy-Cache",
+			CompressMinSize:       1024,
 		},
 		RateLimit: RateLimitConfig{
 			Enabled:           true,
 			RequestsPerSecond: 100,
 			Burst:             200,
-			ByIP:              true,
+			ByIP:              false,
 			ByAPIKey:          false,
 			APIKeyHeader:      "X-API-Key",
+			Algorithm:         "token_bucket",
+			QuotaWindow:       24 * time.Hour,
+			QuotaStore:        "memory",
+			CleanupInterval:   time.Minute,
+			CleanupJitter:     10 * time.Second,
+			IdleTimeout:       5 * time.Minute,
+			Response: RateLimitResponseConfig{
+				ContentType: "application/json",
+				Body:        `{"error":"rate limit exceeded"}`,
+			},
 		},
 		Logging: LoggingConfig{
 			Level:      "info",
 			Format:     "json",
 			OutputPath: "stdout",
+			SampleRate: 1,
 		},
 		Metrics: MetricsConfig{
 			Enabled: true,
 			Path:    "/metrics",
 			Port:    9090,
 		},
+		Tenant: TenantConfig{
+			Enabled:         false,
+			Source:          "header",
+			Header:          "X-Tenant-ID",
+			MaxMetricLabels: 100,
+		},
+		Maintenance: MaintenanceConfig{
+			Enabled:     false,
+			StatusCode:  http.StatusServiceUnavailable,
+			ContentType: "application/json",
+			Body:        `{"error":"service under maintenance"}`,
+		},
+		ErrorPages: ErrorPagesConfig{
+			Format: "json",
+		},
+		Flags: FlagsConfig{
+			Enabled: false,
+			Header:  "X-Proxy-Flags",
+		},
+		Concurrency: ConcurrencyConfig{
+			Enabled:     false,
+			MaxInFlight: 100,
+		},
+		Mirror: MirrorConfig{
+			Enabled:     false,
+			SampleRate:  1,
+			Timeout:     5 * time.Second,
+			MaxBodySize: 1024 * 1024, // 1 MB
+			MaxInFlight: 100,
+		},
+		CORS: CORSConfig{
+			Enabled: false,
+			AllowedMethods: []string{
+				http.MethodGet, http.MethodHead, http.MethodPost,
+				http.MethodPut, http.MethodPatch, http.MethodDelete,
+			},
+			AllowedHeaders: []string{"Accept", "Content-Type", "Authorization"},
+			MaxAge:         600,
+		},
 	}
 }
 
@@ -158,13 +681,17 @@ func loadFromFile(filePath string, cfg *Config) error {
 	if err != nil {
 		return err
 	}
+	data, err = expandEnv(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
 
 	ext := filePath[len(filePath)-4:]
 	switch ext {
 	case "yaml", ".yml":
 		return yaml.Unmarshal(data, cfg)
 	case "json":
-		return json.Unmarshal(data, cfg)
+		return unmarshalJSON(data, cfg)
 	default:
 		// Try YAML first, then JSON
 		if err := yaml.Unmarshal(data, cfg); err != nil {
@@ -174,46 +701,863 @@ func loadFromFile(filePath string, cfg *Config) error {
 	}
 }
 
-// loadFromEnv overrides configuration with environment variables
-func loadFromEnv(cfg *Config) error {
-	if v := os.Getenv("PROXY_SERVER_ADDRESS"); v != "" {
-		cfg.Server.Address = v
+// unmarshalJSON decodes a JSON config file. Durations may be written as
+// integer nanoseconds, as encoding/json expects, or as strings such as
+// "10s", which are converted before decoding.
+func unmarshalJSON(data []byte, cfg *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw any
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	raw, err := parseDurations(raw, reflect.TypeOf(cfg).Elem())
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+// parseDurations replaces duration strings in v, decoded JSON destined for
+// a value of type t, with their value in nanoseconds
+func parseDurations(v any, t reflect.Type) (any, error) {
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q", s)
+		}
+		return json.Number(strconv.FormatInt(int64(d), 10)), nil
+	}
+
+	var err error
+	switch t.Kind() {
+	case reflect.Pointer:
+		return parseDurations(v, t.Elem())
+	case reflect.Struct:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return v, nil
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if value, ok := obj[name]; ok && field.IsExported() {
+				if obj[name], err = parseDurations(value, field.Type); err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := v.([]any)
+		if !ok {
+			return v, nil
+		}
+		for i, value := range list {
+			if list[i], err = parseDurations(value, t.Elem()); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return v, nil
+		}
+		for key, value := range obj {
+			if obj[key], err = parseDurations(value, t.Elem()); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
 	}
-	if v := os.Getenv("PROXY_SERVER_PORT"); v != "" {
-		var port int
-		if _, err := fmt.Sscanf(v, "%d", &port); err == nil {
-			cfg.Server.Port = port
+	return v, nil
+}
+
+// expandEnv replaces ${VAR} and ${VAR:-default} references in a config
+// file with the environment value. The default is used when VAR is unset or
+// empty; an unset VAR without a default is an error. $$ is a literal $.
+// Comments are copied as they are, so they can mention the syntax.
+func expandEnv(data []byte) ([]byte, error) {
+	var out []byte
+	var quote byte // quote character of the scalar being read, if any
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			quote = 0
+		case quote == '"' && c == '\\' && i+1 < len(data),
+			quote == '\'' && c == '\'' && i+1 < len(data) && data[i+1] == '\'':
+			// An escaped character, or '' for a quote in single quotes
+			out = append(out, c, data[i+1])
+			i++
+			continue
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsToken(data, i):
+			quote = c
+		case c == '#' && startsToken(data, i):
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			out = append(out, data[i:i+end]...)
+			i += end - 1
+			continue
+		}
+
+		if c != '$' || i+1 == len(data) {
+			out = append(out, c)
+			continue
+		}
+		switch data[i+1] {
+		case '$':
+			out = append(out, '$')
+			i++
+		case '{':
+			end := bytes.IndexByte(data[i+2:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ${ in config")
+			}
+			ref := string(data[i+2 : i+2+end])
+			name, def, hasDefault := strings.Cut(ref, ":-")
+			if name == "" {
+				return nil, fmt.Errorf("empty variable name in ${%s}", ref)
+			}
+			value, ok := os.LookupEnv(name)
+			switch {
+			case hasDefault && value == "":
+				value = def
+			case !ok:
+				return nil, fmt.Errorf("environment variable %s is not set", name)
+			}
+			out = append(out, value...)
+			i += 2 + end
+		default:
+			out = append(out, '$')
 		}
 	}
-	if v := os.Getenv("PROXY_UPSTREAM_URL"); v != "" {
-		cfg.Upstream.URL = v
+	return out, nil
+}
+
+// startsToken reports whether data[i] begins a YAML token, where a quote
+// opens a quoted scalar and # a comment: at the start of a line or after
+// whitespace or a flow indicator
+func startsToken(data []byte, i int) bool {
+	if i == 0 {
+		return true
 	}
-	if v := os.Getenv("PROXY_CACHE_ENABLED"); v != "" {
-		cfg.Cache.Enabled = v == "true" || v == "1"
+	switch data[i-1] {
+	case ' ', '\t', '\n', '[', '{', ',':
+		return true
 	}
-	if v := os.Getenv("PROXY_RATELIMIT_ENABLED"); v != "" {
-		cfg.RateLimit.Enabled = v == "true" || v == "1"
+	return false
+}
+
+// envPrefix starts every configuration environment variable
+const envPrefix = "PROXY"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// loadFromEnv overrides configuration with environment variables named
+// after the yaml keys, e.g. PROXY_SERVER_READ_TIMEOUT for server.read_timeout
+// or PROXY_UPSTREAM_TLS_SESSION_CACHE_SIZE for upstream.tls.session_cache_size.
+// Lists are comma separated and durations use time.ParseDuration syntax.
+// Lists of structs and maps (backends, routes, templates) can only be set
+// in the config file.
+func loadFromEnv(cfg *Config) error {
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return err
 	}
+	// Kept from before the names were derived from the yaml keys
 	if v := os.Getenv("PROXY_LOG_LEVEL"); v != "" {
 		cfg.Logging.Level = v
 	}
 	return nil
 }
 
+// envVars returns the names of all supported environment variables
+func envVars() []string {
+	var names []string
+	walkEnv(reflect.TypeOf(Config{}), envPrefix, func(name string, _ []int) {
+		names = append(names, name)
+	})
+	return names
+}
+
+// walkEnv calls fn with the variable name and field index path of every
+// field that can be set from the environment
+func walkEnv(t reflect.Type, prefix string, fn func(name string, index []int)) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			walkEnv(field.Type, name, func(name string, index []int) {
+				fn(name, append([]int{i}, index...))
+			})
+		case envSettable(field.Type):
+			fn(name, []int{i})
+		}
+	}
+}
+
+// envSettable reports whether a field type can be parsed from a string
+func envSettable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// applyEnv sets every field whose environment variable is present
+func applyEnv(v reflect.Value, prefix string) error {
+	var err error
+	walkEnv(v.Type(), prefix, func(name string, index []int) {
+		raw := os.Getenv(name)
+		if err != nil || raw == "" {
+			return
+		}
+		if setErr := setFromString(v.FieldByIndex(index), raw); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// setFromString parses raw into the field according to its type
+func setFromString(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// validateSplit checks the route's traffic split
+func (r RouteConfig) validateSplit() error {
+	if len(r.Split) == 0 {
+		return nil
+	}
+	if len(r.Split) < 2 {
+		return fmt.Errorf("split requires at least two variants")
+	}
+
+	names := make(map[string]bool, len(r.Split))
+	total := 0
+	for _, v := range r.Split {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("split variants need unique names, got %q", v.Name)
+		}
+		names[v.Name] = true
+		u, err := url.Parse(v.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("split variant %q: invalid URL %q", v.Name, v.URL)
+		}
+		if v.Weight < 0 {
+			return fmt.Errorf("split variant %q: weight must not be negative", v.Name)
+		}
+		total += v.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("split weights must not all be zero")
+	}
+
+	switch {
+	case r.SplitBy == "", r.SplitBy == "ip":
+	case strings.HasPrefix(r.SplitBy, "header:") && len(r.SplitBy) > len("header:"):
+	case strings.HasPrefix(r.SplitBy, "cookie:") && len(r.SplitBy) > len("cookie:"):
+	default:
+		return fmt.Errorf("invalid split_by %q", r.SplitBy)
+	}
+	return nil
+}
+
+// normalize trims whitespace from the trusted proxy, exempt IP and flag
+// source entries, as ratelimit.ParseTrustedProxies does, so Validate checks
+// exactly what the proxy later parses
+func (c *Config) normalize() {
+	c.Server.TrustedProxies = trimEntries(c.Server.TrustedProxies)
+	c.RateLimit.Exempt.IPs = trimEntries(c.RateLimit.Exempt.IPs)
+	c.Flags.AllowedSources = trimEntries(c.Flags.AllowedSources)
+}
+
+// trimEntries trims whitespace from each entry in place
+func trimEntries(entries []string) []string {
+	for i, entry := range entries {
+		entries[i] = strings.TrimSpace(entry)
+	}
+	return entries
+}
+
+// ResolvedBackends returns the configured backends with unset transport
+// settings filled in from the upstream defaults. When no backends are
+// listed, the single upstream URL is returned as the only backend.
+func (u UpstreamConfig) ResolvedBackends() []BackendConfig {
+	backends := u.Backends
+	if len(backends) == 0 {
+		backends = []BackendConfig{{URL: u.URL}}
+	}
+
+	resolved := make([]BackendConfig, 0, len(backends))
+	for _, b := range backends {
+		b.Transport = b.Transport.Inherit(u.DefaultTransport())
+		resolved = append(resolved, b)
+	}
+	return resolved
+}
+
+// ForbiddenHeaderRegexps compiles ForbiddenHeaderPatterns, anchored to
+// match whole header names without regard to case
+func (u UpstreamConfig) ForbiddenHeaderRegexps() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(u.ForbiddenHeaderPatterns))
+	for _, pattern := range u.ForbiddenHeaderPatterns {
+		re, err := regexp.Compile("(?i)^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream forbidden header pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// DefaultTransport returns the upstream-wide connection settings that
+// backends and split variants inherit
+func (u UpstreamConfig) DefaultTransport() TransportConfig {
+	return TransportConfig{
+		Timeout:             u.Timeout,
+		MaxIdleConns:        u.MaxIdleConns,
+		MaxConnsPerHost:     u.MaxConnsPerHost,
+		IdleConnTimeout:     u.IdleConnTimeout,
+		TLSHandshakeTimeout: u.TLSHandshakeTimeout,
+		TLS:                 u.TLS,
+	}
+}
+
+// Inherit returns t with its unset settings taken from parent. The client
+// certificate and key are only inherited as a pair.
+func (t TransportConfig) Inherit(parent TransportConfig) TransportConfig {
+	if t.Timeout == 0 {
+		t.Timeout = parent.Timeout
+	}
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = parent.MaxIdleConns
+	}
+	if t.MaxConnsPerHost == 0 {
+		t.MaxConnsPerHost = parent.MaxConnsPerHost
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = parent.IdleConnTimeout
+	}
+	if t.TLSHandshakeTimeout == 0 {
+		t.TLSHandshakeTimeout = parent.TLSHandshakeTimeout
+	}
+	if t.TLS.ServerName == "" {
+		t.TLS.ServerName = parent.TLS.ServerName
+	}
+	if !t.TLS.InsecureSkipVerify {
+		t.TLS.InsecureSkipVerify = parent.TLS.InsecureSkipVerify
+	}
+	if t.TLS.SessionCacheSize == 0 {
+		t.TLS.SessionCacheSize = parent.TLS.SessionCacheSize
+	}
+	if t.TLS.CertFile == "" && t.TLS.KeyFile == "" {
+		t.TLS.CertFile = parent.TLS.CertFile
+		t.TLS.KeyFile = parent.TLS.KeyFile
+	}
+	if t.TLS.CAFile == "" {
+		t.TLS.CAFile = parent.TLS.CAFile
+	}
+	return t
+}
+
+// validate checks connection settings; zero values mean unset
+func (t TransportConfig) validate() error {
+	if t.Timeout < 0 || t.IdleConnTimeout < 0 || t.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if t.MaxIdleConns < 0 || t.MaxConnsPerHost < 0 {
+		return fmt.Errorf("connection pool sizes must not be negative")
+	}
+	return nil
+}
+
+// Warnings returns settings that are valid but likely mistakes, for the
+// caller to log at startup
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.Server.ReadTimeout == 0 {
+		warnings = append(warnings, "server read timeout is 0, so slow clients can hold connections open indefinitely")
+	}
+	if c.Server.WriteTimeout > 0 {
+		for _, b := range c.Upstream.ResolvedBackends() {
+			if b.Transport.Timeout == 0 || b.Transport.Timeout >= c.Server.WriteTimeout {
+				warnings = append(warnings, fmt.Sprintf(
+					"server write timeout %v does not exceed the timeout of upstream %s, so slow responses may be cut off",
+					c.Server.WriteTimeout, b.URL))
+			}
+		}
+	}
+	return warnings
+}
+
+// validateUpstreamURL checks that an upstream URL is absolute, uses http
+// or https and names a host, so typos such as "htttp://" fail at startup
+// rather than on the first request
+func validateUpstreamURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q: host is required", raw)
+	}
+	return nil
+}
+
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
 	if c.Server.Port < 1 || c.Server.Port > 65535 {
 		return fmt.Errorf("invalid server port: %d", c.Server.Port)
 	}
-	if c.Upstream.URL == "" {
+	if c.Logging.SampleRate < 0 || c.Logging.SampleRate > 1 {
+		return fmt.Errorf("logging sample rate must be between 0 and 1")
+	}
+	if c.Logging.SlowThreshold < 0 {
+		return fmt.Errorf("logging slow threshold must not be negative")
+	}
+	if c.Logging.MaxSizeMB < 0 || c.Logging.MaxAgeDays < 0 || c.Logging.MaxBackups < 0 {
+		return fmt.Errorf("logging rotation limits must not be negative")
+	}
+	// Backups are only pruned and compressed when the file is rotated
+	if (c.Logging.MaxAgeDays > 0 || c.Logging.MaxBackups > 0 || c.Logging.Compress) &&
+		c.Logging.MaxSizeMB == 0 && !c.Logging.RotateDaily {
+		return fmt.Errorf("logging max_age_days, max_backups and compress require max_size_mb or rotate_daily")
+	}
+	for _, status := range c.Logging.ExcludeStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid logging exclude status: %d", status)
+		}
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 ||
+		c.Server.ShutdownTimeout < 0 || c.Server.DrainDelay < 0 {
+		return fmt.Errorf("server timeouts must not be negative")
+	}
+	if c.Server.Readiness.Timeout <= 0 {
+		return fmt.Errorf("readiness timeout must be positive")
+	}
+	if c.Upstream.URL == "" && len(c.Upstream.Backends) == 0 {
 		return fmt.Errorf("upstream URL is required")
 	}
+	if c.Upstream.URL != "" {
+		if err := validateUpstreamURL(c.Upstream.URL); err != nil {
+			return fmt.Errorf("upstream URL: %w", err)
+		}
+	}
+	if c.Upstream.StartupCheckTimeout < 0 {
+		return fmt.Errorf("upstream startup check timeout must not be negative")
+	}
+	if c.Upstream.StartupCheck && c.Upstream.StartupCheckTimeout == 0 {
+		return fmt.Errorf("upstream startup check timeout must be positive when the startup check is enabled")
+	}
+	if c.Upstream.RequestTimeout < 0 {
+		return fmt.Errorf("upstream request timeout must not be negative")
+	}
+	if c.Upstream.ExpectContinueTimeout < 0 {
+		return fmt.Errorf("upstream expect continue timeout must not be negative")
+	}
+	if err := c.Upstream.DefaultTransport().validate(); err != nil {
+		return fmt.Errorf("upstream: %w", err)
+	}
+	if (c.Upstream.TLS.CertFile == "") != (c.Upstream.TLS.KeyFile == "") {
+		return fmt.Errorf("upstream TLS client certificate requires both a cert file and a key file")
+	}
+	for i, b := range c.Upstream.Backends {
+		if b.URL == "" {
+			return fmt.Errorf("upstream backend %d: URL is required", i)
+		}
+		if err := validateUpstreamURL(b.URL); err != nil {
+			return fmt.Errorf("upstream backend %d: %w", i, err)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("upstream backend %d: weight must not be negative", i)
+		}
+		if err := b.Transport.validate(); err != nil {
+			return fmt.Errorf("upstream backend %d: %w", i, err)
+		}
+		if (b.Transport.TLS.CertFile == "") != (b.Transport.TLS.KeyFile == "") {
+			return fmt.Errorf("upstream backend %d: TLS client certificate requires both a cert file and a key file", i)
+		}
+	}
+	if _, err := c.Upstream.ForbiddenHeaderRegexps(); err != nil {
+		return err
+	}
+	switch c.Upstream.Strategy {
+	case "round_robin", "weighted", "least_conn", "ip_hash":
+	case "cookie_hash":
+		if c.Upstream.HashCookie == "" {
+			return fmt.Errorf("upstream hash cookie is required for cookie_hash")
+		}
+	default:
+		return fmt.Errorf("invalid upstream strategy: %q", c.Upstream.Strategy)
+	}
+	if c.Server.TLS.Enabled() && (c.Server.TLS.CertFile == "" || c.Server.TLS.KeyFile == "") {
+		return fmt.Errorf("server TLS requires both a cert file and a key file")
+	}
+	if c.Server.HTTP3 && !c.Server.TLS.Enabled() {
+		return fmt.Errorf("http3 requires server TLS")
+	}
+	if err := c.Server.TLS.validate(c.Server.Port); err != nil {
+		return err
+	}
+	if c.Server.ProxyProtocol.HeaderTimeout < 0 {
+		return fmt.Errorf("proxy protocol header timeout must not be negative")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("invalid trusted proxy: %q", proxy)
+		}
+	}
+	if c.Server.MaxRequestBodySize < 0 || c.Upstream.MaxResponseBodySize < 0 {
+		return fmt.Errorf("body size limits must not be negative")
+	}
 	if c.Cache.Enabled && c.Cache.MaxSize <= 0 {
 		return fmt.Errorf("cache max size must be positive")
 	}
-	if c.RateLimit.Enabled && c.RateLimit.RequestsPerSecond <= 0 {
+	if c.Cache.Enabled {
+		switch c.Cache.Type {
+		case "memory":
+		case "redis", "tiered":
+			if c.Cache.Redis.Address == "" {
+				return fmt.Errorf("cache type %s requires a redis address", c.Cache.Type)
+			}
+			// Body files are local to this instance, so other instances
+			// sharing the store could not serve them
+			if c.Cache.DiskDir != "" {
+				return fmt.Errorf("cache disk_dir cannot be used with cache type %s", c.Cache.Type)
+			}
+		default:
+			return fmt.Errorf("invalid cache type %q: must be memory, redis or tiered", c.Cache.Type)
+		}
+	}
+	if c.Cache.Enabled {
+		high, low := c.Cache.EvictionHighWatermark, c.Cache.EvictionLowWatermark
+		if high <= 0 || high > 1 || low <= 0 || low > high {
+			return fmt.Errorf("cache eviction watermarks must satisfy 0 < low <= high <= 1")
+		}
+	}
+	if c.Cache.DiskThreshold < 0 {
+		return fmt.Errorf("cache disk threshold must not be negative")
+	}
+	if c.Cache.TTLJitter < 0 {
+		return fmt.Errorf("cache TTL jitter must not be negative")
+	}
+	for _, status := range c.Cache.NegativeStatuses {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("cache negative status %d must be a 4xx or 5xx code", status)
+		}
+	}
+	if c.Cache.CompressMinSize < 0 {
+		return fmt.Errorf("cache compress min size must not be negative")
+	}
+	if c.Cache.CoalesceTimeout < 0 {
+		return fmt.Errorf("cache coalesce timeout must not be negative")
+	}
+	if len(c.Cache.NegativeStatuses) > 0 && c.Cache.NegativeTTL <= 0 {
+		return fmt.Errorf("cache negative TTL must be positive")
+	}
+	for _, method := range c.Cache.CacheableMethods {
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost:
+		default:
+			return fmt.Errorf("invalid cacheable method %q: must be GET, HEAD or POST", method)
+		}
+	}
+	for _, status := range c.Cache.CacheableStatusCodes {
+		if status < 200 || status > 399 || status == http.StatusPartialContent {
+			return fmt.Errorf("cacheable status %d must be a 2xx or 3xx code other than 206", status)
+		}
+	}
+	for _, ct := range c.Cache.CacheableContentTypes {
+		mediaType, params, err := mime.ParseMediaType(ct)
+		if err != nil || len(params) > 0 || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid cacheable content type: %q", ct)
+		}
+	}
+	for _, raw := range c.Cache.WarmupURLs {
+		if u, err := url.ParseRequestURI(raw); err != nil || u.IsAbs() {
+			return fmt.Errorf("invalid cache warmup URL %q: must be a path", raw)
+		}
+	}
+	queryOptions := 0
+	for _, set := range []bool{len(c.Cache.IgnoreQueryParams) > 0, len(c.Cache.OnlyQueryParams) > 0, c.Cache.IgnoreQuery} {
+		if set {
+			queryOptions++
+		}
+	}
+	if queryOptions > 1 {
+		return fmt.Errorf("cache ignore_query_params, only_query_params and ignore_query are mutually exclusive")
+	}
+	if c.RateLimit.Enabled && c.RateLimit.Quota == 0 && c.RateLimit.RequestsPerSecond <= 0 {
 		return fmt.Errorf("rate limit requests per second must be positive")
 	}
+	switch c.RateLimit.Algorithm {
+	case "token_bucket", "gcra":
+	default:
+		return fmt.Errorf("invalid rate limit algorithm: %q", c.RateLimit.Algorithm)
+	}
+	if c.RateLimit.RetryAfterJitter < 0 {
+		return fmt.Errorf("rate limit retry-after jitter must not be negative")
+	}
+	if c.RateLimit.MaxWait < 0 {
+		return fmt.Errorf("rate limit max wait must not be negative")
+	}
+	// Sweeping more often than this costs lock time for nothing
+	if c.RateLimit.CleanupInterval < time.Second {
+		return fmt.Errorf("rate limit cleanup interval must be at least 1s")
+	}
+	if c.RateLimit.CleanupJitter < 0 {
+		return fmt.Errorf("rate limit cleanup jitter must not be negative")
+	}
+	if c.RateLimit.IdleTimeout < c.RateLimit.CleanupInterval {
+		return fmt.Errorf("rate limit idle timeout must be at least the cleanup interval")
+	}
+	if c.RateLimit.MaxBuckets < 0 {
+		return fmt.Errorf("rate limit max buckets must not be negative")
+	}
+	if _, err := template.New("ratelimit").Parse(c.RateLimit.Response.Body); err != nil {
+		return fmt.Errorf("invalid rate limit response body: %w", err)
+	}
+	for _, ip := range c.RateLimit.Exempt.IPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid rate limit exempt IP: %q", ip)
+		}
+	}
+	for name, tier := range c.RateLimit.Tiers {
+		if tier.RequestsPerSecond <= 0 || tier.Burst <= 0 {
+			return fmt.Errorf("rate limit tier %q requires positive requests per second and burst", name)
+		}
+	}
+	for key, tier := range c.RateLimit.APIKeyTiers {
+		if _, ok := c.RateLimit.Tiers[tier]; !ok {
+			return fmt.Errorf("rate limit API key %q refers to unknown tier %q", key, tier)
+		}
+	}
+	if len(c.RateLimit.Tiers) > 0 && (!c.RateLimit.ByAPIKey || c.RateLimit.Quota > 0) {
+		return fmt.Errorf("rate limit tiers require by_api_key and cannot be combined with a quota")
+	}
+	if c.RateLimit.Quota < 0 {
+		return fmt.Errorf("rate limit quota must not be negative")
+	}
+	if c.RateLimit.Quota > 0 && c.RateLimit.QuotaWindow <= 0 {
+		return fmt.Errorf("rate limit quota window must be positive")
+	}
+	switch c.RateLimit.QuotaStore {
+	case "memory":
+	case "redis":
+		if c.RateLimit.Quota > 0 && c.RateLimit.Redis.Address == "" {
+			return fmt.Errorf("rate limit quota store redis requires a redis address")
+		}
+	default:
+		return fmt.Errorf("invalid rate limit quota store %q: must be memory or redis", c.RateLimit.QuotaStore)
+	}
+	if c.Metrics.Enabled && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf("metrics path must start with /: %q", c.Metrics.Path)
+	}
+	if path := c.Metrics.Path; c.Metrics.Enabled && c.Metrics.SamePort &&
+		(path == "/" || path == "/health" || path == "/ready" || strings.HasPrefix(path, "/admin/")) {
+		return fmt.Errorf("metrics path %q conflicts with a built-in endpoint on the main port", path)
+	}
+	if c.Debug.Pprof && (!c.Metrics.Enabled || c.Admin.Token == "") {
+		return fmt.Errorf("pprof requires metrics to be enabled and an admin token")
+	}
+	if c.Concurrency.Enabled && c.Concurrency.MaxInFlight <= 0 {
+		return fmt.Errorf("concurrency max in-flight must be positive")
+	}
+	if c.Concurrency.QueueTimeout < 0 {
+		return fmt.Errorf("concurrency queue timeout must not be negative")
+	}
+	if c.CORS.Enabled && len(c.CORS.AllowedOrigins) == 0 {
+		return fmt.Errorf("cors requires at least one allowed origin")
+	}
+	for i, r := range c.Routes {
+		if !strings.HasPrefix(r.PathPrefix, "/") {
+			return fmt.Errorf("route %d: path prefix must start with /", i)
+		}
+		if err := r.validateSplit(); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if err := r.Transport.validate(); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if (r.Transport.TLS.CertFile == "") != (r.Transport.TLS.KeyFile == "") {
+			return fmt.Errorf("route %d: TLS client certificate requires both a cert file and a key file", i)
+		}
+	}
+	if c.Admin.Enabled && c.Admin.Token == "" {
+		return fmt.Errorf("admin token is required when admin endpoints are enabled")
+	}
+	if c.Maintenance.StatusCode < 100 || c.Maintenance.StatusCode > 599 {
+		return fmt.Errorf("invalid maintenance status code: %d", c.Maintenance.StatusCode)
+	}
+	switch c.ErrorPages.Format {
+	case "json", "html":
+	default:
+		return fmt.Errorf("invalid error page format: %q", c.ErrorPages.Format)
+	}
+	if c.Mirror.Enabled {
+		if c.Mirror.URL == "" {
+			return fmt.Errorf("mirror URL is required when mirroring is enabled")
+		}
+		if c.Mirror.SampleRate < 0 || c.Mirror.SampleRate > 1 {
+			return fmt.Errorf("mirror sample rate must be between 0 and 1")
+		}
+		if c.Mirror.MaxInFlight <= 0 {
+			return fmt.Errorf("mirror max in-flight must be positive")
+		}
+	}
+	if c.Flags.Enabled {
+		if c.Flags.Header == "" || len(c.Flags.AllowedSources) == 0 {
+			return fmt.Errorf("flags require a header and at least one allowed source")
+		}
+		for _, source := range c.Flags.AllowedSources {
+			if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+				return fmt.Errorf("invalid flags allowed source: %q", source)
+			}
+		}
+	}
+	if c.Tenant.Enabled {
+		switch c.Tenant.Source {
+		case "header", "subdomain", "jwt":
+		default:
+			return fmt.Errorf("invalid tenant source: %q", c.Tenant.Source)
+		}
+	}
 	return nil
 }
 
+// redactedValue replaces secrets in a redacted configuration
+const redactedValue = "[REDACTED]"
+
+// Redacted returns a copy of the configuration that is safe to show to
+// operators: the Redis password and admin token are replaced, passwords
+// in upstream URLs are masked, and API keys are replaced with a prefix of
+// their hash so they can still be told apart.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Cache.Redis.Password != "" {
+		r.Cache.Redis.Password = redactedValue
+	}
+	if r.RateLimit.Redis.Password != "" {
+		r.RateLimit.Redis.Password = redactedValue
+	}
+	if r.Admin.Token != "" {
+		r.Admin.Token = redactedValue
+	}
+	r.Upstream.URL = redactURL(c.Upstream.URL)
+	if len(c.Upstream.Backends) > 0 {
+		r.Upstream.Backends = make([]BackendConfig, len(c.Upstream.Backends))
+		for i, b := range c.Upstream.Backends {
+			b.URL = redactURL(b.URL)
+			r.Upstream.Backends[i] = b
+		}
+	}
+	if len(c.Routes) > 0 {
+		r.Routes = make([]RouteConfig, len(c.Routes))
+		for i, route := range c.Routes {
+			if len(route.Split) > 0 {
+				split := make([]VariantConfig, len(route.Split))
+				for j, v := range route.Split {
+					v.URL = redactURL(v.URL)
+					split[j] = v
+				}
+				route.Split = split
+			}
+			r.Routes[i] = route
+		}
+	}
+	r.Mirror.URL = redactURL(c.Mirror.URL)
+	if len(c.RateLimit.Exempt.APIKeys) > 0 {
+		r.RateLimit.Exempt.APIKeys = make([]string, len(c.RateLimit.Exempt.APIKeys))
+		for i, key := range c.RateLimit.Exempt.APIKeys {
+			r.RateLimit.Exempt.APIKeys[i] = maskAPIKey(key)
+		}
+	}
+	if len(c.RateLimit.APIKeyTiers) > 0 {
+		r.RateLimit.APIKeyTiers = make(map[string]string, len(c.RateLimit.APIKeyTiers))
+		for key, tier := range c.RateLimit.APIKeyTiers {
+			r.RateLimit.APIKeyTiers[maskAPIKey(key)] = tier
+		}
+	}
+	return &r
+}
+
+// maskAPIKey replaces a key with a prefix of its SHA-256, which tells keys
+// apart without revealing any of their characters
+func maskAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// redactURL masks the password in a URL's userinfo. Other URLs, including
+// ones that don't parse, are returned unchanged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
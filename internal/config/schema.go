@@ -0,0 +1,246 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaField describes one configuration key. Fields lists the keys of
+// sections, and of the items of lists and maps of sections.
+type SchemaField struct {
+	Key         string        `json:"key" yaml:"key"`
+	Type        string        `json:"type" yaml:"type"`
+	Description string        `json:"description,omitempty" yaml:"description,omitempty"`
+	Default     any           `json:"default,omitempty" yaml:"default,omitempty"`
+	Fields      []SchemaField `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// Schema describes every configuration key in file order, with its
+// default and the description from its desc tag
+func Schema() []SchemaField {
+	return schemaFields(reflect.ValueOf(defaultConfig()).Elem())
+}
+
+// WriteTemplate describes every key with its default and description. As
+// "yaml" it writes a configuration file setting every key to its default,
+// with the description in a comment above it, which loads as it is. As
+// "json" it writes a JSON Schema document of the configuration.
+func WriteTemplate(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(templateJSONSchema(Schema()), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case "yaml":
+		node, err := templateYAML(Schema())
+		if err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(node); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("invalid template format: %q", format)
+	}
+}
+
+// templateYAML returns a mapping of fields to their defaults, each key
+// commented with its description
+func templateYAML(fields []SchemaField) (*yaml.Node, error) {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	for _, f := range fields {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: f.Key, HeadComment: templateComment(f)}
+		var value *yaml.Node
+		switch {
+		case f.Type == "object":
+			v, err := templateYAML(f.Fields)
+			if err != nil {
+				return nil, err
+			}
+			value = v
+		case f.Default == nil && strings.HasPrefix(f.Type, "list of"):
+			value = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		case f.Default == nil && strings.HasPrefix(f.Type, "map of"):
+			value = &yaml.Node{Kind: yaml.MappingNode, Style: yaml.FlowStyle}
+		default:
+			value = &yaml.Node{}
+			if err := value.Encode(f.Default); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Key, err)
+			}
+		}
+		mapping.Content = append(mapping.Content, key, value)
+	}
+	return mapping, nil
+}
+
+// templateComment is the description of a field, listing the keys of the
+// entries of lists and maps of sections, which start out empty
+func templateComment(f SchemaField) string {
+	if f.Type == "object" || len(f.Fields) == 0 {
+		return f.Description
+	}
+	keys := make([]string, len(f.Fields))
+	for i, item := range f.Fields {
+		keys[i] = item.Key
+	}
+	return f.Description + "\nEach entry has the keys " + strings.Join(keys, ", ")
+}
+
+// jsonSchema is a JSON Schema document, or one of its subschemas
+type jsonSchema struct {
+	Schema               string            `json:"$schema,omitempty"`
+	Description          string            `json:"description,omitempty"`
+	Type                 any               `json:"type,omitempty"`
+	Default              any               `json:"default,omitempty"`
+	Properties           *schemaProperties `json:"properties,omitempty"`
+	Items                *jsonSchema       `json:"items,omitempty"`
+	AdditionalProperties *jsonSchema       `json:"additionalProperties,omitempty"`
+}
+
+// schemaProperties are the properties of an object schema, marshaled in
+// file order
+type schemaProperties struct {
+	keys    []string
+	schemas []*jsonSchema
+}
+
+// MarshalJSON writes the properties as an object in file order
+func (p *schemaProperties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range p.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(p.schemas[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// templateJSONSchema returns a JSON Schema document describing fields
+func templateJSONSchema(fields []SchemaField) *jsonSchema {
+	doc := jsonSchemaOf("object", fields)
+	doc.Schema = "https://json-schema.org/draft/2020-12/schema"
+	return doc
+}
+
+// jsonSchemaOf returns the schema of a value of a Schema type, with fields
+// describing sections and the items of lists and maps of sections
+func jsonSchemaOf(typ string, fields []SchemaField) *jsonSchema {
+	switch {
+	case strings.HasPrefix(typ, "list of "):
+		return &jsonSchema{Type: "array", Items: jsonSchemaOf(strings.TrimPrefix(typ, "list of "), fields)}
+	case strings.HasPrefix(typ, "map of "):
+		return &jsonSchema{Type: "object", AdditionalProperties: jsonSchemaOf(strings.TrimPrefix(typ, "map of "), fields)}
+	case typ == "object":
+		props := &schemaProperties{}
+		for _, f := range fields {
+			s := jsonSchemaOf(f.Type, f.Fields)
+			s.Description = f.Description
+			s.Default = f.Default
+			props.keys = append(props.keys, f.Key)
+			props.schemas = append(props.schemas, s)
+		}
+		return &jsonSchema{Type: "object", Properties: props}
+	case typ == "duration":
+		// A string such as "10s", or integer nanoseconds
+		return &jsonSchema{Type: []string{"string", "integer"}}
+	}
+	return &jsonSchema{Type: typ}
+}
+
+// schemaFields walks the yaml-tagged fields of a struct value
+func schemaFields(v reflect.Value) []SchemaField {
+	t := v.Type()
+	var fields []SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+
+		f := SchemaField{
+			Key:         key,
+			Type:        schemaType(field.Type),
+			Description: field.Tag.Get("desc"),
+		}
+		switch elem := schemaElem(field.Type); {
+		case field.Type.Kind() == reflect.Struct:
+			f.Fields = schemaFields(v.Field(i))
+		case elem.Kind() == reflect.Struct:
+			f.Fields = schemaFields(reflect.New(elem).Elem())
+			f.Default = schemaDefault(v.Field(i))
+		default:
+			f.Default = schemaDefault(v.Field(i))
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// schemaElem returns the item type of lists and maps, and t otherwise
+func schemaElem(t reflect.Type) reflect.Type {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Map:
+		return t.Elem()
+	}
+	return t
+}
+
+// schemaType names a field type the way it is written in config files
+func schemaType(t reflect.Type) string {
+	if t == durationType {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return "object"
+	case reflect.Slice:
+		return "list of " + schemaType(t.Elem())
+	case reflect.Map:
+		return "map of " + schemaType(t.Elem())
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	}
+	return t.Kind().String()
+}
+
+// schemaDefault returns a field's default as it is written in config
+// files, or nil for empty lists and maps
+func schemaDefault(v reflect.Value) any {
+	if v.Type() == durationType {
+		return v.Interface().(fmt.Stringer).String()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return nil
+		}
+	}
+	return v.Interface()
+}
@@ -0,0 +1,191 @@
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Config holds CORS policy settings
+type Config struct {
+	AllowedOrigins   []string // exact origins, "*" or wildcards like "https://*.example.com"
+	AllowedMethods   []string
+	AllowedHeaders   []string // "*" reflects any requested header
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int // seconds, 0 omits the header
+}
+
+// Policy applies a CORS configuration to requests and responses
+type Policy struct {
+	cfg            Config
+	allowAll       bool
+	allowAnyHeader bool
+	methods        map[string]bool
+	headers        map[string]bool
+}
+
+// New creates a CORS policy
+func New(cfg Config) *Policy {
+	p := &Policy{
+		cfg:     cfg,
+		methods: make(map[string]bool, len(cfg.AllowedMethods)),
+		headers: make(map[string]bool, len(cfg.AllowedHeaders)),
+	}
+
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			p.allowAll = true
+		}
+	}
+	for _, method := range cfg.AllowedMethods {
+		p.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range cfg.AllowedHeaders {
+		if header == "*" {
+			p.allowAnyHeader = true
+		}
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	return p
+}
+
+// IsPreflight reports whether the request is a CORS preflight request
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// OriginAllowed reports whether the origin matches the allowed origins
+func (p *Policy) OriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.allowAll {
+		return true
+	}
+	for _, allowed := range p.cfg.AllowedOrigins {
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandlePreflight answers a preflight request. It returns 204 with the
+// allow headers when the origin, method and headers are permitted and
+// 403 otherwise.
+func (p *Policy) HandlePreflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requested := parseHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+
+	if !p.OriginAllowed(origin) || !p.methods[method] || !p.headersAllowed(requested) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	p.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.cfg.AllowedMethods, ", "))
+	if len(requested) > 0 {
+		if p.allowAnyHeader {
+			h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		} else {
+			h.Set("Access-Control-Allow-Headers", strings.Join(p.cfg.AllowedHeaders, ", "))
+		}
+	}
+	if p.cfg.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(p.cfg.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Apply sets the CORS headers for an actual (non-preflight) response.
+// Any CORS headers already present, e.g. from the upstream or a cached
+// copy, are replaced so they always reflect the current request's origin.
+func (p *Policy) Apply(h http.Header, origin string) {
+	h.Del("Access-Control-Allow-Origin")
+	h.Del("Access-Control-Allow-Credentials")
+	h.Del("Access-Control-Expose-Headers")
+
+	if !p.allowAll || p.cfg.AllowCredentials {
+		addVary(h, "Origin")
+	}
+	if !p.OriginAllowed(origin) {
+		return
+	}
+
+	p.setOrigin(h, origin)
+	if len(p.cfg.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.cfg.ExposedHeaders, ", "))
+	}
+}
+
+// setOrigin writes the allow-origin and credentials headers
+func (p *Policy) setOrigin(h http.Header, origin string) {
+	if p.allowAll && !p.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	// Credentialed requests must echo the concrete origin
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// headersAllowed reports whether every requested header is permitted
+func (p *Policy) headersAllowed(requested []string) bool {
+	if p.allowAnyHeader {
+		return true
+	}
+	for _, header := range requested {
+		if !p.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOrigin matches an origin against a pattern with at most one "*"
+func matchOrigin(pattern, origin string) bool {
+	if !strings.Contains(pattern, "*") {
+		return strings.EqualFold(pattern, origin)
+	}
+	parts := strings.SplitN(strings.ToLower(pattern), "*", 2)
+	origin = strings.ToLower(origin)
+	return len(origin) > len(parts[0])+len(parts[1]) &&
+		strings.HasPrefix(origin, parts[0]) &&
+		strings.HasSuffix(origin, parts[1])
+}
+
+func parseHeaderList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var headers []string
+	for _, h := range strings.Split(value, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, existing := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
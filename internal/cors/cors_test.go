@@ -0,0 +1,151 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newPolicy(credentials bool, origins ...string) *Policy {
+	return New(Config{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "X-Request-ID"},
+		ExposedHeaders:   []string{"X-Cache"},
+		AllowCredentials: credentials,
+		MaxAge:           600,
+	})
+}
+
+func TestOriginAllowed(t *testing.T) {
+	p := newPolicy(false, "https://app.example.com", "https://*.example.org")
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"http://a.example.org", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.OriginAllowed(tt.origin); got != tt.want {
+			t.Errorf("OriginAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	if !newPolicy(false, "*").OriginAllowed("https://anything.test") {
+		t.Error("expected wildcard to allow any origin")
+	}
+}
+
+func TestHandlePreflight(t *testing.T) {
+	p := newPolicy(false, "https://app.example.com")
+
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		want    int
+	}{
+		{name: "allowed", origin: "https://app.example.com", method: "POST", headers: "content-type", want: http.StatusNoContent},
+		{name: "denied origin", origin: "https://evil.com", method: "POST", want: http.StatusForbidden},
+		{name: "denied method", origin: "https://app.example.com", method: "DELETE", want: http.StatusForbidden},
+		{name: "denied header", origin: "https://app.example.com", method: "GET", headers: "X-Secret", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", "/", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			if !IsPreflight(req) {
+				t.Fatal("expected request to be a preflight")
+			}
+
+			rec := httptest.NewRecorder()
+			p.HandlePreflight(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+			acao := rec.Header().Get("Access-Control-Allow-Origin")
+			if tt.want == http.StatusNoContent {
+				if acao != tt.origin {
+					t.Errorf("expected allow origin %q, got %q", tt.origin, acao)
+				}
+				if rec.Header().Get("Access-Control-Allow-Methods") != "GET, POST" {
+					t.Errorf("unexpected allow methods %q", rec.Header().Get("Access-Control-Allow-Methods"))
+				}
+				if rec.Header().Get("Access-Control-Max-Age") != "600" {
+					t.Errorf("unexpected max age %q", rec.Header().Get("Access-Control-Max-Age"))
+				}
+			} else if acao != "" {
+				t.Errorf("expected no allow origin for denied preflight, got %q", acao)
+			}
+		})
+	}
+}
+
+func TestIsPreflight(t *testing.T) {
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	if IsPreflight(req) {
+		t.Error("plain OPTIONS is not a preflight")
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://a.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	if IsPreflight(req) {
+		t.Error("GET is not a preflight")
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Run("wildcard without credentials", func(t *testing.T) {
+		h := http.Header{}
+		newPolicy(false, "*").Apply(h, "https://any.test")
+		if h.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("expected *, got %q", h.Get("Access-Control-Allow-Origin"))
+		}
+		if h.Get("Access-Control-Expose-Headers") != "X-Cache" {
+			t.Errorf("unexpected expose headers %q", h.Get("Access-Control-Expose-Headers"))
+		}
+	})
+
+	t.Run("credentialed request echoes origin", func(t *testing.T) {
+		h := http.Header{}
+		newPolicy(true, "*").Apply(h, "https://any.test")
+		if h.Get("Access-Control-Allow-Origin") != "https://any.test" {
+			t.Errorf("expected echoed origin, got %q", h.Get("Access-Control-Allow-Origin"))
+		}
+		if h.Get("Access-Control-Allow-Credentials") != "true" {
+			t.Error("expected allow credentials")
+		}
+		if h.Get("Vary") != "Origin" {
+			t.Errorf("expected Vary: Origin, got %q", h.Get("Vary"))
+		}
+	})
+
+	t.Run("denied origin strips stale headers", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("Access-Control-Allow-Origin", "https://app.example.com")
+		h.Set("Vary", "Accept-Encoding, Origin")
+		newPolicy(false, "https://app.example.com").Apply(h, "https://evil.com")
+		if h.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("expected no allow origin, got %q", h.Get("Access-Control-Allow-Origin"))
+		}
+		if len(h.Values("Vary")) != 1 {
+			t.Errorf("expected Vary not to be duplicated, got %v", h.Values("Vary"))
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package errorpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Formats supported for error pages
+const (
+	FormatJSON = "json"
+	FormatHTML = "html"
+)
+
+// Config holds error page settings
+type Config struct {
+	Format string // "json" (default) or "html"
+	// Templates maps a status code ("502") or class ("5xx") to a template
+	// file. Exact codes take precedence over classes.
+	Templates map[string]string
+}
+
+// Data is passed to error page templates
+type Data struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+}
+
+const defaultJSON = `{"error":{{json .Message}},"status":{{.Status}},"request_id":{{json .RequestID}}}`
+
+const defaultHTML = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p>Request ID: {{.RequestID}}</p>
+</body>
+</html>
+`
+
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+// Renderer writes templated error responses
+type Renderer struct {
+	contentType string
+	fallback    executor
+	templates   map[string]executor
+}
+
+// New creates a renderer, loading any configured template files
+func New(cfg Config) (*Renderer, error) {
+	r := &Renderer{templates: make(map[string]executor, len(cfg.Templates))}
+
+	var parse func(name, text string) (executor, error)
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatJSON:
+		r.contentType = "application/json"
+		parse = func(name, text string) (executor, error) {
+			return texttemplate.New(name).Funcs(texttemplate.FuncMap{"json": jsonString}).Parse(text)
+		}
+		r.fallback, _ = parse("default", defaultJSON)
+	case FormatHTML:
+		r.contentType = "text/html; charset=utf-8"
+		parse = func(name, text string) (executor, error) {
+			return htmltemplate.New(name).Parse(text)
+		}
+		r.fallback, _ = parse("default", defaultHTML)
+	default:
+		return nil, fmt.Errorf("unknown error page format: %q", cfg.Format)
+	}
+
+	for key, path := range cfg.Templates {
+		key = strings.ToLower(key)
+		if !validKey(key) {
+			return nil, fmt.Errorf("invalid error page key %q: want a status code or class like 5xx", key)
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error page %s: %w", key, err)
+		}
+		tmpl, err := parse(key, string(text))
+		if err != nil {
+			return nil, fmt.Errorf("error page %s: %w", key, err)
+		}
+		r.templates[key] = tmpl
+	}
+
+	return r, nil
+}
+
+// Render writes an error response for the status using the most specific
+// template available
+func (r *Renderer) Render(w http.ResponseWriter, status int, message, requestID string) {
+	data := Data{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  requestID,
+	}
+
+	// Render into a buffer so a failing template doesn't leave a partial body
+	var buf bytes.Buffer
+	if err := r.lookup(status).Execute(&buf, data); err != nil {
+		buf.Reset()
+		r.fallback.Execute(&buf, data)
+	}
+
+	w.Header().Set("Content-Type", r.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// lookup returns the template for a status code, then its class, then the default
+func (r *Renderer) lookup(status int) executor {
+	code := strconv.Itoa(status)
+	if tmpl, ok := r.templates[code]; ok {
+		return tmpl
+	}
+	if tmpl, ok := r.templates[code[:1]+"xx"]; ok {
+		return tmpl
+	}
+	return r.fallback
+}
+
+// validKey reports whether key is a status code ("502") or class ("5xx")
+func validKey(key string) bool {
+	if len(key) != 3 || key[0] < '1' || key[0] > '5' {
+		return false
+	}
+	if key[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(key)
+	return err == nil
+}
+
+// jsonString encodes a value as a JSON string literal
+func jsonString(v string) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
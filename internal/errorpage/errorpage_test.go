@@ -0,0 +1,98 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTemplate(t *testing.T, name, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRenderDefaultJSON(t *testing.T) {
+	r, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	r.Render(rec, http.StatusBadGateway, `upstream "down"`, "req-1")
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	var body struct {
+		Error     string `json:"error"`
+		Status    int    `json:"status"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	if body.Error != `upstream "down"` || body.Status != 502 || body.RequestID != "req-1" {
+		t.Errorf("unexpected body %+v", body)
+	}
+}
+
+func TestRenderTemplateLookup(t *testing.T) {
+	r, err := New(Config{
+		Format: FormatHTML,
+		Templates: map[string]string{
+			"5xx": writeTemplate(t, "5xx.html", "<p>class {{.Status}} {{.RequestID}}</p>"),
+			"503": writeTemplate(t, "503.html", "<p>maintenance {{.Message}}</p>"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusBadGateway, "<p>class 502 req-1</p>"},
+		{http.StatusServiceUnavailable, "<p>maintenance &lt;b&gt;</p>"},
+		{http.StatusRequestEntityTooLarge, "<h1>413 Request Entity Too Large</h1>"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r.Render(rec, tt.status, "<b>", "req-1")
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("status %d: expected body to contain %q, got %q", tt.status, tt.want, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("status %d: unexpected content type %q", tt.status, ct)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(Config{Format: "xml"}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if _, err := New(Config{Templates: map[string]string{"bad": "x"}}); err == nil {
+		t.Error("expected error for invalid key")
+	}
+	if _, err := New(Config{Templates: map[string]string{"5xx": "/nonexistent/5xx.json"}}); err == nil {
+		t.Error("expected error for missing template file")
+	}
+	path := writeTemplate(t, "broken.json", "{{.Status")
+	if _, err := New(Config{Templates: map[string]string{"502": path}}); err == nil {
+		t.Error("expected error for unparsable template")
+	}
+}
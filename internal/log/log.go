@@ -30,6 +30,9 @@ type ContextKey string
 // RequestIDKey is the context key for request IDs
 const RequestIDKey ContextKey = "request_id"
 
+// TraceIDKey is the context key for the W3C trace ID of the request
+const TraceIDKey ContextKey = "trace_id"
+
 // String creates a string field
 func String(key, val string) Field {
 	return zap.String(key, val)
@@ -45,6 +48,11 @@ func Int64(key string, val int64) Field {
 	return zap.Int64(key, val)
 }
 
+// Float64 creates a float64 field
+func Float64(key string, val float64) Field {
+	return zap.Float64(key, val)
+}
+
 // Duration creates a duration field
 func Duration(key string, val time.Duration) Field {
 	return zap.Duration(key, val)
@@ -76,6 +84,8 @@ type Config struct {
 	Level      string
 	Format     string // "json" or "console"
 	OutputPath string
+	// Rotate applies when OutputPath is a file
+	Rotate RotateConfig
 }
 
 // NewLogger creates a new logger instance
@@ -110,7 +120,13 @@ func NewLogger(cfg Config) (Logger, error) {
 
 	var writer io.Writer = os.Stdout
 	if cfg.OutputPath != "" && cfg.OutputPath != "stdout" {
-		file, err := os.OpenFile(cfg.OutputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		var file io.Writer
+		var err error
+		if cfg.Rotate.enabled() {
+			file, err = newRotatingFile(cfg.OutputPath, cfg.Rotate)
+		} else {
+			file, err = os.OpenFile(cfg.OutputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -184,10 +200,32 @@ func (l *zapLogger) addContextFields(fields []Field) []Field {
 	return fields
 }
 
+type loggerContextKey struct{}
+
+// NewContext returns a copy of ctx that carries a request-scoped logger
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// FromContext returns the request-scoped logger stored in ctx. Without
+// one, fallback is returned bound to ctx.
+func FromContext(ctx context.Context, fallback Logger) Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(Logger); ok {
+		return logger
+	}
+	return fallback.WithContext(ctx)
+}
+
+// NewWithCore creates a logger that writes to the given zap core
+func NewWithCore(core zapcore.Core) Logger {
+	return &zapLogger{
+		logger: zap.New(core),
+	}
+}
+
 // NewNopLogger creates a no-op logger for testing
 func NewNopLogger() Logger {
 	return &zapLogger{
 		logger: zap.NewNop(),
 	}
 }
-
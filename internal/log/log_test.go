@@ -3,6 +3,9 @@ package log
 import (
 	"context"
 	"testing"
+
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestNewLogger(t *testing.T) {
@@ -80,3 +83,43 @@ func BenchmarkLogger(b *testing.B) {
 	}
 }
 
+func TestNewWithCore(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := NewWithCore(core)
+
+	ctx := context.WithValue(context.Background(), RequestIDKey, "req-1")
+	logger.WithContext(ctx).Info("hello", String("key", "value"))
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["key"] != "value" || fields["request_id"] != "req-1" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := NewWithCore(core)
+
+	ctx := context.WithValue(context.Background(), RequestIDKey, "req-2")
+	ctx = NewContext(ctx, logger.WithContext(ctx).With(String("path", "/data")))
+	FromContext(ctx, NewNopLogger()).Info("scoped")
+
+	// Without a stored logger the fallback is used, still bound to ctx
+	bare := context.WithValue(context.Background(), RequestIDKey, "req-3")
+	FromContext(bare, logger).Info("fallback")
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if fields := entries[0].ContextMap(); fields["request_id"] != "req-2" || fields["path"] != "/data" {
+		t.Errorf("unexpected scoped fields: %v", fields)
+	}
+	if fields := entries[1].ContextMap(); fields["request_id"] != "req-3" {
+		t.Errorf("unexpected fallback fields: %v", fields)
+	}
+}
@@ -0,0 +1,277 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp in backup file names. It sorts
+// chronologically and avoids characters that are awkward in file names.
+const backupTimeFormat = "20060102T150405.000"
+
+// RotateConfig controls rotation of a log file. Zero values disable the
+// corresponding limit.
+type RotateConfig struct {
+	MaxSizeMB  int  // rotate before the file grows past this size
+	MaxAgeDays int  // remove backups older than this
+	MaxBackups int  // keep at most this many backups
+	Compress   bool // gzip backups
+	Daily      bool // also rotate on the first write of each day
+}
+
+// enabled reports whether the file should be rotated at all
+func (c RotateConfig) enabled() bool {
+	return c.MaxSizeMB > 0 || c.Daily
+}
+
+// rotatingFile is an append-only log file that is renamed to a timestamped
+// backup once it reaches its size limit or the day changes. Old backups are
+// compressed and pruned in the background.
+type rotatingFile struct {
+	path    string
+	cfg     RotateConfig
+	maxSize int64
+	now     func() time.Time
+	rename  func(oldpath, newpath string) error
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// Serializes compression and pruning of backups
+	millMu sync.Mutex
+	millWG sync.WaitGroup
+}
+
+// newRotatingFile opens path for appending, creating it if needed
+func newRotatingFile(path string, cfg RotateConfig) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:    path,
+		cfg:     cfg,
+		maxSize: int64(cfg.MaxSizeMB) * 1024 * 1024,
+		now:     time.Now,
+		rename:  os.Rename,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the current log file and records its size
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = r.now()
+	return nil
+}
+
+// Write appends p, rotating first when it would cross a limit. If the
+// rotation fails, p is still written to the current file and the rotation
+// error returned; the next write tries again.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rotateErr error
+	if r.shouldRotate(int64(len(p))) {
+		rotateErr = r.rotate()
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("log rotation failed: %w", rotateErr)
+	}
+	return n, err
+}
+
+// shouldRotate reports whether writing n more bytes needs a new file. An
+// empty file is never rotated, so single writes over the limit still land.
+func (r *rotatingFile) shouldRotate(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+n > r.maxSize {
+		return true
+	}
+	if r.cfg.Daily {
+		y1, m1, d1 := r.opened.Date()
+		y2, m2, d2 := r.now().Date()
+		return y1 != y2 || m1 != m2 || d1 != d2
+	}
+	return false
+}
+
+// rotate renames the current file to a backup and opens a fresh one. The
+// current file is only closed once its replacement is open, so a failure
+// leaves it in use.
+func (r *rotatingFile) rotate() error {
+	if err := r.rename(r.path, r.backupName(r.now())); err != nil {
+		return err
+	}
+	old := r.file
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+
+	r.millWG.Add(1)
+	go func() {
+		defer r.millWG.Done()
+		r.mill()
+	}()
+	return nil
+}
+
+// backupName returns an unused backup path for a rotation at t
+func (r *rotatingFile) backupName(t time.Time) string {
+	dir, prefix, ext := r.parts()
+	name := filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+	for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+		name = filepath.Join(dir, fmt.Sprintf("%s%s-%d%s", prefix, t.Format(backupTimeFormat), i, ext))
+	}
+	return name
+}
+
+// parts splits the log path into the directory, the backup name prefix and
+// the extension, e.g. "/var/log", "proxy-" and ".log"
+func (r *rotatingFile) parts() (dir, prefix, ext string) {
+	dir = filepath.Dir(r.path)
+	base := filepath.Base(r.path)
+	ext = filepath.Ext(base)
+	return dir, strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// backup is a rotated log file
+type backup struct {
+	path string
+	time time.Time
+}
+
+// backups lists rotated files, newest first
+func (r *rotatingFile) backups() ([]backup, error) {
+	dir, prefix, ext := r.parts()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, prefix)
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		stamp = strings.TrimSuffix(stamp, ext)
+		if len(stamp) < len(backupTimeFormat) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, stamp[:len(backupTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		found = append(found, backup{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].time.Equal(found[j].time) {
+			return found[i].path > found[j].path
+		}
+		return found[i].time.After(found[j].time)
+	})
+	return found, nil
+}
+
+// mill removes backups past the count and age limits and compresses the
+// rest. Errors are ignored: the next rotation tries again.
+func (r *rotatingFile) mill() {
+	r.millMu.Lock()
+	defer r.millMu.Unlock()
+
+	backups, err := r.backups()
+	if err != nil {
+		return
+	}
+
+	cutoff := r.now().Add(-time.Duration(r.cfg.MaxAgeDays) * 24 * time.Hour)
+	for i, b := range backups {
+		if (r.cfg.MaxBackups > 0 && i >= r.cfg.MaxBackups) || (r.cfg.MaxAgeDays > 0 && b.time.Before(cutoff)) {
+			os.Remove(b.path)
+			continue
+		}
+		if r.cfg.Compress && !strings.HasSuffix(b.path, ".gz") {
+			compressFile(b.path)
+		}
+	}
+}
+
+// compressFile gzips path to path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Sync flushes the current file to disk
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Sync()
+}
+
+// Close closes the current file after pending compression finishes
+func (r *rotatingFile) Close() error {
+	r.millWG.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
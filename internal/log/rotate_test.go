@@ -0,0 +1,169 @@
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerRotatesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	logger, err := NewLogger(Config{
+		Level:      "info",
+		Format:     "json",
+		OutputPath: path,
+		Rotate:     RotateConfig{MaxSizeMB: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ~1.5 MiB of log lines
+	payload := strings.Repeat("x", 1024)
+	for i := 0; i < 1500; i++ {
+		logger.Info("filler", String("payload", payload))
+	}
+
+	rf := &rotatingFile{path: path}
+	backups, err := rf.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %d", len(backups))
+	}
+	info, err := os.Stat(backups[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1024*1024 {
+		t.Errorf("expected backup within the size limit, got %d bytes", info.Size())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected a fresh log file after rotation: %v", err)
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := newRotatingFile(path, RotateConfig{MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.maxSize = 10
+	f.rename = func(string, string) error { return os.ErrPermission }
+
+	f.Write([]byte("first line\n"))
+	if n, err := f.Write([]byte("second line\n")); n != 12 || err == nil {
+		t.Errorf("expected the line written and the rotation error returned, got %d, %v", n, err)
+	}
+
+	// Rotation succeeds once the rename does
+	f.rename = os.Rename
+	if _, err := f.Write([]byte("third line\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	backups, err := f.backups()
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %v (%v)", backups, err)
+	}
+	if data, _ := os.ReadFile(backups[0].path); string(data) != "first line\nsecond line\n" {
+		t.Errorf("expected the lines written during the failure in the backup, got %q", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "third line\n" {
+		t.Errorf("expected a fresh log file, got %q", data)
+	}
+}
+
+func TestRotatingFileCompressesAndPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := newRotatingFile(path, RotateConfig{MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.maxSize = 100
+
+	line := []byte(strings.Repeat("y", 60) + "\n")
+	for i := 0; i < 6; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The last rotation's mill may have run before the backup before it
+	// was compressed; one more pass settles the directory
+	f.mill()
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups to be kept, got %d", len(backups))
+	}
+	for _, b := range backups {
+		if !strings.HasSuffix(b.path, ".gz") {
+			t.Errorf("expected compressed backup, got %s", b.path)
+			continue
+		}
+		file, err := os.Open(b.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(gz)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(line) {
+			t.Errorf("unexpected backup contents %q", data)
+		}
+	}
+}
+
+func TestRotatingFileDaily(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := newRotatingFile(path, RotateConfig{Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Date(2024, 3, 1, 23, 59, 0, 0, time.Local)
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	f.Write([]byte("before midnight\n"))
+	f.Write([]byte("still the same day\n"))
+	if backups, _ := f.backups(); len(backups) != 0 {
+		t.Fatalf("expected no rotation within a day, got %d backups", len(backups))
+	}
+
+	now = now.Add(2 * time.Minute)
+	f.Write([]byte("after midnight\n"))
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup after midnight, got %d", len(backups))
+	}
+	data, err := os.ReadFile(backups[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "before midnight\nstill the same day\n" {
+		t.Errorf("unexpected backup contents %q", data)
+	}
+}
@@ -6,30 +6,78 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Recorder receives the proxy's metrics. Metrics is the Prometheus
+// implementation; programs embedding the proxy can supply their own.
+type Recorder interface {
+	RecordRequest(method, path string, status int, duration time.Duration, requestSize, responseSize int64, traceID string)
+	IncRequestsInFlight(method string)
+	DecRequestsInFlight(method string)
+	RecordTenantRequest(tenant string, status int)
+	RecordVariantRequest(route, variant string, status int)
+	RecordMirrorResponse(status int, duration time.Duration)
+	RecordMirrorFailure(reason string)
+	RecordUpstreamResponse(protocol string)
+	RecordUpstreamError(kind string)
+	RecordCacheHit(method, path string)
+	RecordCacheMiss(method, path string)
+	RecordCacheEviction()
+	RecordCacheExpiration()
+	SetCacheUtilization(ratio float64)
+	RecordRateLimitDrop()
+	RecordHijackFailure()
+	RecordClientWriteError()
+	RecordConcurrencyLimit(outcome string)
+	IncInFlightRequests()
+	DecInFlightRequests()
+	IncActiveConnections()
+	DecActiveConnections()
+}
+
+var _ Recorder = (*Metrics)(nil)
+
 // Metrics holds all Prometheus metrics
 type Metrics struct {
-	registry           *prometheus.Registry
-	requestsTotal      *prometheus.CounterVec
-	requestDuration    *prometheus.HistogramVec
-	requestSize        *prometheus.HistogramVec
-	responseSize       *prometheus.HistogramVec
-	cacheHits          *prometheus.CounterVec
-	cacheMisses        *prometheus.CounterVec
-	rateLimitDropped   prometheus.Counter
-	activeConnections  prometheus.Gauge
+	registry          *prometheus.Registry
+	requestsTotal     *prometheus.CounterVec
+	requestsByClass   *prometheus.CounterVec
+	requestsInFlight  *prometheus.GaugeVec
+	requestDuration   *prometheus.HistogramVec
+	requestSize       *prometheus.HistogramVec
+	responseSize      *prometheus.HistogramVec
+	cacheHits         *prometheus.CounterVec
+	cacheMisses       *prometheus.CounterVec
+	cacheEvictions    prometheus.Counter
+	cacheExpirations  prometheus.Counter
+	cacheUtilization  prometheus.Gauge
+	tenantRequests    *prometheus.CounterVec
+	variantRequests   *prometheus.CounterVec
+	mirrorResponses   *prometheus.CounterVec
+	mirrorDuration    prometheus.Histogram
+	mirrorFailures    *prometheus.CounterVec
+	upstreamResponses *prometheus.CounterVec
+	upstreamErrors    *prometheus.CounterVec
+	rateLimitDropped  prometheus.Counter
+	hijackFailures    prometheus.Counter
+	clientWriteErrors prometheus.Counter
+	concurrencyLimit  *prometheus.CounterVec
+	inFlightRequests  prometheus.Gauge
+	activeConnections prometheus.Gauge
 }
 
 var (
 	defaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
 )
 
-// NewMetrics creates a new Metrics instance
-func NewMetrics() *Metrics {
+// NewMetrics creates a new Metrics instance. Besides the proxy's own
+// metrics, the registry exports Go runtime and process metrics and a
+// build_info gauge labeled with the given version and build time.
+func NewMetrics(version, buildTime string) *Metrics {
 	reg := prometheus.NewRegistry()
-	
+
 	m := &Metrics{
 		registry: reg,
 		requestsTotal: prometheus.NewCounterVec(
@@ -39,6 +87,20 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"method", "path", "status"},
 		),
+		requestsByClass: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_by_class_total",
+				Help: "Total number of HTTP requests by status class (2xx, 4xx, ...)",
+			},
+			[]string{"method", "status_class"},
+		),
+		requestsInFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_requests_in_flight",
+				Help: "Number of HTTP requests currently being served",
+			},
+			[]string{"method"},
+		),
 		requestDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "http_request_duration_seconds",
@@ -77,12 +139,104 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"method", "path"},
 		),
+		cacheEvictions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "cache_evictions_total",
+				Help: "Total number of cache entries evicted to make room",
+			},
+		),
+		cacheExpirations: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "cache_expirations_total",
+				Help: "Total number of expired cache entries removed",
+			},
+		),
+		cacheUtilization: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "cache_utilization_ratio",
+				Help: "Cache size as a fraction of its max size",
+			},
+		),
+		tenantRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_by_tenant_total",
+				Help: "Total number of HTTP requests per tenant",
+			},
+			[]string{"tenant", "status"},
+		),
+		variantRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_by_variant_total",
+				Help: "Total number of HTTP requests per traffic split variant",
+			},
+			[]string{"route", "variant", "status"},
+		),
+		mirrorResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mirror_responses_total",
+				Help: "Total number of responses from the shadow upstream",
+			},
+			[]string{"status"},
+		),
+		mirrorDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "mirror_request_duration_seconds",
+				Help:    "Shadow upstream request latency in seconds",
+				Buckets: defaultBuckets,
+			},
+		),
+		mirrorFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mirror_failures_total",
+				Help: "Total number of mirror requests that failed or were dropped",
+			},
+			[]string{"reason"},
+		),
+		upstreamResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "upstream_responses_total",
+				Help: "Total number of upstream responses by negotiated protocol",
+			},
+			[]string{"protocol"},
+		),
+		upstreamErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "upstream_errors_total",
+				Help: "Total number of failed upstream requests by error type",
+			},
+			[]string{"type"},
+		),
 		rateLimitDropped: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Name: "rate_limit_dropped_total",
 				Help: "Total number of requests dropped by rate limiter",
 			},
 		),
+		hijackFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "hijack_failures_total",
+				Help: "Total number of connection takeovers, e.g. WebSocket upgrades, that failed",
+			},
+		),
+		clientWriteErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "client_write_errors_total",
+				Help: "Total number of responses cut short because writing to the client failed, e.g. after it disconnected",
+			},
+		),
+		concurrencyLimit: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "concurrency_limited_total",
+				Help: "Total number of requests queued or rejected by the concurrency limiter",
+			},
+			[]string{"outcome"},
+		),
+		inFlightRequests: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "in_flight_requests",
+				Help: "Number of requests holding a concurrency limiter slot",
+			},
+		),
 		activeConnections: prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Name: "active_connections",
@@ -94,25 +248,126 @@ func NewMetrics() *Metrics {
 	// Register metrics with custom registry (for tests)
 	reg.MustRegister(
 		m.requestsTotal,
+		m.requestsByClass,
+		m.requestsInFlight,
 		m.requestDuration,
 		m.requestSize,
 		m.responseSize,
 		m.cacheHits,
 		m.cacheMisses,
+		m.cacheEvictions,
+		m.cacheExpirations,
+		m.cacheUtilization,
+		m.tenantRequests,
+		m.variantRequests,
+		m.mirrorResponses,
+		m.mirrorDuration,
+		m.mirrorFailures,
+		m.upstreamResponses,
+		m.upstreamErrors,
 		m.rateLimitDropped,
+		m.hijackFailures,
+		m.clientWriteErrors,
+		m.concurrencyLimit,
+		m.inFlightRequests,
 		m.activeConnections,
 	)
 
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "Build information; the value is always 1",
+		},
+		[]string{"version", "build_time"},
+	)
+	buildInfo.WithLabelValues(version, buildTime).Set(1)
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		buildInfo,
+	)
+
 	return m
 }
 
-// RecordRequest records request metrics
-func (m *Metrics) RecordRequest(method, path string, status int, duration time.Duration, requestSize, responseSize int64) {
+// RecordRequest records request metrics. A non-empty traceID is attached
+// to the duration observation as an exemplar, which is exported when the
+// scraper negotiates OpenMetrics.
+func (m *Metrics) RecordRequest(method, path string, status int, duration time.Duration, requestSize, responseSize int64, traceID string) {
 	statusStr := strconv.Itoa(status)
 	m.requestsTotal.WithLabelValues(method, path, statusStr).Inc()
-	m.requestDuration.WithLabelValues(method, path, statusStr).Observe(duration.Seconds())
+	observer := m.requestDuration.WithLabelValues(method, path, statusStr)
+	if traceID != "" {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceID})
+	} else {
+		observer.Observe(duration.Seconds())
+	}
 	m.requestSize.WithLabelValues(method, path).Observe(float64(requestSize))
 	m.responseSize.WithLabelValues(method, path).Observe(float64(responseSize))
+	m.requestsByClass.WithLabelValues(methodLabel(method), statusClass(status)).Inc()
+}
+
+// IncRequestsInFlight increments requests being served for a method
+func (m *Metrics) IncRequestsInFlight(method string) {
+	m.requestsInFlight.WithLabelValues(methodLabel(method)).Inc()
+}
+
+// DecRequestsInFlight decrements requests being served for a method
+func (m *Metrics) DecRequestsInFlight(method string) {
+	m.requestsInFlight.WithLabelValues(methodLabel(method)).Dec()
+}
+
+// methodLabel maps nonstandard methods to "OTHER" so clients cannot create
+// unbounded label values
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClass returns the class of an HTTP status, e.g. "2xx"
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// RecordTenantRequest records a request for a tenant. The tenant label
+// must come from a bounded set to keep cardinality under control.
+func (m *Metrics) RecordTenantRequest(tenant string, status int) {
+	m.tenantRequests.WithLabelValues(tenant, strconv.Itoa(status)).Inc()
+}
+
+// RecordVariantRequest records a request served by a traffic split variant
+func (m *Metrics) RecordVariantRequest(route, variant string, status int) {
+	m.variantRequests.WithLabelValues(route, variant, strconv.Itoa(status)).Inc()
+}
+
+// RecordMirrorResponse records a response from the shadow upstream
+func (m *Metrics) RecordMirrorResponse(status int, duration time.Duration) {
+	m.mirrorResponses.WithLabelValues(strconv.Itoa(status)).Inc()
+	m.mirrorDuration.Observe(duration.Seconds())
+}
+
+// RecordMirrorFailure records a mirror request that failed or was dropped
+func (m *Metrics) RecordMirrorFailure(reason string) {
+	m.mirrorFailures.WithLabelValues(reason).Inc()
+}
+
+// RecordUpstreamResponse records the protocol an upstream response was
+// received over, e.g. "HTTP/1.1" or "HTTP/2.0"
+func (m *Metrics) RecordUpstreamResponse(protocol string) {
+	m.upstreamResponses.WithLabelValues(protocol).Inc()
+}
+
+// RecordUpstreamError records a failed upstream request by error type,
+// e.g. "dns" or "response_header_timeout"
+func (m *Metrics) RecordUpstreamError(kind string) {
+	m.upstreamErrors.WithLabelValues(kind).Inc()
 }
 
 // RecordCacheHit records a cache hit
@@ -125,11 +380,54 @@ func (m *Metrics) RecordCacheMiss(method, path string) {
 	m.cacheMisses.WithLabelValues(method, path).Inc()
 }
 
+// RecordCacheEviction records an entry evicted to make room
+func (m *Metrics) RecordCacheEviction() {
+	m.cacheEvictions.Inc()
+}
+
+// RecordCacheExpiration records an expired entry being removed
+func (m *Metrics) RecordCacheExpiration() {
+	m.cacheExpirations.Inc()
+}
+
+// SetCacheUtilization sets the cache size as a fraction of its max size
+func (m *Metrics) SetCacheUtilization(ratio float64) {
+	m.cacheUtilization.Set(ratio)
+}
+
 // RecordRateLimitDrop records a rate limit drop
 func (m *Metrics) RecordRateLimitDrop() {
 	m.rateLimitDropped.Inc()
 }
 
+// RecordHijackFailure records a response whose connection could not be
+// taken over, e.g. for a protocol upgrade
+func (m *Metrics) RecordHijackFailure() {
+	m.hijackFailures.Inc()
+}
+
+// RecordClientWriteError records a response that could not be written
+// to the client in full
+func (m *Metrics) RecordClientWriteError() {
+	m.clientWriteErrors.Inc()
+}
+
+// RecordConcurrencyLimit records a request that had to wait for a
+// concurrency slot ("queued") or was turned away ("rejected")
+func (m *Metrics) RecordConcurrencyLimit(outcome string) {
+	m.concurrencyLimit.WithLabelValues(outcome).Inc()
+}
+
+// IncInFlightRequests increments requests holding a concurrency slot
+func (m *Metrics) IncInFlightRequests() {
+	m.inFlightRequests.Inc()
+}
+
+// DecInFlightRequests decrements requests holding a concurrency slot
+func (m *Metrics) DecInFlightRequests() {
+	m.inFlightRequests.Dec()
+}
+
 // IncActiveConnections increments active connections
 func (m *Metrics) IncActiveConnections() {
 	m.activeConnections.Inc()
@@ -142,6 +440,5 @@ func (m *Metrics) DecActiveConnections() {
 
 // Handler returns the Prometheus HTTP handler
 func (m *Metrics) Handler() http.Handler {
-	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
 }
-
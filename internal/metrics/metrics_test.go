@@ -1,48 +1,181 @@
 package metrics
 
 import (
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewMetrics(t *testing.T) {
-	m := NewMetrics()
+	m := NewMetrics("dev", "unknown")
 	if m == nil {
 		t.Fatal("NewMetrics() returned nil")
 	}
 }
 
 func TestRecordRequest(t *testing.T) {
-	m := NewMetrics()
-	m.RecordRequest("GET", "/api/test", 200, 10*time.Millisecond, 1024, 2048)
+	m := NewMetrics("dev", "unknown")
+	m.RecordRequest("GET", "/api/test", 200, 10*time.Millisecond, 1024, 2048, "")
 	// No panic means success
 }
 
 func TestRecordCache(t *testing.T) {
-	m := NewMetrics()
+	m := NewMetrics("dev", "unknown")
 	m.RecordCacheHit("GET", "/api/test")
 	m.RecordCacheMiss("GET", "/api/test")
 	// No panic means success
 }
 
+func TestRecordCacheEvictions(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordCacheEviction()
+	m.RecordCacheExpiration()
+	m.SetCacheUtilization(0.5)
+	// No panic means success
+}
+
 func TestRecordRateLimitDrop(t *testing.T) {
-	m := NewMetrics()
+	m := NewMetrics("dev", "unknown")
 	m.RecordRateLimitDrop()
 	// No panic means success
 }
 
+func TestRecordHijackFailure(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordHijackFailure()
+	// No panic means success
+}
+
+func TestRecordClientWriteError(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordClientWriteError()
+	// No panic means success
+}
+
+func TestRecordConcurrencyLimit(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordConcurrencyLimit("queued")
+	m.RecordConcurrencyLimit("rejected")
+	// No panic means success
+}
+
+func TestInFlightRequests(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.IncInFlightRequests()
+	m.IncInFlightRequests()
+	m.DecInFlightRequests()
+	if got := testutil.ToFloat64(m.inFlightRequests); got != 1 {
+		t.Errorf("expected 1 request holding a slot, got %v", got)
+	}
+}
+
 func TestActiveConnections(t *testing.T) {
-	m := NewMetrics()
+	m := NewMetrics("dev", "unknown")
 	m.IncActiveConnections()
 	m.DecActiveConnections()
 	// No panic means success
 }
 
 func BenchmarkRecordRequest(b *testing.B) {
-	m := NewMetrics()
+	m := NewMetrics("dev", "unknown")
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		m.RecordRequest("GET", "/api/test", 200, time.Millisecond, 1024, 2048)
+		m.RecordRequest("GET", "/api/test", 200, time.Millisecond, 1024, 2048, "")
+	}
+}
+
+func TestRecordTenantRequest(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordTenantRequest("acme", 200)
+	// No panic means success
+}
+
+func TestRecordMirror(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordMirrorResponse(200, 10*time.Millisecond)
+	m.RecordMirrorFailure("dropped")
+	// No panic means success
+}
+
+func TestRecordUpstreamResponse(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordUpstreamResponse("HTTP/2.0")
+	// No panic means success
+}
+
+func TestRecordUpstreamError(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordUpstreamError("dns")
+	m.RecordUpstreamError("response_header_timeout")
+	// No panic means success
+}
+
+func TestRecordVariantRequest(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordVariantRequest("/api/", "canary", 200)
+	// No panic means success
+}
+
+func TestHandlerExportsRuntimeAndBuildInfo(t *testing.T) {
+	m := NewMetrics("1.2.3", "2026-01-01T00:00:00Z")
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"go_goroutines ",
+		`build_info{build_time="2026-01-01T00:00:00Z",version="1.2.3"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected scrape output to contain %q", want)
+		}
+	}
+}
+
+func TestRequestStatusClassAndInFlight(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordRequest("GET", "/a", 200, time.Millisecond, 0, 0, "")
+	m.RecordRequest("GET", "/b", 204, time.Millisecond, 0, 0, "")
+	m.RecordRequest("BREW", "/c", 503, time.Millisecond, 0, 0, "")
+
+	if got := testutil.ToFloat64(m.requestsByClass.WithLabelValues("GET", "2xx")); got != 2 {
+		t.Errorf("expected 2 GET 2xx requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.requestsByClass.WithLabelValues("OTHER", "5xx")); got != 1 {
+		t.Errorf("expected nonstandard methods to be counted as OTHER, got %v", got)
+	}
+
+	m.IncRequestsInFlight("POST")
+	m.IncRequestsInFlight("POST")
+	m.DecRequestsInFlight("POST")
+	if got := testutil.ToFloat64(m.requestsInFlight.WithLabelValues("POST")); got != 1 {
+		t.Errorf("expected 1 POST in flight, got %v", got)
 	}
 }
 
+func TestRequestDurationExemplar(t *testing.T) {
+	m := NewMetrics("dev", "unknown")
+	m.RecordRequest("GET", "/a", 200, 5*time.Millisecond, 0, 0, "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("expected OpenMetrics output, got %q", ct)
+	}
+	found := false
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "http_request_duration_seconds_bucket{") &&
+			strings.Contains(line, `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a duration bucket with a trace_id exemplar, got:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,210 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Failure reasons reported to the Recorder
+const (
+	FailureError   = "error"   // the mirror request failed or timed out
+	FailureDropped = "dropped" // too many mirror requests were in flight
+)
+
+// Config holds shadow traffic settings
+type Config struct {
+	URL         string
+	SampleRate  float64       // fraction of requests mirrored, 0 to 1
+	Timeout     time.Duration // bounds each mirror request end to end
+	MaxBodySize int64         // requests with larger bodies are not mirrored
+	MaxInFlight int           // mirror requests beyond this are dropped
+	// StripHeaders, and headers whose names match StripHeaderPatterns,
+	// are removed before the request is sent to the mirror
+	StripHeaders        []string
+	StripHeaderPatterns []*regexp.Regexp
+	// Transport sends mirror requests, http.DefaultTransport when nil
+	Transport http.RoundTripper
+}
+
+// Recorder receives the outcome of mirror requests
+type Recorder interface {
+	RecordMirrorResponse(status int, duration time.Duration)
+	RecordMirrorFailure(reason string)
+}
+
+// Mirror asynchronously replays a sample of requests to a shadow upstream.
+// Responses are discarded and never reach the client.
+type Mirror struct {
+	target      *url.URL
+	rate        float64
+	timeout     time.Duration
+	maxBodySize int64
+	strip       []string
+	stripRe     []*regexp.Regexp
+	client      *http.Client
+	recorder    Recorder
+	slots       chan struct{}
+	wg          sync.WaitGroup
+	sample      func() float64
+}
+
+// New creates a mirror for the given target. The recorder may be nil.
+func New(cfg Config, recorder Recorder) (*Mirror, error) {
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror URL %q: %w", cfg.URL, err)
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("mirror URL %q must be an absolute http(s) URL", cfg.URL)
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("mirror sample rate must be between 0 and 1, got %v", cfg.SampleRate)
+	}
+	if cfg.MaxInFlight <= 0 {
+		return nil, fmt.Errorf("mirror max in-flight must be positive")
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Mirror{
+		target:      target,
+		rate:        cfg.SampleRate,
+		timeout:     cfg.Timeout,
+		maxBodySize: cfg.MaxBodySize,
+		strip:       cfg.StripHeaders,
+		stripRe:     cfg.StripHeaderPatterns,
+		client: &http.Client{
+			Transport: transport,
+			// Redirects are part of the response being discarded
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		recorder: recorder,
+		slots:    make(chan struct{}, cfg.MaxInFlight),
+		sample:   rand.Float64,
+	}, nil
+}
+
+// Sampled reports whether the next request should be mirrored
+func (m *Mirror) Sampled() bool {
+	return m.rate > 0 && m.sample() < m.rate
+}
+
+// Capture buffers the request body so it can be replayed to the mirror and
+// rewinds r.Body for the primary upstream. It returns false when the body
+// is too large or could not be read, in which case the request must not be
+// mirrored; r.Body still yields the original bytes and error.
+func (m *Mirror) Capture(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.maxBodySize {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodySize+1))
+	r.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+	if err != nil || int64(len(body)) > m.maxBodySize {
+		return nil, false
+	}
+	return body, true
+}
+
+// replayBody serves buffered bytes before the rest of the original body
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Send replays the request with the captured body to the mirror in the
+// background. It never blocks; when too many mirror requests are in
+// flight the request is dropped.
+func (m *Mirror) Send(r *http.Request, body []byte) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.recordFailure(FailureDropped)
+		return
+	}
+
+	// Detach from the client request so the mirror outlives it
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.URL.Scheme = m.target.Scheme
+	req.URL.Host = m.target.Host
+	req.Host = m.target.Host
+	req.RequestURI = ""
+	for _, h := range m.strip {
+		req.Header.Del(h)
+	}
+	for name := range req.Header {
+		for _, re := range m.stripRe {
+			if re.MatchString(name) {
+				delete(req.Header, name)
+				break
+			}
+		}
+	}
+	req.ContentLength = int64(len(body))
+	req.Body = http.NoBody
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.slots }()
+		m.do(req)
+	}()
+}
+
+// do performs a mirror request and discards the response
+func (m *Mirror) do(req *http.Request) {
+	ctx := req.Context()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		m.recordFailure(FailureError)
+		return
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		m.recordFailure(FailureError)
+		return
+	}
+
+	if m.recorder != nil {
+		m.recorder.RecordMirrorResponse(resp.StatusCode, time.Since(start))
+	}
+}
+
+func (m *Mirror) recordFailure(reason string) {
+	if m.recorder != nil {
+		m.recorder.RecordMirrorFailure(reason)
+	}
+}
+
+// Close waits for in-flight mirror requests and closes idle connections
+func (m *Mirror) Close() {
+	m.wg.Wait()
+	m.client.CloseIdleConnections()
+}
@@ -0,0 +1,184 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recorder collects mirror outcomes
+type recorder struct {
+	mu       sync.Mutex
+	statuses []int
+	failures []string
+}
+
+func (r *recorder) RecordMirrorResponse(status int, _ time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *recorder) RecordMirrorFailure(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, reason)
+}
+
+func newMirror(t *testing.T, target string, rate float64, rec Recorder) *Mirror {
+	t.Helper()
+	m, err := New(Config{
+		URL:          target,
+		SampleRate:   rate,
+		Timeout:      time.Second,
+		MaxBodySize:  16,
+		MaxInFlight:  10,
+		StripHeaders: []string{"Authorization"},
+	}, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	tests := []Config{
+		{URL: "/relative", SampleRate: 1, MaxInFlight: 1},
+		{URL: "ftp://shadow", SampleRate: 1, MaxInFlight: 1},
+		{URL: "http://shadow", SampleRate: 2, MaxInFlight: 1},
+		{URL: "http://shadow", SampleRate: 1},
+	}
+	for _, cfg := range tests {
+		if _, err := New(cfg, nil); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestSampledFraction(t *testing.T) {
+	m := newMirror(t, "http://shadow", 0.25, nil)
+
+	const n = 10000
+	sampled := 0
+	for i := 0; i < n; i++ {
+		if m.Sampled() {
+			sampled++
+		}
+	}
+	if sampled < n*20/100 || sampled > n*30/100 {
+		t.Errorf("expected about 25%% sampled, got %d of %d", sampled, n)
+	}
+
+	if newMirror(t, "http://shadow", 0, nil).Sampled() {
+		t.Error("expected a zero rate never to sample")
+	}
+}
+
+func TestSendReplaysRequest(t *testing.T) {
+	type received struct {
+		method, uri, host, auth, body string
+	}
+	got := make(chan received, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.Method, r.RequestURI, r.Host, r.Header.Get("Authorization"), string(body)}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer shadow.Close()
+
+	rec := &recorder{}
+	m := newMirror(t, shadow.URL, 1, rec)
+
+	req := httptest.NewRequest("POST", "/orders?id=7", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer secret")
+	body, ok := m.Capture(req)
+	if !ok {
+		t.Fatal("expected body to be captured")
+	}
+	m.Send(req, body)
+	m.Close()
+
+	// The primary request still sees the full body
+	primary, _ := io.ReadAll(req.Body)
+	if string(primary) != "payload" {
+		t.Errorf("expected primary body to be replayed, got %q", primary)
+	}
+
+	r := <-got
+	if r.method != "POST" || r.uri != "/orders?id=7" || r.body != "payload" {
+		t.Errorf("unexpected mirror request %+v", r)
+	}
+	if r.host != strings.TrimPrefix(shadow.URL, "http://") {
+		t.Errorf("expected Host to be the mirror target, got %q", r.host)
+	}
+	if r.auth != "" {
+		t.Error("expected stripped headers not to reach the mirror")
+	}
+	if len(rec.statuses) != 1 || rec.statuses[0] != http.StatusCreated {
+		t.Errorf("expected one recorded 201, got %v", rec.statuses)
+	}
+}
+
+func TestCaptureSkipsLargeBodies(t *testing.T) {
+	m := newMirror(t, "http://shadow", 1, nil)
+	payload := strings.Repeat("x", 32)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+	if _, ok := m.Capture(req); ok {
+		t.Error("expected declared large body not to be mirrored")
+	}
+
+	req = httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader(payload)))
+	req.ContentLength = -1
+	if _, ok := m.Capture(req); ok {
+		t.Error("expected streamed large body not to be mirrored")
+	}
+	primary, _ := io.ReadAll(req.Body)
+	if string(primary) != payload {
+		t.Errorf("expected primary body intact, got %d bytes", len(primary))
+	}
+}
+
+func TestSendDropsWhenSaturated(t *testing.T) {
+	release := make(chan struct{})
+	var hits atomic.Int32
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+	}))
+	defer shadow.Close()
+
+	rec := &recorder{}
+	m, err := New(Config{URL: shadow.URL, SampleRate: 1, MaxInFlight: 1, Timeout: time.Second}, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Send(httptest.NewRequest("GET", "/", nil), nil)
+	m.Send(httptest.NewRequest("GET", "/", nil), nil)
+	close(release)
+	m.Close()
+
+	if hits.Load() != 1 {
+		t.Errorf("expected one mirror request, got %d", hits.Load())
+	}
+	if len(rec.failures) != 1 || rec.failures[0] != FailureDropped {
+		t.Errorf("expected one dropped mirror, got %v", rec.failures)
+	}
+}
+
+func TestSendRecordsFailure(t *testing.T) {
+	rec := &recorder{}
+	m := newMirror(t, "http://127.0.0.1:1", 1, rec)
+	m.Send(httptest.NewRequest("GET", "/", nil), nil)
+	m.Close()
+
+	if len(rec.failures) != 1 || rec.failures[0] != FailureError {
+		t.Errorf("expected one mirror error, got %v", rec.failures)
+	}
+}
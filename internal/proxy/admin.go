@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+	"github.com/mumumio1/wproxy/internal/route"
+	"github.com/mumumio1/wproxy/internal/upstream"
+)
+
+// maintenance holds the runtime-toggleable maintenance mode state
+type maintenance struct {
+	enabled     atomic.Bool
+	statusCode  int
+	contentType string
+	body        []byte
+	allowPaths  []string
+}
+
+// newMaintenance creates maintenance state from configuration
+func newMaintenance(cfg config.MaintenanceConfig) *maintenance {
+	m := &maintenance{
+		statusCode:  cfg.StatusCode,
+		contentType: cfg.ContentType,
+		body:        []byte(cfg.Body),
+		allowPaths:  cfg.AllowPaths,
+	}
+	m.enabled.Store(cfg.Enabled)
+	return m
+}
+
+// bypass reports whether the path is allowlisted during maintenance.
+// Prefixes match whole path segments, so "/status" does not let
+// "/statuspage" through.
+func (m *maintenance) bypass(path string) bool {
+	for _, prefix := range m.allowPaths {
+		if route.HasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceMiddleware serves the maintenance response while enabled
+func maintenanceMiddleware(next http.Handler, m *maintenance) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enabled.Load() || m.bypass(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", m.contentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(m.statusCode)
+		w.Write(m.body)
+	})
+}
+
+// maintenanceHandler reports (GET) or toggles (PUT) maintenance mode
+func maintenanceHandler(m *maintenance, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var req struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&req); err != nil || req.Enabled == nil {
+				writeJSONError(w, http.StatusBadRequest, `expected {"enabled": true|false}`)
+				return
+			}
+			m.enabled.Store(*req.Enabled)
+			log.FromContext(r.Context(), logger).Warn("Maintenance mode changed",
+				log.Bool("enabled", *req.Enabled),
+			)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"maintenance":%t}`, m.enabled.Load())
+	}
+}
+
+// MetricsHandler serves metrics on the configured path and, when
+// enabled, pprof profiles under /debug/pprof/ behind the admin token
+func MetricsHandler(cfg *config.Config, m *metrics.Metrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Metrics.Path, m.Handler())
+	if cfg.Debug.Pprof {
+		debug := http.NewServeMux()
+		debug.HandleFunc("/debug/pprof/", pprof.Index)
+		debug.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debug.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debug.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debug.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/pprof/", adminAuthMiddleware(debug, cfg.Admin.Token))
+	}
+	return mux
+}
+
+// configHandler returns the effective configuration, after defaults, the
+// config file and environment overrides are merged, with secrets redacted
+func configHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.Redacted())
+	}
+}
+
+// Page sizes for /admin/cache/keys. The maximum bounds the response a
+// single request can produce from a large cache.
+const (
+	defaultCacheKeysLimit = 100
+	maxCacheKeysLimit     = 1000
+)
+
+// cacheKeyInfo is a cached entry as listed by /admin/cache/keys
+type cacheKeyInfo struct {
+	Key        string  `json:"key"`
+	Method     string  `json:"method,omitempty"`
+	URL        string  `json:"url,omitempty"`
+	StatusCode int     `json:"status_code"`
+	Size       int64   `json:"size"`
+	AgeSeconds float64 `json:"age_seconds"`
+	TTLSeconds float64 `json:"ttl_seconds"`
+	ETag       string  `json:"etag,omitempty"`
+	// OriginalSize is the body length before compression, for entries
+	// stored compressed
+	OriginalSize int64 `json:"original_size,omitempty"`
+}
+
+// cacheKeysHandler lists cached keys with their metadata a page at a
+// time, selected with the offset and limit query parameters
+func cacheKeysHandler(c cache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		lister, ok := c.(cache.Lister)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "cache listing is not available")
+			return
+		}
+
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		limit, err := queryInt(r, "limit", defaultCacheKeysLimit)
+		if err != nil || limit < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(limit, maxCacheKeysLimit)
+
+		entries, total := lister.Keys(offset, limit)
+		keys := make([]cacheKeyInfo, len(entries))
+		for i, e := range entries {
+			keys[i] = cacheKeyInfo{
+				Key:          e.Key,
+				Method:       e.Method,
+				URL:          e.URL,
+				StatusCode:   e.StatusCode,
+				Size:         e.Size,
+				AgeSeconds:   e.Age.Seconds(),
+				TTLSeconds:   e.TTL.Seconds(),
+				ETag:         e.ETag,
+				OriginalSize: e.OriginalSize,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Total  int            `json:"total"`
+			Offset int            `json:"offset"`
+			Limit  int            `json:"limit"`
+			Keys   []cacheKeyInfo `json:"keys"`
+		}{total, offset, limit, keys})
+	}
+}
+
+// queryInt parses an integer query parameter, returning def if it is unset
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// rateLimitResetHandler clears a client's rate limit state (DELETE), e.g.
+// after a customer upgrade. The key is the one the rate limiter uses,
+// such as an IP address or "apikey:" followed by the API key.
+func rateLimitResetHandler(limiter ratelimit.Limiter, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if limiter == nil {
+			writeJSONError(w, http.StatusNotFound, "rate limiting is disabled")
+			return
+		}
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeJSONError(w, http.StatusBadRequest, "key is required")
+			return
+		}
+
+		limiter.Reset(key)
+		log.FromContext(r.Context(), logger).Info("Rate limit reset", log.String("key", key))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// processStart is when the process started, for the uptime reported by
+// /admin/healthz
+var processStart = time.Now()
+
+// cacheDiagnostics is the cache section of /admin/healthz
+type cacheDiagnostics struct {
+	Enabled bool   `json:"enabled"`
+	Backend string `json:"backend,omitempty"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"max_size,omitempty"`
+	Entries int    `json:"entries"`
+}
+
+// rateLimitDiagnostics is the rate limiter section of /admin/healthz.
+// Buckets is left out when the limiter cannot count its keys.
+type rateLimitDiagnostics struct {
+	Enabled   bool   `json:"enabled"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Buckets   *int   `json:"buckets,omitempty"`
+}
+
+// backendDiagnostics is the health of one upstream backend
+type backendDiagnostics struct {
+	URL    string `json:"url"`
+	Status string `json:"status"` // ok or failing
+	Error  string `json:"error,omitempty"`
+}
+
+// healthzHandler reports the state of each subsystem in one place: the
+// cache, the rate limiter, whether each upstream backend accepts
+// connections, and the build and uptime. Unlike /ready it always answers
+// 200; the status is degraded when any backend is failing.
+func healthzHandler(cfg *config.Config, pool *upstream.Pool, c cache.Cache, limiter ratelimit.Limiter, version string) http.HandlerFunc {
+	timeout := cfg.Server.Readiness.Timeout
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		cacheState := cacheDiagnostics{Enabled: c != nil}
+		if c != nil {
+			cacheState.Backend = cfg.Cache.Type
+			cacheState.Size = c.Size()
+			cacheState.MaxSize = cfg.Cache.MaxSize
+			cacheState.Entries = c.Len()
+		}
+
+		limiterState := rateLimitDiagnostics{Enabled: limiter != nil}
+		if limiter != nil {
+			limiterState.Algorithm = cfg.RateLimit.Algorithm
+			if cfg.RateLimit.Quota > 0 {
+				limiterState.Algorithm = "quota"
+			}
+			if counter, ok := limiter.(ratelimit.Counter); ok {
+				buckets := counter.Len()
+				limiterState.Buckets = &buckets
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		backends := liveBackends(pool)
+		upstreams := make([]backendDiagnostics, len(backends))
+		var wg sync.WaitGroup
+		for i, b := range backends {
+			upstreams[i] = backendDiagnostics{URL: b.URL.Redacted(), Status: "ok"}
+			wg.Go(func() {
+				if err := dialBackend(ctx, b); err != nil {
+					upstreams[i].Status = "failing"
+					upstreams[i].Error = err.Error()
+				}
+			})
+		}
+		wg.Wait()
+
+		status := "ok"
+		for _, b := range upstreams {
+			if b.Status != "ok" {
+				status = "degraded"
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Status        string               `json:"status"`
+			Version       string               `json:"version,omitempty"`
+			StartedAt     time.Time            `json:"started_at"`
+			UptimeSeconds float64              `json:"uptime_seconds"`
+			Cache         cacheDiagnostics     `json:"cache"`
+			RateLimiter   rateLimitDiagnostics `json:"rate_limiter"`
+			Upstreams     []backendDiagnostics `json:"upstreams"`
+		}{status, version, processStart, time.Since(processStart).Seconds(), cacheState, limiterState, upstreams})
+	}
+}
+
+// adminAuthMiddleware requires the admin bearer token
+func adminAuthMiddleware(next http.Handler, token string) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
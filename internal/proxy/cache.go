@@ -0,0 +1,836 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/cors"
+	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/tenant"
+)
+
+// Values of the cache control header with which a backend overrides the
+// cacheability of a response
+const (
+	cacheBypass = "bypass"
+	cacheForce  = "force"
+)
+
+// isStorable reports whether an upstream response may be stored in the
+// cache, judged from its status, headers and the backend's cache
+// directive alone
+func isStorable(resp *http.Response, rules cache.Rules, directive string) bool {
+	// A 304 answers the client's own conditional request and has no body
+	if resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return responseCacheable(resp.Request, resp.StatusCode, resp.Header, rules, directive)
+}
+
+// responseCacheable applies the backend's cache directive to the rules. A
+// forced response is judged without its Cache-Control, cookies or content
+// type; the method and status rules still apply.
+func responseCacheable(r *http.Request, statusCode int, headers http.Header, rules cache.Rules, directive string) bool {
+	switch directive {
+	case cacheBypass:
+		return false
+	case cacheForce:
+		rules.AllowCookies = true
+		rules.ContentTypes = nil
+		headers = headers.Clone()
+		headers.Del("Cache-Control")
+	}
+	return rules.IsCacheable(r, statusCode, headers)
+}
+
+// cacheRules returns the configured cacheability rules
+func cacheRules(cfg *config.Config) cache.Rules {
+	return cache.Rules{
+		Methods:          cfg.Cache.CacheableMethods,
+		StatusCodes:      cfg.Cache.CacheableStatusCodes,
+		NegativeStatuses: cfg.Cache.NegativeStatuses,
+		AllowCookies:     cfg.Cache.CacheCookies,
+		ContentTypes:     cfg.Cache.CacheableContentTypes,
+	}
+}
+
+// safeMethod reports whether a request method is defined as read-only
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// maxKeyedBodySize bounds the request bodies read to key cached responses
+// to methods such as POST; larger requests bypass the cache
+const maxKeyedBodySize = 1 << 20
+
+// withBodyKey reads the body of a request whose method has one so the
+// cache key can include its hash, and replaces it for the upstream. It
+// returns false if the body is too large or unreadable to key on.
+func withBodyKey(r *http.Request) (*http.Request, bool) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r, true
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return r.WithContext(context.WithValue(r.Context(), bodyKeyContextKey{}, "")), true
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxKeyedBodySize+1))
+	rest := r.Body
+	r = r.Clone(r.Context())
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rest), rest}
+	if err != nil || len(body) > maxKeyedBodySize {
+		return r, false
+	}
+	sum := sha256.Sum256(body)
+	return r.WithContext(context.WithValue(r.Context(), bodyKeyContextKey{}, hex.EncodeToString(sum[:]))), true
+}
+
+// requestCacheKey returns the cache key for a request, namespaced by tenant
+// and traffic split variant
+func requestCacheKey(r *http.Request, queries *cache.QueryFilter) string {
+	key := cache.CacheKey(r, nil, queries)
+	if hash, ok := r.Context().Value(bodyKeyContextKey{}).(string); ok {
+		key = "body:" + hash + ":" + key
+	}
+	return namespacedKey(r, key)
+}
+
+// urlCacheKey returns the key of the entry GET and HEAD requests for the
+// request's URL share, whatever the request's own method
+func urlCacheKey(r *http.Request, queries *cache.QueryFilter) string {
+	get := &http.Request{Method: http.MethodGet, URL: r.URL}
+	return namespacedKey(r, cache.CacheKey(get, nil, queries))
+}
+
+// namespacedKey prefixes a cache key with the request's tenant and
+// traffic split variant
+func namespacedKey(r *http.Request, key string) string {
+	if v := variantFromContext(r.Context()); v != nil {
+		key = "variant:" + v.Name + ":" + key
+	}
+	if id := tenant.FromContext(r.Context()); id != "" {
+		key = "tenant:" + id + ":" + key
+	}
+	return key
+}
+
+// handleProxy handles the main proxy logic with caching
+func handleProxy(
+	w http.ResponseWriter,
+	r *http.Request,
+	proxy http.Handler,
+	cfg *config.Config,
+	m metrics.Recorder,
+	c cache.Cache,
+	policy *cors.Policy,
+	headerFilter *cache.HeaderFilter,
+	queryFilter *cache.QueryFilter,
+	bodies *cache.DiskStore,
+	misses *missGroup,
+) {
+	// Normally created by loggingMiddleware so it can report the outcome
+	outcome := outcomeFromContext(r.Context())
+	if outcome == nil {
+		outcome = &requestOutcome{}
+		r = r.WithContext(context.WithValue(r.Context(), outcomeContextKey{}, outcome))
+	}
+
+	cacheEnabled := c != nil
+	// Kept for invalidation when c is cleared below
+	stored := c
+	if flagsFromContext(r.Context()).noCache {
+		c = nil
+	}
+
+	// Stale entry being revalidated with a conditional upstream request
+	var stale *cache.Entry
+	clientIfNoneMatch := r.Header.Get("If-None-Match")
+
+	r, refresh := refreshRequested(r, cfg.Cache.RefreshQueryParam)
+
+	rules := cacheRules(cfg)
+	if c != nil && !rules.IsCacheable(r, 0, nil) {
+		c = nil
+	}
+	if c != nil {
+		var keyed bool
+		if r, keyed = withBodyKey(r); !keyed {
+			c = nil
+		}
+	}
+	if cacheEnabled && c == nil {
+		outcome.cacheStatus = "bypass"
+	}
+
+	// A refresh skips stored entries, stale ones included, and replaces
+	// them with the upstream's full response
+	if c != nil && refresh {
+		outcome.cacheStatus = "refresh"
+	}
+
+	// Check cache if enabled
+	if c != nil && !refresh {
+		cacheKey := requestCacheKey(r, queryFilter)
+
+		// A single lookup answers both the client's If-None-Match and a
+		// plain hit. A body file evicted since the lookup is treated as a
+		// miss.
+		serveHit := func() bool {
+			entry, ok := c.Get(cacheKey)
+			if !ok {
+				return false
+			}
+			if clientIfNoneMatch != "" && entryMatches(clientIfNoneMatch, entry) {
+				if m != nil {
+					m.RecordCacheHit(r.Method, r.URL.Path)
+				}
+				outcome.cacheStatus = "hit"
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+			if body, err := entry.OpenBody(); err == nil {
+				if m != nil {
+					m.RecordCacheHit(r.Method, r.URL.Path)
+				}
+				outcome.cacheStatus = "hit"
+				writeCachedEntry(w, r, entry, body, "HIT", policy)
+				return true
+			}
+			c.Delete(cacheKey)
+			return false
+		}
+		if serveHit() {
+			return
+		}
+
+		// Concurrent misses wait for the first GET's response, which a
+		// failing upstream answers with a negatively cached error. Waiters
+		// that still miss, e.g. because that response wasn't cacheable,
+		// join again until the coalesce timeout has passed.
+		if misses != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), misses.timeout)
+			for {
+				wait, done := misses.join(cacheKey, r.Method == http.MethodGet)
+				if done != nil {
+					defer done()
+					break
+				}
+				if wait == nil || !misses.await(ctx, wait) {
+					break
+				}
+				if serveHit() {
+					cancel()
+					return
+				}
+			}
+			cancel()
+		}
+
+		if m != nil {
+			m.RecordCacheMiss(r.Method, r.URL.Path)
+		}
+		outcome.cacheStatus = "miss"
+
+		if entry, ok := c.GetStale(cacheKey); ok && entry.Revalidatable() {
+			stale = entry
+		}
+	}
+
+	// Cache miss or caching disabled - proxy to upstream
+	// Wrap response writer to capture response
+	rec := &responseRecorder{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+		body:           getBodyBuffer(),
+	}
+	defer rec.release()
+	if c != nil {
+		// Bodies larger than the cache can hold are streamed but not buffered
+		rec.maxBuffer = cfg.Cache.MaxSize
+		rec.disk = bodies
+		rec.hash = cache.NewETagHash()
+	}
+	// Removes a spilled body file unless the cache took ownership of it
+	defer rec.removeFile()
+
+	rec.outcome = outcome
+
+	var headerSnapshot http.Header
+	if stale != nil {
+		// Ask the upstream whether our copy is still current. The client's
+		// own conditionals are answered by us once the result is known.
+		r = r.Clone(r.Context())
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+		etag, lastModified := stale.Validators()
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			r.Header.Set("If-Modified-Since", lastModified)
+		}
+		rec.revalidating = true
+		headerSnapshot = w.Header().Clone()
+	}
+
+	if timeout := cfg.Upstream.RequestTimeout; timeout > 0 {
+		ctx, cancel := context.WithTimeoutCause(r.Context(), timeout, errUpstreamTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	upstreamStart := time.Now()
+	proxy.ServeHTTP(rec, r)
+	outcome.upstreamDuration = time.Since(upstreamStart)
+
+	// A successful unsafe request may have changed the resource, so the
+	// entry stored for its URL is dropped (RFC 9111, section 4.4)
+	if stored != nil && !safeMethod(r.Method) && rec.statusCode < 400 {
+		stored.Delete(urlCacheKey(r, queryFilter))
+	}
+
+	if rec.notModified {
+		outcome.cacheStatus = "revalidated"
+		// Drop the headers the proxy copied from the 304 and serve the
+		// refreshed entry instead
+		h := w.Header()
+		for key := range h {
+			delete(h, key)
+		}
+		for key, values := range headerSnapshot {
+			h[key] = values
+		}
+
+		entry := refreshEntry(stale, headerFilter.Storable(rec.notModifiedHeader), cache.ParseAge(rec.notModifiedHeader),
+			defaultTTL(cfg, stale.StatusCode), cfg.Cache.TTLJitter)
+		if !c.Set(requestCacheKey(r, queryFilter), entry) && entry.BodyFile != "" {
+			// No longer owned by the cache; remove it once served
+			defer os.Remove(entry.BodyFile)
+		}
+
+		if clientIfNoneMatch != "" && entryMatches(clientIfNoneMatch, entry) {
+			if entry.ETag != "" {
+				w.Header().Set("ETag", entry.ETag)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		body, err := entry.OpenBody()
+		if err != nil {
+			c.Delete(requestCacheKey(r, queryFilter))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		writeCachedEntry(w, r, entry, body, "REVALIDATED", policy)
+		return
+	}
+
+	// Cache response if applicable. HEAD responses have no body, so only
+	// GET populates the entries both methods share.
+	// An error rendered because the client went away says nothing about
+	// the upstream and is not stored, even when its status is negatively
+	// cached.
+	if c != nil && r.Method != http.MethodHead && !rec.overflow && !outcome.truncated && !outcome.uncacheable &&
+		!errors.Is(context.Cause(r.Context()), context.Canceled) &&
+		responseCacheable(r, rec.statusCode, rec.Header(), rules, outcome.cacheDirective) {
+		cacheKey := requestCacheKey(r, queryFilter)
+		etag := cache.ETagFromHash(rec.hash)
+
+		headers := headerFilter.Storable(rec.Header())
+		entry := &cache.Entry{
+			StatusCode: rec.statusCode,
+			Headers:    headers,
+			Body:       bytes.Clone(*rec.body), // rec.body goes back to the pool
+			ETag:       etag,
+			CreatedAt:  time.Now(),
+			InitialAge: cache.ParseAge(rec.Header()),
+			Size:       cache.EntrySize(headers, etag, rec.size),
+			Method:     r.Method,
+			URL:        r.URL.RequestURI(),
+		}
+		if outcome.cacheDirective == cacheForce {
+			entry.ExpiresAt = forcedExpiry(rec.Header(), entry.InitialAge, defaultTTL(cfg, rec.statusCode), cfg.Cache.TTLJitter)
+		} else {
+			entry.ExpiresAt = expiry(rec.Header(), entry.InitialAge, defaultTTL(cfg, rec.statusCode), cfg.Cache.TTLJitter)
+		}
+		if rec.file != nil {
+			if err := rec.file.Close(); err != nil {
+				return
+			}
+			entry.BodyFile = rec.file.Name()
+		}
+		if cfg.Cache.CompressEntries {
+			entry.Compress(cfg.Cache.CompressMinSize)
+		}
+
+		// An entry too large for the cache has been streamed uncached;
+		// its body file is still removed by rec
+		if !c.Set(cacheKey, entry) {
+			return
+		}
+		rec.file = nil
+
+		// Set cache headers
+		rec.Header().Set("X-Cache", "MISS")
+		rec.Header().Set("ETag", etag)
+	}
+}
+
+// missGroup tracks the cache misses being fetched from the upstream, so
+// concurrent requests for the same key wait for the first one instead of
+// all reaching the upstream. A nil group coalesces nothing.
+type missGroup struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[string]chan struct{}
+}
+
+// newMissGroup returns a group whose waiters give up after timeout, or
+// nil when timeout is 0
+func newMissGroup(timeout time.Duration) *missGroup {
+	if timeout <= 0 {
+		return nil
+	}
+	return &missGroup{timeout: timeout, calls: make(map[string]chan struct{})}
+}
+
+// join registers a miss for key. The first request that may lead gets
+// done, to call once its response is stored; the others get a channel
+// closed at that point. Only GETs lead, since a HEAD or POST response
+// leaves nothing the others can be served from. A request that may not
+// lead gets neither when no miss for key is in flight.
+func (g *missGroup) join(key string, lead bool) (wait <-chan struct{}, done func()) {
+	if g == nil {
+		return nil, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ch, ok := g.calls[key]; ok {
+		return ch, nil
+	}
+	if !lead {
+		return nil, nil
+	}
+	ch := make(chan struct{})
+	g.calls[key] = ch
+	return nil, func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(ch)
+	}
+}
+
+// await waits for wait to be closed, reporting false when ctx, which
+// carries the coalesce timeout, ends first
+func (g *missGroup) await(ctx context.Context, wait <-chan struct{}) bool {
+	select {
+	case <-wait:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// refreshRequested reports whether the client asked for a fresh response
+// with Cache-Control: no-cache or the refresh query parameter, set to a
+// true value or left empty. The parameter is removed from the returned
+// request whatever its value.
+func refreshRequested(r *http.Request, param string) (*http.Request, bool) {
+	refresh := cache.RequiresRevalidation(r.Header)
+	if param == "" || r.URL.RawQuery == "" {
+		return r, refresh
+	}
+
+	var kept []string
+	found := false
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		name, value, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(name); err != nil || name != param {
+			kept = append(kept, pair)
+			continue
+		}
+		found = true
+		value, _ = url.QueryUnescape(value)
+		if on, err := strconv.ParseBool(value); value == "" || (err == nil && on) {
+			refresh = true
+		}
+	}
+	if !found {
+		return r, refresh
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = strings.Join(kept, "&")
+	return r, refresh
+}
+
+// writeCachedEntry writes a cached response to the client with a fresh
+// Date and an Age computed from when the entry was stored. Bodies are
+// streamed, and 200 responses honor Range requests (RFC 7233), including
+// multiple ranges and 416 for unsatisfiable ones.
+func writeCachedEntry(w http.ResponseWriter, r *http.Request, entry *cache.Entry, body io.ReadSeekCloser, status string, policy *cors.Policy) {
+	defer body.Close()
+
+	// A compressed entry is sent as stored when the client accepts gzip,
+	// other than for ranges, which are served from the original body
+	gzipped := entry.Compressed && r.Header.Get("Range") == "" && acceptsGzip(r.Header)
+	if entry.Compressed && !gzipped {
+		plain, err := cache.Decompress(body)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		defer plain.Close()
+		body = plain
+	}
+
+	for key, values := range entry.Headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	now := time.Now()
+	w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", strconv.FormatInt(int64(entry.Age(now)/time.Second), 10))
+	w.Header().Set("X-Cache", status)
+	if entry.ETag != "" {
+		w.Header().Set("ETag", entry.ETag)
+	}
+	if entry.Compressed {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		// The gzip bytes are a different representation of the same
+		// content, which strong validators must tell apart
+		if entry.ETag != "" {
+			w.Header().Set("ETag", "W/"+entry.ETag)
+		}
+	}
+	if policy != nil {
+		policy.Apply(w.Header(), r.Header.Get("Origin"))
+	}
+
+	// Content-Length comes from the stored body rather than the upstream,
+	// which leaves it out of chunked responses
+	w.Header().Del("Content-Length")
+	size, err := bodySize(body)
+	if entry.StatusCode == http.StatusOK {
+		// ServeContent sets Content-Length itself unless the body is
+		// encoded, when it only serves ranges of the encoded bytes
+		if err == nil && w.Header().Get("Content-Encoding") != "" && r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		http.ServeContent(w, r, "", time.Time{}, body)
+		return
+	}
+	if err == nil && entry.StatusCode != http.StatusNoContent && entry.StatusCode != http.StatusNotModified {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(entry.StatusCode)
+	if r.Method != http.MethodHead {
+		io.Copy(w, body)
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows a gzip
+// response, by name or else through "*"
+func acceptsGzip(h http.Header) bool {
+	named, wildcard := -1.0, -1.0
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if weight, err := strconv.ParseFloat(v, 64); err == nil {
+					q = weight
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip":
+				named = q
+			case "*":
+				wildcard = q
+			}
+		}
+	}
+	if named >= 0 {
+		return named > 0
+	}
+	return wildcard > 0
+}
+
+// addVary adds a header name to Vary unless it is already listed
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if listed = strings.TrimSpace(listed); listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// bodySize returns the length of a cached body and rewinds it
+func bodySize(body io.Seeker) (int64, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// entryMatches reports whether an If-None-Match value matches either the
+// ETag the proxy serves for the entry or the upstream's own ETag
+func entryMatches(ifNoneMatch string, entry *cache.Entry) bool {
+	upstreamETag, _ := entry.Validators()
+	return cache.ETagMatch(ifNoneMatch, entry.ETag) || cache.ETagMatch(ifNoneMatch, upstreamETag)
+}
+
+// defaultTTL returns how long a response without its own freshness
+// lifetime is cached. Errors only get this far when negatively cacheable
+// and are kept for the shorter negative TTL.
+func defaultTTL(cfg *config.Config, statusCode int) time.Duration {
+	if statusCode >= 400 {
+		return cfg.Cache.NegativeTTL
+	}
+	return cfg.Cache.DefaultTTL
+}
+
+// revalidationHeaders are taken from a 304 response to update a stored entry
+var revalidationHeaders = []string{"Cache-Control", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// refreshEntry returns a copy of a stale entry updated with the headers of
+// a 304 revalidation response and a new, jittered expiry
+func refreshEntry(stale *cache.Entry, notModified http.Header, age, defaultTTL time.Duration, jitter time.Duration) *cache.Entry {
+	entry := *stale
+	entry.Headers = stale.Headers.Clone()
+	for _, key := range revalidationHeaders {
+		if values := notModified.Values(key); len(values) > 0 {
+			entry.Headers[key] = values
+		}
+	}
+	// The body is unchanged; only the headers' share of the size moves
+	entry.Size += cache.EntrySize(entry.Headers, "", 0) - cache.EntrySize(stale.Headers, "", 0)
+	entry.CreatedAt = time.Now()
+	entry.InitialAge = age
+	entry.ExpiresAt = expiry(entry.Headers, age, defaultTTL, jitter)
+	return &entry
+}
+
+// expiry returns when an entry stored now with the given headers and
+// already age old goes stale. no-cache entries are stale at once so every
+// request revalidates them with the upstream before they are served.
+func expiry(headers http.Header, age, defaultTTL time.Duration, jitter time.Duration) time.Time {
+	now := time.Now()
+	if cache.RequiresRevalidation(headers) {
+		return now
+	}
+	return now.Add(cache.JitterTTL(cache.FreshFor(headers, age, defaultTTL), jitter))
+}
+
+// forcedExpiry is expiry for responses the backend forced into the cache:
+// a lifetime the response sets still applies, but no-cache doesn't make it
+// stale at once
+func forcedExpiry(headers http.Header, age, defaultTTL time.Duration, jitter time.Duration) time.Time {
+	return time.Now().Add(cache.JitterTTL(cache.FreshFor(headers, age, defaultTTL), jitter))
+}
+
+// responseRecorder wraps http.ResponseWriter to capture the response
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       *[]byte
+	written    bool
+	maxBuffer  int64 // maximum bytes to buffer, 0 disables buffering
+	overflow   bool  // body exceeded maxBuffer or is uncacheable and was not kept
+	outcome    *requestOutcome
+
+	// Bodies over the disk store's threshold are written to file instead
+	// of body; size and hash cover the body wherever it is kept
+	disk *cache.DiskStore
+	file *os.File
+	size int64
+	hash hash.Hash
+
+	// revalidating holds back a 304 from the upstream so the cached entry
+	// can be served instead
+	revalidating      bool
+	notModified       bool
+	notModifiedHeader http.Header
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if isInformational(code) {
+		rec.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if rec.revalidating && !rec.written && code == http.StatusNotModified {
+		rec.notModified = true
+		rec.notModifiedHeader = rec.Header().Clone()
+		rec.written = true
+		return
+	}
+	if !rec.written {
+		rec.statusCode = code
+		rec.ResponseWriter.WriteHeader(code)
+		rec.written = true
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.written {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.notModified {
+		return len(b), nil
+	}
+	if !rec.overflow {
+		if rec.outcome != nil && rec.outcome.uncacheable {
+			// Headers ruled out caching, stop buffering right away
+			rec.discard()
+		} else if rec.size+int64(len(b)) > rec.maxBuffer {
+			rec.discard()
+		} else {
+			rec.keep(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {
+	if !rec.written {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.notModified {
+		// Nothing is sent until the cached entry replaces the 304
+		return
+	}
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection over, e.g. for a WebSocket upgrade. Nothing
+// sent over it afterwards passes through the recorder, so the response is
+// not cached.
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil {
+		rec.discard()
+	}
+	return conn, rw, err
+}
+
+func (rec *responseRecorder) Push(target string, opts *http.PushOptions) error {
+	return push(rec.ResponseWriter, target, opts)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// keep buffers b, moving the body to disk once it passes the threshold
+func (rec *responseRecorder) keep(b []byte) {
+	if rec.file == nil && rec.disk != nil && rec.size+int64(len(b)) > rec.disk.Threshold() {
+		f, err := rec.disk.Create()
+		if err == nil {
+			rec.file = f
+			_, err = f.Write(*rec.body)
+			*rec.body = (*rec.body)[:0]
+		}
+		if err != nil {
+			rec.discard()
+			return
+		}
+	}
+
+	if rec.file != nil {
+		if _, err := rec.file.Write(b); err != nil {
+			rec.discard()
+			return
+		}
+	} else {
+		*rec.body = append(*rec.body, b...)
+	}
+	rec.size += int64(len(b))
+	if rec.hash != nil {
+		rec.hash.Write(b)
+	}
+}
+
+// discard stops buffering the body
+func (rec *responseRecorder) discard() {
+	rec.overflow = true
+	*rec.body = (*rec.body)[:0]
+	rec.removeFile()
+}
+
+// release returns the body buffer to the pool. Cache entries hold copies,
+// so nothing refers to it afterwards.
+func (rec *responseRecorder) release() {
+	putBodyBuffer(rec.body)
+	rec.body = nil
+}
+
+// maxPooledBuffer caps the buffers kept in bodyBufferPool so one large
+// response does not pin its memory for the life of the process
+const maxPooledBuffer = 1 << 20
+
+// bodyBufferPool holds the buffers responseRecorder captures bodies in
+var bodyBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 32*1024)
+		return &b
+	},
+}
+
+// getBodyBuffer returns an empty buffer from the pool
+func getBodyBuffer() *[]byte {
+	return bodyBufferPool.Get().(*[]byte)
+}
+
+// putBodyBuffer returns a buffer to the pool unless it has grown too large
+func putBodyBuffer(b *[]byte) {
+	if b == nil || cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:0]
+	bodyBufferPool.Put(b)
+}
+
+// removeFile deletes a body file that was not handed to the cache
+func (rec *responseRecorder) removeFile() {
+	if rec.file != nil {
+		rec.file.Close()
+		os.Remove(rec.file.Name())
+		rec.file = nil
+	}
+}
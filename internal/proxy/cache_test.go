@@ -0,0 +1,805 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+)
+
+// newCachingProxy builds a proxy with an in-memory cache in front of an
+// upstream that counts its requests
+func newCachingProxy(t *testing.T, handler http.HandlerFunc) (*Proxy, *int) {
+	t.Helper()
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		handler(w, r)
+	})
+
+	p, err := New(newTestConfig(t, up.URL), Deps{
+		Logger: log.NewNopLogger(),
+		Cache:  cache.NewMemoryCache(1024*1024, time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p, &hits
+}
+
+func TestCachingFlowMissHitNotModified(t *testing.T) {
+	p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1}`))
+	})
+
+	send := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/items/1", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	miss := send("")
+	if miss.Code != http.StatusOK || miss.Body.String() != `{"id":1}` {
+		t.Fatalf("miss: unexpected response %d %q", miss.Code, miss.Body.String())
+	}
+	if got := miss.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("miss: expected X-Cache MISS, got %q", got)
+	}
+	etag := miss.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("miss: expected the stored entry's ETag")
+	}
+
+	hit := send("")
+	if hit.Code != http.StatusOK || hit.Body.String() != `{"id":1}` {
+		t.Fatalf("hit: unexpected response %d %q", hit.Code, hit.Body.String())
+	}
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("hit: expected X-Cache HIT, got %q", got)
+	}
+	if got := hit.Header().Get("ETag"); got != etag {
+		t.Errorf("hit: expected ETag %s, got %s", etag, got)
+	}
+	if got := hit.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("hit: expected the upstream Content-Type, got %q", got)
+	}
+	if hit.Header().Get("Date") == "" || hit.Header().Get("Age") == "" {
+		t.Errorf("hit: expected Date and Age headers, got %v", hit.Header())
+	}
+
+	notModified := send(etag)
+	if notModified.Code != http.StatusNotModified || notModified.Body.Len() != 0 {
+		t.Errorf("conditional: expected an empty 304, got %d %q", notModified.Code, notModified.Body.String())
+	}
+
+	if stale := send(`"something-else"`); stale.Code != http.StatusOK || stale.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("conditional with another ETag: expected a full HIT, got %d %q", stale.Code, stale.Header().Get("X-Cache"))
+	}
+
+	if *hits != 1 {
+		t.Errorf("expected only the miss to reach the upstream, got %d requests", *hits)
+	}
+}
+
+func TestCachingFlowPostNotCached(t *testing.T) {
+	p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("created"))
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("POST", "/items", strings.NewReader(`{"name":"x"}`)))
+		if rec.Code != http.StatusOK || rec.Body.String() != "created" {
+			t.Fatalf("post %d: unexpected response %d %q", i, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != "" {
+			t.Errorf("post %d: expected no X-Cache header, got %q", i, got)
+		}
+	}
+	if *hits != 2 {
+		t.Errorf("expected every POST to reach the upstream, got %d requests", *hits)
+	}
+
+	// A POST must not be answered from, or populate, the GET entry
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/items", nil))
+	if got := rec.Header().Get("X-Cache"); got != "MISS" || *hits != 3 {
+		t.Errorf("expected the first GET to miss, got X-Cache %q after %d requests", got, *hits)
+	}
+}
+
+func TestCachingFlowUncacheableResponse(t *testing.T) {
+	p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+		w.Write([]byte("mine"))
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/me", nil))
+		if rec.Body.String() != "mine" || rec.Header().Get("X-Cache") != "" {
+			t.Errorf("request %d: expected an uncached response, got %q with X-Cache %q", i, rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+	if *hits != 2 {
+		t.Errorf("expected both requests to reach the upstream, got %d", *hits)
+	}
+}
+
+func TestCachingFlowSetCookieNotCached(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{"set-cookie", "Set-Cookie", "session=abc; HttpOnly"},
+		{"vary cookie", "Vary", "Cookie"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "public, max-age=60")
+				w.Header().Set(tc.header, tc.value)
+				w.Write([]byte("personal"))
+			})
+
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				p.ServeHTTP(rec, httptest.NewRequest("GET", "/profile", nil))
+				if rec.Body.String() != "personal" || rec.Header().Get("X-Cache") != "" {
+					t.Errorf("request %d: expected an uncached response, got %q with X-Cache %q", i, rec.Body.String(), rec.Header().Get("X-Cache"))
+				}
+				if got := rec.Header().Get(tc.header); got != tc.value {
+					t.Errorf("request %d: expected %s %q, got %q", i, tc.header, tc.value, got)
+				}
+			}
+			if *hits != 2 {
+				t.Errorf("expected both requests to reach the upstream, got %d", *hits)
+			}
+		})
+	}
+}
+
+func TestCachingFlowCacheCookiesOverride(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "region=eu")
+		w.Write([]byte("shared"))
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CacheCookies = true
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: cache.NewMemoryCache(1024*1024, time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/shared", nil))
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("expected X-Cache %s, got %q", want, got)
+		}
+	}
+}
+
+func TestCachingFlowContentTypes(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/logo.png" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Write([]byte("content"))
+	})
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CacheableContentTypes = []string{"application/json", "image/*"}
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for path, want := range map[string][]string{
+		"/logo.png":   {"MISS", "HIT"},
+		"/index.html": {"", ""}, // not cacheable, so no X-Cache
+	} {
+		for _, status := range want {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if got := rec.Header().Get("X-Cache"); got != status {
+				t.Errorf("%s: expected X-Cache %s, got %q", path, status, got)
+			}
+		}
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected only the image to be stored, got %d entries", c.Len())
+	}
+}
+
+func TestCachingFlowVaryStarNotStored(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "*")
+		w.Write([]byte("varies"))
+	})
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CacheCookies = true
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/varies", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "varies" {
+			t.Fatalf("request %d: unexpected response %d %q", i, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Vary"); got != "*" {
+			t.Errorf("request %d: expected Vary to be passed through, got %q", i, got)
+		}
+		if got := rec.Header().Get("X-Cache"); got != "" {
+			t.Errorf("request %d: expected no X-Cache header, got %q", i, got)
+		}
+	}
+	if _, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/varies", nil), nil)); ok {
+		t.Error("expected the Vary: * response not to be stored")
+	}
+}
+
+func TestCachingFlowRefresh(t *testing.T) {
+	version := 0
+	var queries []string
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		version++
+		queries = append(queries, r.URL.RawQuery)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "v%d", version)
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.RefreshQueryParam = "nocache"
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: cache.NewMemoryCache(1024*1024, time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	send := func(target, cacheControl string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		name, target, cacheControl string
+		body, xCache               string
+	}{
+		{"miss", "/items?page=2", "", "v1", "MISS"},
+		{"hit", "/items?page=2", "", "v1", "HIT"},
+		{"client no-cache", "/items?page=2", "no-cache", "v2", "MISS"},
+		{"hit after no-cache", "/items?page=2", "", "v2", "HIT"},
+		{"query flag", "/items?nocache=1&page=2", "", "v3", "MISS"},
+		{"hit after query flag", "/items?page=2", "", "v3", "HIT"},
+		{"query flag off", "/items?page=2&nocache=0", "", "v3", "HIT"},
+	} {
+		rec := send(tc.target, tc.cacheControl)
+		if rec.Body.String() != tc.body || rec.Header().Get("X-Cache") != tc.xCache {
+			t.Errorf("%s: expected %s with X-Cache %s, got %q with %q", tc.name, tc.body, tc.xCache, rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+	for _, q := range queries {
+		if q != "page=2" {
+			t.Errorf("expected the refresh parameter not to reach the upstream, got query %q", q)
+		}
+	}
+}
+
+// countingCache counts lookups on the wrapped cache
+type countingCache struct {
+	cache.Cache
+	gets atomic.Int64
+}
+
+func (c *countingCache) Get(key string) (*cache.Entry, bool) {
+	c.gets.Add(1)
+	return c.Cache.Get(key)
+}
+
+func TestCacheLookedUpOncePerRequest(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+
+	c := &countingCache{Cache: cache.NewMemoryCache(1024*1024, time.Minute)}
+	p, err := New(newTestConfig(t, up.URL), Deps{Logger: log.NewNopLogger(), Cache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	send := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/once", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	etag := send("").Header().Get("ETag")
+	for _, tc := range []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"hit", "", http.StatusOK},
+		{"matching conditional", etag, http.StatusNotModified},
+		{"other conditional", `"other"`, http.StatusOK},
+	} {
+		before := c.gets.Load()
+		if rec := send(tc.ifNoneMatch); rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		if n := c.gets.Load() - before; n != 1 {
+			t.Errorf("%s: expected 1 cache lookup, got %d", tc.name, n)
+		}
+	}
+}
+
+func TestCachingFlowChunkedContentLength(t *testing.T) {
+	p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		switch r.URL.Path {
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "br")
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+		// Flushing before the body is complete makes the response chunked
+		w.Write([]byte(strings.Repeat("a", 100)))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(strings.Repeat("b", 50)))
+	})
+
+	for _, path := range []string{"/plain", "/encoded", "/missing"} {
+		for _, want := range []string{"MISS", "HIT"} {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if got := rec.Header().Get("X-Cache"); got != want {
+				t.Errorf("%s: expected X-Cache %q, got %q", path, want, got)
+			}
+			if rec.Body.Len() != 150 {
+				t.Errorf("%s %s: expected a 150 byte body, got %d", path, want, rec.Body.Len())
+			}
+			if want == "HIT" {
+				if got := rec.Header().Get("Content-Length"); got != "150" {
+					t.Errorf("%s: expected Content-Length 150 on replay, got %q", path, got)
+				}
+			}
+		}
+	}
+	if *hits != 3 {
+		t.Errorf("expected one upstream request per path, got %d", *hits)
+	}
+
+	// HEAD is answered from the GET entry with the same length
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("HEAD", "/missing", nil))
+	if got := rec.Header().Get("Content-Length"); got != "150" || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: expected Content-Length 150 and no body, got %q and %d bytes", got, rec.Body.Len())
+	}
+}
+
+func TestCachingFlowChunkedOverMaxSize(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		for i := 0; i < 4; i++ {
+			w.Write([]byte(strings.Repeat("x", 1024)))
+			w.(http.Flusher).Flush()
+		}
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.MaxSize = 2048
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: cache.NewMemoryCache(cfg.Cache.MaxSize, time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/large", nil))
+		if rec.Body.Len() != 4096 {
+			t.Errorf("request %d: expected the full 4096 byte body, got %d", i+1, rec.Body.Len())
+		}
+		if got := rec.Header().Get("X-Cache"); got != "" {
+			t.Errorf("request %d: expected a body over the cache size to stay uncached, got X-Cache %q", i+1, got)
+		}
+	}
+	if hits != 2 {
+		t.Errorf("expected both requests to reach the upstream, got %d", hits)
+	}
+}
+
+func TestCachingFlowControlHeader(t *testing.T) {
+	p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bypass":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("X-Proxy-Cache", "bypass")
+		case "/force":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("X-Proxy-Cache", "Force")
+		case "/force-error":
+			w.Header().Set("X-Proxy-Cache", "force")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("body"))
+	})
+
+	for path, want := range map[string][]string{
+		"/bypass":      {"", ""}, // not cacheable, so no X-Cache
+		"/force":       {"MISS", "HIT"},
+		"/force-error": {"", ""}, // errors are never forced into the cache
+	} {
+		before := *hits
+		for i, status := range want {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if got := rec.Header().Get("X-Cache"); got != status {
+				t.Errorf("%s request %d: expected X-Cache %q, got %q", path, i+1, status, got)
+			}
+			if got := rec.Header().Get("X-Proxy-Cache"); got != "" {
+				t.Errorf("%s request %d: control header reached the client: %q", path, i+1, got)
+			}
+		}
+		upstream := 2
+		if want[1] == "HIT" {
+			upstream = 1
+		}
+		if got := *hits - before; got != upstream {
+			t.Errorf("%s: expected %d upstream requests, got %d", path, upstream, got)
+		}
+	}
+}
+
+func TestCachingFlowControlHeaderDisabled(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Proxy-Cache", "bypass")
+		w.Write([]byte("body"))
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.ControlHeader = ""
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: cache.NewMemoryCache(1024*1024, time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("expected X-Cache %q with the control header disabled, got %q", want, got)
+		}
+		if got := rec.Header().Get("X-Proxy-Cache"); got != "bypass" {
+			t.Errorf("expected the header to pass through when disabled, got %q", got)
+		}
+	}
+}
+
+func TestCachingFlowCompressedEntries(t *testing.T) {
+	body := strings.Repeat(`{"id":1,"name":"item"},`, 500)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CompressEntries = true
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	send := func(acceptEncoding, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/items", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("", ""); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != body {
+		t.Fatalf("expected the full body on a miss, got X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	keys, _ := c.(cache.Lister).Keys(0, 1)
+	if len(keys) != 1 || keys[0].OriginalSize != int64(len(body)) || keys[0].Size >= int64(len(body)) {
+		t.Fatalf("expected the entry stored compressed, got %+v", keys)
+	}
+
+	// Clients that accept gzip get the stored bytes
+	rec := send("br, gzip", "")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzipped hit, got X-Cache %q Content-Encoding %q", rec.Header().Get("X-Cache"), rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) || !strings.HasPrefix(rec.Header().Get("ETag"), "W/") {
+		t.Errorf("unexpected Content-Length %q or ETag %q", rec.Header().Get("Content-Length"), rec.Header().Get("ETag"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); string(got) != body {
+		t.Error("expected the gzipped body to decompress to the original")
+	}
+
+	// The others, and ranges, get the original body
+	for _, tc := range []struct{ acceptEncoding, rangeHeader, want string }{
+		{"", "", body},
+		{"gzip;q=0, *", "", body},
+		{"gzip", "bytes=0-9", body[:10]},
+	} {
+		rec := send(tc.acceptEncoding, tc.rangeHeader)
+		if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != tc.want {
+			t.Errorf("Accept-Encoding %q Range %q: expected the decompressed body, got Content-Encoding %q and %d bytes",
+				tc.acceptEncoding, tc.rangeHeader, rec.Header().Get("Content-Encoding"), rec.Body.Len())
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("expected Vary: Accept-Encoding, got %q", rec.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestCachingFlowCoalescesFailingUpstream(t *testing.T) {
+	var hits atomic.Int32
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		// Long enough for the other requests to miss and start waiting
+		time.Sleep(200 * time.Millisecond)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.NegativeStatuses = []int{http.StatusServiceUnavailable}
+	cfg.Cache.NegativeTTL = time.Minute
+	cfg.Cache.CoalesceTimeout = 5 * time.Second
+	p, err := New(cfg, Deps{
+		Logger: log.NewNopLogger(),
+		Cache:  cache.NewMemoryCache(1024*1024, time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/flaky", nil))
+		return rec
+	}
+
+	const clients = 10
+	statuses := make([]int, clients)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = send().Code
+		}()
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("client %d: expected 503, got %d", i, status)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected one upstream attempt for %d concurrent clients, got %d", clients, n)
+	}
+
+	// Within the negative TTL the error keeps being served from the cache
+	if rec := send(); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected cached 503, got %d X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected no upstream attempt within the negative TTL, got %d", n)
+	}
+}
+
+func TestCachingFlowCoalescingRejoinsOnMiss(t *testing.T) {
+	var hits, active, peak atomic.Int32
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		// Never cacheable, so every waiter wakes to a miss
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CoalesceTimeout = 5 * time.Second
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: cache.NewMemoryCache(1024*1024, time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	const clients = 5
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest("GET", "/uncacheable", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected 200, got %d", rec.Code)
+			}
+		})
+	}
+	wg.Wait()
+
+	if n := hits.Load(); n != clients {
+		t.Errorf("expected every client to reach the upstream, got %d requests", n)
+	}
+	// Waiters join again instead of all going upstream together
+	if n := peak.Load(); n != 1 {
+		t.Errorf("expected one upstream request per key at a time, got %d concurrently", n)
+	}
+}
+
+func TestCachingFlowOnlyGETLeadsCoalescing(t *testing.T) {
+	release := make(chan struct{})
+	headArrived := make(chan struct{})
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			close(headArrived)
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	defer close(release)
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CoalesceTimeout = 5 * time.Second
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Cache: cache.NewMemoryCache(1024*1024, time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	go p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/page", nil))
+	<-headArrived
+
+	// The GET must not wait for the HEAD in flight
+	got := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+		got <- rec.Code
+	}()
+	select {
+	case code := <-got:
+		if code != http.StatusOK {
+			t.Errorf("expected 200, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GET waited for a HEAD to lead the miss")
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	p, hits := newCachingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.RequestURI()))
+	})
+
+	warmed, failed := p.WarmCache(context.Background(), []string{"/a", "/b?page=2", "/missing"})
+	if warmed != 2 || failed != 1 {
+		t.Errorf("expected 2 warmed and 1 failed, got %d and %d", warmed, failed)
+	}
+	if *hits != 3 {
+		t.Fatalf("expected 3 upstream requests during warmup, got %d", *hits)
+	}
+
+	for _, path := range []string{"/a", "/b?page=2"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if got := rec.Header().Get("X-Cache"); got != "HIT" || rec.Body.String() != path {
+			t.Errorf("%s: expected a cached %q, got X-Cache %q and %q", path, path, got, rec.Body.String())
+		}
+	}
+	if *hits != 3 {
+		t.Errorf("expected warmed paths to be served from cache, upstream got %d requests", *hits)
+	}
+}
+
+func TestWarmCacheWaitsForRateLimit(t *testing.T) {
+	var hits atomic.Int32
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	cfg := newTestConfig(t, up.URL)
+	p, err := New(cfg, Deps{
+		Logger:       log.NewNopLogger(),
+		Cache:        cache.NewMemoryCache(1024*1024, time.Minute),
+		Limiter:      ratelimit.NewTokenBucket(1, 1),
+		KeyExtractor: ratelimit.IPKeyExtractor,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	start := time.Now()
+	warmed, failed := p.WarmCache(context.Background(), []string{"/a", "/b"})
+	if warmed != 2 || failed != 0 || hits.Load() != 2 {
+		t.Errorf("expected both paths warmed, got %d warmed, %d failed, %d upstream requests", warmed, failed, hits.Load())
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("expected warmup to wait for the rate limiter, took %v", elapsed)
+	}
+
+	// Canceled warmups count the remaining paths as failed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if warmed, failed := p.WarmCache(ctx, []string{"/c", "/d"}); warmed != 0 || failed != 2 {
+		t.Errorf("expected a canceled warmup to fail both paths, got %d warmed and %d failed", warmed, failed)
+	}
+}
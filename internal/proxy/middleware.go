@@ -0,0 +1,678 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/cors"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/mirror"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+	"github.com/mumumio1/wproxy/internal/route"
+	"github.com/mumumio1/wproxy/internal/tenant"
+)
+
+// requestIDMiddleware adds a unique request ID to each request
+func requestIDMiddleware(next http.Handler, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+
+		ctx := context.WithValue(r.Context(), log.RequestIDKey, requestID)
+		ctx = log.NewContext(ctx, logger.WithContext(ctx).With(
+			log.String("method", r.Method),
+			log.String("path", r.URL.Path),
+		))
+		w.Header().Set("X-Request-ID", requestID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceContextMiddleware stores the trace ID from a W3C traceparent header
+// in the request context, linking metrics to the caller's trace
+func traceContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if traceID := parseTraceparent(r.Header.Get("traceparent")); traceID != "" {
+			r = r.WithContext(context.WithValue(r.Context(), log.TraceIDKey, traceID))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseTraceparent returns the trace ID of a traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or "" if it is malformed
+func parseTraceparent(header string) string {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ""
+	}
+	traceID := strings.ToLower(parts[1])
+	if _, err := hex.DecodeString(traceID); err != nil || traceID == strings.Repeat("0", 32) {
+		return ""
+	}
+	return traceID
+}
+
+// loggingMiddleware writes an access log line per request. Successful
+// requests are logged with probability sampleRate; errors and requests
+// slower than slowThreshold are always logged, and slow requests also get
+// a warning. Requests matching exclude are never logged.
+func loggingMiddleware(next http.Handler, logger log.Logger, sampleRate float64, slowThreshold time.Duration, exclude *accessLogExclusion) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Wrap response writer to capture status code
+		ww := &wrappedWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		outcome := &requestOutcome{}
+		reqLogger := log.FromContext(r.Context(), logger)
+		logWriteErr := func() {
+			if ww.writeErr != nil {
+				reqLogger.Debug("Client write failed",
+					log.Int64("bytes_written", ww.bytesWritten),
+					log.Error(ww.writeErr),
+				)
+			}
+		}
+		defer onAbort(logWriteErr)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), outcomeContextKey{}, outcome)))
+
+		duration := time.Since(start)
+		logWriteErr()
+		if slowThreshold > 0 && duration >= slowThreshold {
+			reqLogger.Warn("Slow request",
+				log.Duration("duration", duration),
+				log.Duration("threshold", slowThreshold),
+			)
+		}
+		if exclude.matches(ww.statusCode, r.URL.Path) || !shouldLogRequest(ww.statusCode, duration, sampleRate, slowThreshold) {
+			return
+		}
+
+		fields := []log.Field{
+			log.String("remote_addr", r.RemoteAddr),
+			log.Int("status", ww.statusCode),
+			log.Duration("duration", duration),
+		}
+		if id := tenant.FromContext(r.Context()); id != "" {
+			fields = append(fields, log.String("tenant", id))
+		}
+		if outcome.cacheStatus != "" {
+			fields = append(fields, log.String("cache_status", outcome.cacheStatus))
+		}
+		if outcome.upstreamHost != "" {
+			fields = append(fields,
+				log.String("upstream_host", outcome.upstreamHost),
+				log.Duration("upstream_duration", outcome.upstreamDuration),
+			)
+		}
+		if sampleRate < 1 {
+			fields = append(fields, log.Float64("sample_rate", sampleRate))
+		}
+
+		reqLogger.Info("HTTP request", fields...)
+	})
+}
+
+// accessLogExclusion selects the requests left out of the access log. A
+// nil exclusion matches nothing.
+type accessLogExclusion struct {
+	statuses map[int]bool
+	paths    []string
+}
+
+// newAccessLogExclusion creates the exclusion from configuration, or
+// returns nil when nothing is excluded
+func newAccessLogExclusion(cfg config.LoggingConfig) *accessLogExclusion {
+	if len(cfg.ExcludeStatuses) == 0 && len(cfg.ExcludePaths) == 0 {
+		return nil
+	}
+	e := &accessLogExclusion{statuses: make(map[int]bool, len(cfg.ExcludeStatuses)), paths: cfg.ExcludePaths}
+	for _, status := range cfg.ExcludeStatuses {
+		e.statuses[status] = true
+	}
+	return e
+}
+
+// matches reports whether a request is left out of the access log
+func (e *accessLogExclusion) matches(status int, path string) bool {
+	if e == nil {
+		return false
+	}
+	if e.statuses[status] {
+		return true
+	}
+	for _, prefix := range e.paths {
+		if route.HasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldLogRequest makes the per-request access log sampling decision
+func shouldLogRequest(status int, duration time.Duration, sampleRate float64, slowThreshold time.Duration) bool {
+	if status >= 400 || (slowThreshold > 0 && duration >= slowThreshold) {
+		return true
+	}
+	return sampleRate >= 1 || rand.Float64() < sampleRate
+}
+
+// corsMiddleware short-circuits CORS preflight requests
+func corsMiddleware(next http.Handler, policy *cors.Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cors.IsPreflight(r) {
+			policy.HandlePreflight(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyMiddleware holds a limiter slot while a request is forwarded
+// upstream, counting held slots in the in-flight gauge. Requests over the
+// cap wait up to queueTimeout for a slot and are then rejected with a 503,
+// which is never cached.
+func concurrencyMiddleware(next http.Handler, limiter *ratelimit.ConcurrencyLimiter, queueTimeout time.Duration, m metrics.Recorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.TryAcquire() {
+			acquired := false
+			if queueTimeout > 0 {
+				if m != nil {
+					m.RecordConcurrencyLimit("queued")
+				}
+				ctx, cancel := context.WithTimeout(r.Context(), queueTimeout)
+				acquired = limiter.Acquire(ctx) == nil
+				cancel()
+			}
+			if !acquired {
+				if m != nil {
+					m.RecordConcurrencyLimit("rejected")
+				}
+				if outcome := outcomeFromContext(r.Context()); outcome != nil {
+					outcome.uncacheable = true
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, `{"error":"too many concurrent requests"}`)
+				return
+			}
+		}
+		defer limiter.Release()
+
+		if m != nil {
+			m.IncInFlightRequests()
+			defer m.DecInFlightRequests()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mirrorMiddleware replays a sample of requests to the shadow upstream.
+// The body is buffered up front so both upstreams receive it.
+func mirrorMiddleware(next http.Handler, mir *mirror.Mirror) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mir.Sampled() {
+			if body, ok := mir.Capture(r); ok {
+				mir.Send(r, body)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasTrafficSplit reports whether any route splits traffic between variants
+func hasTrafficSplit(cfg *config.Config) bool {
+	for _, r := range cfg.Routes {
+		if len(r.Split) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMiddleware assigns requests on split routes to an upstream variant,
+// sticky by the route's bucket key, and exposes it in X-Variant
+func splitMiddleware(next http.Handler, cfg *config.Config, m metrics.Recorder) http.Handler {
+	routes := route.NewTable(routeConfigs(cfg))
+	// Already validated when the config was loaded
+	trusted, _ := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := routes.Match(r.URL.Path)
+		if rt == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v := rt.Variant(splitKey(r, rt.SplitBy, trusted))
+		if v == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-Variant", v.Name)
+		r = r.WithContext(context.WithValue(r.Context(), variantContextKey{}, v))
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ww := &wrappedWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(ww, r)
+		m.RecordVariantRequest(rt.PathPrefix, v.Name, ww.statusCode)
+	})
+}
+
+// splitKey returns the bucket key for a split route: a header, a cookie,
+// or the client IP by default
+func splitKey(r *http.Request, splitBy string, trusted ratelimit.TrustedProxies) string {
+	if name, ok := strings.CutPrefix(splitBy, "header:"); ok {
+		return r.Header.Get(name)
+	}
+	if name, ok := strings.CutPrefix(splitBy, "cookie:"); ok {
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	return ratelimit.ClientIP(r, trusted)
+}
+
+// requestBodyLimitMiddleware rejects request bodies larger than limit with 413
+func requestBodyLimitMiddleware(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// optionsMiddleware answers OPTIONS requests locally with the allowed methods
+func optionsMiddleware(next http.Handler, allowedMethods []string) http.Handler {
+	allow := strings.Join(allowedMethods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// tenantMiddleware resolves the tenant and stores it in the request context
+func tenantMiddleware(next http.Handler, resolver *tenant.Resolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := resolver.Resolve(r); id != "" {
+			r = r.WithContext(tenant.NewContext(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// flagsMiddleware honors the flags header from allowed sources and strips
+// it from every request so it never reaches the upstream
+func flagsMiddleware(next http.Handler, cfg *config.Config) http.Handler {
+	// Already validated when the config was loaded
+	trusted, _ := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	allowed, _ := ratelimit.ParseTrustedProxies(cfg.Flags.AllowedSources)
+	header := cfg.Flags.Header
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.Header.Values(header)
+		if len(values) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Del(header)
+
+		if ip := net.ParseIP(ratelimit.ClientIP(r, trusted)); ip == nil || !allowed.Contains(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var flags requestFlags
+		for _, flag := range strings.Split(strings.Join(values, ","), ",") {
+			switch strings.ToLower(strings.TrimSpace(flag)) {
+			case "nocache":
+				flags.noCache = true
+			case "nolimit":
+				flags.noLimit = true
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), flagsContextKey{}, flags)))
+	})
+}
+
+// tenantKeyExtractor prefixes rate limit keys with the request's tenant
+// when it is one of allowed. Tenants come from the request unverified, so
+// scoping by any tenant would let a client pick a fresh budget for each
+// request.
+func tenantKeyExtractor(next ratelimit.KeyExtractor, allowed []string) ratelimit.KeyExtractor {
+	scoped := make(map[string]bool, len(allowed))
+	for _, id := range allowed {
+		scoped[id] = true
+	}
+	return func(r *http.Request) string {
+		key := next(r)
+		if id := tenant.FromContext(r.Context()); scoped[id] {
+			key = "tenant:" + id + ":" + key
+		}
+		return key
+	}
+}
+
+// metricsMiddleware records request metrics
+func metricsMiddleware(next http.Handler, m metrics.Recorder, resolver *tenant.Resolver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		m.IncActiveConnections()
+		defer m.DecActiveConnections()
+		m.IncRequestsInFlight(r.Method)
+		defer m.DecRequestsInFlight(r.Method)
+
+		ww := &wrappedWriter{ResponseWriter: w, statusCode: http.StatusOK, m: m}
+
+		record := func() {
+			duration := time.Since(start)
+
+			// Get request/response sizes
+			requestSize := r.ContentLength
+			if requestSize < 0 {
+				requestSize = 0
+			}
+
+			responseSize := ww.bytesWritten
+			traceID, _ := r.Context().Value(log.TraceIDKey).(string)
+			if ww.writeErr != nil {
+				m.RecordClientWriteError()
+			}
+
+			m.RecordRequest(
+				r.Method,
+				r.URL.Path,
+				ww.statusCode,
+				duration,
+				requestSize,
+				responseSize,
+				traceID,
+			)
+
+			if resolver != nil {
+				if label := resolver.MetricLabel(tenant.FromContext(r.Context())); label != "" {
+					m.RecordTenantRequest(label, ww.statusCode)
+				}
+			}
+		}
+		defer onAbort(record)
+
+		next.ServeHTTP(ww, r)
+		record()
+	})
+}
+
+// rateLimitMiddleware applies rate limiting
+func rateLimitMiddleware(
+	next http.Handler,
+	limiter ratelimit.Limiter,
+	keyExtractor ratelimit.KeyExtractor,
+	m metrics.Recorder,
+	logger log.Logger,
+	jitter time.Duration,
+	maxWait time.Duration,
+	exempt func(*http.Request) bool,
+	resp *rateLimitResponse,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Checked before the key is extracted so exempt clients never
+		// get a bucket
+		if flagsFromContext(r.Context()).noLimit || (exempt != nil && exempt(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := keyExtractor(r)
+
+		allowed := limiter.Allow(key)
+		if !allowed && maxWait > 0 {
+			// Hold the request until a token frees up, within maxWait
+			ctx, cancel := context.WithTimeout(r.Context(), maxWait)
+			allowed = limiter.WaitCtx(ctx, key) == nil
+			cancel()
+			if r.Context().Err() != nil {
+				// The client gave up while waiting
+				return
+			}
+		}
+
+		if reporter, ok := limiter.(ratelimit.QuotaReporter); ok {
+			setQuotaHeaders(w, reporter, key)
+		}
+
+		if !allowed {
+			if m != nil {
+				m.RecordRateLimitDrop()
+			}
+
+			log.FromContext(r.Context(), logger).Warn("Rate limit exceeded",
+				log.String("key", key),
+			)
+
+			resp.write(w, retryAfter(limiter.Wait(key), jitter))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// defaultRateLimitBody is sent with a 429 when no body is configured
+const defaultRateLimitBody = `{"error":"rate limit exceeded"}`
+
+// rateLimitResponse writes the 429 sent to limited clients. A nil
+// response sends the default JSON body.
+type rateLimitResponse struct {
+	contentType    string
+	body           *template.Template
+	retryAfterDate bool
+}
+
+// newRateLimitResponse creates the 429 response from configuration
+func newRateLimitResponse(cfg config.RateLimitResponseConfig) *rateLimitResponse {
+	// Already validated when the config was loaded
+	body, _ := template.New("ratelimit").Parse(cfg.Body)
+	return &rateLimitResponse{
+		contentType:    cfg.ContentType,
+		body:           body,
+		retryAfterDate: cfg.RetryAfterDate,
+	}
+}
+
+// write sends the 429. Retry-After is rounded up to whole seconds, so a
+// sub-second wait is never advertised as 0.
+func (resp *rateLimitResponse) write(w http.ResponseWriter, wait time.Duration) {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+
+	contentType, body := "application/json", []byte(defaultRateLimitBody)
+	if resp != nil && resp.body != nil {
+		var buf bytes.Buffer
+		if err := resp.body.Execute(&buf, struct{ RetryAfter int }{seconds}); err == nil {
+			contentType, body = resp.contentType, buf.Bytes()
+		}
+	}
+
+	if resp != nil && resp.retryAfterDate {
+		w.Header().Set("Retry-After", time.Now().Add(time.Duration(seconds)*time.Second).UTC().Format(http.TimeFormat))
+	} else {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(body)
+}
+
+// rateLimitExemption returns a matcher for requests that skip the rate
+// limiter, or nil when nothing is exempt
+func rateLimitExemption(cfg *config.Config) func(*http.Request) bool {
+	exempt := cfg.RateLimit.Exempt
+	if len(exempt.IPs) == 0 && len(exempt.APIKeys) == 0 && len(exempt.PathPrefixes) == 0 {
+		return nil
+	}
+
+	// Already validated when the config was loaded
+	trusted, _ := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	ips, _ := ratelimit.ParseTrustedProxies(exempt.IPs)
+	header := cfg.RateLimit.APIKeyHeader
+
+	return func(r *http.Request) bool {
+		for _, prefix := range exempt.PathPrefixes {
+			if route.HasPathPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		}
+		if key := r.Header.Get(header); key != "" && slices.Contains(exempt.APIKeys, key) {
+			return true
+		}
+		if len(ips) > 0 {
+			if ip := net.ParseIP(ratelimit.ClientIP(r, trusted)); ip != nil && ips.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// setQuotaHeaders reports the client's quota in X-RateLimit-* headers
+func setQuotaHeaders(w http.ResponseWriter, reporter ratelimit.QuotaReporter, key string) {
+	limit, remaining, reset := reporter.Quota(key)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+// retryAfter adds a random jitter in [0, jitter) to the wait time
+func retryAfter(wait, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return wait
+	}
+	return wait + rand.N(jitter)
+}
+
+// onAbort calls fn when the handler panics with http.ErrAbortHandler, as
+// the reverse proxy does when copying a response to the client fails, and
+// then lets the panic continue. It must be deferred.
+func onAbort(fn func()) {
+	if err := recover(); err != nil {
+		if err == http.ErrAbortHandler {
+			fn()
+		}
+		panic(err)
+	}
+}
+
+// wrappedWriter wraps http.ResponseWriter to capture status code and bytes
+// written. Flush, Hijack and Push are passed through so streaming and
+// protocol upgrades survive the middleware chain.
+type wrappedWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+	written      bool
+	// writeErr is the first error writing the body to the client
+	writeErr error
+
+	// m counts failed hijacks; set on one wrapper in the chain only so a
+	// failure is not counted once per wrapper
+	m metrics.Recorder
+}
+
+func (ww *wrappedWriter) WriteHeader(code int) {
+	// Interim responses such as 100 Continue precede the real status
+	if isInformational(code) {
+		ww.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !ww.written {
+		ww.statusCode = code
+		ww.ResponseWriter.WriteHeader(code)
+		ww.written = true
+	}
+}
+
+func (ww *wrappedWriter) Write(b []byte) (int, error) {
+	if !ww.written {
+		ww.WriteHeader(http.StatusOK)
+	}
+	n, err := ww.ResponseWriter.Write(b)
+	ww.bytesWritten += int64(n)
+	if err != nil && ww.writeErr == nil {
+		ww.writeErr = err
+	}
+	return n, err
+}
+
+func (ww *wrappedWriter) Flush() {
+	if !ww.written {
+		ww.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(ww.ResponseWriter).Flush()
+}
+
+func (ww *wrappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(ww.ResponseWriter).Hijack()
+	if err != nil && ww.m != nil {
+		ww.m.RecordHijackFailure()
+	}
+	return conn, rw, err
+}
+
+func (ww *wrappedWriter) Push(target string, opts *http.PushOptions) error {
+	return push(ww.ResponseWriter, target, opts)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (ww *wrappedWriter) Unwrap() http.ResponseWriter {
+	return ww.ResponseWriter
+}
+
+// isInformational reports whether code is a 1xx interim response. 101
+// Switching Protocols is final: nothing follows it over HTTP.
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// push forwards an HTTP/2 server push to w when it supports it
+func push(w http.ResponseWriter, target string, opts *http.PushOptions) error {
+	if p, ok := w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
@@ -0,0 +1,461 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/cors"
+	"github.com/mumumio1/wproxy/internal/errorpage"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/mirror"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+	"github.com/mumumio1/wproxy/internal/route"
+	"github.com/mumumio1/wproxy/internal/tenant"
+	"github.com/mumumio1/wproxy/internal/upstream"
+)
+
+// Deps are the shared components a Proxy is built around. Nil fields
+// disable the corresponding feature; Logger is required.
+type Deps struct {
+	Logger       log.Logger
+	Metrics      metrics.Recorder
+	Cache        cache.Cache
+	Limiter      ratelimit.Limiter
+	KeyExtractor ratelimit.KeyExtractor
+	Resolver     *tenant.Resolver
+	Lifecycle    *Lifecycle
+	// Version is the build reported by /admin/healthz
+	Version string
+	// MetricsHandler serves scrapes at metrics.path on the main port when
+	// metrics.same_port is set, and is required then
+	MetricsHandler http.Handler
+}
+
+// Proxy is the complete request handling chain in front of the upstream
+// pools: middleware, caching and the reverse proxy itself
+type Proxy struct {
+	handler  http.Handler
+	pool     *upstream.Pool
+	variants *upstream.Pool
+	routes   *routePools
+	// splits are the traffic splits the proxy was created with, keyed by
+	// route path prefix, since reloads cannot change them
+	splits map[string]trafficSplit
+	mirror *mirror.Mirror
+	logger log.Logger
+}
+
+// New builds the upstream pools, traffic mirror and middleware chain
+// described by cfg
+func New(cfg *config.Config, deps Deps) (*Proxy, error) {
+	pool, err := upstream.NewPool(upstreamBackends(cfg), upstream.Strategy(cfg.Upstream.Strategy))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream configuration: %w", err)
+	}
+
+	samePortMetrics := cfg.Metrics.Enabled && cfg.Metrics.SamePort
+	if samePortMetrics && deps.MetricsHandler == nil {
+		return nil, fmt.Errorf("invalid metrics configuration: same_port requires a metrics handler")
+	}
+
+	pages, err := errorpage.New(errorPageConfig(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("invalid error page configuration: %w", err)
+	}
+
+	// Traffic split variants get a pool of their own
+	variants, err := newVariantPool(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid traffic split configuration: %w", err)
+	}
+
+	// Routes with their own transport settings get pools of their own
+	routes, err := newRoutePools(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route configuration: %w", err)
+	}
+
+	var mir *mirror.Mirror
+	if cfg.Mirror.Enabled {
+		mir, err = newMirror(cfg, deps.Metrics)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror configuration: %w", err)
+		}
+	}
+
+	proxy := newReverseProxy(cfg, pool, variants, routes, pages, deps.Metrics, deps.Logger)
+	handler := createProxyHandler(proxy, cfg, deps.Logger, deps.Metrics, deps.Cache,
+		deps.Limiter, deps.KeyExtractor, deps.Resolver, mir, deps.Lifecycle, deps.Version)
+
+	// Metrics served on the main port skip the whole chain, so scrapes are
+	// never proxied, rate limited or counted as traffic
+	if samePortMetrics {
+		outer := http.NewServeMux()
+		outer.Handle(cfg.Metrics.Path, deps.MetricsHandler)
+		outer.Handle("/", handler)
+		handler = outer
+	}
+
+	return &Proxy{
+		handler:  handler,
+		pool:     pool,
+		variants: variants,
+		routes:   routes,
+		splits:   trafficSplits(cfg),
+		mirror:   mir,
+		logger:   deps.Logger,
+	}, nil
+}
+
+// ServeHTTP handles a client request
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// Backends returns the primary upstream backends
+func (p *Proxy) Backends() []*upstream.Backend {
+	return p.pool.Backends()
+}
+
+// UpdateUpstream points the proxy at the upstream backends of cfg, e.g.
+// after the config files are reloaded. New requests go to the new
+// backends while those in flight complete, and the connections to split
+// variants take the new transport settings. Traffic splits themselves
+// cannot change without a restart, so a config that changes them is
+// rejected. Other settings keep the values the proxy was created with. A
+// failed update changes nothing.
+func (p *Proxy) UpdateUpstream(cfg *config.Config) error {
+	if !maps.EqualFunc(p.splits, trafficSplits(cfg), trafficSplit.equal) {
+		return fmt.Errorf("invalid upstream configuration: changing a traffic split requires a restart")
+	}
+	updates := make([]*upstream.PendingUpdate, 0, 2)
+	main, err := p.pool.Prepare(upstreamBackends(cfg))
+	if err != nil {
+		return fmt.Errorf("invalid upstream configuration: %w", err)
+	}
+	updates = append(updates, main)
+	if p.variants != nil {
+		variants, err := p.variants.Prepare(variantBackends(cfg))
+		if err != nil {
+			return fmt.Errorf("invalid traffic split configuration: %w", err)
+		}
+		updates = append(updates, variants)
+	}
+	routes, err := p.routes.prepare(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid upstream configuration: %w", err)
+	}
+	for _, u := range append(updates, routes...) {
+		u.Apply()
+	}
+	return nil
+}
+
+// trafficSplit is how a route shares its traffic between variants
+type trafficSplit struct {
+	variants []config.VariantConfig
+	by       string
+}
+
+func (s trafficSplit) equal(other trafficSplit) bool {
+	return s.by == other.by && slices.Equal(s.variants, other.variants)
+}
+
+// trafficSplits returns the split of each route that has one, keyed by
+// path prefix
+func trafficSplits(cfg *config.Config) map[string]trafficSplit {
+	splits := make(map[string]trafficSplit)
+	for _, r := range cfg.Routes {
+		if len(r.Split) > 0 {
+			splits[r.PathPrefix] = trafficSplit{variants: r.Split, by: r.SplitBy}
+		}
+	}
+	return splits
+}
+
+// Close stops the traffic mirror and closes idle upstream connections
+func (p *Proxy) Close() {
+	if p.mirror != nil {
+		p.mirror.Close()
+	}
+	p.pool.CloseIdleConnections()
+	if p.variants != nil {
+		p.variants.CloseIdleConnections()
+	}
+	p.routes.CloseIdleConnections()
+}
+
+// Lifecycle tracks readiness and in-flight requests for graceful draining
+type Lifecycle struct {
+	draining     atomic.Bool
+	shuttingDown atomic.Bool
+	inFlight     atomic.Int64
+}
+
+// StartDrain marks the server as draining so /ready reports unavailable.
+// Requests are still served while load balancers catch up.
+func (lc *Lifecycle) StartDrain() {
+	lc.draining.Store(true)
+}
+
+// StartShutdown marks the end of the drain: new requests are refused
+// while those in flight complete
+func (lc *Lifecycle) StartShutdown() {
+	lc.draining.Store(true)
+	lc.shuttingDown.Store(true)
+}
+
+// ShuttingDown reports whether new requests are being refused
+func (lc *Lifecycle) ShuttingDown() bool {
+	return lc.shuttingDown.Load()
+}
+
+// Draining reports whether the server is draining
+func (lc *Lifecycle) Draining() bool {
+	return lc.draining.Load()
+}
+
+// InFlight returns the number of requests currently being served
+func (lc *Lifecycle) InFlight() int64 {
+	return lc.inFlight.Load()
+}
+
+// requestOutcome records what happened to a request while it was proxied
+type requestOutcome struct {
+	truncated   bool // upstream body was cut off by the response size limit
+	uncacheable bool // upstream headers ruled out caching
+	// cacheDirective is the backend's cache control header value, lower
+	// cased: bypass, force or empty
+	cacheDirective string
+
+	// Reported in the access log
+	cacheStatus      string // hit, miss, revalidated, refresh or bypass; empty when caching is off
+	upstreamHost     string
+	upstreamDuration time.Duration
+}
+
+type outcomeContextKey struct{}
+
+// bodyKeyContextKey holds the hash of a request body that is part of the
+// request's cache key
+type bodyKeyContextKey struct{}
+
+type variantContextKey struct{}
+
+// requestFlags are per-request feature flags sent by a trusted source
+type requestFlags struct {
+	noCache bool // bypass cache lookup and storage
+	noLimit bool // bypass rate limiting
+}
+
+type flagsContextKey struct{}
+
+// flagsFromContext returns the request's flags, all off when none were set
+func flagsFromContext(ctx context.Context) requestFlags {
+	flags, _ := ctx.Value(flagsContextKey{}).(requestFlags)
+	return flags
+}
+
+// variantFromContext returns the traffic split variant chosen for a request
+func variantFromContext(ctx context.Context) *route.Variant {
+	v, _ := ctx.Value(variantContextKey{}).(*route.Variant)
+	return v
+}
+
+// outcomeFromContext returns the request outcome stored in the context
+func outcomeFromContext(ctx context.Context) *requestOutcome {
+	outcome, _ := ctx.Value(outcomeContextKey{}).(*requestOutcome)
+	return outcome
+}
+
+// writeJSONError writes a JSON error response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":%q}`, message)
+}
+
+// corsPolicy builds the CORS policy, or returns nil when CORS is disabled
+func corsPolicy(cfg *config.Config) *cors.Policy {
+	if !cfg.CORS.Enabled {
+		return nil
+	}
+	return cors.New(cors.Config{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   cfg.CORS.AllowedMethods,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		ExposedHeaders:   cfg.CORS.ExposedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		MaxAge:           cfg.CORS.MaxAge,
+	})
+}
+
+// createProxyHandler creates the main HTTP handler with all middleware
+func createProxyHandler(
+	proxy *httputil.ReverseProxy,
+	cfg *config.Config,
+	logger log.Logger,
+	m metrics.Recorder,
+	c cache.Cache,
+	limiter ratelimit.Limiter,
+	keyExtractor ratelimit.KeyExtractor,
+	resolver *tenant.Resolver,
+	mir *mirror.Mirror,
+	lc *Lifecycle,
+	version string,
+) http.Handler {
+	mux := http.NewServeMux()
+	pool := upstreamPool(proxy.Transport)
+
+	// Health check endpoint
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"status":"healthy"}`)
+	})
+
+	var bodies *cache.DiskStore
+	if cfg.Cache.DiskDir != "" {
+		bodies = cache.NewDiskStore(cfg.Cache.DiskDir, cfg.Cache.DiskThreshold)
+	}
+
+	// Readiness check endpoint
+	mux.HandleFunc("/ready", readyHandler(cfg, pool, c, bodies, lc))
+
+	// Proxy handler
+	policy := corsPolicy(cfg)
+	headerFilter := cache.NewHeaderFilter(cfg.Cache.ExcludeHeaders)
+	queryFilter := cache.NewQueryFilter(cfg.Cache.IgnoreQueryParams, cfg.Cache.OnlyQueryParams, cfg.Cache.IgnoreQuery)
+	misses := newMissGroup(cfg.Cache.CoalesceTimeout)
+
+	// Cap the requests in flight to protect fragile backends. Only those
+	// forwarded upstream take a slot; cache hits are served regardless.
+	var upstreamHandler http.Handler = proxy
+	if cfg.Concurrency.Enabled {
+		slots := ratelimit.NewConcurrencyLimiter(cfg.Concurrency.MaxInFlight)
+		upstreamHandler = concurrencyMiddleware(proxy, slots, cfg.Concurrency.QueueTimeout, m)
+	}
+
+	var proxyHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleProxy(w, r, upstreamHandler, cfg, m, c, policy, headerFilter, queryFilter, bodies, misses)
+	})
+
+	// Mirror sampled requests that get past rate limiting and the other
+	// middleware, cache hits included, so the shadow sees what clients send
+	if mir != nil {
+		proxyHandler = mirrorMiddleware(proxyHandler, mir)
+	}
+
+	// Variants are chosen before the cache lookup so each has its own entries
+	if hasTrafficSplit(cfg) {
+		proxyHandler = splitMiddleware(proxyHandler, cfg, m)
+	}
+
+	if limit := cfg.Server.MaxRequestBodySize; limit > 0 {
+		proxyHandler = requestBodyLimitMiddleware(proxyHandler, limit)
+	}
+
+	if cfg.Server.AnswerOptions {
+		proxyHandler = optionsMiddleware(proxyHandler, cfg.Server.AllowedMethods)
+	}
+
+	// CORS preflights are answered before reaching the upstream
+	if policy != nil {
+		proxyHandler = corsMiddleware(proxyHandler, policy)
+	}
+
+	// Maintenance mode applies to proxied traffic only
+	maint := newMaintenance(cfg.Maintenance)
+	proxyHandler = maintenanceMiddleware(proxyHandler, maint)
+
+	mux.Handle("/", proxyHandler)
+
+	// Admin endpoints
+	if cfg.Admin.Enabled {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/admin/maintenance", maintenanceHandler(maint, logger))
+		admin.HandleFunc("/admin/config", configHandler(cfg))
+		admin.HandleFunc("/admin/cache/keys", cacheKeysHandler(c))
+		admin.HandleFunc("/admin/ratelimit", rateLimitResetHandler(limiter, logger))
+		admin.HandleFunc("/admin/healthz", healthzHandler(cfg, pool, c, limiter, version))
+		mux.Handle("/admin/", adminAuthMiddleware(admin, cfg.Admin.Token))
+	}
+
+	// Apply middleware chain
+	var handler http.Handler = mux
+
+	// Logging middleware
+	handler = loggingMiddleware(handler, logger, cfg.Logging.SampleRate, cfg.Logging.SlowThreshold, newAccessLogExclusion(cfg.Logging))
+
+	// Metrics middleware
+	if m != nil {
+		handler = metricsMiddleware(handler, m, resolver)
+		handler = traceContextMiddleware(handler)
+	}
+
+	// Rate limiting middleware
+	if limiter != nil {
+		if resolver != nil && len(cfg.Tenant.RateLimitTenants) > 0 {
+			keyExtractor = tenantKeyExtractor(keyExtractor, cfg.Tenant.RateLimitTenants)
+		}
+		handler = rateLimitMiddleware(handler, limiter, keyExtractor, m, logger, cfg.RateLimit.RetryAfterJitter, cfg.RateLimit.MaxWait, rateLimitExemption(cfg), newRateLimitResponse(cfg.RateLimit.Response))
+	}
+
+	// Tenant middleware runs first so every later stage sees the tenant
+	if resolver != nil {
+		handler = tenantMiddleware(handler, resolver)
+	}
+
+	// Flags are resolved before rate limiting so nolimit can bypass it
+	if cfg.Flags.Enabled {
+		handler = flagsMiddleware(handler, cfg)
+	}
+
+	// The request ID and request-scoped logger are set before any stage
+	// that logs
+	handler = requestIDMiddleware(handler, logger)
+
+	// In-flight tracking wraps everything so drain logging sees all requests
+	if lc != nil {
+		handler = inFlightMiddleware(handler, lc)
+		handler = shutdownMiddleware(handler, lc, cfg.Server.ShutdownTimeout)
+	}
+
+	return handler
+}
+
+// shutdownMiddleware refuses requests arriving once shutdown has begun,
+// before the listener stops accepting them, with a 503 that closes the
+// connection. Retry-After covers the time the shutdown may take.
+func shutdownMiddleware(next http.Handler, lc *Lifecycle, shutdownTimeout time.Duration) http.Handler {
+	retryAfter := strconv.Itoa(max(int(math.Ceil(shutdownTimeout.Seconds())), 1))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !lc.ShuttingDown() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", retryAfter)
+		writeJSONError(w, http.StatusServiceUnavailable, "server is shutting down")
+	})
+}
+
+// inFlightMiddleware counts requests currently being served
+func inFlightMiddleware(next http.Handler, lc *Lifecycle) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lc.inFlight.Add(1)
+		defer lc.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
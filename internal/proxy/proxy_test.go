@@ -0,0 +1,3806 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/errorpage"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+	"github.com/mumumio1/wproxy/internal/tenant"
+	"github.com/mumumio1/wproxy/internal/upstream"
+)
+
+// newTestUpstream starts an upstream server using the given handler
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestConfig returns a default configuration pointing at the given upstream
+func newTestConfig(t *testing.T, upstreamURL string) *config.Config {
+	t.Helper()
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Upstream.URL = upstreamURL
+	return cfg
+}
+
+// newTestProxy creates a reverse proxy for the configured upstreams
+func newTestProxy(t *testing.T, cfg *config.Config) *httputil.ReverseProxy {
+	t.Helper()
+	pool, err := upstream.NewPool(upstreamBackends(cfg), upstream.Strategy(cfg.Upstream.Strategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.CloseIdleConnections)
+	pages, err := errorpage.New(errorPageConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants, err := newVariantPool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants != nil {
+		t.Cleanup(variants.CloseIdleConnections)
+	}
+	return newReverseProxy(cfg, pool, variants, nil, pages, nil, log.NewNopLogger())
+}
+
+func TestTenantFlowsIntoCacheKeysAndLogs(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	resolver, err := tenant.NewResolver(tenant.Config{Source: tenant.SourceHeader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewWithCore(core), nil, c, nil, nil, resolver, nil, nil, "")
+
+	for _, id := range []string{"acme", "globex", "acme"} {
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("X-Tenant-ID", id)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if hits != 2 {
+		t.Errorf("expected 2 upstream hits (one per tenant), got %d", hits)
+	}
+	if c.Len() != 2 {
+		t.Errorf("expected 2 cache entries, got %d", c.Len())
+	}
+
+	req := httptest.NewRequest("GET", "/data", nil)
+	key := requestCacheKey(req.WithContext(tenant.NewContext(req.Context(), "acme")), nil)
+	if _, ok := c.Get(key); !ok {
+		t.Errorf("expected entry under tenant-scoped key %s", key)
+	}
+	if _, ok := c.Get(cache.CacheKey(req, nil, nil)); ok {
+		t.Error("expected no entry under the unscoped key")
+	}
+
+	var tenants []interface{}
+	for _, entry := range logs.FilterMessage("HTTP request").All() {
+		tenants = append(tenants, entry.ContextMap()["tenant"])
+	}
+	if len(tenants) != 3 || tenants[0] != "acme" || tenants[1] != "globex" || tenants[2] != "acme" {
+		t.Errorf("unexpected tenant log fields: %v", tenants)
+	}
+}
+
+func TestTenantKeyExtractor(t *testing.T) {
+	extractor := tenantKeyExtractor(func(*http.Request) string { return "1.2.3.4" }, []string{"acme"})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if got := extractor(req); got != "1.2.3.4" {
+		t.Errorf("expected unscoped key, got %q", got)
+	}
+
+	scoped := req.WithContext(tenant.NewContext(req.Context(), "acme"))
+	if got := extractor(scoped); got != "tenant:acme:1.2.3.4" {
+		t.Errorf("expected tenant-scoped key, got %q", got)
+	}
+
+	// Naming an unlisted tenant does not buy a fresh budget
+	other := req.WithContext(tenant.NewContext(req.Context(), "made-up-1"))
+	if got := extractor(other); got != "1.2.3.4" {
+		t.Errorf("expected an unlisted tenant to share the unscoped key, got %q", got)
+	}
+}
+
+func TestTenantRateLimitNotBypassed(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Tenant.Enabled = true
+	resolver, err := tenant.NewResolver(tenant.Config{Source: tenant.SourceHeader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil,
+		limiter, ratelimit.IPKeyExtractor, resolver, nil, nil, "")
+
+	codes := make([]int, 3)
+	for i := range codes {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Tenant-ID", fmt.Sprintf("tenant-%d", i))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		codes[i] = rec.Code
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("expected new tenant names to share the client's budget, got %v", codes)
+	}
+}
+
+func TestOptionsAnsweredLocally(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.AnswerOptions = true
+	cfg.Server.AllowedMethods = []string{"GET", "POST", "OPTIONS"}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/api/items", nil))
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Allow"); got != "GET, POST, OPTIONS" {
+		t.Errorf("unexpected Allow header %q", got)
+	}
+	if hits != 0 {
+		t.Errorf("expected OPTIONS not to reach upstream, got %d hits", hits)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/items", nil))
+	if rec.Code != http.StatusOK || hits != 1 {
+		t.Errorf("expected GET to be proxied, got status %d with %d hits", rec.Code, hits)
+	}
+}
+
+func TestOptionsProxiedWhenDisabled(t *testing.T) {
+	var method string
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/api/items", nil))
+
+	if method != http.MethodOptions {
+		t.Errorf("expected OPTIONS to reach upstream, got %q", method)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("expected upstream response, got %d Allow=%q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestCORSThroughProxy(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.CORS.Enabled = true
+	cfg.CORS.AllowedOrigins = []string{"https://app.example.com", "https://admin.example.com"}
+	cfg.CORS.AllowCredentials = true
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	// Preflight is answered without reaching the upstream
+	req := httptest.NewRequest("OPTIONS", "/data", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || hits != 0 {
+		t.Fatalf("expected local 204 preflight, got %d with %d upstream hits", rec.Code, hits)
+	}
+
+	get := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/data", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Actual response from upstream carries credentialed CORS headers
+	rec = get("https://app.example.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("unexpected CORS headers on miss: %v", rec.Header())
+	}
+
+	// Cache hit for another origin must not replay the first origin
+	rec = get("https://admin.example.com")
+	if rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected cache hit, got %q", rec.Header().Get("X-Cache"))
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://admin.example.com" {
+		t.Errorf("expected hit to reflect current origin, got %q", got)
+	}
+
+	// Denied origins get no CORS headers
+	rec = get("https://evil.com")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no allow origin for denied origin, got %q", got)
+	}
+}
+
+func TestRouteContentTypeValidation(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/broken":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<html>upstream error</html>"))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"ok":true}`))
+		}
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Routes = []config.RouteConfig{
+		{PathPrefix: "/api/", ExpectContentType: []string{"application/json"}},
+	}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/broken", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for mismatched content type, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "upstream error") {
+		t.Error("expected upstream body to be replaced")
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON gateway error, got %q", ct)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/ok", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"ok":true}` {
+		t.Errorf("expected matching response to pass through, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.MaxRequestBodySize = 16
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	// Declared length over the limit is rejected up front
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("x", 32))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for declared oversize body, got %d", rec.Code)
+	}
+
+	// Unknown length is cut off while streaming to the upstream
+	req := httptest.NewRequest("POST", "/upload", io.MultiReader(strings.NewReader(strings.Repeat("x", 32))))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for streamed oversize body, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/upload", strings.NewReader("small")))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for body within limit, got %d", rec.Code)
+	}
+}
+
+func TestResponseBodyLimit(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		body := strings.Repeat("x", 64)
+		if r.URL.Path == "/chunked" {
+			// Flushing before writing forces chunked encoding
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.Write([]byte(body))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Upstream.MaxResponseBodySize = 32
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/declared", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for declared oversize response, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/chunked", nil))
+	if rec.Body.Len() > 32 {
+		t.Errorf("expected streamed response to be cut at 32 bytes, got %d", rec.Body.Len())
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected truncated response not to be cached, got %d entries", c.Len())
+	}
+}
+
+func TestLargeCacheableResponseStreamedNotCached(t *testing.T) {
+	body := strings.Repeat("x", 4096)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.MaxSize = 1024
+	c := cache.NewMemoryCache(cfg.Cache.MaxSize, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/big", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("expected full body to be streamed, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected oversized response not to be cached, got %d entries", c.Len())
+	}
+}
+
+func TestMalformedRuntimeUpstream(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	pool, err := upstream.NewPool(upstreamBackends(cfg), upstream.Strategy(cfg.Upstream.Strategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.CloseIdleConnections()
+	pages, _ := errorpage.New(errorpage.Config{})
+	handler := createProxyHandler(newReverseProxy(cfg, pool, nil, nil, pages, nil, log.NewNopLogger()), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	// A malformed backend registered at runtime is skipped by the balancer
+	bad, err := pool.Add(upstream.BackendConfig{URL: "localhost:9999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200 from healthy backend, got %d", i, rec.Code)
+		}
+	}
+
+	// With only malformed backends left the proxy answers a clean 502
+	pool.Remove(pool.Backends()[0])
+	if len(pool.Backends()) != 1 || pool.Backends()[0] != bad {
+		t.Fatal("expected only the malformed backend to remain")
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON error body, got %q", ct)
+	}
+}
+
+func TestMaintenanceModeToggle(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Admin.Enabled = true
+	cfg.Admin.Token = "secret"
+	cfg.Maintenance.AllowPaths = []string{"/status"}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/api", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 before maintenance, got %d", rec.Code)
+	}
+
+	if rec := do("PUT", "/admin/maintenance", `{"enabled":true}`, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with bad token, got %d", rec.Code)
+	}
+	if rec := do("PUT", "/admin/maintenance", `{"enabled":true}`, "secret"); rec.Code != http.StatusOK || rec.Body.String() != `{"maintenance":true}` {
+		t.Fatalf("expected maintenance enabled, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := do("GET", "/api", "", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 during maintenance, got %d", rec.Code)
+	}
+	if rec.Body.String() != cfg.Maintenance.Body || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected maintenance response %q (%s)", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+	if rec := do("GET", "/health", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected /health to stay up, got %d", rec.Code)
+	}
+	if rec := do("GET", "/status/check", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected allowlisted path to bypass maintenance, got %d", rec.Code)
+	}
+	if rec := do("GET", "/statuspage", "", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /statuspage not to bypass maintenance, got %d", rec.Code)
+	}
+
+	if rec := do("PUT", "/admin/maintenance", `{"enabled":false}`, "secret"); rec.Body.String() != `{"maintenance":false}` {
+		t.Fatalf("expected maintenance disabled, got %s", rec.Body.String())
+	}
+	if rec := do("GET", "/api", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 after maintenance, got %d", rec.Code)
+	}
+
+	if rec := do("PUT", "/admin/maintenance", `{}`, "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing field, got %d", rec.Code)
+	}
+}
+
+func TestMaintenanceCustomResponse(t *testing.T) {
+	cfg := newTestConfig(t, "http://127.0.0.1:1")
+	cfg.Maintenance.Enabled = true
+	cfg.Maintenance.StatusCode = http.StatusTeapot
+	cfg.Maintenance.ContentType = "text/html"
+	cfg.Maintenance.Body = "<h1>Back soon</h1>"
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "<h1>Back soon</h1>" || rec.Header().Get("Content-Type") != "text/html" {
+		t.Errorf("unexpected maintenance response %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestSetCookieResponseStreamedNotBuffered(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		}
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/login", nil))
+	if rec.Body.String() != "chunkchunkchunk" {
+		t.Errorf("expected response to be streamed through, got %q", rec.Body.String())
+	}
+	if rec.Header().Get("Set-Cookie") == "" {
+		t.Error("expected Set-Cookie to reach the client")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected Set-Cookie response not to be cached, got %d entries", c.Len())
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/public", nil))
+	if c.Len() != 1 {
+		t.Errorf("expected cookie-free response to be cached, got %d entries", c.Len())
+	}
+}
+
+func TestResponseRecorderStopsBufferingWhenUncacheable(t *testing.T) {
+	outcome := &requestOutcome{}
+	rec := &responseRecorder{
+		ResponseWriter: httptest.NewRecorder(),
+		statusCode:     http.StatusOK,
+		body:           &[]byte{},
+		maxBuffer:      1024,
+		outcome:        outcome,
+	}
+
+	rec.Write([]byte("first"))
+	if string(*rec.body) != "first" {
+		t.Fatalf("expected body to be buffered, got %q", *rec.body)
+	}
+
+	outcome.uncacheable = true
+	rec.Write([]byte("second"))
+	if len(*rec.body) != 0 || !rec.overflow {
+		t.Errorf("expected buffering to stop, got %q (overflow=%v)", *rec.body, rec.overflow)
+	}
+	if got := rec.ResponseWriter.(*httptest.ResponseRecorder).Body.String(); got != "firstsecond" {
+		t.Errorf("expected all bytes to reach the client, got %q", got)
+	}
+}
+
+func TestRateLimitWaitProceeds(t *testing.T) {
+	limiter := ratelimit.NewTokenBucket(20, 1)
+	extractor := func(*http.Request) string { return "client" }
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := rateLimitMiddleware(ok, limiter, extractor, nil, log.NewNopLogger(), 0, time.Second, nil, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Over the limit, the request is held until the next token instead of
+	// being rejected
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected request to proceed after waiting, got %d", rec.Code)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("expected the request to wait for a token, took %v", waited)
+	}
+
+	// A wait longer than max_wait is still rejected, without sleeping
+	slow := ratelimit.NewTokenBucket(1, 1)
+	handler = rateLimitMiddleware(ok, slow, extractor, nil, log.NewNopLogger(), 0, 50*time.Millisecond, nil, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	start = time.Now()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 when the wait exceeds max_wait, got %d", rec.Code)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Errorf("expected an unattainable wait to fail fast, took %v", time.Since(start))
+	}
+}
+
+func TestRateLimitWaitClientCancel(t *testing.T) {
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	extractor := func(*http.Request) string { return "client" }
+	var reached atomic.Bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached.Store(true) })
+	handler := rateLimitMiddleware(next, limiter, extractor, nil, log.NewNopLogger(), 0, 10*time.Second, nil, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	reached.Store(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if time.Since(start) > time.Second {
+		t.Errorf("expected cancellation to end the wait, took %v", time.Since(start))
+	}
+	if reached.Load() {
+		t.Error("expected a cancelled request not to be proxied")
+	}
+}
+
+func TestRetryAfterJitter(t *testing.T) {
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	extractor := func(*http.Request) string { return "client" }
+	jitter := 10 * time.Second
+	handler := rateLimitMiddleware(http.NotFoundHandler(), limiter, extractor, nil, log.NewNopLogger(), jitter, 0, nil, nil)
+
+	// Exhaust the bucket
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	maxSeconds := int((limiter.Wait("client") + jitter).Seconds()) + 1
+	seen := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", rec.Code)
+		}
+		secs, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		if err != nil {
+			t.Fatalf("invalid Retry-After %q", rec.Header().Get("Retry-After"))
+		}
+		if secs < 0 || secs > maxSeconds {
+			t.Errorf("Retry-After %d outside [0, %d]", secs, maxSeconds)
+		}
+		seen[secs] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("expected Retry-After to vary with jitter, got %v", seen)
+	}
+}
+
+func TestRetryAfterWithoutJitter(t *testing.T) {
+	if got := retryAfter(3*time.Second, 0); got != 3*time.Second {
+		t.Errorf("retryAfter() = %v, want 3s", got)
+	}
+	for i := 0; i < 20; i++ {
+		got := retryAfter(time.Second, 500*time.Millisecond)
+		if got < time.Second || got >= 1500*time.Millisecond {
+			t.Errorf("retryAfter() = %v outside [1s, 1.5s)", got)
+		}
+	}
+}
+
+func TestRateLimitResponseRoundsUp(t *testing.T) {
+	for _, tc := range []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "1"},
+		{300 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1001 * time.Millisecond, "2"},
+	} {
+		rec := httptest.NewRecorder()
+		(*rateLimitResponse)(nil).write(rec, tc.wait)
+		if got := rec.Header().Get("Retry-After"); got != tc.want {
+			t.Errorf("wait %v: Retry-After = %q, want %q", tc.wait, got, tc.want)
+		}
+		if rec.Body.String() != `{"error":"rate limit exceeded"}` {
+			t.Errorf("unexpected default body %q", rec.Body.String())
+		}
+	}
+}
+
+func TestRateLimitResponseCustomBody(t *testing.T) {
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	extractor := func(*http.Request) string { return "client" }
+	resp := newRateLimitResponse(config.RateLimitResponseConfig{
+		ContentType: "text/plain; charset=utf-8",
+		Body:        "slow down, retry in {{.RetryAfter}}s",
+	})
+	handler := rateLimitMiddleware(http.NotFoundHandler(), limiter, extractor, nil, log.NewNopLogger(), 0, 0, nil, resp)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After 1, got %q", rec.Header().Get("Retry-After"))
+	}
+	if rec.Body.String() != "slow down, retry in 1s" {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestRateLimitResponseRetryAfterDate(t *testing.T) {
+	resp := newRateLimitResponse(config.RateLimitResponseConfig{
+		ContentType:    "application/json",
+		Body:           `{"error":"rate limit exceeded"}`,
+		RetryAfterDate: true,
+	})
+	before := time.Now().Truncate(time.Second)
+	rec := httptest.NewRecorder()
+	resp.write(rec, 1500*time.Millisecond)
+
+	date, err := http.ParseTime(rec.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("invalid Retry-After date %q: %v", rec.Header().Get("Retry-After"), err)
+	}
+	if d := date.Sub(before); d < 2*time.Second || d > 3*time.Second {
+		t.Errorf("Retry-After date %v is %v from now, want about 2s", date, d)
+	}
+}
+
+func TestUpstreamDialFailureErrorPage(t *testing.T) {
+	// Reserve a port and close it so dialing the upstream fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tmpl := filepath.Join(t.TempDir(), "5xx.html")
+	if err := os.WriteFile(tmpl, []byte("<h1>{{.Status}}</h1><p>Reference: {{.RequestID}}</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig(t, "http://"+addr)
+	cfg.Cache.Enabled = false
+	cfg.ErrorPages.Format = "html"
+	cfg.ErrorPages.Templates = map[string]string{"5xx": tmpl}
+
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if want := "<h1>502</h1><p>Reference: req-42</p>"; rec.Body.String() != want {
+		t.Errorf("expected body %q, got %q", want, rec.Body.String())
+	}
+}
+
+func TestUpstreamRequestTimeout(t *testing.T) {
+	// Mirrors the /slow handler of test/testserver, with a shorter delay
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"status":"slow response"}`))
+		case "/slow-body":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(" rest"))
+		default:
+			w.Write([]byte("fast"))
+		}
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.Enabled = false
+	cfg.Upstream.RequestTimeout = 50 * time.Millisecond
+	rec := &fakeRecorder{}
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger(), Metrics: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		p.ServeHTTP(res, httptest.NewRequest("GET", path, nil))
+		return res
+	}
+
+	if res := get("/fast"); res.Code != http.StatusOK || res.Body.String() != "fast" {
+		t.Errorf("expected a fast response within the timeout, got %d %q", res.Code, res.Body.String())
+	}
+
+	start := time.Now()
+	if res := get("/slow"); res.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 when the upstream is slower than the timeout, got %d", res.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the request to be cut off at the timeout, took %v", elapsed)
+	}
+	if !slices.Contains(rec.calls, "upstream error request_timeout") {
+		t.Errorf("expected a request_timeout upstream error, got %v", rec.calls)
+	}
+
+	// Once the headers are sent the body is cut short instead
+	start = time.Now()
+	if res := get("/slow-body"); res.Code != http.StatusOK || res.Body.String() != "partial" {
+		t.Errorf("expected the body to stop at the timeout, got %d %q", res.Code, res.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the body transfer to be cut off at the timeout, took %v", elapsed)
+	}
+}
+
+func TestClientNotModifiedAfterRevalidation(t *testing.T) {
+	var conditional []string
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("payload"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	// Prime the cache; max-age=0 makes the entry stale immediately
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/doc", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("unexpected priming response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// The client holds the current validator, so after the upstream
+	// confirms the stale copy it gets a 304 without a body
+	req := httptest.NewRequest("GET", "/doc", nil)
+	req.Header.Set("If-None-Match", `W/"v1"`)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", rec.Body.String())
+	}
+
+	// A client with an outdated validator gets the revalidated body
+	req = httptest.NewRequest("GET", "/doc", nil)
+	req.Header.Set("If-None-Match", `"v0"`)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("expected cached body, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("expected X-Cache REVALIDATED, got %q", rec.Header().Get("X-Cache"))
+	}
+
+	want := []string{"", `"v1"`, `"v1"`}
+	if strings.Join(conditional, "|") != strings.Join(want, "|") {
+		t.Errorf("upstream If-None-Match = %q, want %q", conditional, want)
+	}
+}
+
+func TestCacheHitRecomputesDateAndAge(t *testing.T) {
+	staleDate := "Mon, 01 Jan 2024 00:00:00 GMT"
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Header().Set("Date", staleDate)
+		w.Header().Set("Age", "500")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Backend-Node", "node-1")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.ExcludeHeaders = []string{"X-Backend-Node"}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	entry, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/page", nil), nil))
+	if !ok {
+		t.Fatal("expected response to be cached")
+	}
+	for _, name := range []string{"Date", "Age", "Keep-Alive", "X-Backend-Node", "X-Request-Id"} {
+		if v := entry.Headers.Get(name); v != "" {
+			t.Errorf("expected %s not to be stored, got %q", name, v)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+	if rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected cache hit, got %q", rec.Header().Get("X-Cache"))
+	}
+
+	date, err := http.ParseTime(rec.Header().Get("Date"))
+	if err != nil {
+		t.Fatalf("invalid Date %q: %v", rec.Header().Get("Date"), err)
+	}
+	if time.Since(date) > 5*time.Second {
+		t.Errorf("expected a fresh Date, got %s", rec.Header().Get("Date"))
+	}
+	if age := rec.Header().Get("Age"); age != "500" {
+		t.Errorf("expected the upstream's Age of 500, got %q", age)
+	}
+	if rec.Header().Get("Keep-Alive") != "" || rec.Header().Get("X-Backend-Node") != "" {
+		t.Error("expected excluded headers not to be replayed")
+	}
+	if ids := rec.Header().Values("X-Request-ID"); len(ids) != 1 {
+		t.Errorf("expected a single request ID, got %v", ids)
+	}
+}
+
+func TestCacheAgeCountsAgainstMaxAge(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", r.URL.Query().Get("age"))
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func(target string) string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Header().Get("X-Cache")
+	}
+
+	// Already as old as its max-age when received, so never fresh
+	get("/old?age=60")
+	if status := get("/old?age=60"); status == "HIT" || hits != 2 {
+		t.Errorf("expected a response as old as max-age not to be served from cache, got %q after %d upstream requests", status, hits)
+	}
+
+	get("/young?age=10")
+	if status := get("/young?age=10"); status != "HIT" {
+		t.Errorf("expected a response younger than max-age to be a hit, got %q", status)
+	}
+	entry, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/young?age=10", nil), nil))
+	if !ok {
+		t.Fatal("expected response to be cached")
+	}
+	if ttl := time.Until(entry.ExpiresAt); ttl > 50*time.Second {
+		t.Errorf("expected the age to shorten the freshness to 50s, got %v", ttl)
+	}
+}
+
+func TestCookieHashStickySessions(t *testing.T) {
+	hits := make(map[string]int)
+	newBackend := func(name string) string {
+		return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			hits[name]++
+			w.Header().Set("Cache-Control", "no-store")
+		}).URL
+	}
+
+	cfg := newTestConfig(t, "")
+	cfg.Upstream.Strategy = "cookie_hash"
+	cfg.Upstream.Backends = []config.BackendConfig{{URL: newBackend("a")}, {URL: newBackend("b")}}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: "user-42"})
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(hits) != 1 {
+		t.Errorf("expected one session to stick to a single backend, got %v", hits)
+	}
+}
+
+func TestMirrorDoesNotAffectClient(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("primary:" + string(body)))
+	})
+
+	const n = 200
+	var mirrored atomic.Int32
+	mirroredBodies := make(chan string, n)
+	shadow := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored.Add(1)
+		mirroredBodies <- string(body)
+		// A failing, slow shadow must not leak into the client response
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("X-Shadow", "true")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Mirror.Enabled = true
+	cfg.Mirror.URL = shadow.URL
+	cfg.Mirror.SampleRate = 0.5
+	mir, err := newMirror(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, mir, nil, "")
+
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/orders", strings.NewReader("order-"+strconv.Itoa(i))))
+		if rec.Code != http.StatusOK || rec.Body.String() != "primary:order-"+strconv.Itoa(i) {
+			t.Fatalf("expected primary response, got %d %q", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("X-Shadow") != "" {
+			t.Fatal("expected mirror headers not to reach the client")
+		}
+	}
+	mir.Close()
+
+	if got := mirrored.Load(); got < n*30/100 || got > n*70/100 {
+		t.Errorf("expected about half of %d requests mirrored, got %d", n, got)
+	}
+	close(mirroredBodies)
+	for body := range mirroredBodies {
+		if !strings.HasPrefix(body, "order-") {
+			t.Errorf("expected mirror to receive the request body, got %q", body)
+		}
+	}
+}
+
+func TestForbiddenHeaderPatternsStripped(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	record := func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}
+	up := newTestUpstream(t, record)
+	shadow := newTestUpstream(t, record)
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Upstream.ForbiddenHeaderPatterns = []string{"X-Internal-.*"}
+	cfg.Mirror.Enabled = true
+	cfg.Mirror.URL = shadow.URL
+	cfg.Mirror.SampleRate = 1
+	mir, err := newMirror(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, mir, nil, "")
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("X-Internal-Token", "secret")
+	req.Header.Set("x-internal-user", "42")
+	req.Header.Set("X-Internal", "kept")
+	req.Header.Set("X-Request-Source", "web")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	mir.Close()
+
+	for _, name := range []string{"upstream", "mirror"} {
+		got := <-headers
+		if got.Get("X-Internal-Token") != "" || got.Get("X-Internal-User") != "" {
+			t.Errorf("%s: expected the X-Internal-* family to be stripped, got %v", name, got)
+		}
+		if got.Get("X-Internal") != "kept" || got.Get("X-Request-Source") != "web" {
+			t.Errorf("%s: expected unrelated headers to be kept, got %v", name, got)
+		}
+	}
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Server.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.Upstream.Forwarding.Forwarded = true
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	send := func(remoteAddr string, header http.Header) http.Header {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://shop.example.com/api", nil)
+		req.RemoteAddr = remoteAddr
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		return <-headers
+	}
+
+	// Forwarding headers from an untrusted client are replaced
+	got := send("192.0.2.7:5000", http.Header{
+		"X-Forwarded-For":   {"198.51.100.1"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"evil.example.com"},
+		"Forwarded":         {"for=198.51.100.1"},
+	})
+	if v := got.Get("X-Forwarded-For"); v != "192.0.2.7" {
+		t.Errorf("untrusted: expected X-Forwarded-For 192.0.2.7, got %q", v)
+	}
+	if v := got.Get("X-Forwarded-Proto"); v != "http" {
+		t.Errorf("untrusted: expected X-Forwarded-Proto http, got %q", v)
+	}
+	if v := got.Get("X-Forwarded-Host"); v != "shop.example.com" {
+		t.Errorf("untrusted: expected X-Forwarded-Host shop.example.com, got %q", v)
+	}
+	if v := got.Get("Forwarded"); v != "for=192.0.2.7;host=shop.example.com;proto=http" {
+		t.Errorf("untrusted: unexpected Forwarded %q", v)
+	}
+
+	// A trusted proxy's headers are extended
+	got = send("10.1.2.3:5000", http.Header{
+		"X-Forwarded-For":   {"203.0.113.9"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {`for="[2001:db8::1]";proto=https`},
+	})
+	if v := got.Get("X-Forwarded-For"); v != "203.0.113.9, 10.1.2.3" {
+		t.Errorf("trusted: expected the chain to be extended, got %q", v)
+	}
+	if v := got.Get("X-Forwarded-Proto"); v != "https" {
+		t.Errorf("trusted: expected the original proto to be kept, got %q", v)
+	}
+	if v := got.Get("Forwarded"); v != `for="[2001:db8::1]";proto=https, for=10.1.2.3;host=shop.example.com;proto=http` {
+		t.Errorf("trusted: unexpected Forwarded %q", v)
+	}
+
+	// IPv6 peers are bracketed and quoted in Forwarded
+	got = send("[2001:db8::2]:5000", nil)
+	if v := got.Get("Forwarded"); v != `for="[2001:db8::2]";host=shop.example.com;proto=http` {
+		t.Errorf("ipv6: unexpected Forwarded %q", v)
+	}
+}
+
+func TestForwardingHeadersDisabled(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Upstream.Forwarding.XForwarded = false
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	got := <-headers
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("expected no %s, got %q", name, v)
+		}
+	}
+}
+
+func TestTrafficSplitCanary(t *testing.T) {
+	newVariant := func(name string) string {
+		return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(name))
+		}).URL
+	}
+
+	cfg := newTestConfig(t, newVariant("default"))
+	cfg.Routes = []config.RouteConfig{{
+		PathPrefix: "/api/",
+		SplitBy:    "header:X-User-ID",
+		Split: []config.VariantConfig{
+			{Name: "stable", URL: newVariant("stable"), Weight: 90},
+			{Name: "canary", URL: newVariant("canary"), Weight: 10},
+		},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-User-ID", user)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	const n = 2000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		user := "user-" + strconv.Itoa(i)
+		rec := get("/api/items", user)
+		variant := rec.Header().Get("X-Variant")
+		if rec.Body.String() != variant {
+			t.Fatalf("X-Variant %q does not match the upstream that answered %q", variant, rec.Body.String())
+		}
+		counts[variant]++
+
+		// Sticky per user, and cached per variant
+		if again := get("/api/items", user); again.Body.String() != variant {
+			t.Fatalf("user %s moved from %s to %s", user, variant, again.Body.String())
+		}
+	}
+
+	if canary := counts["canary"]; canary < n*7/100 || canary > n*13/100 {
+		t.Errorf("expected about 10%% canary, got %v", counts)
+	}
+
+	if rec := get("/other", "user-1"); rec.Body.String() != "default" || rec.Header().Get("X-Variant") != "" {
+		t.Errorf("expected unsplit route to use the default upstream, got %q", rec.Body.String())
+	}
+}
+
+func TestRouteTransport(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})
+	newVariant := func() *httptest.Server {
+		return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("variant"))
+		})
+	}
+	variant := newVariant()
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.Enabled = false
+	cfg.Routes = []config.RouteConfig{
+		{PathPrefix: "/bulk/", Transport: config.TransportConfig{MaxConnsPerHost: 2, MaxIdleConns: 4}},
+		{PathPrefix: "/fast/", Transport: config.TransportConfig{Timeout: 20 * time.Millisecond}},
+		{PathPrefix: "/bulk/exempt/"}, // more specific, so it uses the shared pools
+		{
+			PathPrefix: "/split/",
+			Transport:  config.TransportConfig{MaxConnsPerHost: 3},
+			Split: []config.VariantConfig{
+				{Name: "a", URL: variant.URL, Weight: 1},
+				{Name: "b", URL: newVariant().URL, Weight: 1},
+			},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	key := strings.TrimSuffix(up.URL, "/")
+	shared := p.pool.Transports()[key]
+	if shared.MaxIdleConnsPerHost != cfg.Upstream.MaxConnsPerHost {
+		t.Errorf("expected the shared pool to keep %d connections per host, got %d", cfg.Upstream.MaxConnsPerHost, shared.MaxIdleConnsPerHost)
+	}
+
+	bulk := p.routes.forPath("/bulk/items")
+	if bulk == nil {
+		t.Fatal("expected /bulk/ to have pools of its own")
+	}
+	tr := bulk.primary.Transports()[key]
+	if tr == shared {
+		t.Fatal("expected the route to have its own transport")
+	}
+	if tr.MaxIdleConnsPerHost != 2 || tr.MaxIdleConns != 4 {
+		t.Errorf("route pool = %d/%d, want 4/2", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+	if tr.ResponseHeaderTimeout != cfg.Upstream.Timeout {
+		t.Errorf("expected the route to inherit timeout %v, got %v", cfg.Upstream.Timeout, tr.ResponseHeaderTimeout)
+	}
+	if p.routes.forPath("/bulk/exempt/items") != nil || p.routes.forPath("/other") != nil {
+		t.Error("expected routes without transport settings to use the shared pools")
+	}
+
+	split := p.routes.forPath("/split/items")
+	if split == nil || split.variants == nil {
+		t.Fatal("expected /split/ to have a variant pool of its own")
+	}
+	if vt := split.variants.Transports()[variant.URL]; vt == nil || vt.MaxIdleConnsPerHost != 3 {
+		t.Errorf("expected the route's variant transport to keep 3 connections per host, got %+v", vt)
+	}
+
+	// Requests go through the route's transport: only /fast/ times out
+	for path, want := range map[string]int{
+		"/bulk/items":  http.StatusOK,
+		"/fast/items":  http.StatusBadGateway,
+		"/other":       http.StatusOK,
+		"/split/items": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/split/items", nil))
+	if rec.Body.String() != "variant" {
+		t.Errorf("expected /split/ to reach its variant, got %q", rec.Body.String())
+	}
+}
+
+func TestUpdateUpstream(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 1)
+	oldUp := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("old"))
+	})
+	newUp := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new"))
+	})
+
+	cfg := newTestConfig(t, oldUp.URL)
+	cfg.Cache.Enabled = false
+	cfg.Server.Readiness.CheckUpstream = true
+	cfg.Routes = []config.RouteConfig{{PathPrefix: "/bulk/", Transport: config.TransportConfig{MaxConnsPerHost: 2}}}
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Body.String()
+	}
+	if body := get("/"); body != "old" {
+		t.Fatalf("expected the initial upstream, got %q", body)
+	}
+
+	// A request in flight during the reload completes on the old upstream
+	inFlight := make(chan string)
+	go func() { inFlight <- get("/slow") }()
+	<-arrived
+
+	reloaded := newTestConfig(t, newUp.URL)
+	reloaded.Routes = cfg.Routes
+	if err := p.UpdateUpstream(reloaded); err != nil {
+		t.Fatalf("UpdateUpstream() error = %v", err)
+	}
+	for _, path := range []string{"/", "/bulk/items"} {
+		if body := get(path); body != "new" {
+			t.Errorf("%s: expected the reloaded upstream, got %q", path, body)
+		}
+	}
+
+	close(release)
+	if body := <-inFlight; body != "old" {
+		t.Errorf("expected the in-flight request to complete, got %q", body)
+	}
+
+	// Readiness dials the backends the proxy currently uses
+	oldUp.Close()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /ready to check the reloaded upstream, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// A route that fails to update leaves every pool on the previous backends
+	broken := newTestConfig(t, "http://127.0.0.1:1")
+	broken.Routes = []config.RouteConfig{{PathPrefix: "/bulk/", Transport: config.TransportConfig{
+		MaxConnsPerHost: 2,
+		TLS:             config.UpstreamTLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	}}}
+	if err := p.UpdateUpstream(broken); err == nil {
+		t.Fatal("expected UpdateUpstream() to fail")
+	}
+	for _, path := range []string{"/", "/bulk/items"} {
+		if body := get(path); body != "new" {
+			t.Errorf("%s: expected the previous upstream after a failed reload, got %q", path, body)
+		}
+	}
+}
+
+func TestUpdateUpstreamVariants(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	})
+	variant := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("variant"))
+	})
+	split := []config.VariantConfig{
+		{Name: "a", URL: variant.URL, Weight: 1},
+		{Name: "b", URL: up.URL, Weight: 0},
+	}
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.Enabled = false
+	cfg.Routes = []config.RouteConfig{
+		{PathPrefix: "/split/", Split: split},
+		{PathPrefix: "/rsplit/", Transport: config.TransportConfig{MaxConnsPerHost: 3}, Split: split},
+	}
+	p, err := New(cfg, Deps{Logger: log.NewNopLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+	for _, path := range []string{"/split/slow", "/rsplit/slow"} {
+		if code, body := get(path); code != http.StatusOK || body != "variant" {
+			t.Fatalf("%s: expected the variant, got %d %q", path, code, body)
+		}
+	}
+
+	// The variant pools take the reloaded transport settings
+	reloaded := newTestConfig(t, up.URL)
+	reloaded.Upstream.Timeout = 20 * time.Millisecond
+	reloaded.Routes = []config.RouteConfig{
+		{PathPrefix: "/split/", Split: split},
+		{PathPrefix: "/rsplit/", Transport: config.TransportConfig{MaxConnsPerHost: 3, Timeout: 20 * time.Millisecond}, Split: split},
+	}
+	if err := p.UpdateUpstream(reloaded); err != nil {
+		t.Fatalf("UpdateUpstream() error = %v", err)
+	}
+	for _, path := range []string{"/split/slow", "/rsplit/slow"} {
+		if code, _ := get(path); code != http.StatusBadGateway {
+			t.Errorf("%s: expected the reloaded timeout to apply to the variant, got %d", path, code)
+		}
+	}
+
+	// A changed split is rejected and leaves every pool as it was
+	changed := newTestConfig(t, up.URL)
+	changed.Routes = []config.RouteConfig{
+		{PathPrefix: "/split/", Split: []config.VariantConfig{split[0], {Name: "b", URL: up.URL, Weight: 1}}},
+		reloaded.Routes[1],
+	}
+	if err := p.UpdateUpstream(changed); err == nil || !strings.Contains(err.Error(), "restart") {
+		t.Fatalf("expected a changed split to be rejected, got %v", err)
+	}
+	if code, _ := get("/split/slow"); code != http.StatusBadGateway {
+		t.Errorf("expected the previous variant pool after a rejected reload, got %d", code)
+	}
+	if code, body := get("/split/fast"); code != http.StatusOK || body != "variant" {
+		t.Errorf("expected the previous split after a rejected reload, got %d %q", code, body)
+	}
+}
+
+func TestFlagsOnlyFromAllowedSources(t *testing.T) {
+	var hits atomic.Int32
+	var leaked atomic.Bool
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("X-Proxy-Flags") != "" {
+			leaked.Store(true)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Flags.Enabled = true
+	cfg.Flags.AllowedSources = []string{"10.0.0.0/8"}
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil,
+		cache.NewMemoryCache(1024*1024, time.Minute), limiter, ratelimit.IPKeyExtractor, nil, nil, nil, "")
+
+	send := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Proxy-Flags", "nocache, NOLIMIT")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Trusted: every request bypasses both the limiter and the cache
+	for i := 0; i < 3; i++ {
+		if rec := send("10.1.2.3:1234", "/trusted"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "" {
+			t.Fatalf("expected uncached 200 for trusted source, got %d X-Cache=%q", rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	if hits.Load() != 3 {
+		t.Errorf("expected every trusted request to reach the upstream, got %d", hits.Load())
+	}
+
+	// Untrusted: flags are ignored, so the cache answers and the limiter applies
+	if rec := send("192.0.2.1:1234", "/untrusted"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected cached miss for untrusted source, got %d X-Cache=%q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if rec := send("192.0.2.1:1234", "/untrusted"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected untrusted source to be rate limited, got %d", rec.Code)
+	}
+
+	if leaked.Load() {
+		t.Error("expected the flags header to be stripped before proxying")
+	}
+}
+
+// fakeRecorder records metrics calls as strings
+type fakeRecorder struct {
+	mu       sync.Mutex
+	calls    []string
+	active   int
+	inFlight int
+}
+
+func (f *fakeRecorder) record(format string, args ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeRecorder) RecordRequest(method, path string, status int, _ time.Duration, requestSize, responseSize int64, _ string) {
+	f.record("request %s %s %d %d %d", method, path, status, requestSize, responseSize)
+}
+
+func (f *fakeRecorder) IncRequestsInFlight(method string) {}
+
+func (f *fakeRecorder) DecRequestsInFlight(method string) {}
+
+func (f *fakeRecorder) RecordTenantRequest(tenant string, status int) {
+	f.record("tenant %s %d", tenant, status)
+}
+
+func (f *fakeRecorder) RecordVariantRequest(route, variant string, status int) {
+	f.record("variant %s %s %d", route, variant, status)
+}
+
+func (f *fakeRecorder) RecordMirrorResponse(status int, _ time.Duration) {
+	f.record("mirror %d", status)
+}
+
+func (f *fakeRecorder) RecordMirrorFailure(reason string) {
+	f.record("mirror failure %s", reason)
+}
+
+func (f *fakeRecorder) RecordUpstreamResponse(protocol string) {
+	f.record("upstream %s", protocol)
+}
+
+func (f *fakeRecorder) RecordCacheEviction() {}
+
+func (f *fakeRecorder) RecordCacheExpiration() {}
+
+func (f *fakeRecorder) SetCacheUtilization(ratio float64) {}
+
+func (f *fakeRecorder) RecordUpstreamError(kind string) {
+	f.record("upstream error %s", kind)
+}
+
+func (f *fakeRecorder) RecordCacheHit(method, path string) {
+	f.record("cache hit %s %s", method, path)
+}
+
+func (f *fakeRecorder) RecordCacheMiss(method, path string) {
+	f.record("cache miss %s %s", method, path)
+}
+
+func (f *fakeRecorder) RecordRateLimitDrop() {
+	f.record("rate limit drop")
+}
+
+func (f *fakeRecorder) RecordHijackFailure() {
+	f.record("hijack failure")
+}
+
+func (f *fakeRecorder) RecordClientWriteError() {
+	f.record("client write error")
+}
+
+func (f *fakeRecorder) RecordConcurrencyLimit(outcome string) {
+	f.record("concurrency %s", outcome)
+}
+
+func (f *fakeRecorder) IncInFlightRequests() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight++
+}
+
+func (f *fakeRecorder) DecInFlightRequests() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+}
+
+func (f *fakeRecorder) IncActiveConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active++
+}
+
+func (f *fakeRecorder) DecActiveConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active--
+}
+
+var _ metrics.Recorder = (*fakeRecorder)(nil)
+
+func TestCustomMetricsRecorder(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	rec := &fakeRecorder{}
+	limiter := ratelimit.NewTokenBucket(1, 2)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), rec,
+		cache.NewMemoryCache(1024*1024, time.Minute), limiter, ratelimit.IPKeyExtractor, nil, nil, nil, "")
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/greeting", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	want := []string{
+		"cache miss GET /greeting",
+		"request GET /greeting 200 0 5",
+		"cache hit GET /greeting",
+		"request GET /greeting 200 0 5",
+		// Rejected before reaching the metrics middleware
+		"rate limit drop",
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if strings.Join(rec.calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected recorder calls:\n got %q\nwant %q", rec.calls, want)
+	}
+	if rec.active != 0 {
+		t.Errorf("expected active connections to return to zero, got %d", rec.active)
+	}
+}
+
+// newUpgradeUpstream starts an upstream that switches to an echo protocol
+// when asked to upgrade
+func newUpgradeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	return newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		brw.WriteString("echo: " + line)
+		brw.Flush()
+	})
+}
+
+func TestUpgradeThroughMiddlewareChain(t *testing.T) {
+	up := newUpgradeUpstream(t)
+	cfg := newTestConfig(t, up.URL)
+	rec := &fakeRecorder{}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), rec,
+		cache.NewMemoryCache(1024*1024, time.Minute), ratelimit.NewTokenBucket(100, 100), ratelimit.IPKeyExtractor,
+		nil, nil, &Lifecycle{}, "")
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /socket HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "hello\n")
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "echo: hello\n" {
+		t.Errorf("unexpected reply %q", line)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if slices.Contains(rec.calls, "hijack failure") {
+		t.Errorf("unexpected hijack failure: %q", rec.calls)
+	}
+}
+
+func TestHijackFailureCounted(t *testing.T) {
+	up := newUpgradeUpstream(t)
+	cfg := newTestConfig(t, up.URL)
+	rec := &fakeRecorder{}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), rec, nil, nil, nil, nil, nil, nil, "")
+
+	// A ResponseRecorder cannot hand over its connection
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if n := slices.Index(rec.calls, "hijack failure"); n < 0 || slices.Index(rec.calls[n+1:], "hijack failure") >= 0 {
+		t.Errorf("expected exactly one hijack failure, got %q", rec.calls)
+	}
+}
+
+func TestClientWriteErrorCounted(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 16<<20)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(body)
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.MaxSize = 64 << 20
+	rec := &fakeRecorder{}
+	core, logs := observer.New(zapcore.DebugLevel)
+	c := cache.NewMemoryCache(cfg.Cache.MaxSize, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewWithCore(core), rec, c, nil, nil, nil, nil, nil, "")
+
+	// Cached first, so the replay keeps writing after the client is gone
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/big", nil))
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET /big HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if _, err := io.ReadFull(conn, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	counted := func() (written, failed int) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		for _, call := range rec.calls {
+			switch {
+			case strings.HasPrefix(call, "request GET /big"):
+				written++
+			case call == "client write error":
+				failed++
+			}
+		}
+		return written, failed
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for written, _ := counted(); written < 2 && time.Now().Before(deadline); written, _ = counted() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if written, failed := counted(); written != 2 || failed != 1 {
+		t.Fatalf("expected one client write error for the disconnected replay, got %d of %d requests", failed, written)
+	}
+
+	entries := logs.FilterMessage("Client write failed").All()
+	if len(entries) != 1 || entries[0].Level != zapcore.DebugLevel {
+		t.Fatalf("expected one debug log for the failed write, got %v", entries)
+	}
+	if _, ok := entries[0].ContextMap()["request_id"]; !ok {
+		t.Errorf("expected the request ID in the log, got %v", entries[0].ContextMap())
+	}
+}
+
+func TestClientWriteErrorCountedWhenProxied(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 16<<20)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.Enabled = false
+	rec := &fakeRecorder{}
+	core, logs := observer.New(zapcore.DebugLevel)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewWithCore(core), rec, nil, nil, nil, nil, nil, nil, "")
+
+	// The reverse proxy aborts the handler when the client goes away
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET /big HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	if _, err := io.ReadFull(conn, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	counted := func() (written, failed int) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		for _, call := range rec.calls {
+			switch {
+			case strings.HasPrefix(call, "request GET /big"):
+				written++
+			case call == "client write error":
+				failed++
+			}
+		}
+		return written, failed
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for written, _ := counted(); written < 1 && time.Now().Before(deadline); written, _ = counted() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if written, failed := counted(); written != 1 || failed != 1 {
+		t.Fatalf("expected one client write error for the aborted response, got %d of %d requests", failed, written)
+	}
+	if n := logs.FilterMessage("Client write failed").Len(); n != 1 {
+		t.Errorf("expected one log for the failed write, got %d", n)
+	}
+}
+
+func TestExpectContinuePassthrough(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("expected the expectation to be forwarded, got %q", r.Header.Get("Expect"))
+		}
+		if r.URL.Path == "/reject" {
+			// Refuse before reading, so no 100 Continue is sent
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+	cfg := newTestConfig(t, up.URL)
+	rec := &fakeRecorder{}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), rec,
+		cache.NewMemoryCache(1024*1024, time.Minute), nil, nil, nil, nil, nil, "")
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	send := func(path string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", path)
+		return bufio.NewReader(conn), conn
+	}
+
+	// The body is only sent once the upstream's 100 Continue is relayed
+	br, conn := send("/upload")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("expected 100 Continue before the body, got %d", resp.StatusCode)
+	}
+	conn.Write([]byte("hello"))
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "hello" {
+		t.Errorf("expected 201 echoing the body, got %d %q", resp.StatusCode, body)
+	}
+
+	// A refusal reaches the client without it ever sending the body
+	br, _ = send("/reject")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 without 100 Continue, got %d", resp.StatusCode)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	want := []string{"request POST /upload 201 5 5", "request POST /reject 413 5 0"}
+	if strings.Join(rec.calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected final statuses to be recorded, got %q", rec.calls)
+	}
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t, srv.URL)
+	cfg.Upstream.EnableHTTP2 = true
+	pool, err := upstream.NewPool(upstreamBackends(cfg), upstream.Strategy(cfg.Upstream.Strategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.CloseIdleConnections)
+	pages, err := errorpage.New(errorPageConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &fakeRecorder{}
+	proxy := newReverseProxy(cfg, pool, nil, nil, pages, rec, log.NewNopLogger())
+	handler := createProxyHandler(proxy, cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "HTTP/2.0" {
+		t.Fatalf("expected upstream to be reached over h2c, got %d %q", w.Code, w.Body.String())
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.calls) != 1 || rec.calls[0] != "upstream HTTP/2.0" {
+		t.Errorf("expected the negotiated protocol to be recorded, got %q", rec.calls)
+	}
+}
+
+func TestLargeCachedBodyStreamedFromDisk(t *testing.T) {
+	large := strings.Repeat("0123456789abcdef", 4096) // 64 KB
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.URL.Path == "/small" {
+			w.Write([]byte("tiny"))
+			return
+		}
+		w.Write([]byte(large))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.DiskDir = t.TempDir()
+	cfg.Cache.DiskThreshold = 1024
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func(path, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	bodyFiles := func() []string {
+		files, _ := filepath.Glob(filepath.Join(cfg.Cache.DiskDir, "*"))
+		return files
+	}
+
+	if rec := get("/large", ""); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != large {
+		t.Fatalf("expected full body on miss, got X-Cache=%q and %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if files := bodyFiles(); len(files) != 1 {
+		t.Fatalf("expected the large body on disk, got %v", files)
+	}
+
+	rec := get("/large", "")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != large {
+		t.Fatalf("expected full body on hit, got X-Cache=%q and %d bytes", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if rec.Header().Get("ETag") != cache.GenerateETag([]byte(large)) {
+		t.Errorf("expected ETag over the streamed body, got %q", rec.Header().Get("ETag"))
+	}
+
+	rec = get("/large", "bytes=16-31")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != large[16:32] {
+		t.Errorf("expected 206 with the requested range, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 16-31/65536" {
+		t.Errorf("expected Content-Range bytes 16-31/65536, got %q", got)
+	}
+
+	// Small bodies stay in memory
+	get("/small", "")
+	if rec := get("/small", ""); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "tiny" {
+		t.Errorf("expected small body from memory, got X-Cache=%q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if files := bodyFiles(); len(files) != 1 {
+		t.Errorf("expected only the large body on disk, got %v", files)
+	}
+
+	c.Clear()
+	if files := bodyFiles(); len(files) != 0 {
+		t.Errorf("expected clearing the cache to remove body files, got %v", files)
+	}
+}
+
+func TestCachedRangeRequests(t *testing.T) {
+	const body = "0123456789abcdefghij"
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/media", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A partial upstream response is passed through but not cached
+	if rec := get("bytes=0-3"); rec.Code != http.StatusPartialContent || rec.Header().Get("X-Cache") != "" {
+		t.Fatalf("expected uncached 206 on miss, got %d X-Cache=%q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if rec := get(""); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != body {
+		t.Fatalf("expected full response to be cached, got X-Cache=%q %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	tests := []struct {
+		name, rangeHeader string
+		status            int
+		contentRange      string
+		body              string
+	}{
+		{"single", "bytes=2-5", http.StatusPartialContent, "bytes 2-5/20", "2345"},
+		{"open ended", "bytes=16-", http.StatusPartialContent, "bytes 16-19/20", "ghij"},
+		{"suffix", "bytes=-3", http.StatusPartialContent, "bytes 17-19/20", "hij"},
+		{"clamped end", "bytes=18-100", http.StatusPartialContent, "bytes 18-19/20", "ij"},
+		{"out of bounds", "bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "bytes */20", ""},
+	}
+	for _, tt := range tests {
+		rec := get(tt.rangeHeader)
+		if rec.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("%s: expected cache hit, got X-Cache=%q", tt.name, rec.Header().Get("X-Cache"))
+		}
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%s: expected Content-Range %q, got %q", tt.name, tt.contentRange, got)
+		}
+		if tt.status == http.StatusPartialContent && rec.Body.String() != tt.body {
+			t.Errorf("%s: expected body %q, got %q", tt.name, tt.body, rec.Body.String())
+		}
+	}
+
+	// Several ranges come back as multipart/byteranges
+	rec := get("bytes=0-1,10-11")
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if rec.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected multipart 206, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rec.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+"="+string(data))
+	}
+	if strings.Join(parts, ";") != "bytes 0-1/20=01;bytes 10-11/20=ab" {
+		t.Errorf("unexpected multipart ranges %q", parts)
+	}
+
+	if rec := get(""); rec.Header().Get("Accept-Ranges") != "bytes" || rec.Body.String() != body {
+		t.Errorf("expected full hit advertising byte ranges, got Accept-Ranges=%q", rec.Header().Get("Accept-Ranges"))
+	}
+	if hits != 2 {
+		t.Errorf("expected ranges to be served from the cache, upstream hit %d times", hits)
+	}
+}
+
+func TestCacheTTLJitterSpreadsExpiry(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=100")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.TTLJitter = 50 * time.Second
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	start := time.Now()
+	var earliest, latest time.Time
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("GET", "/item/"+strconv.Itoa(i), nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		entry, ok := c.Get(requestCacheKey(req, nil))
+		if !ok {
+			t.Fatalf("expected /item/%d to be cached", i)
+		}
+		ttl := entry.ExpiresAt.Sub(start)
+		if ttl < 49*time.Second || ttl > 101*time.Second {
+			t.Fatalf("expiry %v outside the jitter band [50s, 100s]", ttl)
+		}
+		if earliest.IsZero() || entry.ExpiresAt.Before(earliest) {
+			earliest = entry.ExpiresAt
+		}
+		if entry.ExpiresAt.After(latest) {
+			latest = entry.ExpiresAt
+		}
+	}
+	if latest.Sub(earliest) < 10*time.Second {
+		t.Errorf("expected expiries spread across the band, got a %v spread", latest.Sub(earliest))
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/unavailable":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok"))
+		}
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.DefaultTTL = time.Hour
+	cfg.Cache.NegativeTTL = 10 * time.Second
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	expiry := func(path string) (time.Duration, bool) {
+		start := time.Now()
+		req := httptest.NewRequest("GET", path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		entry, ok := c.Get(requestCacheKey(req, nil))
+		if !ok {
+			return 0, false
+		}
+		return entry.ExpiresAt.Sub(start), true
+	}
+
+	if ttl, ok := expiry("/missing"); !ok || ttl < 9*time.Second || ttl > 11*time.Second {
+		t.Errorf("expected 404 cached for the negative TTL, got %v (cached=%v)", ttl, ok)
+	}
+	if ttl, ok := expiry("/found"); !ok || ttl < 59*time.Minute {
+		t.Errorf("expected 200 cached for the default TTL, got %v (cached=%v)", ttl, ok)
+	}
+	if _, ok := expiry("/unavailable"); ok {
+		t.Error("expected 503 not to be cached by default")
+	}
+
+	// Listing 503 makes it negatively cacheable too
+	cfg.Cache.NegativeStatuses = []int{http.StatusNotFound, http.StatusServiceUnavailable}
+	handler = createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+	if ttl, ok := expiry("/unavailable"); !ok || ttl > 11*time.Second {
+		t.Errorf("expected configured 503 cached for the negative TTL, got %v (cached=%v)", ttl, ok)
+	}
+}
+
+func TestNoCacheRevalidatesEveryUse(t *testing.T) {
+	var mu sync.Mutex
+	var conditional []string
+	version := "v1"
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		etag := `"` + version + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache, max-age=3600")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("payload " + version))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/doc", nil))
+		return rec
+	}
+
+	if rec := get(); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected no-cache response to be stored, got X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+
+	// Despite max-age, every use is confirmed with the upstream first
+	for i := 0; i < 2; i++ {
+		rec := get()
+		if rec.Body.String() != "payload v1" || rec.Header().Get("X-Cache") != "REVALIDATED" {
+			t.Fatalf("expected revalidated cached body, got %q X-Cache %q", rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+
+	// A changed resource is fetched instead of serving the stored copy
+	mu.Lock()
+	version = "v2"
+	mu.Unlock()
+	if rec := get(); rec.Body.String() != "payload v2" {
+		t.Errorf("expected updated body after failed revalidation, got %q", rec.Body.String())
+	}
+
+	want := []string{"", `"v1"`, `"v1"`, `"v1"`}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(conditional, "|") != strings.Join(want, "|") {
+		t.Errorf("upstream If-None-Match = %q, want %q", conditional, want)
+	}
+}
+
+func TestNoStoreIsNeverCached(t *testing.T) {
+	var hits int
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("secret"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/doc", nil))
+	}
+	if hits != 2 || c.Len() != 0 {
+		t.Errorf("expected no-store to bypass the cache, got %d upstream hits and %d entries", hits, c.Len())
+	}
+}
+
+func TestStaleNeverServedWithoutRevalidation(t *testing.T) {
+	var mu sync.Mutex
+	down := false
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=3600, s-maxage=1")
+		w.Write([]byte("payload"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	req := httptest.NewRequest("GET", "/doc", nil)
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	entry, ok := c.Get(requestCacheKey(req, nil))
+	if !ok {
+		t.Fatal("expected response to be cached")
+	}
+	if ttl := entry.ExpiresAt.Sub(start); ttl > 2*time.Second {
+		t.Errorf("expected s-maxage to override max-age, got TTL %v", ttl)
+	}
+
+	// Once stale, a failed revalidation surfaces the upstream error
+	// rather than the stored copy
+	entry.ExpiresAt = time.Now().Add(-time.Second)
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/doc", nil))
+	if rec.Code != http.StatusServiceUnavailable || strings.Contains(rec.Body.String(), "payload") {
+		t.Errorf("expected upstream error instead of stale body, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCachedEntrySizeCountsHeaders(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Large", strings.Repeat("h", 4096))
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/doc", nil))
+	if c.Len() != 1 || c.Size() <= 4096 {
+		t.Errorf("expected stored headers to count toward cache size, got %d bytes for %d entries", c.Size(), c.Len())
+	}
+}
+
+func TestEntryLargerThanCacheStreamedUncached(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/small" {
+			w.Write([]byte("ok"))
+			return
+		}
+		// Fits the body buffer but not the cache once headers are counted
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.MaxSize = 1024
+	c := cache.NewMemoryCache(cfg.Cache.MaxSize, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/small", nil))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/big", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 1000 {
+		t.Errorf("expected full body to be streamed, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected only the small entry to stay cached, got %d entries", c.Len())
+	}
+	if _, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/small", nil), nil)); !ok {
+		t.Error("expected the small entry to survive")
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("cached"))
+			return
+		}
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Concurrency.Enabled = true
+	cfg.Concurrency.MaxInFlight = 2
+	cfg.Cache.NegativeStatuses = []int{http.StatusServiceUnavailable}
+	rec := &fakeRecorder{}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), rec, c, nil, nil, nil, nil, nil, "")
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cached", nil))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/slow/%d", i), nil))
+			codes <- w.Code
+		}()
+	}
+	<-started
+	<-started
+
+	rec.mu.Lock()
+	if rec.inFlight != 2 {
+		t.Errorf("expected the gauge to count 2 held slots, got %d", rec.inFlight)
+	}
+	rec.mu.Unlock()
+
+	// Both slots are held, so a third request is turned away
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 over the cap, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After on rejection")
+	}
+	if _, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/other", nil), nil)); ok {
+		t.Error("expected the rejection not to be cached")
+	}
+
+	// Cache hits need no upstream slot
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/cached", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected a cache hit while the slots are held, got %d %q", w.Code, w.Header().Get("X-Cache"))
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected requests within the cap to succeed, got %d", code)
+		}
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.inFlight != 0 {
+		t.Errorf("expected the gauge back at 0 once requests finish, got %d", rec.inFlight)
+	}
+	if !slices.Contains(rec.calls, "concurrency rejected") {
+		t.Errorf("expected a rejection to be recorded, got %q", rec.calls)
+	}
+}
+
+func TestConcurrencyLimitQueues(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Concurrency.Enabled = true
+	cfg.Concurrency.MaxInFlight = 1
+	cfg.Concurrency.QueueTimeout = 5 * time.Second
+	rec := &fakeRecorder{}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), rec, nil, nil, nil, nil, nil, nil, "")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	}()
+	<-started
+
+	// The queued request proceeds once the slot is released
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected queued request to succeed, got %d", w.Code)
+	}
+	<-done
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !slices.Contains(rec.calls, "concurrency queued") || slices.Contains(rec.calls, "concurrency rejected") {
+		t.Errorf("expected one queued and no rejected request, got %q", rec.calls)
+	}
+}
+
+func TestQuotaRateLimitHeaders(t *testing.T) {
+	limiter := ratelimit.NewQuotaLimiter(2, 24*time.Hour)
+	extractor := func(*http.Request) string { return "client" }
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := rateLimitMiddleware(ok, limiter, extractor, nil, log.NewNopLogger(), 0, 0, nil, nil)
+
+	for i, want := range []struct {
+		code      int
+		remaining string
+	}{
+		{http.StatusOK, "1"},
+		{http.StatusOK, "0"},
+		{http.StatusTooManyRequests, "0"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != want.code {
+			t.Errorf("request %d: expected %d, got %d", i, want.code, rec.Code)
+		}
+		if rec.Header().Get("X-RateLimit-Limit") != "2" || rec.Header().Get("X-RateLimit-Remaining") != want.remaining {
+			t.Errorf("request %d: unexpected quota headers limit=%q remaining=%q", i,
+				rec.Header().Get("X-RateLimit-Limit"), rec.Header().Get("X-RateLimit-Remaining"))
+		}
+		reset, err := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil || reset <= time.Now().Unix() || reset > time.Now().Add(24*time.Hour).Unix() {
+			t.Errorf("request %d: expected reset within the next day, got %q", i, rec.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+}
+
+// keyRecorder is a limiter that records the keys it is asked about
+type keyRecorder struct {
+	ratelimit.Limiter
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (k *keyRecorder) Allow(key string) bool {
+	k.mu.Lock()
+	k.keys[key] = true
+	k.mu.Unlock()
+	return k.Limiter.Allow(key)
+}
+
+func TestAdminRateLimitReset(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Admin.Enabled = true
+	cfg.Admin.Token = "secret"
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, limiter, ratelimit.IPKeyExtractor, nil, nil, nil, "")
+
+	do := func(method, target, token, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Admin calls are rate limited too, so each comes from its own address
+	client := "192.0.2.10:1234"
+	admins := 0
+	admin := func() string {
+		admins++
+		return fmt.Sprintf("198.51.100.%d:1234", admins)
+	}
+	if rec := do("GET", "/api", "", client); rec.Code != http.StatusOK {
+		t.Fatalf("expected the first request through, got %d", rec.Code)
+	}
+	if rec := do("GET", "/api", "", client); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the client to be limited, got %d", rec.Code)
+	}
+
+	if rec := do("DELETE", "/admin/ratelimit?key=192.0.2.10", "", admin()); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", rec.Code)
+	}
+	if rec := do("DELETE", "/admin/ratelimit", "secret", admin()); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a key, got %d", rec.Code)
+	}
+	if rec := do("GET", "/admin/ratelimit?key=192.0.2.10", "secret", admin()); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+	if rec := do("DELETE", "/admin/ratelimit?key=192.0.2.10", "secret", admin()); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	if rec := do("GET", "/api", "", client); rec.Code != http.StatusOK {
+		t.Errorf("expected the client to be allowed again after the reset, got %d", rec.Code)
+	}
+}
+
+func TestRateLimitExempt(t *testing.T) {
+	cfg := newTestConfig(t, "http://127.0.0.1:1")
+	cfg.RateLimit.Exempt = config.RateLimitExemptConfig{
+		IPs:          []string{"10.0.0.0/8"},
+		APIKeys:      []string{"monitor-key"},
+		PathPrefixes: []string{"/healthz"},
+	}
+	limiter := &keyRecorder{Limiter: ratelimit.NewTokenBucket(1, 1), keys: make(map[string]bool)}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := rateLimitMiddleware(ok, limiter, ratelimit.IPKeyExtractor, nil, log.NewNopLogger(), 0, 0, rateLimitExemption(cfg), nil)
+
+	send := func(remote, path, apiKey string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remote
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := send("10.1.2.3:1234", "/api", ""); code != http.StatusOK {
+			t.Fatalf("request %d: expected exempt IP never to be limited, got %d", i, code)
+		}
+		if code := send("192.0.2.7:1234", "/healthz", ""); code != http.StatusOK {
+			t.Fatalf("request %d: expected exempt path never to be limited, got %d", i, code)
+		}
+		if code := send("192.0.2.8:1234", "/api", "monitor-key"); code != http.StatusOK {
+			t.Fatalf("request %d: expected exempt API key never to be limited, got %d", i, code)
+		}
+	}
+
+	if code := send("192.0.2.1:1234", "/api", ""); code != http.StatusOK {
+		t.Errorf("expected first request from another client to pass, got %d", code)
+	}
+	if code := send("192.0.2.1:1234", "/api", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected other clients to be limited, got %d", code)
+	}
+
+	// Exempt prefixes match whole path segments only
+	send("192.0.2.2:1234", "/healthzx", "")
+	if code := send("192.0.2.2:1234", "/healthzx", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected /healthzx to be limited, got %d", code)
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if len(limiter.keys) != 2 || !limiter.keys["192.0.2.1"] || !limiter.keys["192.0.2.2"] {
+		t.Errorf("expected only the limited clients to reach the limiter, got %v", limiter.keys)
+	}
+}
+
+func TestRateLimitTiers(t *testing.T) {
+	limiter := ratelimit.NewTieredLimiter(
+		ratelimit.NewTokenBucket(1, 2),
+		map[string]ratelimit.Limiter{"premium": ratelimit.NewTokenBucket(1, 5)},
+		ratelimit.APIKeyTier(map[string]string{"paid-key": "premium"}),
+	)
+	extractor := ratelimit.APIKeyExtractor("X-API-Key", ratelimit.IPKeyExtractor)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := rateLimitMiddleware(ok, limiter, extractor, nil, log.NewNopLogger(), 0, 0, nil, nil)
+
+	served := func(remote, apiKey string) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = remote
+			if apiKey != "" {
+				req.Header.Set("X-API-Key", apiKey)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code == http.StatusOK {
+				n++
+			}
+		}
+		return n
+	}
+
+	premium, anonymous := served("192.0.2.1:1234", "paid-key"), served("192.0.2.2:1234", "")
+	if premium != 5 || anonymous != 2 {
+		t.Errorf("expected premium key to get 5 requests and anonymous client 2, got %d and %d", premium, anonymous)
+	}
+}
+
+func TestUpstreamErrorsAreClassified(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := newTestConfig(t, "http://"+addr)
+	pool, err := upstream.NewPool(upstreamBackends(cfg), upstream.Strategy(cfg.Upstream.Strategy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.CloseIdleConnections)
+	pages, err := errorpage.New(errorPageConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &fakeRecorder{}
+	proxy := newReverseProxy(cfg, pool, nil, nil, pages, rec, log.NewNopLogger())
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 for an unreachable upstream, got %d", w.Code)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !slices.Contains(rec.calls, "upstream error connection_refused") {
+		t.Errorf("expected a connection_refused upstream error, got %v", rec.calls)
+	}
+}
+
+func TestRequestsInFlightGauge(t *testing.T) {
+	m := metrics.NewMetrics("dev", "unknown")
+	entered, release := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+	handler := metricsMiddleware(slow, m, nil)
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/slow", nil))
+	}()
+	<-entered
+	if body := scrape(); !strings.Contains(body, `http_requests_in_flight{method="POST"} 1`) {
+		t.Error("expected the in-flight gauge to count the slow request")
+	}
+
+	close(release)
+	<-done
+	body := scrape()
+	if !strings.Contains(body, `http_requests_in_flight{method="POST"} 0`) {
+		t.Error("expected the in-flight gauge to drop once the request finished")
+	}
+	if !strings.Contains(body, `http_requests_by_class_total{method="POST",status_class="2xx"} 1`) {
+		t.Error("expected the finished request to be counted in its status class")
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+		{"00-not-hex-01", ""},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := parseTraceparent(tt.header); got != tt.want {
+			t.Errorf("parseTraceparent(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRequestMetricsCarryTraceExemplar(t *testing.T) {
+	m := metrics.NewMetrics("dev", "unknown")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := traceContextMiddleware(metricsMiddleware(ok, m, nil))
+
+	req := httptest.NewRequest("GET", "/traced", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	scrape := httptest.NewRequest("GET", "/metrics", nil)
+	scrape.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, scrape)
+	if !strings.Contains(rec.Body.String(), `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+		t.Error("expected the request's trace ID as an exemplar in the OpenMetrics scrape")
+	}
+}
+
+func TestPprofEndpoint(t *testing.T) {
+	cfg := newTestConfig(t, "http://127.0.0.1:1")
+	cfg.Admin.Token = "secret"
+	m := metrics.NewMetrics("dev", "unknown")
+
+	get := func(handler http.Handler, path, token string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	disabled := MetricsHandler(cfg, m)
+	if code := get(disabled, "/debug/pprof/", "secret"); code != http.StatusNotFound {
+		t.Errorf("expected 404 with pprof disabled, got %d", code)
+	}
+	if code := get(disabled, "/metrics", ""); code != http.StatusOK {
+		t.Errorf("expected metrics to be served, got %d", code)
+	}
+
+	cfg.Debug.Pprof = true
+	enabled := MetricsHandler(cfg, m)
+	if code := get(enabled, "/debug/pprof/", "secret"); code != http.StatusOK {
+		t.Errorf("expected 200 with pprof enabled, got %d", code)
+	}
+	if code := get(enabled, "/debug/pprof/", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", code)
+	}
+}
+
+func TestHeadServedFromGetEntry(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Method != http.MethodHead {
+			w.Write([]byte("hello"))
+		}
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	// A HEAD miss is proxied but does not populate the entry
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("HEAD", "/doc", nil))
+	if _, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/doc", nil), nil)); ok {
+		t.Fatal("expected a HEAD response not to be cached")
+	}
+
+	get := httptest.NewRecorder()
+	handler.ServeHTTP(get, httptest.NewRequest("GET", "/doc", nil))
+	if get.Body.String() != "hello" {
+		t.Fatalf("expected GET body from upstream, got %q", get.Body.String())
+	}
+
+	head := httptest.NewRecorder()
+	handler.ServeHTTP(head, httptest.NewRequest("HEAD", "/doc", nil))
+	if hits != 2 {
+		t.Errorf("expected HEAD to be served from the GET entry, upstream hit %d times", hits)
+	}
+	if head.Code != http.StatusOK || head.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected a 200 cache hit, got %d with X-Cache %q", head.Code, head.Header().Get("X-Cache"))
+	}
+	if head.Header().Get("Content-Type") != "text/plain" || head.Header().Get("ETag") != get.Header().Get("ETag") {
+		t.Errorf("expected the GET response's headers, got %v", head.Header())
+	}
+	if head.Header().Get("Content-Length") != "5" {
+		t.Errorf("expected Content-Length of the cached body, got %q", head.Header().Get("Content-Length"))
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("expected an empty HEAD body, got %q", head.Body.String())
+	}
+}
+
+func TestTrackingParamsShareCacheEntry(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("page"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.IgnoreQueryParams = []string{"utm_*", "fbclid"}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	for _, target := range []string{"/landing", "/landing?utm_source=x", "/landing?fbclid=abc&utm_medium=mail"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Body.String() != "page" {
+			t.Fatalf("%s: expected the page, got %q", target, w.Body.String())
+		}
+	}
+	if hits != 1 {
+		t.Errorf("expected tracking parameters to share one cache entry, upstream hit %d times", hits)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/landing?page=2", nil))
+	if hits != 2 {
+		t.Errorf("expected other query parameters to miss the cache, upstream hit %d times", hits)
+	}
+}
+
+func TestCacheHitAgeGrows(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	age := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/page", nil))
+		if rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("expected cache hit, got %q", rec.Header().Get("X-Cache"))
+		}
+		return rec.Header().Get("Age")
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+	if got := age(); got != "0" {
+		t.Errorf("expected Age 0 right after storing, got %q", got)
+	}
+
+	// Pretend the entry was stored 42 seconds ago
+	entry, ok := c.Get(requestCacheKey(httptest.NewRequest("GET", "/page", nil), nil))
+	if !ok {
+		t.Fatal("expected response to be cached")
+	}
+	entry.CreatedAt = entry.CreatedAt.Add(-42 * time.Second)
+	if got := age(); got != "42" {
+		t.Errorf("expected Age to grow to 42, got %q", got)
+	}
+}
+
+func TestCacheablePostKeyedOnBody(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("results for " + string(body)))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CacheableMethods = []string{"GET", "HEAD", "POST"}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	search := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/search", strings.NewReader(query)))
+		return w
+	}
+
+	if w := search("cats"); w.Body.String() != "results for cats" {
+		t.Fatalf("expected the upstream to see the body, got %q", w.Body.String())
+	}
+	if w := search("cats"); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "results for cats" {
+		t.Errorf("expected a repeated search to hit the cache, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if w := search("dogs"); w.Body.String() != "results for dogs" {
+		t.Errorf("expected a different body to miss the cache, got %q", w.Body.String())
+	}
+	if hits != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", hits)
+	}
+
+	// GET is unaffected by the POST entries
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/search", nil))
+	if hits != 3 {
+		t.Errorf("expected GET to use its own entry, got %d upstream requests", hits)
+	}
+}
+
+func TestUnsafeMethodInvalidatesEntry(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if r.Header.Get("X-Fail") != "" {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("item"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/items/1?v=2", nil))
+		return w.Header().Get("X-Cache")
+	}
+	get()
+	if status := get(); status != "HIT" {
+		t.Fatalf("expected the GET to be cached, got %q", status)
+	}
+
+	// A failed update leaves the entry alone
+	req := httptest.NewRequest("PUT", "/items/1?v=2", strings.NewReader("new"))
+	req.Header.Set("X-Fail", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if status := get(); status != "HIT" {
+		t.Errorf("expected a failed PUT to keep the entry, got %q", status)
+	}
+
+	for _, method := range []string{"PUT", "PATCH", "DELETE", "POST"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items/1?v=2", strings.NewReader("new")))
+		if status := get(); status == "HIT" {
+			t.Errorf("expected a successful %s to drop the entry", method)
+		}
+	}
+}
+
+func TestCacheableStatusCodes(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Location", "/elsewhere")
+		w.WriteHeader(http.StatusFound)
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Cache.CacheableStatusCodes = []int{http.StatusOK, http.StatusMovedPermanently}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/moved", nil))
+	}
+	if hits != 2 {
+		t.Errorf("expected an unlisted 302 not to be cached, got %d upstream requests", hits)
+	}
+}
+
+func TestAdminConfigEndpoint(t *testing.T) {
+	cfg := newTestConfig(t, "http://127.0.0.1:1")
+	cfg.Admin.Enabled = true
+	cfg.Admin.Token = "secret"
+	cfg.Cache.Redis.Password = "hunter2"
+	cfg.Cache.DefaultTTL = 90 * time.Second
+	cfg.RateLimit.Exempt.APIKeys = []string{"internal-monitoring-key"}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/config", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", rec.Code)
+	}
+
+	rec := get("secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var got config.Config
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid config JSON: %v", err)
+	}
+	if got.Upstream.URL != cfg.Upstream.URL || got.Cache.DefaultTTL != 90*time.Second || got.Server.Port != cfg.Server.Port {
+		t.Errorf("expected the loaded values, got upstream %q, TTL %v, port %d", got.Upstream.URL, got.Cache.DefaultTTL, got.Server.Port)
+	}
+	if got.Admin.Token != "[REDACTED]" || got.Cache.Redis.Password != "[REDACTED]" {
+		t.Errorf("expected secrets to be redacted, got token %q and password %q", got.Admin.Token, got.Cache.Redis.Password)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "hunter2") || strings.Contains(body, "internal-monitoring-key") {
+		t.Error("expected no secret to appear in the response")
+	}
+	if cfg.Admin.Token != "secret" {
+		t.Error("expected redaction to leave the running config untouched")
+	}
+}
+
+func TestAdminCacheKeysEndpoint(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	cfg := newTestConfig(t, up.URL)
+	cfg.Admin.Enabled = true
+	cfg.Admin.Token = "secret"
+	cfg.Cache.CacheableMethods = []string{"GET", "HEAD", "POST"}
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/b", strings.NewReader("query")))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/c?page=2", nil))
+
+	get := func(target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/admin/cache/keys", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", rec.Code)
+	}
+	if rec := get("/admin/cache/keys?limit=0", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a zero limit, got %d", rec.Code)
+	}
+
+	type keysPage struct {
+		Total  int `json:"total"`
+		Offset int `json:"offset"`
+		Limit  int `json:"limit"`
+		Keys   []struct {
+			Key        string  `json:"key"`
+			Method     string  `json:"method"`
+			URL        string  `json:"url"`
+			StatusCode int     `json:"status_code"`
+			Size       int64   `json:"size"`
+			AgeSeconds float64 `json:"age_seconds"`
+			TTLSeconds float64 `json:"ttl_seconds"`
+			ETag       string  `json:"etag"`
+		} `json:"keys"`
+	}
+	list := func(target string) keysPage {
+		t.Helper()
+		rec := get(target, "secret")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", target, rec.Code)
+		}
+		var page keysPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", target, err)
+		}
+		return page
+	}
+
+	page := list("/admin/cache/keys")
+	if page.Total != 3 || len(page.Keys) != 3 || page.Limit != 100 {
+		t.Fatalf("expected all 3 keys on the default page, got %+v", page)
+	}
+	k := page.Keys[0]
+	wantKey := requestCacheKey(httptest.NewRequest("GET", "/c?page=2", nil), nil)
+	if k.Key != wantKey || k.Method != "GET" || k.URL != "/c?page=2" || k.StatusCode != http.StatusOK || k.ETag == "" || k.Size <= 4 {
+		t.Errorf("unexpected entry %+v", k)
+	}
+	if k.AgeSeconds < 0 || k.AgeSeconds > 5 || k.TTLSeconds < 55 || k.TTLSeconds > 60 {
+		t.Errorf("unexpected age %v or TTL %v", k.AgeSeconds, k.TTLSeconds)
+	}
+
+	page = list("/admin/cache/keys?offset=1&limit=1")
+	if page.Total != 3 || page.Offset != 1 || len(page.Keys) != 1 || page.Keys[0].Method != "POST" || page.Keys[0].URL != "/b" {
+		t.Errorf("expected the second key alone, got %+v", page)
+	}
+	if page := list("/admin/cache/keys?limit=100000"); page.Limit != maxCacheKeysLimit {
+		t.Errorf("expected the limit to be capped at %d, got %d", maxCacheKeysLimit, page.Limit)
+	}
+}
+
+func TestAdminHealthzEndpoint(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := "http://127.0.0.1:1"
+	cfg := newTestConfig(t, up.URL)
+	cfg.Upstream.Backends = []config.BackendConfig{{URL: up.URL}, {URL: down}}
+	cfg.Admin.Enabled = true
+	cfg.Admin.Token = "secret"
+	cfg.Cache.Type = "memory"
+	cfg.RateLimit.Algorithm = "token_bucket"
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	c.Set("GET:/a", &cache.Entry{StatusCode: http.StatusOK, Body: []byte("body"), ExpiresAt: time.Now().Add(time.Minute)})
+	limiter := ratelimit.NewTokenBucket(100, 100)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c,
+		limiter, ratelimit.IPKeyExtractor, nil, nil, nil, "1.2.3")
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/healthz", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the admin token, got %d", rec.Code)
+	}
+
+	rec := get("secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var body struct {
+		Status        string    `json:"status"`
+		Version       string    `json:"version"`
+		StartedAt     time.Time `json:"started_at"`
+		UptimeSeconds float64   `json:"uptime_seconds"`
+		Cache         struct {
+			Enabled bool   `json:"enabled"`
+			Backend string `json:"backend"`
+			Size    int64  `json:"size"`
+			MaxSize int64  `json:"max_size"`
+			Entries int    `json:"entries"`
+		} `json:"cache"`
+		RateLimiter struct {
+			Enabled   bool   `json:"enabled"`
+			Algorithm string `json:"algorithm"`
+			Buckets   *int   `json:"buckets"`
+		} `json:"rate_limiter"`
+		Upstreams []struct {
+			URL    string `json:"url"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"upstreams"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if body.Status != "degraded" || body.Version != "1.2.3" {
+		t.Errorf("expected degraded status and the build version, got %q %q", body.Status, body.Version)
+	}
+	if body.StartedAt.After(time.Now()) || body.UptimeSeconds <= 0 {
+		t.Errorf("unexpected start %v or uptime %v", body.StartedAt, body.UptimeSeconds)
+	}
+	if !body.Cache.Enabled || body.Cache.Backend != "memory" || body.Cache.Entries != 1 ||
+		body.Cache.Size != c.Size() || body.Cache.MaxSize != cfg.Cache.MaxSize {
+		t.Errorf("unexpected cache section %+v", body.Cache)
+	}
+	// The unauthorized request and this one share the client's bucket
+	if !body.RateLimiter.Enabled || body.RateLimiter.Algorithm != "token_bucket" ||
+		body.RateLimiter.Buckets == nil || *body.RateLimiter.Buckets != 1 {
+		t.Errorf("unexpected rate limiter section %+v", body.RateLimiter)
+	}
+	if len(body.Upstreams) != 2 {
+		t.Fatalf("expected both backends, got %+v", body.Upstreams)
+	}
+	if u := body.Upstreams[0]; u.URL != up.URL || u.Status != "ok" || u.Error != "" {
+		t.Errorf("expected the live backend to be ok, got %+v", u)
+	}
+	if u := body.Upstreams[1]; u.URL != down || u.Status != "failing" || u.Error == "" {
+		t.Errorf("expected the closed backend to be failing, got %+v", u)
+	}
+}
+
+func TestLoggingSampling(t *testing.T) {
+	serve := func(sampleRate float64, slow time.Duration, h http.HandlerFunc, n int) int {
+		core, logs := observer.New(zapcore.InfoLevel)
+		handler := loggingMiddleware(h, log.NewWithCore(core), sampleRate, slow, nil)
+		for i := 0; i < n; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		return logs.FilterMessage("HTTP request").Len()
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+
+	if got := serve(0, 0, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}, 50); got != 50 {
+		t.Errorf("expected every error to be logged, got %d of 50", got)
+	}
+
+	if got := serve(0, 5*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		ok(w, r)
+	}, 5); got != 5 {
+		t.Errorf("expected every slow request to be logged, got %d of 5", got)
+	}
+
+	if got := serve(1, 0, ok, 100); got != 100 {
+		t.Errorf("expected every request at sample rate 1, got %d of 100", got)
+	}
+	if got := serve(0, 0, ok, 100); got != 0 {
+		t.Errorf("expected no requests at sample rate 0, got %d", got)
+	}
+
+	// 5000 draws at p=0.2 have a standard deviation of ~28
+	if got := serve(0.2, 0, ok, 5000); got < 800 || got > 1200 {
+		t.Errorf("expected roughly 1000 of 5000 requests logged at sample rate 0.2, got %d", got)
+	}
+}
+
+func TestLoggingExclusions(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Logging.ExcludeStatuses = []int{http.StatusNotModified}
+	cfg.Logging.ExcludePaths = []string{"/static/", "/health"}
+	core, logs := observer.New(zapcore.InfoLevel)
+	rec := &fakeRecorder{}
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewWithCore(core), rec, nil, nil, nil, nil, nil, nil, "")
+
+	send := func(path, ifNoneMatch string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("/static/app.js", `"v1"`) // 304 on an excluded path
+	send("/static/app.js", "")     // excluded path
+	send("/api/items", `"v1"`)     // excluded status
+	send("/health", "")
+	send("/healthcheck", "") // not under /health
+	send("/api/items", "")
+
+	entries := logs.FilterMessage("HTTP request").All()
+	if len(entries) != 2 {
+		t.Fatalf("expected only the unexcluded requests in the access log, got %d lines", len(entries))
+	}
+	if fields := entries[0].ContextMap(); fields["path"] != "/healthcheck" {
+		t.Errorf("expected /healthcheck to be logged, got %v", fields)
+	}
+	if fields := entries[1].ContextMap(); fields["path"] != "/api/items" || fields["status"] != int64(http.StatusOK) {
+		t.Errorf("expected the 200 for /api/items to be logged, got %v", fields)
+	}
+
+	// Excluded requests are still counted in metrics
+	var requests []string
+	for _, call := range rec.calls {
+		if strings.HasPrefix(call, "request ") {
+			requests = append(requests, call)
+		}
+	}
+	if len(requests) != 6 {
+		t.Fatalf("expected every request in metrics, got %v", requests)
+	}
+	if !strings.HasPrefix(requests[0], "request GET /static/app.js 304 ") {
+		t.Errorf("expected the excluded 304 to be recorded, got %q", requests[0])
+	}
+}
+
+func TestLoggingCacheStatus(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	})
+	upURL, _ := url.Parse(up.URL)
+
+	cfg := newTestConfig(t, up.URL)
+	core, logs := observer.New(zapcore.InfoLevel)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewWithCore(core), nil, c, nil, nil, nil, nil, nil, "")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/data", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/data", nil))
+
+	entries := logs.FilterMessage("HTTP request").All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 access log lines, got %d", len(entries))
+	}
+
+	miss := entries[0].ContextMap()
+	if miss["cache_status"] != "miss" {
+		t.Errorf("expected cache_status miss, got %v", miss["cache_status"])
+	}
+	if miss["upstream_host"] != upURL.Host {
+		t.Errorf("expected upstream_host %s, got %v", upURL.Host, miss["upstream_host"])
+	}
+	if d, ok := miss["upstream_duration"].(time.Duration); !ok || d <= 0 {
+		t.Errorf("expected a positive upstream_duration on a miss, got %v", miss["upstream_duration"])
+	}
+
+	hit := entries[1].ContextMap()
+	if hit["cache_status"] != "hit" {
+		t.Errorf("expected cache_status hit, got %v", hit["cache_status"])
+	}
+	if _, ok := hit["upstream_duration"]; ok {
+		t.Errorf("expected no upstream_duration on a hit, got %v", hit["upstream_duration"])
+	}
+}
+
+func TestSlowRequestWarning(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	})
+	logger := log.NewWithCore(core)
+	handler := requestIDMiddleware(loggingMiddleware(slow, logger, 1, 25*time.Millisecond, nil), logger)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if n := logs.FilterMessage("Slow request").Len(); n != 0 {
+		t.Fatalf("expected no slow request warning under the threshold, got %d", n)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	warnings := logs.FilterMessage("Slow request").All()
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 slow request warning, got %d", len(warnings))
+	}
+	if warnings[0].Level != zapcore.WarnLevel {
+		t.Errorf("expected warn level, got %v", warnings[0].Level)
+	}
+	fields := warnings[0].ContextMap()
+	if fields["path"] != "/slow" {
+		t.Errorf("expected path /slow, got %v", fields["path"])
+	}
+	if d, ok := fields["duration"].(time.Duration); !ok || d < 25*time.Millisecond {
+		t.Errorf("expected duration past the threshold, got %v", fields["duration"])
+	}
+	if n := logs.FilterMessage("HTTP request").Len(); n != 2 {
+		t.Errorf("expected both requests in the access log, got %d", n)
+	}
+
+	// Disabled by default
+	core, logs = observer.New(zapcore.InfoLevel)
+	handler = loggingMiddleware(slow, log.NewWithCore(core), 1, 0, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	if n := logs.FilterMessage("Slow request").Len(); n != 0 {
+		t.Errorf("expected no warning with the threshold disabled, got %d", n)
+	}
+}
+
+func TestRequestScopedLogger(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	core, logs := observer.New(zapcore.InfoLevel)
+	limiter := ratelimit.NewTokenBucket(1, 1)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewWithCore(core), nil,
+		nil, limiter, ratelimit.IPKeyExtractor, nil, nil, nil, "")
+
+	send := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("X-Request-ID", id)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	send("req-ok")
+	if rec := send("req-limited"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("X-Request-ID") != "req-limited" {
+		t.Errorf("expected a 429 carrying the request ID, got %d %q", rec.Code, rec.Header().Get("X-Request-ID"))
+	}
+
+	for _, msg := range []string{"HTTP request", "Rate limit exceeded"} {
+		for _, entry := range logs.FilterMessage(msg).All() {
+			fields := entry.ContextMap()
+			if fields["request_id"] == nil || fields["method"] != "GET" || fields["path"] != "/data" {
+				t.Errorf("%s: expected request_id, method and path, got %v", msg, fields)
+			}
+		}
+	}
+	if n := logs.FilterMessage("Rate limit exceeded").FilterField(log.String("request_id", "req-limited")).Len(); n != 1 {
+		t.Errorf("expected the rate limit warning to carry the request ID, got %d matches", n)
+	}
+}
+
+func TestPooledBodyBuffersNotRetained(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat(strings.TrimPrefix(r.URL.Path, "/"), 100)))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	c := cache.NewMemoryCache(1024*1024, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	// Each miss reuses the previous miss's buffer from the pool
+	for _, p := range []string{"/a", "/b", "/c"} {
+		get(p)
+	}
+	for _, p := range []string{"/a", "/b", "/c"} {
+		rec := get(p)
+		want := strings.Repeat(strings.TrimPrefix(p, "/"), 100)
+		if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != want {
+			t.Errorf("%s: expected cached body to survive buffer reuse, got %s %q", p, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that allocates nothing per write
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+
+// BenchmarkResponseRecorderBody compares capturing a 16 KiB body into a
+// fresh buffer per request with the pooled buffers handleProxy uses
+func BenchmarkResponseRecorderBody(b *testing.B) {
+	chunk := make([]byte, 4096)
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	capture := func(body *[]byte) *responseRecorder {
+		rec := &responseRecorder{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+			body:           body,
+			maxBuffer:      1 << 20,
+		}
+		for i := 0; i < 4; i++ {
+			rec.Write(chunk)
+		}
+		return rec
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			capture(&[]byte{})
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			capture(getBodyBuffer()).release()
+		}
+	})
+}
+
+func TestMetricsOnMainPort(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte("upstream"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	cfg.Metrics.Enabled = true
+	cfg.Metrics.SamePort = true
+	m := metrics.NewMetrics("dev", "unknown")
+	deps := Deps{
+		Logger:         log.NewNopLogger(),
+		Metrics:        m,
+		Limiter:        ratelimit.NewTokenBucket(1, 1),
+		KeyExtractor:   ratelimit.IPKeyExtractor,
+		MetricsHandler: m.Handler(),
+	}
+	p, err := New(cfg, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	var handler http.Handler = p
+
+	// Scrapes are neither rate limited nor proxied
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", cfg.Metrics.Path, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "go_goroutines") {
+			t.Fatalf("scrape %d: expected metrics, got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if hits != 0 {
+		t.Errorf("expected no upstream requests for scrapes, got %d", hits)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics/other", nil))
+	if rec.Body.String() != "upstream" || hits != 1 {
+		t.Errorf("expected other paths to be proxied, got %q after %d upstream hits", rec.Body.String(), hits)
+	}
+
+	// Without same_port the path is ordinary proxied traffic
+	cfg.Metrics.SamePort = false
+	handler = createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), m,
+		nil, nil, nil, nil, nil, nil, "")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", cfg.Metrics.Path, nil))
+	if rec.Body.String() != "upstream" {
+		t.Errorf("expected the metrics path to be proxied, got %q", rec.Body.String())
+	}
+
+	// Same port metrics without a handler to serve them is an error rather
+	// than a path silently proxied upstream
+	cfg.Metrics.SamePort = true
+	deps.MetricsHandler = nil
+	if _, err := New(cfg, deps); err == nil {
+		t.Error("expected same_port without a metrics handler to fail")
+	}
+}
+
+func TestNewCacheHitAndMiss(t *testing.T) {
+	hits := 0
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("payload"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	p, err := New(cfg, Deps{
+		Logger: log.NewNopLogger(),
+		Cache:  cache.NewMemoryCache(1024*1024, time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/item", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+			t.Fatalf("request %d: unexpected response %d %q", i, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: expected X-Cache %s, got %q", i, want, got)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("expected 1 upstream request, got %d", hits)
+	}
+}
+
+func TestNewRateLimited(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	cfg := newTestConfig(t, up.URL)
+	p, err := New(cfg, Deps{
+		Logger:       log.NewNopLogger(),
+		Limiter:      ratelimit.NewTokenBucket(1, 2),
+		KeyExtractor: ratelimit.IPKeyExtractor,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	send := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := send("192.0.2.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: expected 200, got %d", i, rec.Code)
+		}
+	}
+	rec := send("192.0.2.1:1000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After past the burst, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := send("192.0.2.2:1000"); rec.Code != http.StatusOK {
+		t.Errorf("expected another client to be unaffected, got %d", rec.Code)
+	}
+}
+
+func TestReadyReportsUnreachableUpstream(t *testing.T) {
+	// Reserve a port and close it so dialing the upstream fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := newTestConfig(t, "http://"+addr)
+	cfg.Server.Readiness.CheckUpstream = true
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with the upstream down, got %d", rec.Code)
+	}
+	var body struct {
+		Status string                    `json:"status"`
+		Checks map[string]readinessCheck `json:"checks"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	up := body.Checks["upstream"]
+	if body.Status != "degraded" || up.Status != "failing" || up.Healthy != 0 || up.Total != 1 || up.Error == "" {
+		t.Errorf("unexpected readiness breakdown %s", rec.Body.String())
+	}
+
+	// Liveness does not depend on the upstream
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /health to stay 200, got %d", rec.Code)
+	}
+
+	// Without the upstream check the proxy reports ready
+	cfg.Server.Readiness.CheckUpstream = false
+	handler = createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 without the upstream check, got %d", rec.Code)
+	}
+}
+
+func TestReadyChecksCacheAndBackends(t *testing.T) {
+	up := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	// The second backend is unreachable but one healthy backend is enough
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	cfg := newTestConfig(t, "")
+	cfg.Upstream.Backends = []config.BackendConfig{{URL: up.URL}, {URL: down}}
+	cfg.Cache.DiskDir = t.TempDir()
+	cfg.Server.Readiness.CheckUpstream = true
+	c := cache.NewMemoryCache(1<<20, time.Minute)
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with one healthy backend, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"healthy":1,"total":2`) {
+		t.Errorf("unexpected readiness breakdown %s", rec.Body.String())
+	}
+
+	// A body directory that cannot be created fails the cache check
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Cache.DiskDir = filepath.Join(file, "bodies")
+	handler = createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, c, nil, nil, nil, nil, nil, "")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"cache":{"status":"failing"`) {
+		t.Errorf("expected the cache check to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyReusesRecentResult(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newTestConfig(t, "http://"+ln.Addr().String())
+	cfg.Server.Readiness.CheckUpstream = true
+	handler := createProxyHandler(newTestProxy(t, cfg), cfg, log.NewNopLogger(), nil, nil, nil, nil, nil, nil, nil, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the upstream listening, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A probe right after the upstream goes away reuses the last result
+	ln.Close()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the cached 200 within %s, got %d", readyCacheTTL, rec.Code)
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/cache"
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/upstream"
+)
+
+// readinessCheck is the result of one dependency check reported by /ready
+type readinessCheck struct {
+	Status  string `json:"status"` // ok or failing
+	Healthy int    `json:"healthy,omitempty"`
+	Total   int    `json:"total,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// readyCacheTTL is how long /ready reuses the results of its checks, so
+// that frequent probes don't dial every backend each time
+const readyCacheTTL = time.Second
+
+// readyHandler reports whether the proxy can serve traffic: it is not
+// draining, at least one upstream backend is reachable and the cache's
+// external dependencies are available. Failing checks answer 503 with a
+// breakdown so operators can see which dependency is down. Results are
+// reused for readyCacheTTL.
+func readyHandler(cfg *config.Config, pool *upstream.Pool, c cache.Cache, bodies *cache.DiskStore, lc *Lifecycle) http.HandlerFunc {
+	timeout := cfg.Server.Readiness.Timeout
+
+	var mu sync.Mutex
+	var checks map[string]readinessCheck
+	var checkedAt time.Time
+	runChecks := func(ctx context.Context) map[string]readinessCheck {
+		mu.Lock()
+		defer mu.Unlock()
+		if checks != nil && time.Since(checkedAt) < readyCacheTTL {
+			return checks
+		}
+
+		// Shared with concurrent probes, so not cut short if this one's
+		// client goes away
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+
+		checks = make(map[string]readinessCheck)
+		if cfg.Server.Readiness.CheckUpstream {
+			checks["upstream"] = checkBackends(ctx, liveBackends(pool))
+		}
+		if c != nil || bodies != nil {
+			checks["cache"] = checkCache(c, bodies)
+		}
+		checkedAt = time.Now()
+		return checks
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if lc != nil && lc.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+			return
+		}
+
+		checks := runChecks(r.Context())
+		status, code := "ready", http.StatusOK
+		for _, check := range checks {
+			if check.Status != "ok" {
+				status, code = "degraded", http.StatusServiceUnavailable
+			}
+		}
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Status string                    `json:"status"`
+			Checks map[string]readinessCheck `json:"checks,omitempty"`
+		}{status, checks})
+	}
+}
+
+// checkBackends dials every backend concurrently and passes when at least
+// one accepts a connection
+func checkBackends(ctx context.Context, backends []*upstream.Backend) readinessCheck {
+	var healthy atomic.Int64
+	var lastErr atomic.Value
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Go(func() {
+			if err := dialBackend(ctx, b); err != nil {
+				lastErr.Store(err.Error())
+				return
+			}
+			healthy.Add(1)
+		})
+	}
+	wg.Wait()
+
+	check := readinessCheck{Status: "ok", Healthy: int(healthy.Load()), Total: len(backends)}
+	if check.Healthy == 0 {
+		check.Status = "failing"
+		check.Error, _ = lastErr.Load().(string)
+	}
+	return check
+}
+
+// liveBackends returns the pool's current backends, which change when the
+// upstream configuration is reloaded
+func liveBackends(pool *upstream.Pool) []*upstream.Backend {
+	if pool == nil {
+		return nil
+	}
+	return pool.Backends()
+}
+
+// dialBackend checks that the backend accepts TCP connections
+func dialBackend(ctx context.Context, b *upstream.Backend) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", b.Addr())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkCache checks the cache backend and the directory for large bodies.
+// An in-memory cache has nothing that can fail.
+func checkCache(c cache.Cache, bodies *cache.DiskStore) readinessCheck {
+	var err error
+	if checker, ok := c.(cache.Checker); ok {
+		err = checker.Check()
+	}
+	if err == nil && bodies != nil {
+		err = bodies.Check()
+	}
+	if err != nil {
+		return readinessCheck{Status: "failing", Error: err.Error()}
+	}
+	return readinessCheck{Status: "ok"}
+}
@@ -0,0 +1,658 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mumumio1/wproxy/internal/config"
+	"github.com/mumumio1/wproxy/internal/errorpage"
+	"github.com/mumumio1/wproxy/internal/log"
+	"github.com/mumumio1/wproxy/internal/metrics"
+	"github.com/mumumio1/wproxy/internal/mirror"
+	"github.com/mumumio1/wproxy/internal/ratelimit"
+	"github.com/mumumio1/wproxy/internal/route"
+	"github.com/mumumio1/wproxy/internal/upstream"
+)
+
+// upstreamBackends converts the upstream config into backend definitions
+func upstreamBackends(cfg *config.Config) []upstream.BackendConfig {
+	return routeBackends(cfg, config.TransportConfig{})
+}
+
+// routeBackends converts the upstream config into backend definitions
+// whose connection settings are overridden by those of a route
+func routeBackends(cfg *config.Config, override config.TransportConfig) []upstream.BackendConfig {
+	resolved := cfg.Upstream.ResolvedBackends()
+	backends := make([]upstream.BackendConfig, 0, len(resolved))
+	for _, b := range resolved {
+		backends = append(backends, upstream.BackendConfig{
+			URL:       b.URL,
+			Weight:    b.Weight,
+			Transport: transportConfig(cfg, override.Inherit(b.Transport)),
+		})
+	}
+	return backends
+}
+
+// defaultTransportConfig returns the upstream-wide transport settings
+func defaultTransportConfig(cfg *config.Config) upstream.TransportConfig {
+	return transportConfig(cfg, cfg.Upstream.DefaultTransport())
+}
+
+// transportConfig converts connection settings into a transport definition
+func transportConfig(cfg *config.Config, t config.TransportConfig) upstream.TransportConfig {
+	return upstream.TransportConfig{
+		Timeout:               t.Timeout,
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		IdleConnTimeout:       t.IdleConnTimeout,
+		TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
+		TLSServerName:         t.TLS.ServerName,
+		InsecureSkipVerify:    t.TLS.InsecureSkipVerify,
+		TLSSessionCacheSize:   t.TLS.SessionCacheSize,
+		TLSClientCertFile:     t.TLS.CertFile,
+		TLSClientKeyFile:      t.TLS.KeyFile,
+		TLSCAFile:             t.TLS.CAFile,
+		HTTP2:                 cfg.Upstream.EnableHTTP2,
+		ExpectContinueTimeout: cfg.Upstream.ExpectContinueTimeout,
+	}
+}
+
+// newVariantPool creates a pool holding the upstreams of every traffic
+// split variant, or returns nil when no route splits traffic. Variants get
+// their own connection pools and never receive load-balanced traffic.
+func newVariantPool(cfg *config.Config) (*upstream.Pool, error) {
+	backends := variantBackends(cfg)
+	if len(backends) == 0 {
+		return nil, nil
+	}
+	return upstream.NewPool(backends, upstream.RoundRobin)
+}
+
+// variantBackends returns the split variants of every route, each once,
+// with the upstream-wide transport settings
+func variantBackends(cfg *config.Config) []upstream.BackendConfig {
+	seen := make(map[string]bool)
+	var backends []upstream.BackendConfig
+	for _, r := range cfg.Routes {
+		for _, v := range r.Split {
+			if seen[v.URL] {
+				continue
+			}
+			seen[v.URL] = true
+			backends = append(backends, upstream.BackendConfig{
+				URL:       v.URL,
+				Transport: defaultTransportConfig(cfg),
+			})
+		}
+	}
+	return backends
+}
+
+// routeVariantBackends returns the split variants of a route with
+// transport settings, each once, with the route's transport settings
+func routeVariantBackends(cfg *config.Config, r config.RouteConfig) []upstream.BackendConfig {
+	transport := transportConfig(cfg, r.Transport.Inherit(cfg.Upstream.DefaultTransport()))
+	backends := make([]upstream.BackendConfig, 0, len(r.Split))
+	seen := make(map[string]bool)
+	for _, v := range r.Split {
+		if !seen[v.URL] {
+			seen[v.URL] = true
+			backends = append(backends, upstream.BackendConfig{URL: v.URL, Transport: transport})
+		}
+	}
+	return backends
+}
+
+// routePool holds the connections of a route with its own transport
+// settings: to every backend, and to its split variants if it has any
+type routePool struct {
+	primary  *upstream.Pool
+	variants *upstream.Pool
+}
+
+// routePools maps requests to the pools of the routes that override the
+// transport settings. A nil routePools sends every request through the
+// upstream-wide pools.
+type routePools struct {
+	routes *route.Table
+	pools  map[string]*routePool // keyed by path prefix
+}
+
+// newRoutePools creates pools for the routes with transport settings, or
+// returns nil when no route has any
+func newRoutePools(cfg *config.Config) (*routePools, error) {
+	pools := make(map[string]*routePool)
+	for _, r := range cfg.Routes {
+		if !r.HasTransport() {
+			continue
+		}
+		primary, err := upstream.NewPool(routeBackends(cfg, r.Transport), upstream.Strategy(cfg.Upstream.Strategy))
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.PathPrefix, err)
+		}
+		rp := &routePool{primary: primary}
+		if len(r.Split) > 0 {
+			if rp.variants, err = upstream.NewPool(routeVariantBackends(cfg, r), upstream.RoundRobin); err != nil {
+				return nil, fmt.Errorf("route %s: %w", r.PathPrefix, err)
+			}
+		}
+		pools[r.PathPrefix] = rp
+	}
+	if len(pools) == 0 {
+		return nil, nil
+	}
+	return &routePools{routes: route.NewTable(routeConfigs(cfg)), pools: pools}, nil
+}
+
+// forPath returns the pools of the route matching a path, or nil when the
+// route, if any, uses the upstream-wide pools
+func (rp *routePools) forPath(path string) *routePool {
+	if rp == nil {
+		return nil
+	}
+	rt := rp.routes.Match(path)
+	if rt == nil {
+		return nil
+	}
+	return rp.pools[rt.PathPrefix]
+}
+
+// prepare validates the upstream backends of cfg for the pools of routes
+// with transport settings, and for their split variants. Routes added
+// since the pools were created keep using the upstream-wide pools.
+func (rp *routePools) prepare(cfg *config.Config) ([]*upstream.PendingUpdate, error) {
+	if rp == nil {
+		return nil, nil
+	}
+	var updates []*upstream.PendingUpdate
+	for _, r := range cfg.Routes {
+		p, ok := rp.pools[r.PathPrefix]
+		if !ok || !r.HasTransport() {
+			continue
+		}
+		u, err := p.primary.Prepare(routeBackends(cfg, r.Transport))
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.PathPrefix, err)
+		}
+		updates = append(updates, u)
+		if p.variants != nil && len(r.Split) > 0 {
+			u, err := p.variants.Prepare(routeVariantBackends(cfg, r))
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", r.PathPrefix, err)
+			}
+			updates = append(updates, u)
+		}
+	}
+	return updates, nil
+}
+
+// CloseIdleConnections closes idle connections in every route's pools
+func (rp *routePools) CloseIdleConnections() {
+	if rp == nil {
+		return
+	}
+	for _, p := range rp.pools {
+		p.primary.CloseIdleConnections()
+		if p.variants != nil {
+			p.variants.CloseIdleConnections()
+		}
+	}
+}
+
+// routeTransport sends requests for routes with transport settings through
+// their own pools and everything else through next
+type routeTransport struct {
+	routes *routePools
+	next   http.RoundTripper
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rp := t.routes.forPath(req.URL.Path)
+	if rp == nil {
+		return t.next.RoundTrip(req)
+	}
+	if rp.variants != nil && variantFromContext(req.Context()) != nil {
+		return rp.variants.RoundTrip(req)
+	}
+	return rp.primary.RoundTrip(req)
+}
+
+// upstreamPool returns the upstream-wide pool behind a reverse proxy
+// transport, or nil when it does not go through one
+func upstreamPool(rt http.RoundTripper) *upstream.Pool {
+	switch t := rt.(type) {
+	case *upstream.Pool:
+		return t
+	case *variantTransport:
+		return t.primary
+	case *routeTransport:
+		return upstreamPool(t.next)
+	}
+	return nil
+}
+
+// newReverseProxy creates the reverse proxy forwarding to the upstream pool.
+// Requests assigned to a traffic split variant go to the variants pool.
+func newReverseProxy(
+	cfg *config.Config,
+	pool *upstream.Pool,
+	variants *upstream.Pool,
+	routes *routePools,
+	pages *errorpage.Renderer,
+	m metrics.Recorder,
+	logger log.Logger,
+) *httputil.ReverseProxy {
+	hashKey := balancerKey(cfg)
+	// Patterns were validated when the config was loaded
+	forbiddenPatterns, _ := cfg.Upstream.ForbiddenHeaderRegexps()
+	stripForbidden := func(h http.Header) {
+		stripHeaders(h, cfg.Upstream.ForbiddenHeaders, forbiddenPatterns)
+	}
+	// Already validated when the config was loaded
+	trusted, _ := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies)
+
+	var transport http.RoundTripper = pool
+	variantURLs := make(map[string]*url.URL)
+	if variants != nil {
+		for _, r := range cfg.Routes {
+			for _, v := range r.Split {
+				// Already validated when the config was loaded
+				variantURLs[v.URL], _ = url.Parse(v.URL)
+			}
+		}
+		transport = &variantTransport{primary: pool, variants: variants}
+	}
+	if routes != nil {
+		transport = &routeTransport{routes: routes, next: transport}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// Before req.Host is pointed at the upstream
+			setForwardingHeaders(req, cfg.Upstream.Forwarding, trusted)
+
+			if v := variantFromContext(req.Context()); v != nil {
+				if target, ok := variantURLs[v.URL]; ok {
+					req.URL.Scheme = target.Scheme
+					req.URL.Host = target.Host
+					req.Host = target.Host
+					if outcome := outcomeFromContext(req.Context()); outcome != nil {
+						outcome.upstreamHost = target.Host
+					}
+					stripForbidden(req.Header)
+					return
+				}
+			}
+
+			primary := pool
+			if rp := routes.forPath(req.URL.Path); rp != nil {
+				primary = rp.primary
+			}
+			backend := primary.NextFor(hashKey(req))
+			if backend == nil {
+				// Leaving the host empty makes the pool fail the round trip
+				// with ErrNoBackend, which the error handler turns into a 502
+				log.FromContext(req.Context(), logger).Error("No usable upstream backend")
+				req.URL.Host = ""
+				return
+			}
+			req.URL.Scheme = backend.URL.Scheme
+			req.URL.Host = backend.URL.Host
+			req.Host = backend.URL.Host
+			// The pool may be updated before the round trip, so it must
+			// not have to find the backend again by host
+			*req = *req.WithContext(upstream.WithBackend(req.Context(), backend))
+			if outcome := outcomeFromContext(req.Context()); outcome != nil {
+				outcome.upstreamHost = backend.URL.Host
+			}
+
+			stripForbidden(req.Header)
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			requestID, _ := r.Context().Value(log.RequestIDKey).(string)
+
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				pages.Render(w, http.StatusRequestEntityTooLarge, "request body too large", requestID)
+				return
+			}
+
+			kind := upstream.ClassifyError(err)
+			status, message := http.StatusBadGateway, "bad gateway"
+			if errors.Is(context.Cause(r.Context()), errUpstreamTimeout) {
+				kind = "request_timeout"
+				status, message = http.StatusGatewayTimeout, "gateway timeout"
+			}
+			if m != nil {
+				m.RecordUpstreamError(kind)
+			}
+			log.FromContext(r.Context(), logger).Error("Upstream request failed",
+				log.String("error_type", kind),
+				log.Error(err),
+			)
+			pages.Render(w, status, message, requestID)
+		},
+	}
+
+	var hooks []func(*http.Response) error
+
+	if m != nil {
+		hooks = append(hooks, func(resp *http.Response) error {
+			m.RecordUpstreamResponse(resp.Proto)
+			return nil
+		})
+	}
+
+	if limit := cfg.Upstream.MaxResponseBodySize; limit > 0 {
+		hooks = append(hooks, func(resp *http.Response) error {
+			return limitResponseBody(resp, limit)
+		})
+	}
+
+	if len(cfg.Routes) > 0 {
+		routes := route.NewTable(routeConfigs(cfg))
+		hooks = append(hooks, func(resp *http.Response) error {
+			return validateContentType(resp, routes)
+		})
+	}
+
+	if policy := corsPolicy(cfg); policy != nil {
+		hooks = append(hooks, func(resp *http.Response) error {
+			policy.Apply(resp.Header, resp.Request.Header.Get("Origin"))
+			return nil
+		})
+	}
+
+	// The backend's cache directive is meant for the proxy alone
+	if name := cfg.Cache.ControlHeader; name != "" {
+		hooks = append(hooks, func(resp *http.Response) error {
+			directive := strings.ToLower(strings.TrimSpace(resp.Header.Get(name)))
+			resp.Header.Del(name)
+			if outcome := outcomeFromContext(resp.Request.Context()); outcome != nil {
+				outcome.cacheDirective = directive
+			}
+			return nil
+		})
+	}
+
+	// Decide cacheability as soon as upstream headers arrive so uncacheable
+	// responses are streamed without being buffered
+	hooks = append(hooks, func(resp *http.Response) error {
+		if outcome := outcomeFromContext(resp.Request.Context()); outcome != nil {
+			outcome.uncacheable = !isStorable(resp, cacheRules(cfg), outcome.cacheDirective)
+		}
+		return nil
+	})
+
+	if len(hooks) > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			for _, hook := range hooks {
+				if err := hook(resp); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return proxy
+}
+
+// variantTransport sends requests assigned to a traffic split variant
+// through the variants pool and everything else through the primary pool
+type variantTransport struct {
+	primary  *upstream.Pool
+	variants *upstream.Pool
+}
+
+func (t *variantTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if variantFromContext(req.Context()) != nil {
+		return t.variants.RoundTrip(req)
+	}
+	return t.primary.RoundTrip(req)
+}
+
+// balancerKey returns the function deriving the sticky-session key for the
+// hashed balancing strategies
+func balancerKey(cfg *config.Config) func(*http.Request) string {
+	if !upstream.Strategy(cfg.Upstream.Strategy).Hashed() {
+		return func(*http.Request) string { return "" }
+	}
+
+	// Already validated when the config was loaded
+	trusted, _ := ratelimit.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	cookieName := cfg.Upstream.HashCookie
+	byCookie := cfg.Upstream.Strategy == string(upstream.CookieHash)
+
+	return func(r *http.Request) string {
+		if byCookie {
+			if cookie, err := r.Cookie(cookieName); err == nil && cookie.Value != "" {
+				return "cookie:" + cookie.Value
+			}
+		}
+		return "ip:" + ratelimit.ClientIP(r, trusted)
+	}
+}
+
+// setForwardingHeaders adds the configured forwarding headers to a request
+// bound for the upstream. Headers from a trusted proxy describe the original
+// client and are extended; from anyone else they could be forged, so they
+// are dropped first.
+func setForwardingHeaders(req *http.Request, cfg config.ForwardingConfig, trusted ratelimit.TrustedProxies) {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	if ip := net.ParseIP(peer); ip == nil || !trusted.Contains(ip) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			req.Header.Del(name)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if cfg.XForwarded {
+		// The reverse proxy appends the peer to X-Forwarded-For itself
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+	} else {
+		// A nil value stops the reverse proxy from adding X-Forwarded-For
+		req.Header["X-Forwarded-For"] = nil
+	}
+
+	if cfg.Forwarded {
+		element := "for=" + forwardedNode(peer) + ";host=" + forwardedValue(req.Host) + ";proto=" + proto
+		if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		req.Header.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats an address as a Forwarded "for" node: IPv6
+// addresses are bracketed and quoted, as RFC 7239 requires
+func forwardedNode(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return `"[` + addr + `]"`
+	}
+	return forwardedValue(addr)
+}
+
+// forwardedValue returns v as a Forwarded parameter value, quoting it
+// unless it is a plain token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// isTokenChar reports whether c may appear in an HTTP token (RFC 9110)
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// stripHeaders removes the named headers and those matching any pattern
+func stripHeaders(h http.Header, names []string, patterns []*regexp.Regexp) {
+	for _, name := range names {
+		h.Del(name)
+	}
+	if len(patterns) == 0 {
+		return
+	}
+	for name := range h {
+		for _, re := range patterns {
+			if re.MatchString(name) {
+				delete(h, name)
+				break
+			}
+		}
+	}
+}
+
+// newMirror creates the traffic mirror with its own connection pool. The
+// mirror inherits the upstream transport settings and forbidden headers.
+func newMirror(cfg *config.Config, m metrics.Recorder) (*mirror.Mirror, error) {
+	var recorder mirror.Recorder
+	if m != nil {
+		recorder = m
+	}
+	transport, err := upstream.NewTransport(defaultTransportConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := cfg.Upstream.ForbiddenHeaderRegexps()
+	if err != nil {
+		return nil, err
+	}
+	return mirror.New(mirror.Config{
+		URL:                 cfg.Mirror.URL,
+		SampleRate:          cfg.Mirror.SampleRate,
+		Timeout:             cfg.Mirror.Timeout,
+		MaxBodySize:         cfg.Mirror.MaxBodySize,
+		MaxInFlight:         cfg.Mirror.MaxInFlight,
+		StripHeaders:        cfg.Upstream.ForbiddenHeaders,
+		StripHeaderPatterns: patterns,
+		Transport:           transport,
+	}, recorder)
+}
+
+// errUpstreamTimeout is the cause of a request canceled by the upstream
+// request timeout
+var errUpstreamTimeout = errors.New("upstream request timeout")
+
+// errResponseTooLarge is returned when an upstream body exceeds the limit
+var errResponseTooLarge = errors.New("upstream response body too large")
+
+// limitResponseBody rejects upstream responses whose declared length exceeds
+// the limit and aborts streamed bodies once they grow past it
+func limitResponseBody(resp *http.Response, limit int64) error {
+	// An upgraded connection is a stream, not a response body
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	if resp.ContentLength > limit {
+		return errResponseTooLarge
+	}
+	resp.Body = &limitedBody{
+		ReadCloser: resp.Body,
+		remaining:  limit,
+		outcome:    outcomeFromContext(resp.Request.Context()),
+	}
+	return nil
+}
+
+// limitedBody fails reads once more than the allowed bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	outcome   *requestOutcome
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the limit to detect overflow
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		if b.outcome != nil {
+			b.outcome.truncated = true
+		}
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
+
+// errorPageConfig converts the error page config into renderer settings
+func errorPageConfig(cfg *config.Config) errorpage.Config {
+	return errorpage.Config{
+		Format:    cfg.ErrorPages.Format,
+		Templates: cfg.ErrorPages.Templates,
+	}
+}
+
+// routeConfigs converts the route config into route definitions
+func routeConfigs(cfg *config.Config) []route.Config {
+	routes := make([]route.Config, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		variants := make([]route.Variant, 0, len(r.Split))
+		for _, v := range r.Split {
+			variants = append(variants, route.Variant{Name: v.Name, URL: v.URL, Weight: v.Weight})
+		}
+		routes = append(routes, route.Config{
+			PathPrefix:         r.PathPrefix,
+			ExpectContentTypes: r.ExpectContentType,
+			Variants:           variants,
+			SplitBy:            r.SplitBy,
+		})
+	}
+	return routes
+}
+
+// validateContentType rejects upstream responses whose content type does
+// not match what the route expects, e.g. an HTML error page on a JSON API
+func validateContentType(resp *http.Response, routes *route.Table) error {
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	rt := routes.Match(resp.Request.URL.Path)
+	if rt == nil {
+		return nil
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !rt.AcceptsContentType(contentType) {
+		return fmt.Errorf("unexpected upstream content type %q for route %s", contentType, rt.PathPrefix)
+	}
+	return nil
+}
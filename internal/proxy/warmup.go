@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/log"
+)
+
+// warmupRemoteAddr is the client address of warmup requests, so they are
+// rate limited as local traffic
+const warmupRemoteAddr = "127.0.0.1:0"
+
+// WarmCache requests each path through the full handler chain, one at a
+// time, so cacheable responses are stored before clients ask for them.
+// A request that is rate limited waits out its Retry-After and is tried
+// again. It returns the number of paths answered with a 2xx or 3xx and
+// the number that failed, and stops early when ctx is canceled.
+func (p *Proxy) WarmCache(ctx context.Context, paths []string) (warmed, failed int) {
+	for i, path := range paths {
+		if ctx.Err() != nil {
+			failed += len(paths) - i
+			break
+		}
+		status, err := p.warm(ctx, path)
+		switch {
+		case err != nil:
+			p.logger.Warn("Cache warmup request failed", log.String("path", path), log.Error(err))
+			failed++
+		case status >= http.StatusBadRequest:
+			p.logger.Warn("Cache warmup request failed", log.String("path", path), log.Int("status", status))
+			failed++
+		default:
+			warmed++
+		}
+	}
+
+	p.logger.Info("Cache warmup finished",
+		log.Int("warmed", warmed),
+		log.Int("failed", failed),
+	)
+	return warmed, failed
+}
+
+// warm requests path until it is not rate limited, returning the status
+func (p *Proxy) warm(ctx context.Context, path string) (int, error) {
+	for {
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		if err != nil {
+			return 0, err
+		}
+		r.RemoteAddr = warmupRemoteAddr
+		r.RequestURI = path
+		r.Header.Set("User-Agent", "wproxy-cache-warmer")
+
+		w := &warmupWriter{header: make(http.Header), status: http.StatusOK}
+		p.handler.ServeHTTP(w, r)
+		if w.status != http.StatusTooManyRequests {
+			return w.status, nil
+		}
+
+		t := time.NewTimer(parseRetryAfter(w.header.Get("Retry-After")))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// parseRetryAfter parses a Retry-After value in seconds or as an HTTP date,
+// waiting a second when it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return time.Second
+}
+
+// warmupWriter records the status of a warmup response and discards the
+// body
+type warmupWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+func (w *warmupWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmupWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader || isInformational(statusCode) {
+		return
+	}
+	w.status = statusCode
+	w.wroteHeader = true
+}
+
+func (w *warmupWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return len(b), nil
+}
@@ -0,0 +1,205 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest valid version 1 header, including CRLF
+const maxV1Length = 107
+
+// ErrNoHeader is returned when a connection does not start with a PROXY
+// protocol header
+var ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+
+// Listener accepts connections that start with a PROXY protocol v1 or v2
+// header and reports the client address it carries as RemoteAddr. Every
+// connection must send a header; connections without one fail on first use.
+type Listener struct {
+	net.Listener
+	// Timeout bounds reading the header, 0 means no limit
+	Timeout time.Duration
+}
+
+// NewListener wraps l to read PROXY protocol headers
+func NewListener(l net.Listener, timeout time.Duration) *Listener {
+	return &Listener{Listener: l, Timeout: timeout}
+}
+
+// Accept waits for the next connection. The header is read lazily on the
+// first Read or RemoteAddr so a slow client cannot stall the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, r: bufio.NewReaderSize(c, 256), timeout: l.Timeout}, nil
+}
+
+// Conn is a connection whose addresses come from its PROXY protocol header
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+// Read reads from the connection after the header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the header. It falls back to
+// the peer address for LOCAL commands, unknown families or invalid headers.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header, if any
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	peek, err := c.r.Peek(len(v2Signature))
+	switch {
+	case err == nil && bytes.Equal(peek, v2Signature):
+		c.remote, c.local, c.err = readV2(c.r)
+	case len(peek) >= 6 && string(peek[:6]) == "PROXY ":
+		c.remote, c.local, c.err = readV1(c.r)
+	case err != nil:
+		c.err = err
+	default:
+		c.err = ErrNoHeader
+	}
+}
+
+// readV1 parses a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Length {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("proxyproto: v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+
+	src, err := v1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func v1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("proxyproto: invalid v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 parses a binary header. TLVs after the addresses are skipped.
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxyproto: unsupported version %d", hdr[12]>>4)
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health checks from the balancer itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("proxyproto: unsupported command %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("proxyproto: v2 address block too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
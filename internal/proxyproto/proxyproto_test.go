@@ -0,0 +1,192 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// v2Header builds a binary PROXY header for TCP over IPv4 or IPv6
+func v2Header(command byte, src, dst *net.TCPAddr, tlvs []byte) []byte {
+	family := byte(0x11)
+	srcIP, dstIP := []byte(src.IP.To4()), []byte(dst.IP.To4())
+	if srcIP == nil {
+		family = 0x21
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	var body []byte
+	body = append(body, srcIP...)
+	body = append(body, dstIP...)
+	body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+	body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+	body = append(body, tlvs...)
+
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, 0x20|command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return append(hdr, body...)
+}
+
+// accept sends data over a fresh connection to a wrapped listener and
+// returns the accepted connection
+func accept(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inner.Close() })
+	l := NewListener(inner, time.Second)
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readPayload(t *testing.T, conn net.Conn, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read payload: %v", err)
+	}
+	return string(buf)
+}
+
+func TestV1Header(t *testing.T) {
+	tests := []struct {
+		header, remote, local string
+	}{
+		{"PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n", "192.0.2.10:56324", "198.51.100.1:443"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4000 8080\r\n", "[2001:db8::1]:4000", "[2001:db8::2]:8080"},
+	}
+	for _, tt := range tests {
+		conn := accept(t, []byte(tt.header+"GET / HTTP/1.1\r\n"))
+		if got := conn.RemoteAddr().String(); got != tt.remote {
+			t.Errorf("expected remote %s, got %s", tt.remote, got)
+		}
+		if got := conn.LocalAddr().String(); got != tt.local {
+			t.Errorf("expected local %s, got %s", tt.local, got)
+		}
+		if got := readPayload(t, conn, 16); got != "GET / HTTP/1.1\r\n" {
+			t.Errorf("expected payload after header, got %q", got)
+		}
+	}
+}
+
+func TestV1UnknownKeepsPeerAddress(t *testing.T) {
+	conn := accept(t, []byte("PROXY UNKNOWN\r\nping"))
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("expected peer address, got %s", conn.RemoteAddr())
+	}
+	if got := readPayload(t, conn, 4); got != "ping" {
+		t.Errorf("expected payload, got %q", got)
+	}
+}
+
+func TestV2Header(t *testing.T) {
+	tests := []struct {
+		src, dst *net.TCPAddr
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		},
+	}
+	for _, tt := range tests {
+		// A trailing TLV must be skipped, not treated as payload
+		tlv := []byte{0x04, 0x00, 0x02, 'i', 'd'}
+		conn := accept(t, append(v2Header(0x1, tt.src, tt.dst, tlv), "ping"...))
+		if got := conn.RemoteAddr().String(); got != tt.src.String() {
+			t.Errorf("expected remote %s, got %s", tt.src, got)
+		}
+		if got := conn.LocalAddr().String(); got != tt.dst.String() {
+			t.Errorf("expected local %s, got %s", tt.dst, got)
+		}
+		if got := readPayload(t, conn, 4); got != "ping" {
+			t.Errorf("expected payload after header, got %q", got)
+		}
+	}
+}
+
+func TestV2LocalKeepsPeerAddress(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1}
+	conn := accept(t, append(v2Header(0x0, addr, addr, nil), "ping"...))
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("expected peer address for LOCAL command, got %s", conn.RemoteAddr())
+	}
+	if got := readPayload(t, conn, 4); got != "ping" {
+		t.Errorf("expected payload, got %q", got)
+	}
+}
+
+func TestInvalidHeaders(t *testing.T) {
+	tests := map[string][]byte{
+		"missing":     []byte("GET / HTTP/1.1\r\n\r\n"),
+		"bad v1":      []byte("PROXY TCP4 not-an-ip 198.51.100.1 1 2\r\n"),
+		"v1 family":   []byte("PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n"),
+		"v1 no crlf":  []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\n"),
+		"bad version": append(append([]byte{}, v2Signature...), 0x31, 0x11, 0, 0),
+		"short v2":    append(append([]byte{}, v2Signature...), 0x21, 0x11, 0, 4, 1, 2, 3, 4),
+		"bad command": append(append([]byte{}, v2Signature...), 0x2f, 0x11, 0, 0),
+	}
+	for name, data := range tests {
+		conn := accept(t, data)
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: expected read to fail", name)
+		}
+	}
+
+	conn := accept(t, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("expected ErrNoHeader, got %v", err)
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	l := NewListener(inner, 50*time.Millisecond)
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected silent client to time out")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected header read to be bounded by the timeout, took %v", time.Since(start))
+	}
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+import "context"
+
+// ConcurrencyLimiter caps how many requests are in flight at once,
+// regardless of their rate, to protect backends that degrade under load
+type ConcurrencyLimiter struct {
+	slots chan struct{}
+}
+
+// NewConcurrencyLimiter creates a limiter allowing max requests at once
+func NewConcurrencyLimiter(max int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{slots: make(chan struct{}, max)}
+}
+
+// TryAcquire takes a slot if one is free without waiting
+func (l *ConcurrencyLimiter) TryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Acquire waits for a free slot until ctx is done
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by TryAcquire or Acquire
+func (l *ConcurrencyLimiter) Release() {
+	<-l.slots
+}
+
+// InFlight returns the number of slots currently taken
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
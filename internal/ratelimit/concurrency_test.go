@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter(2)
+
+	if !limiter.TryAcquire() || !limiter.TryAcquire() {
+		t.Fatal("expected slots up to the cap to be granted")
+	}
+	if limiter.TryAcquire() {
+		t.Error("expected acquire beyond the cap to fail")
+	}
+	if limiter.InFlight() != 2 {
+		t.Errorf("expected 2 in flight, got %d", limiter.InFlight())
+	}
+
+	limiter.Release()
+	if !limiter.TryAcquire() {
+		t.Error("expected a released slot to be reusable")
+	}
+}
+
+func TestConcurrencyLimiterAcquireWaits(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1)
+	limiter.TryAcquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx); err == nil {
+		t.Fatal("expected acquire to time out while the slot is held")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		limiter.Release()
+	}()
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Errorf("expected acquire to succeed once the slot is released, got %v", err)
+	}
+}
+
+func TestConcurrencyLimiterCapsParallelism(t *testing.T) {
+	limiter := NewConcurrencyLimiter(3)
+	var current, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.Acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			defer limiter.Release()
+			n := current.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			current.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if peak.Load() > 3 {
+		t.Errorf("expected at most 3 concurrent holders, saw %d", peak.Load())
+	}
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// gcra implements the generic cell rate algorithm, a leaky bucket used as a
+// meter. Instead of counting tokens it tracks each key's theoretical
+// arrival time (TAT): the time at which the key's bucket would be empty. A
+// request is allowed when it arrives no earlier than TAT minus the burst
+// tolerance, and then pushes TAT forward by one emission interval. Admitted
+// requests are paced exactly 1/rate apart once the burst is used, and the
+// wait for the next one is known precisely.
+type gcra struct {
+	mu        sync.Mutex
+	interval  time.Duration // emission interval, 1/rate
+	tolerance time.Duration // how far TAT may run ahead of now
+	tats      map[string]time.Time
+	lru       *keyLRU
+	now       func() time.Time
+	done      chan struct{}
+}
+
+// NewGCRA creates a GCRA rate limiter allowing requestsPerSecond on average
+// with bursts of up to burst requests
+func NewGCRA(requestsPerSecond int, burst int) Limiter {
+	return NewGCRAWithCleanup(requestsPerSecond, burst, DefaultCleanup)
+}
+
+// NewGCRAWithCleanup creates a GCRA rate limiter that sweeps drained keys
+// on cleanup's interval. Its IdleTimeout does not apply: a drained key
+// already behaves exactly like an unseen one.
+func NewGCRAWithCleanup(requestsPerSecond int, burst int, cleanup Cleanup) Limiter {
+	cleanup = cleanup.withDefaults()
+	interval := time.Second / time.Duration(requestsPerSecond)
+	g := &gcra{
+		interval:  interval,
+		tolerance: interval * time.Duration(max(burst-1, 0)),
+		tats:      make(map[string]time.Time),
+		lru:       newKeyLRU(cleanup.MaxBuckets),
+		now:       time.Now,
+		done:      make(chan struct{}),
+	}
+
+	go cleanup.sweep(g.done, g.cleanup)
+
+	return g
+}
+
+// wait returns how long until a request for key conforms
+// (must be called with lock held)
+func (g *gcra) wait(key string, now time.Time) time.Duration {
+	tat, ok := g.tats[key]
+	if !ok {
+		return 0
+	}
+	return max(tat.Add(-g.tolerance).Sub(now), 0)
+}
+
+// Allow checks if a request should be allowed
+func (g *gcra) Allow(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if g.wait(key, now) > 0 {
+		// A limited key is in use too; keep it from being evicted
+		g.lru.touch(key)
+		return false
+	}
+
+	tat, ok := g.tats[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	g.tats[key] = tat.Add(g.interval)
+	if evicted, ok := g.lru.touch(key); ok {
+		delete(g.tats, evicted)
+	}
+	return true
+}
+
+// Wait returns exactly how long until the key's next request is allowed
+func (g *gcra) Wait(key string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.wait(key, g.now())
+}
+
+// WaitCtx blocks until a request is allowed or ctx is done
+func (g *gcra) WaitCtx(ctx context.Context, key string) error {
+	return waitCtx(ctx, g, key)
+}
+
+// Reset forgets the key's TAT, restoring its full burst
+func (g *gcra) Reset(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.tats, key)
+	g.lru.remove(key)
+}
+
+// cleanup removes keys whose bucket has drained completely, since they
+// behave exactly like unseen keys
+func (g *gcra) cleanup() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	for key, tat := range g.tats {
+		if tat.Before(now) {
+			delete(g.tats, key)
+			g.lru.remove(key)
+		}
+	}
+}
+
+// Len returns the number of keys whose bucket has not drained yet
+func (g *gcra) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.tats)
+}
+
+// Stop stops the rate limiter cleanup goroutine
+func (g *gcra) Stop() {
+	close(g.done)
+}
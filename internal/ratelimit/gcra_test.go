@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// admissions sends a request every step for n steps on a fake clock and
+// records which were allowed
+func admissions(limiter Limiter, now *time.Time, step time.Duration, n int) []bool {
+	allowed := make([]bool, n)
+	for i := range allowed {
+		allowed[i] = limiter.Allow("client")
+		*now = now.Add(step)
+	}
+	return allowed
+}
+
+func TestGCRAPacesSteadyStream(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	g := NewGCRA(10, 3).(*gcra)
+	defer g.Stop()
+	g.now = clock
+	tb := NewTokenBucket(10, 3).(*tokenBucket)
+	defer tb.Stop()
+	tb.now = clock
+
+	// 40 requests at 40/s against a limit of 10/s
+	start := now
+	gcraAllowed := admissions(g, &now, 25*time.Millisecond, 40)
+	now = start
+	bucketAllowed := admissions(tb, &now, 25*time.Millisecond, 40)
+
+	count := func(allowed []bool) int {
+		n := 0
+		for _, ok := range allowed {
+			if ok {
+				n++
+			}
+		}
+		return n
+	}
+	if count(gcraAllowed) != count(bucketAllowed) {
+		t.Errorf("expected GCRA to admit as many requests as the token bucket, got %d and %d",
+			count(gcraAllowed), count(bucketAllowed))
+	}
+
+	// The burst is admitted at once, then exactly every fourth request
+	for i, ok := range gcraAllowed {
+		want := i < 3 || (i-3)%4 == 1
+		if ok != want {
+			t.Errorf("request %d: expected allowed=%v, got %v", i, want, ok)
+		}
+	}
+}
+
+func TestGCRAWait(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	g := NewGCRA(10, 2).(*gcra)
+	defer g.Stop()
+	g.now = func() time.Time { return now }
+
+	if wait := g.Wait("client"); wait != 0 {
+		t.Errorf("expected no wait for an unseen key, got %v", wait)
+	}
+	if !g.Allow("client") || !g.Allow("client") {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if g.Allow("client") {
+		t.Fatal("expected a request beyond the burst to be denied")
+	}
+	if wait := g.Wait("client"); wait != 100*time.Millisecond {
+		t.Errorf("expected a wait of one emission interval, got %v", wait)
+	}
+
+	now = now.Add(30 * time.Millisecond)
+	if wait := g.Wait("client"); wait != 70*time.Millisecond {
+		t.Errorf("expected the wait to shrink with elapsed time, got %v", wait)
+	}
+	now = now.Add(70 * time.Millisecond)
+	if !g.Allow("client") {
+		t.Error("expected a request to be allowed once the wait elapsed")
+	}
+	if g.Allow("client") {
+		t.Error("expected a single request per emission interval after the burst")
+	}
+}
+
+func TestGCRACleanup(t *testing.T) {
+	g := NewGCRAWithCleanup(1000, 1, Cleanup{Interval: 10 * time.Millisecond}).(*gcra)
+	defer g.Stop()
+
+	has := func(key string) bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		_, ok := g.tats[key]
+		return ok
+	}
+
+	g.Allow("drained")
+	deadline := time.Now().Add(2 * time.Second)
+	for has("drained") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if has("drained") {
+		t.Error("expected the drained key to be removed")
+	}
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QuotaStore counts requests per key within a quota window. The memory
+// store suits a single instance; the Redis store is shared by all
+// instances, making the quota global.
+type QuotaStore interface {
+	// Incr adds one to the key's count for the window ending at reset and
+	// returns the new count
+	Incr(key string, reset time.Time) (int64, error)
+	// Count returns the key's count for the window ending at reset
+	Count(key string, reset time.Time) (int64, error)
+	// Delete drops the key's count for the window ending at reset
+	Delete(key string, reset time.Time) error
+}
+
+// QuotaReporter is implemented by limiters that can report a key's quota
+// for X-RateLimit-* response headers
+type QuotaReporter interface {
+	Quota(key string) (limit, remaining int, reset time.Time)
+}
+
+// QuotaLimiter allows a fixed number of requests per key in each calendar
+// window, e.g. 10000 a day. Windows are aligned to multiples of the window
+// length in UTC, so a 24h window resets at midnight UTC for every key.
+type QuotaLimiter struct {
+	limit  int64
+	window time.Duration
+	store  QuotaStore
+	now    func() time.Time
+}
+
+var (
+	_ Limiter       = (*QuotaLimiter)(nil)
+	_ QuotaReporter = (*QuotaLimiter)(nil)
+)
+
+// NewQuotaLimiter creates a quota limiter counting requests in memory for
+// any number of keys
+func NewQuotaLimiter(limit int, window time.Duration) *QuotaLimiter {
+	return NewQuotaLimiterWithStore(limit, window, NewMemoryQuotaStore(0))
+}
+
+// NewQuotaLimiterWithStore creates a quota limiter counting requests in
+// store, which may be shared between instances
+func NewQuotaLimiterWithStore(limit int, window time.Duration, store QuotaStore) *QuotaLimiter {
+	return &QuotaLimiter{limit: int64(limit), window: window, store: store, now: time.Now}
+}
+
+// reset returns when the current window ends
+func (q *QuotaLimiter) reset() time.Time {
+	return q.now().UTC().Truncate(q.window).Add(q.window)
+}
+
+// Allow counts a request against the key's quota. Requests are allowed
+// when the store fails, so an outage does not take the proxy down with it.
+func (q *QuotaLimiter) Allow(key string) bool {
+	count, err := q.store.Incr(key, q.reset())
+	return err != nil || count <= q.limit
+}
+
+// Wait returns the time until the window resets if the quota is used up
+func (q *QuotaLimiter) Wait(key string) time.Duration {
+	reset := q.reset()
+	count, err := q.store.Count(key, reset)
+	if err != nil || count < q.limit {
+		return 0
+	}
+	return reset.Sub(q.now())
+}
+
+// WaitCtx blocks until the window resets if the quota is used up. Since
+// windows are long, it usually fails at once because ctx's deadline comes
+// first.
+func (q *QuotaLimiter) WaitCtx(ctx context.Context, key string) error {
+	return waitCtx(ctx, q, key)
+}
+
+// Quota returns the key's limit, the requests left in the current window
+// and when the window resets
+func (q *QuotaLimiter) Quota(key string) (limit, remaining int, reset time.Time) {
+	reset = q.reset()
+	count, err := q.store.Count(key, reset)
+	if err != nil {
+		count = 0
+	}
+	return int(q.limit), int(max(q.limit-count, 0)), reset
+}
+
+// Reset clears the key's count for the current window. A store failure
+// leaves the count in place.
+func (q *QuotaLimiter) Reset(key string) {
+	q.store.Delete(key, q.reset())
+}
+
+// memoryQuotaStore counts requests in memory for the current window
+type memoryQuotaStore struct {
+	mu     sync.Mutex
+	reset  time.Time
+	counts map[string]int64
+	lru    *keyLRU
+}
+
+// NewMemoryQuotaStore creates a quota store local to this instance that
+// counts at most maxKeys keys per window. Past that the least recently
+// used key is forgotten, and starts its quota afresh if it returns. 0
+// means no limit.
+func NewMemoryQuotaStore(maxKeys int) QuotaStore {
+	return &memoryQuotaStore{counts: make(map[string]int64), lru: newKeyLRU(maxKeys)}
+}
+
+// roll starts a new window, dropping every count from the previous one
+// (must be called with lock held)
+func (s *memoryQuotaStore) roll(reset time.Time) {
+	if reset.After(s.reset) {
+		s.reset = reset
+		clear(s.counts)
+		s.lru = newKeyLRU(s.lru.max)
+	}
+}
+
+func (s *memoryQuotaStore) Incr(key string, reset time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(reset)
+	s.counts[key]++
+	if evicted, ok := s.lru.touch(key); ok {
+		delete(s.counts, evicted)
+	}
+	return s.counts[key], nil
+}
+
+func (s *memoryQuotaStore) Count(key string, reset time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(reset)
+	return s.counts[key], nil
+}
+
+func (s *memoryQuotaStore) Delete(key string, reset time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roll(reset)
+	delete(s.counts, key)
+	s.lru.remove(key)
+	return nil
+}
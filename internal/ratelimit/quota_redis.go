@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/redis"
+)
+
+// redisQuotaStore counts requests in Redis, so every instance pointed at
+// the same server shares one quota per key
+type redisQuotaStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisQuotaStore creates a quota store shared by every instance using
+// the same Redis server. Counts live under keys named by prefix, the
+// window's reset time and the client key, and expire when the window
+// resets.
+func NewRedisQuotaStore(client *redis.Client, prefix string) QuotaStore {
+	return &redisQuotaStore{client: client, prefix: prefix}
+}
+
+// key names the count of key in the window ending at reset
+func (s *redisQuotaStore) key(key string, reset time.Time) string {
+	return s.prefix + strconv.FormatInt(reset.Unix(), 10) + ":" + key
+}
+
+// Incr increments the count and sets its expiry in one transaction, so a
+// count is never left without one
+func (s *redisQuotaStore) Incr(key string, reset time.Time) (int64, error) {
+	k := s.key(key, reset)
+	replies, err := s.client.Pipeline(context.Background(),
+		[]string{"MULTI"},
+		[]string{"INCR", k},
+		[]string{"EXPIREAT", k, strconv.FormatInt(reset.Unix(), 10)},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return 0, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return 0, err
+		}
+	}
+	results, ok := replies[3].([]any)
+	if !ok || len(results) != 2 {
+		return 0, fmt.Errorf("redis: unexpected EXEC reply %v", replies[3])
+	}
+	count, ok := results[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %v", results[0])
+	}
+	return count, nil
+}
+
+func (s *redisQuotaStore) Count(key string, reset time.Time) (int64, error) {
+	reply, err := s.client.Do(context.Background(), "GET", s.key(key, reset))
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	v, _ := reply.(string)
+	count, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("redis: invalid quota count %q", v)
+	}
+	return count, nil
+}
+
+func (s *redisQuotaStore) Delete(key string, reset time.Time) error {
+	_, err := s.client.Do(context.Background(), "DEL", s.key(key, reset))
+	return err
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mumumio1/wproxy/internal/redis"
+	"github.com/mumumio1/wproxy/internal/redis/redistest"
+)
+
+func TestRedisQuotaStoreShared(t *testing.T) {
+	srv := redistest.NewServer(t)
+	now := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	srv.SetTime(now)
+
+	// Two instances, each with its own client, share one quota
+	instances := make([]*QuotaLimiter, 2)
+	for i := range instances {
+		client := redis.NewClient(redis.Options{Address: srv.Addr()})
+		t.Cleanup(func() { client.Close() })
+		instances[i] = NewQuotaLimiterWithStore(3, 24*time.Hour, NewRedisQuotaStore(client, "quota:"))
+		instances[i].now = func() time.Time { return now }
+	}
+
+	for i := 0; i < 3; i++ {
+		if !instances[i%2].Allow("client") {
+			t.Fatalf("expected request %d within the quota", i)
+		}
+	}
+	for _, q := range instances {
+		if q.Allow("client") {
+			t.Error("expected the quota used up on one instance to apply to the other")
+		}
+		if _, remaining, _ := q.Quota("client"); remaining != 0 {
+			t.Errorf("expected none remaining, got %d", remaining)
+		}
+	}
+
+	// Denied requests are counted too
+	key := fmt.Sprintf("quota:%d:client", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC).Unix())
+	if v, ok := srv.Get(key); !ok || v != "5" {
+		t.Errorf("expected count 5 under %s, got %q (keys %v)", key, v, srv.Keys())
+	}
+	if ttl := srv.TTL(key); ttl != time.Hour {
+		t.Errorf("expected the count to expire at the reset, got TTL %v", ttl)
+	}
+
+	instances[0].Reset("client")
+	if !instances[1].Allow("client") {
+		t.Error("expected a reset on one instance to apply to the other")
+	}
+
+	// The count expires with its window and the next window starts afresh
+	now = now.Add(2 * time.Hour)
+	srv.SetTime(now)
+	if _, ok := srv.Get(key); ok {
+		t.Error("expected the previous window's count to expire")
+	}
+	if _, remaining, _ := instances[0].Quota("client"); remaining != 3 {
+		t.Errorf("expected a fresh quota in the new window, got %d remaining", remaining)
+	}
+}
+
+func TestRedisQuotaStoreDownAllows(t *testing.T) {
+	srv := redistest.NewServer(t)
+	client := redis.NewClient(redis.Options{Address: srv.Addr(), Timeout: time.Second})
+	defer client.Close()
+	q := NewQuotaLimiterWithStore(1, time.Hour, NewRedisQuotaStore(client, "quota:"))
+
+	srv.SetDown(true)
+	for i := 0; i < 3; i++ {
+		if !q.Allow("client") {
+			t.Fatal("expected requests to be allowed while Redis is down")
+		}
+	}
+	if q.Wait("client") != 0 {
+		t.Error("expected no wait while Redis is down")
+	}
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newClockedQuota returns a quota limiter whose clock is set by the caller
+func newClockedQuota(limit int, window time.Duration, now *time.Time) *QuotaLimiter {
+	q := NewQuotaLimiter(limit, window)
+	q.now = func() time.Time { return *now }
+	return q
+}
+
+func TestQuotaExhaustion(t *testing.T) {
+	now := time.Date(2026, 3, 1, 15, 30, 0, 0, time.UTC)
+	q := newClockedQuota(3, 24*time.Hour, &now)
+
+	for i := 0; i < 3; i++ {
+		if !q.Allow("client") {
+			t.Fatalf("expected request %d within the quota", i)
+		}
+	}
+	if q.Allow("client") {
+		t.Error("expected request beyond the quota to be denied")
+	}
+	if !q.Allow("other") {
+		t.Error("expected quotas to be tracked per key")
+	}
+
+	limit, remaining, reset := q.Quota("client")
+	if limit != 3 || remaining != 0 {
+		t.Errorf("expected limit 3 and none remaining, got %d and %d", limit, remaining)
+	}
+	if want := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC); !reset.Equal(want) {
+		t.Errorf("expected reset at midnight UTC, got %v", reset)
+	}
+	if wait := q.Wait("client"); wait != 8*time.Hour+30*time.Minute {
+		t.Errorf("expected to wait until the reset, got %v", wait)
+	}
+	if _, remaining, _ := q.Quota("other"); remaining != 2 {
+		t.Errorf("expected 2 remaining for the other key, got %d", remaining)
+	}
+}
+
+func TestQuotaWindowRollover(t *testing.T) {
+	now := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	q := newClockedQuota(1, 24*time.Hour, &now)
+
+	if !q.Allow("client") || q.Allow("client") {
+		t.Fatal("expected exactly one request in the first window")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, remaining, _ := q.Quota("client"); remaining != 1 {
+		t.Errorf("expected the quota to reset in the new window, got %d remaining", remaining)
+	}
+	if !q.Allow("client") {
+		t.Error("expected a request in the new window to be allowed")
+	}
+	if q.Wait("client") <= 0 {
+		t.Error("expected to wait again once the new window is used up")
+	}
+}
+
+func TestQuotaWaitCtxFailsFast(t *testing.T) {
+	q := NewQuotaLimiter(1, time.Hour)
+	q.Allow("client")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := q.WaitCtx(ctx, "client"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("expected a wait past the deadline to fail at once, took %v", time.Since(start))
+	}
+}
+
+func TestMemoryQuotaStoreMaxKeys(t *testing.T) {
+	store := NewMemoryQuotaStore(100).(*memoryQuotaStore)
+	reset := time.Now().Add(time.Hour)
+
+	store.Incr("first", reset)
+	for i := range 1000 {
+		store.Incr(fmt.Sprintf("client-%d", i), reset)
+		// Keep the first client in use so it is not the one evicted
+		store.Incr("first", reset)
+	}
+
+	if len(store.counts) != 100 || store.lru.order.Len() != 100 {
+		t.Errorf("expected 100 counts, got %d (%d in LRU)", len(store.counts), store.lru.order.Len())
+	}
+	if n, _ := store.Count("first", reset); n != 1001 {
+		t.Errorf("expected the recently used key to keep its count, got %d", n)
+	}
+	if n, _ := store.Count("client-0", reset); n != 0 {
+		t.Errorf("expected the least recently used key to be evicted, got count %d", n)
+	}
+
+	// A new window starts with an empty LRU
+	store.Incr("first", reset.Add(time.Hour))
+	if len(store.counts) != 1 || store.lru.order.Len() != 1 {
+		t.Errorf("expected only the new window's key, got %d (%d in LRU)", len(store.counts), store.lru.order.Len())
+	}
+}
+
+// failingStore simulates an unreachable shared store
+type failingStore struct{}
+
+func (failingStore) Incr(string, time.Time) (int64, error) {
+	return 0, errors.New("store unavailable")
+}
+
+func (failingStore) Count(string, time.Time) (int64, error) {
+	return 0, errors.New("store unavailable")
+}
+
+func (failingStore) Delete(string, time.Time) error {
+	return errors.New("store unavailable")
+}
+
+func TestQuotaStoreFailureAllows(t *testing.T) {
+	q := NewQuotaLimiterWithStore(1, time.Hour, failingStore{})
+	for i := 0; i < 3; i++ {
+		if !q.Allow("client") {
+			t.Fatal("expected requests to be allowed while the store is down")
+		}
+	}
+	if q.Wait("client") != 0 {
+		t.Error("expected no wait while the store is down")
+	}
+}
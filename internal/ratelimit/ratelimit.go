@@ -1,8 +1,13 @@
 package ratelimit
 
 import (
+	"container/list"
+	"context"
+	"fmt"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -11,36 +16,184 @@ import (
 type Limiter interface {
 	Allow(key string) bool
 	Wait(key string) time.Duration
+	// WaitCtx blocks until a token for key is available and takes it. It
+	// returns ctx's error if ctx is done first, or at once when ctx's
+	// deadline falls before the next token.
+	WaitCtx(ctx context.Context, key string) error
+	// Reset forgets the key's state so its next request starts afresh
+	Reset(key string)
+}
+
+// Counter is implemented by limiters that can report how many keys they
+// currently track
+type Counter interface {
+	Len() int
+}
+
+// Cleanup controls how limiters forget idle clients. Zero fields take
+// their value from DefaultCleanup.
+type Cleanup struct {
+	// Interval is the time between sweeps
+	Interval time.Duration
+	// Jitter adds a random delay in [0, Jitter) to each interval so
+	// replicas started together don't sweep in lockstep
+	Jitter time.Duration
+	// IdleTimeout is how long a token bucket goes unused before it is
+	// removed. Buckets are always kept until they have refilled, since
+	// removing them earlier would hand the client a fresh burst.
+	IdleTimeout time.Duration
+	// MaxBuckets caps the number of clients tracked between sweeps. Once
+	// it is reached the least recently used client is forgotten, and gets
+	// a fresh burst if it returns. 0 means no limit.
+	MaxBuckets int
+}
+
+// DefaultCleanup sweeps every minute and removes buckets idle for 5 minutes
+var DefaultCleanup = Cleanup{Interval: time.Minute, IdleTimeout: 5 * time.Minute}
+
+// withDefaults fills in zero fields from DefaultCleanup
+func (c Cleanup) withDefaults() Cleanup {
+	if c.Interval <= 0 {
+		c.Interval = DefaultCleanup.Interval
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = DefaultCleanup.IdleTimeout
+	}
+	return c
+}
+
+// next returns the delay until the next sweep
+func (c Cleanup) next() time.Duration {
+	if c.Jitter <= 0 {
+		return c.Interval
+	}
+	return c.Interval + rand.N(c.Jitter)
+}
+
+// sweep calls fn every interval, plus jitter, until done is closed
+func (c Cleanup) sweep(done <-chan struct{}, fn func()) {
+	timer := time.NewTimer(c.next())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			fn()
+			timer.Reset(c.next())
+		case <-done:
+			return
+		}
+	}
+}
+
+// waitCtx polls l until it allows key, sleeping for l.Wait between
+// attempts. It gives up at once when ctx's deadline falls before the next
+// attempt, so callers can reject the request without holding it.
+func waitCtx(ctx context.Context, l Limiter, key string) error {
+	for {
+		if l.Allow(key) {
+			return nil
+		}
+		// Wait may round down, and another waiter may take the token
+		// first, so never spin
+		wait := max(l.Wait(key), time.Millisecond)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return context.DeadlineExceeded
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// keyLRU orders a limiter's keys by last use so the least recently used
+// one can be evicted once there are more than max. The caller serializes
+// access. A zero max tracks nothing.
+type keyLRU struct {
+	max   int
+	order *list.List // most recently used first
+	elems map[string]*list.Element
+}
+
+func newKeyLRU(max int) *keyLRU {
+	return &keyLRU{max: max, order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+// touch marks key as used and returns the key evicted to make room for
+// it, if any
+func (l *keyLRU) touch(key string) (string, bool) {
+	if l.max <= 0 {
+		return "", false
+	}
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+		return "", false
+	}
+	l.elems[key] = l.order.PushFront(key)
+	if l.order.Len() <= l.max {
+		return "", false
+	}
+	oldest := l.order.Remove(l.order.Back()).(string)
+	delete(l.elems, oldest)
+	return oldest, true
+}
+
+// remove forgets key
+func (l *keyLRU) remove(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.Remove(e)
+		delete(l.elems, key)
+	}
 }
 
 // tokenBucket implements a token bucket rate limiter
 type tokenBucket struct {
-	mu            sync.RWMutex
-	rate          float64 // tokens per second
-	burst         int     // maximum tokens
-	buckets       map[string]*bucket
-	cleanupTicker *time.Ticker
-	done          chan struct{}
+	mu          sync.RWMutex
+	rate        float64 // tokens per second
+	burst       int     // maximum tokens
+	buckets     map[string]*bucket
+	lru         *keyLRU
+	now         func() time.Time
+	idleTimeout time.Duration
+	done        chan struct{}
 }
 
 type bucket struct {
-	tokens       float64
-	lastRefill   time.Time
-	mu           sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+	mu         sync.Mutex
 }
 
 // NewTokenBucket creates a new token bucket rate limiter
 func NewTokenBucket(requestsPerSecond int, burst int) Limiter {
+	return NewTokenBucketWithCleanup(requestsPerSecond, burst, DefaultCleanup)
+}
+
+// NewTokenBucketWithCleanup creates a token bucket rate limiter that
+// removes idle buckets as configured by cleanup
+func NewTokenBucketWithCleanup(requestsPerSecond int, burst int, cleanup Cleanup) Limiter {
+	cleanup = cleanup.withDefaults()
+	rate := float64(requestsPerSecond)
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
 	tb := &tokenBucket{
-		rate:          float64(requestsPerSecond),
-		burst:         burst,
-		buckets:       make(map[string]*bucket),
-		cleanupTicker: time.NewTicker(1 * time.Minute),
-		done:          make(chan struct{}),
+		rate:        rate,
+		burst:       burst,
+		buckets:     make(map[string]*bucket),
+		lru:         newKeyLRU(cleanup.MaxBuckets),
+		now:         time.Now,
+		idleTimeout: max(cleanup.IdleTimeout, refill),
+		done:        make(chan struct{}),
 	}
 
 	// Start cleanup goroutine
-	go tb.cleanup()
+	go cleanup.sweep(tb.done, tb.cleanup)
 
 	return tb
 }
@@ -52,18 +205,21 @@ func (tb *tokenBucket) Allow(key string) bool {
 	if !exists {
 		b = &bucket{
 			tokens:     float64(tb.burst),
-			lastRefill: time.Now(),
+			lastRefill: tb.now(),
 		}
 		tb.buckets[key] = b
 	}
+	if evicted, ok := tb.lru.touch(key); ok {
+		delete(tb.buckets, evicted)
+	}
 	tb.mu.Unlock()
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	now := time.Now()
+	now := tb.now()
 	elapsed := now.Sub(b.lastRefill).Seconds()
-	
+
 	// Refill tokens based on elapsed time
 	b.tokens = min(float64(tb.burst), b.tokens+elapsed*tb.rate)
 	b.lastRefill = now
@@ -98,28 +254,41 @@ func (tb *tokenBucket) Wait(key string) time.Duration {
 	return waitTime
 }
 
-// cleanup removes stale buckets
+// WaitCtx blocks until a token is taken or ctx is done
+func (tb *tokenBucket) WaitCtx(ctx context.Context, key string) error {
+	return waitCtx(ctx, tb, key)
+}
+
+// Reset removes the key's bucket, restoring its full burst
+func (tb *tokenBucket) Reset(key string) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	delete(tb.buckets, key)
+	tb.lru.remove(key)
+}
+
+// cleanup removes buckets idle for longer than the idle timeout
 func (tb *tokenBucket) cleanup() {
-	for {
-		select {
-		case <-tb.cleanupTicker.C:
-			tb.mu.Lock()
-			now := time.Now()
-			for key, b := range tb.buckets {
-				b.mu.Lock()
-				if now.Sub(b.lastRefill) > 5*time.Minute {
-					delete(tb.buckets, key)
-				}
-				b.mu.Unlock()
-			}
-			tb.mu.Unlock()
-		case <-tb.done:
-			tb.cleanupTicker.Stop()
-			return
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.now()
+	for key, b := range tb.buckets {
+		b.mu.Lock()
+		if now.Sub(b.lastRefill) > tb.idleTimeout {
+			delete(tb.buckets, key)
+			tb.lru.remove(key)
 		}
+		b.mu.Unlock()
 	}
 }
 
+// Len returns the number of buckets tracked
+func (tb *tokenBucket) Len() int {
+	tb.mu.RLock()
+	defer tb.mu.RUnlock()
+	return len(tb.buckets)
+}
+
 // Stop stops the rate limiter cleanup goroutine
 func (tb *tokenBucket) Stop() {
 	close(tb.done)
@@ -128,41 +297,143 @@ func (tb *tokenBucket) Stop() {
 // KeyExtractor extracts a rate limit key from a request
 type KeyExtractor func(*http.Request) string
 
-// IPKeyExtractor extracts the client IP address
-func IPKeyExtractor(r *http.Request) string {
-	// Try X-Forwarded-For first
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the list
-		for idx := 0; idx < len(xff); idx++ {
-			if xff[idx] == ',' {
-				return xff[:idx]
+// TrustedProxies is a set of networks whose forwarding headers are trusted
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of CIDRs or single IP addresses
+func ParseTrustedProxies(entries []string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
 			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
 		}
-		return xff
+		proxies = append(proxies, ipnet)
 	}
+	return proxies, nil
+}
 
-	// Try X-Real-IP
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+// Contains reports whether ip belongs to a trusted proxy network
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipnet := range tp {
+		if ipnet.Contains(ip) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+// ClientIP returns the client IP address for a request. Forwarding headers
+// are only honored when the request comes from a trusted proxy, in which case
+// the X-Forwarded-For chain is walked from the right, skipping trusted hops,
+// and the first untrusted address is returned.
+func ClientIP(r *http.Request, trusted TrustedProxies) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return r.RemoteAddr
+		remote = r.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !trusted.Contains(remoteIP) {
+		return remote
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseForwardedIP(hops[i])
+			if ip == nil {
+				// A malformed hop breaks the chain of trust
+				return remote
+			}
+			client = ip.String()
+			if !trusted.Contains(ip) {
+				return client
+			}
+		}
+		return client
 	}
-	return host
+
+	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+		if ip := parseForwardedIP(xri); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return remote
+}
+
+// parseForwardedIP parses a single forwarded address, tolerating
+// surrounding whitespace and an optional port ("1.2.3.4:80", "[::1]:80")
+func parseForwardedIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// IPKeyExtractor extracts the client IP address from RemoteAddr,
+// ignoring forwarding headers
+func IPKeyExtractor(r *http.Request) string {
+	return ClientIP(r, nil)
 }
 
-// APIKeyExtractor extracts an API key from a header
-func APIKeyExtractor(headerName string) KeyExtractor {
+// TrustedIPKeyExtractor extracts the client IP address, honoring forwarding
+// headers set by the given trusted proxies
+func TrustedIPKeyExtractor(trusted TrustedProxies) KeyExtractor {
+	return func(r *http.Request) string {
+		return ClientIP(r, trusted)
+	}
+}
+
+// APIKeyExtractor extracts an API key from a header, falling back to the
+// given extractor (or IPKeyExtractor if nil) when the header is absent
+func APIKeyExtractor(headerName string, fallback KeyExtractor) KeyExtractor {
+	if fallback == nil {
+		fallback = IPKeyExtractor
+	}
 	return func(r *http.Request) string {
 		key := r.Header.Get(headerName)
 		if key == "" {
-			// Fall back to IP if no API key
-			return IPKeyExtractor(r)
+			return fallback(r)
+		}
+		return apiKeyPrefix + key
+	}
+}
+
+// APIKeyAndIPKeyExtractor keys requests carrying an API key on the client
+// IP and the key together, so each address using a key gets its own
+// budget. Requests without a key are keyed on the IP alone rather than on
+// the IP twice. The API key comes last, so APIKeyTier still finds it.
+func APIKeyAndIPKeyExtractor(headerName string, ip KeyExtractor) KeyExtractor {
+	if ip == nil {
+		ip = IPKeyExtractor
+	}
+	withKey := CompositeKeyExtractor(ip, APIKeyExtractor(headerName, ip))
+	return func(r *http.Request) string {
+		if r.Header.Get(headerName) == "" {
+			return ip(r)
 		}
-		return "apikey:" + key
+		return withKey(r)
 	}
 }
 
@@ -190,4 +461,3 @@ func min(a, b float64) float64 {
 	}
 	return b
 }
-
@@ -1,6 +1,10 @@
 package ratelimit
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -59,22 +63,16 @@ func TestIPKeyExtractor(t *testing.T) {
 		want       string
 	}{
 		{
-			name:       "X-Forwarded-For single",
+			name:       "X-Forwarded-For ignored without trusted proxies",
 			remoteAddr: "192.168.1.1:1234",
 			xff:        "203.0.113.1",
-			want:       "203.0.113.1",
-		},
-		{
-			name:       "X-Forwarded-For multiple",
-			remoteAddr: "192.168.1.1:1234",
-			xff:        "203.0.113.1, 198.51.100.1",
-			want:       "203.0.113.1",
+			want:       "192.168.1.1",
 		},
 		{
-			name:       "X-Real-IP",
+			name:       "X-Real-IP ignored without trusted proxies",
 			remoteAddr: "192.168.1.1:1234",
 			xri:        "203.0.113.1",
-			want:       "203.0.113.1",
+			want:       "192.168.1.1",
 		},
 		{
 			name:       "RemoteAddr fallback",
@@ -104,8 +102,170 @@ func TestIPKeyExtractor(t *testing.T) {
 	}
 }
 
+func TestClientIPTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		xri        string
+		want       string
+	}{
+		{
+			name:       "spoofed XFF from untrusted source",
+			remoteAddr: "198.51.100.7:1234",
+			xff:        []string{"1.2.3.4"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "spoofed X-Real-IP from untrusted source",
+			remoteAddr: "198.51.100.7:1234",
+			xri:        "1.2.3.4",
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "single trusted hop",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"203.0.113.1"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "multi-hop chain skips trusted proxies",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"203.0.113.1, 198.51.100.2, 10.1.2.3, 192.168.1.1"},
+			want:       "198.51.100.2",
+		},
+		{
+			name:       "client-supplied spoof prefix is ignored",
+			remoteAddr: "192.168.1.1:1234",
+			xff:        []string{"6.6.6.6, 203.0.113.1"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "multiple XFF headers are joined",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"203.0.113.1", "10.0.0.9"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "all hops trusted returns leftmost",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"10.0.0.7, 10.0.0.6"},
+			want:       "10.0.0.7",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			remoteAddr: "10.0.0.5:1234",
+			xri:        "203.0.113.9",
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.0.0.5:1234",
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "whitespace around entries",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"  203.0.113.1 ,\t10.0.0.9  "},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "leading whitespace in single entry",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{" 203.0.113.1"},
+			want:       "203.0.113.1",
+		},
+		{
+			name:       "entries with ports",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"203.0.113.1:4711, [2001:db8::1]:443"},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "malformed first entry falls back to RemoteAddr",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"not-an-ip, 10.0.0.9"},
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "malformed single entry falls back to RemoteAddr",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{"unknown"},
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "empty entry falls back to RemoteAddr",
+			remoteAddr: "10.0.0.5:1234",
+			xff:        []string{", 10.0.0.9"},
+			want:       "10.0.0.5",
+		},
+		{
+			name:       "X-Real-IP with whitespace",
+			remoteAddr: "10.0.0.5:1234",
+			xri:        " 203.0.113.9 ",
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "malformed X-Real-IP falls back to RemoteAddr",
+			remoteAddr: "10.0.0.5:1234",
+			xri:        "bogus",
+			want:       "10.0.0.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				RemoteAddr: tt.remoteAddr,
+				Header:     http.Header{},
+			}
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.xri != "" {
+				req.Header.Set("X-Real-IP", tt.xri)
+			}
+
+			if got := ClientIP(req, trusted); got != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+			if got := TrustedIPKeyExtractor(trusted)(req); got != tt.want {
+				t.Errorf("TrustedIPKeyExtractor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 172.16.0.1 ", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies() error = %v", err)
+	}
+	if len(trusted) != 3 {
+		t.Fatalf("expected 3 networks, got %d", len(trusted))
+	}
+	if !trusted.Contains(net.ParseIP("172.16.0.1")) || trusted.Contains(net.ParseIP("172.16.0.2")) {
+		t.Error("single IP should match only itself")
+	}
+	if !trusted.Contains(net.ParseIP("2001:db8::1")) {
+		t.Error("expected IPv6 CIDR to match")
+	}
+
+	if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error for invalid entry")
+	}
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/99"}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
 func TestAPIKeyExtractor(t *testing.T) {
-	extractor := APIKeyExtractor("X-API-Key")
+	extractor := APIKeyExtractor("X-API-Key", nil)
 
 	// Test with API key
 	req := httptest.NewRequest("GET", "/test", nil)
@@ -132,7 +292,7 @@ func TestAPIKeyExtractor(t *testing.T) {
 func TestCompositeKeyExtractor(t *testing.T) {
 	extractor := CompositeKeyExtractor(
 		IPKeyExtractor,
-		APIKeyExtractor("X-API-Key"),
+		APIKeyExtractor("X-API-Key", nil),
 	)
 
 	req := &http.Request{
@@ -147,6 +307,38 @@ func TestCompositeKeyExtractor(t *testing.T) {
 	}
 }
 
+func TestAPIKeyAndIPKeyExtractor(t *testing.T) {
+	extractor := APIKeyAndIPKeyExtractor("X-API-Key", nil)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("X-API-Key", "secret123")
+	req.RemoteAddr = "192.168.1.1:1234"
+	if got := extractor(req); got != "192.168.1.1:apikey:secret123" {
+		t.Errorf("expected key and IP, got %q", got)
+	}
+
+	// The same key from another address has its own budget
+	req.RemoteAddr = "192.168.1.2:1234"
+	if got := extractor(req); got != "192.168.1.2:apikey:secret123" {
+		t.Errorf("expected key and second IP, got %q", got)
+	}
+
+	// Without a key the IP is used once, not twice
+	req = httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	if got := extractor(req); got != "192.168.1.1" {
+		t.Errorf("expected the IP alone, got %q", got)
+	}
+
+	// Tiers are still looked up by the API key
+	tier := APIKeyTier(map[string]string{"secret123": "premium"})
+	req.Header.Set("X-API-Key", "secret123")
+	req.RemoteAddr = "[2001:db8::1]:1234"
+	if got := tier(extractor(req)); got != "premium" {
+		t.Errorf("expected premium tier for the combined key, got %q", got)
+	}
+}
+
 func TestWait(t *testing.T) {
 	limiter := NewTokenBucket(10, 1)
 
@@ -163,6 +355,191 @@ func TestWait(t *testing.T) {
 	}
 }
 
+func TestWaitCtx(t *testing.T) {
+	limiter := NewTokenBucket(20, 1)
+	limiter.Allow("key")
+
+	start := time.Now()
+	if err := limiter.WaitCtx(context.Background(), "key"); err != nil {
+		t.Fatalf("expected token after waiting, got %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("expected to wait for the refill, took %v", waited)
+	}
+	if limiter.Allow("key") {
+		t.Error("expected WaitCtx to consume the token")
+	}
+}
+
+func TestWaitCtxCancel(t *testing.T) {
+	limiter := NewTokenBucket(1, 1)
+	limiter.Allow("key")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := limiter.WaitCtx(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// A deadline before the next token fails without waiting
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.WaitCtx(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Errorf("expected to fail fast, took %v", time.Since(start))
+	}
+}
+
+func TestTokenBucketCleanup(t *testing.T) {
+	tb := NewTokenBucketWithCleanup(1000, 1, Cleanup{
+		Interval:    10 * time.Millisecond,
+		Jitter:      5 * time.Millisecond,
+		IdleTimeout: 50 * time.Millisecond,
+	}).(*tokenBucket)
+	defer tb.Stop()
+
+	has := func(key string) bool {
+		tb.mu.RLock()
+		defer tb.mu.RUnlock()
+		_, ok := tb.buckets[key]
+		return ok
+	}
+
+	tb.Allow("stale")
+	deadline := time.Now().Add(2 * time.Second)
+	for has("stale") && time.Now().Before(deadline) {
+		tb.Allow("active")
+		time.Sleep(5 * time.Millisecond)
+	}
+	if has("stale") {
+		t.Error("expected the idle bucket to be removed")
+	}
+	if !has("active") {
+		t.Error("expected the active bucket to be kept")
+	}
+}
+
+func TestMaxBuckets(t *testing.T) {
+	cleanup := Cleanup{Interval: time.Hour, MaxBuckets: 100}
+	tb := NewTokenBucketWithCleanup(1, 1, cleanup).(*tokenBucket)
+	defer tb.Stop()
+	g := NewGCRAWithCleanup(1, 1, cleanup).(*gcra)
+	defer g.Stop()
+
+	for _, l := range []Limiter{tb, g} {
+		l.Allow("first")
+		for i := range 1000 {
+			l.Allow(fmt.Sprintf("client-%d", i))
+			// Keep the first client in use so it is not the one evicted
+			l.Allow("first")
+		}
+	}
+
+	tb.mu.RLock()
+	if len(tb.buckets) != 100 || tb.lru.order.Len() != 100 {
+		t.Errorf("token bucket: expected 100 buckets, got %d (%d in LRU)", len(tb.buckets), tb.lru.order.Len())
+	}
+	_, kept := tb.buckets["first"]
+	_, evicted := tb.buckets["client-0"]
+	tb.mu.RUnlock()
+	if !kept || evicted {
+		t.Errorf("token bucket: expected the least recently used client to be evicted, kept first=%v client-0=%v", kept, evicted)
+	}
+
+	g.mu.Lock()
+	if len(g.tats) != 100 || g.lru.order.Len() != 100 {
+		t.Errorf("gcra: expected 100 keys, got %d (%d in LRU)", len(g.tats), g.lru.order.Len())
+	}
+	_, kept = g.tats["first"]
+	_, evicted = g.tats["client-0"]
+	g.mu.Unlock()
+	if !kept || evicted {
+		t.Errorf("gcra: expected the least recently used client to be evicted, kept first=%v client-0=%v", kept, evicted)
+	}
+
+	// The still-limited first client keeps its state
+	if tb.Allow("first") || g.Allow("first") {
+		t.Error("expected the recently used client to stay limited")
+	}
+
+	tb.Reset("first")
+	g.Reset("first")
+	if tb.lru.order.Len() != 99 || g.lru.order.Len() != 99 {
+		t.Error("expected Reset to remove the key from the LRU")
+	}
+}
+
+func TestTokenBucketCleanupKeepsRefillingBuckets(t *testing.T) {
+	// A drained bucket needs 10s to refill; removing it sooner would give
+	// the client a fresh burst
+	tb := NewTokenBucketWithCleanup(1, 10, Cleanup{IdleTimeout: time.Second}).(*tokenBucket)
+	defer tb.Stop()
+	if tb.idleTimeout != 10*time.Second {
+		t.Errorf("expected the idle timeout to cover the refill time, got %v", tb.idleTimeout)
+	}
+}
+
+func TestReset(t *testing.T) {
+	limiters := map[string]Limiter{
+		"token bucket": NewTokenBucket(1, 2),
+		"gcra":         NewGCRA(1, 2),
+		"quota":        NewQuotaLimiter(2, time.Hour),
+		"tiered": NewTieredLimiter(NewTokenBucket(1, 2),
+			map[string]Limiter{"premium": NewTokenBucket(1, 2)},
+			APIKeyTier(map[string]string{"paid": "premium"})),
+	}
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"client", "apikey:paid"} {
+				for limiter.Allow(key) {
+				}
+				limiter.Allow("other")
+				limiter.Allow("other")
+
+				limiter.Reset(key)
+				if !limiter.Allow(key) || !limiter.Allow(key) {
+					t.Errorf("%s: expected the full burst after a reset", key)
+				}
+				if limiter.Allow("other") {
+					t.Errorf("%s: expected other keys to stay limited", key)
+				}
+				limiter.Reset("other")
+			}
+		})
+	}
+}
+
+func TestLen(t *testing.T) {
+	limiters := map[string]Limiter{
+		"token bucket": NewTokenBucket(1, 2),
+		"gcra":         NewGCRA(1, 2),
+		"tiered": NewTieredLimiter(NewTokenBucket(1, 2),
+			map[string]Limiter{"premium": NewTokenBucket(1, 2)},
+			APIKeyTier(map[string]string{"paid": "premium"})),
+	}
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			counter, ok := limiter.(Counter)
+			if !ok {
+				t.Fatal("expected the limiter to report its key count")
+			}
+			for _, key := range []string{"client", "other", "apikey:paid"} {
+				limiter.Allow(key)
+			}
+			if n := counter.Len(); n != 3 {
+				t.Errorf("expected 3 keys, got %d", n)
+			}
+			limiter.Reset("client")
+			if n := counter.Len(); n != 2 {
+				t.Errorf("expected 2 keys after a reset, got %d", n)
+			}
+		})
+	}
+}
+
 func BenchmarkTokenBucketAllow(b *testing.B) {
 	limiter := NewTokenBucket(1000, 2000)
 	b.ResetTimer()
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix marks keys produced by APIKeyExtractor
+const apiKeyPrefix = "apikey:"
+
+// TieredLimiter gives keys different limits, e.g. a higher allowance for
+// paid API keys. Each tier has its own limiter; keys without a known tier
+// use the base limiter.
+type TieredLimiter struct {
+	base   Limiter
+	tiers  map[string]Limiter
+	tierOf func(key string) string
+}
+
+var _ Limiter = (*TieredLimiter)(nil)
+
+// NewTieredLimiter creates a limiter that picks tiers[tierOf(key)] for each
+// key, falling back to base
+func NewTieredLimiter(base Limiter, tiers map[string]Limiter, tierOf func(key string) string) *TieredLimiter {
+	return &TieredLimiter{base: base, tiers: tiers, tierOf: tierOf}
+}
+
+// APIKeyTier returns a tier lookup for keys produced by APIKeyExtractor,
+// including keys prefixed by other extractors, using a map from API key
+// to tier name. Other keys have no tier.
+func APIKeyTier(keyTiers map[string]string) func(key string) string {
+	return func(key string) string {
+		if _, apiKey, ok := strings.Cut(key, apiKeyPrefix); ok {
+			return keyTiers[apiKey]
+		}
+		return ""
+	}
+}
+
+func (t *TieredLimiter) limiter(key string) Limiter {
+	if l, ok := t.tiers[t.tierOf(key)]; ok {
+		return l
+	}
+	return t.base
+}
+
+// Allow checks the key against its tier's limiter
+func (t *TieredLimiter) Allow(key string) bool {
+	return t.limiter(key).Allow(key)
+}
+
+// Wait returns how long the key must wait under its tier's limiter
+func (t *TieredLimiter) Wait(key string) time.Duration {
+	return t.limiter(key).Wait(key)
+}
+
+// WaitCtx waits for a token from the key's tier
+func (t *TieredLimiter) WaitCtx(ctx context.Context, key string) error {
+	return t.limiter(key).WaitCtx(ctx, key)
+}
+
+// Reset clears the key in the base limiter and every tier, so no state
+// is left behind whichever tier the key maps to
+func (t *TieredLimiter) Reset(key string) {
+	t.base.Reset(key)
+	for _, l := range t.tiers {
+		l.Reset(key)
+	}
+}
+
+// Len returns the number of keys tracked by the base limiter and every
+// tier that can report it
+func (t *TieredLimiter) Len() int {
+	n := 0
+	if c, ok := t.base.(Counter); ok {
+		n += c.Len()
+	}
+	for _, l := range t.tiers {
+		if c, ok := l.(Counter); ok {
+			n += c.Len()
+		}
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTieredLimiter(t *testing.T) {
+	limiter := NewTieredLimiter(
+		NewTokenBucket(1, 2),
+		map[string]Limiter{"premium": NewTokenBucket(1, 10)},
+		APIKeyTier(map[string]string{"paid": "premium"}),
+	)
+
+	allowed := func(key string) int {
+		n := 0
+		for i := 0; i < 20; i++ {
+			if limiter.Allow(key) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := allowed("apikey:paid"); n != 10 {
+		t.Errorf("expected premium key to get its burst of 10, got %d", n)
+	}
+	if n := allowed("apikey:free"); n != 2 {
+		t.Errorf("expected unknown key to get the base burst of 2, got %d", n)
+	}
+	if n := allowed("192.0.2.1"); n != 2 {
+		t.Errorf("expected anonymous client to get the base burst of 2, got %d", n)
+	}
+	if limiter.Wait("apikey:paid") <= 0 {
+		t.Error("expected exhausted premium key to wait on its own tier")
+	}
+}
+
+func TestAPIKeyTier(t *testing.T) {
+	tierOf := APIKeyTier(map[string]string{"paid": "premium"})
+	extractor := APIKeyExtractor("X-API-Key", nil)
+
+	req := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: http.Header{"X-Api-Key": []string{"paid"}}}
+	if tier := tierOf(extractor(req)); tier != "premium" {
+		t.Errorf("expected premium tier for extracted key, got %q", tier)
+	}
+	if tier := tierOf("tenant:acme:" + extractor(req)); tier != "premium" {
+		t.Errorf("expected tier lookup to see through key prefixes, got %q", tier)
+	}
+	if tier := tierOf("192.0.2.1"); tier != "" {
+		t.Errorf("expected no tier for an IP key, got %q", tier)
+	}
+}
@@ -0,0 +1,276 @@
+// Package redis is a minimal Redis client speaking RESP2: enough for the
+// shared cache and quota stores, with pipelining and a small pool of
+// connections.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options configures a Client
+type Options struct {
+	Address  string
+	Password string
+	DB       int
+	// Timeout bounds dialing and each round trip unless the context has
+	// an earlier deadline. 0 means 5 seconds.
+	Timeout time.Duration
+	// PoolSize is the number of idle connections kept for reuse. 0 means
+	// 10.
+	PoolSize int
+}
+
+// Error is an error reply from the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// ErrClosed is returned by commands sent after Close
+var ErrClosed = errors.New("redis: client closed")
+
+// Client sends commands to a Redis server. It is safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// conn is one connection to the server
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+// NewClient creates a client for the server at opts.Address. Connections
+// are opened when commands are sent, so an unreachable server is only
+// reported then.
+func NewClient(opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	return &Client{opts: opts}
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers, a []any for arrays and nil for a nil
+// reply. An error reply is returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends commands in one round trip and returns their replies in
+// order. Error replies are returned in the slice as Error values, so one
+// failing command does not hide the replies of the others.
+func (c *Client) Pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := cn.roundTrip(c.deadline(ctx), cmds)
+	if err != nil {
+		// The connection may hold a partial reply, so it is not reused
+		cn.nc.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return replies, nil
+}
+
+// Close closes the idle connections. Commands in flight complete, after
+// which their connections are closed too.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// deadline is the earlier of ctx's deadline and the client timeout
+func (c *Client) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(c.opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// get returns an idle connection or dials a new one
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	dialer := net.Dialer{Deadline: c.deadline(ctx)}
+	nc, err := dialer.DialContext(ctx, "tcp", c.opts.Address)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	cn := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	var setup [][]string
+	if c.opts.Password != "" {
+		setup = append(setup, []string{"AUTH", c.opts.Password})
+	}
+	if c.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.opts.DB)})
+	}
+	if len(setup) > 0 {
+		replies, err := cn.roundTrip(c.deadline(ctx), setup)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(Error); ok {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("redis: connection setup: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+// put returns a healthy connection to the pool, or closes it when the
+// pool is full or the client closed
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.opts.PoolSize {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// roundTrip writes cmds and reads one reply for each
+func (cn *conn) roundTrip(deadline time.Time, cmds [][]string) ([]any, error) {
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	for _, args := range cmds {
+		writeCommand(cn.w, args)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		reply, err := readReply(cn.r)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// writeCommand writes args as an array of bulk strings
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readReply reads one reply of any type
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer reply %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("invalid bulk length %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("invalid array length %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
+
+// readLine reads a line terminated by CRLF, without the terminator
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mumumio1/wproxy/internal/redis/redistest"
+)
+
+func TestDo(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := NewClient(Options{Address: srv.Addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	if reply, err := c.Do(ctx, "SET", "key", "a value\r\nwith CRLF"); err != nil || reply != "OK" {
+		t.Fatalf("SET = %v, %v", reply, err)
+	}
+	if reply, err := c.Do(ctx, "GET", "key"); err != nil || reply != "a value\r\nwith CRLF" {
+		t.Errorf("GET = %q, %v", reply, err)
+	}
+	if reply, err := c.Do(ctx, "GET", "missing"); err != nil || reply != nil {
+		t.Errorf("GET of a missing key = %v, %v, want nil", reply, err)
+	}
+	if reply, err := c.Do(ctx, "INCR", "counter"); err != nil || reply != int64(1) {
+		t.Errorf("INCR = %v, %v", reply, err)
+	}
+
+	var redisErr Error
+	if _, err := c.Do(ctx, "INCR", "key"); !errors.As(err, &redisErr) {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := NewClient(Options{Address: srv.Addr()})
+	defer c.Close()
+
+	replies, err := c.Pipeline(context.Background(),
+		[]string{"INCR", "n"},
+		[]string{"GET", "n"},
+		[]string{"NOSUCHCOMMAND"},
+		[]string{"INCR", "n"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[0] != int64(1) || replies[1] != "1" || replies[3] != int64(2) {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if _, ok := replies[2].(Error); !ok {
+		t.Errorf("expected the failing command's reply to be an Error, got %v", replies[2])
+	}
+}
+
+func TestAuthAndSelect(t *testing.T) {
+	srv := redistest.NewServer(t)
+	srv.SetPassword("s3cret")
+
+	c := NewClient(Options{Address: srv.Addr(), Password: "s3cret", DB: 2})
+	defer c.Close()
+	if reply, err := c.Do(context.Background(), "PING"); err != nil || reply != "PONG" {
+		t.Errorf("PING = %v, %v", reply, err)
+	}
+
+	wrong := NewClient(Options{Address: srv.Addr(), Password: "wrong"})
+	defer wrong.Close()
+	if _, err := wrong.Do(context.Background(), "PING"); err == nil || !strings.Contains(err.Error(), "setup") {
+		t.Errorf("expected a wrong password to fail the connection setup, got %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := NewClient(Options{Address: srv.Addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		t.Fatal(err)
+	}
+	// The pooled connection is dropped while the server is down
+	srv.SetDown(true)
+	if _, err := c.Do(ctx, "PING"); err == nil {
+		t.Error("expected an error while the server is down")
+	}
+	srv.SetDown(false)
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		t.Errorf("expected a new connection once the server is back, got %v", err)
+	}
+}
+
+func TestClosedClient(t *testing.T) {
+	srv := redistest.NewServer(t)
+	c := NewClient(Options{Address: srv.Addr()})
+	c.Close()
+	if _, err := c.Do(context.Background(), "PING"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	c := NewClient(Options{Address: "127.0.0.1:1"})
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Do(ctx, "PING"); err == nil {
+		t.Error("expected an error with a canceled context")
+	}
+}
@@ -0,0 +1,374 @@
+// Package redistest runs an in-memory Redis server for tests. It speaks
+// enough of RESP2 and the command set for the redis package's users: keys
+// with expiry, counters, MULTI/EXEC and SCAN.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is an in-memory Redis server listening on a local port
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	password string
+	now      time.Time // zero means the wall clock
+	data     map[string]string
+	expires  map[string]time.Time
+	down     bool
+	conns    map[net.Conn]bool
+}
+
+// NewServer starts a server that is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		ln:      ln,
+		data:    make(map[string]string),
+		expires: make(map[string]time.Time),
+		conns:   make(map[net.Conn]bool),
+	}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes its connections
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// SetPassword makes new connections send the password with AUTH before
+// other commands
+func (s *Server) SetPassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// SetDown makes the server drop every connection and command while down,
+// like an unreachable server
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+	if down {
+		for c := range s.conns {
+			c.Close()
+		}
+	}
+}
+
+// SetTime fixes the server's clock for key expiry
+func (s *Server) SetTime(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Get returns a key's value as the server holds it
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(key)
+	v, ok := s.data[key]
+	return v, ok
+}
+
+// TTL returns the time until a key expires, or 0 if it does not
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if at, ok := s.expires[key]; ok {
+		return at.Sub(s.clock())
+	}
+	return 0
+}
+
+// Keys returns the live keys, sorted
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys("*")
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.down {
+			s.mu.Unlock()
+			c.Close()
+			continue
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// handle serves one connection until it is closed
+func (s *Server) handle(c net.Conn) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	s.mu.Lock()
+	password := s.password
+	s.mu.Unlock()
+	authed := password == ""
+	var queued [][]string // commands inside MULTI, nil outside
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		switch {
+		case name == "AUTH":
+			if len(args) == 2 && args[1] == password {
+				authed = true
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case name == "MULTI":
+			queued = [][]string{}
+			w.WriteString("+OK\r\n")
+		case name == "EXEC" && queued != nil:
+			fmt.Fprintf(w, "*%d\r\n", len(queued))
+			s.mu.Lock()
+			for _, cmd := range queued {
+				writeReply(w, s.exec(cmd))
+			}
+			s.mu.Unlock()
+			queued = nil
+		case queued != nil:
+			queued = append(queued, args)
+			w.WriteString("+QUEUED\r\n")
+		default:
+			s.mu.Lock()
+			reply := s.exec(args)
+			s.mu.Unlock()
+			writeReply(w, reply)
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// errorReply is an error reply
+type errorReply string
+
+// exec runs a command (must be called with lock held)
+func (s *Server) exec(args []string) any {
+	name, args := strings.ToUpper(args[0]), args[1:]
+	for _, key := range args[:min(len(args), 1)] {
+		s.expire(key)
+	}
+
+	switch {
+	case name == "PING":
+		return "PONG"
+	case name == "SELECT" && len(args) == 1:
+		return "OK"
+	case name == "GET" && len(args) == 1:
+		if v, ok := s.data[args[0]]; ok {
+			return []byte(v)
+		}
+		return nil
+	case name == "SET" && (len(args) == 2 || len(args) == 4 && strings.EqualFold(args[2], "PX")):
+		s.data[args[0]] = args[1]
+		delete(s.expires, args[0])
+		if len(args) == 4 {
+			ms, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil || ms <= 0 {
+				return errorReply("ERR invalid expire time in 'set' command")
+			}
+			s.expires[args[0]] = s.clock().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "OK"
+	case name == "DEL" && len(args) > 0:
+		var n int64
+		for _, key := range args {
+			s.expire(key)
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				delete(s.expires, key)
+				n++
+			}
+		}
+		return n
+	case name == "INCR" && len(args) == 1:
+		n, err := strconv.ParseInt(s.dataOr(args[0], "0"), 10, 64)
+		if err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		n++
+		s.data[args[0]] = strconv.FormatInt(n, 10)
+		return n
+	case name == "EXPIREAT" && len(args) == 2:
+		sec, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		if _, ok := s.data[args[0]]; !ok {
+			return int64(0)
+		}
+		s.expires[args[0]] = time.Unix(sec, 0)
+		s.expire(args[0])
+		return int64(1)
+	case name == "STRLEN" && len(args) == 1:
+		return int64(len(s.data[args[0]]))
+	case name == "SCAN" && len(args) >= 1:
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.EqualFold(args[i], "MATCH") {
+				pattern = args[i+1]
+			}
+		}
+		keys := s.keys(pattern)
+		items := make([]any, len(keys))
+		for i, key := range keys {
+			items[i] = []byte(key)
+		}
+		// Everything in one batch, ending the iteration at once
+		return []any{[]byte("0"), items}
+	case name == "FLUSHDB":
+		clear(s.data)
+		clear(s.expires)
+		return "OK"
+	}
+	return errorReply(fmt.Sprintf("ERR unknown command or wrong number of arguments for '%s'", strings.ToLower(name)))
+}
+
+// clock returns the server's current time (must be called with lock held)
+func (s *Server) clock() time.Time {
+	if s.now.IsZero() {
+		return time.Now()
+	}
+	return s.now
+}
+
+// expire drops a key past its expiry (must be called with lock held)
+func (s *Server) expire(key string) {
+	if at, ok := s.expires[key]; ok && !s.clock().Before(at) {
+		delete(s.data, key)
+		delete(s.expires, key)
+	}
+}
+
+// dataOr returns a key's value or def (must be called with lock held)
+func (s *Server) dataOr(key, def string) string {
+	if v, ok := s.data[key]; ok {
+		return v
+	}
+	return def
+}
+
+// keys returns the live keys matching a glob pattern, sorted (must be
+// called with lock held)
+func (s *Server) keys(pattern string) []string {
+	var keys []string
+	for key := range s.data {
+		s.expire(key)
+		if _, ok := s.data[key]; !ok {
+			continue
+		}
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "*"), "\r\n"))
+	if err != nil || n < 1 || line[0] != '*' {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "$"), "\r\n"))
+		if err != nil || size < 0 || line[0] != '$' {
+			return nil, fmt.Errorf("invalid argument %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// writeReply writes a reply: string as a simple string, []byte as a bulk
+// string, int64, []any as an array, nil as a nil bulk string and
+// errorReply as an error
+func writeReply(w *bufio.Writer, reply any) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case errorReply:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
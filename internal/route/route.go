@@ -0,0 +1,141 @@
+package route
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// Config describes a route matched by path prefix
+type Config struct {
+	PathPrefix         string
+	ExpectContentTypes []string // e.g. "application/json", "image/*"
+	Variants           []Variant
+	SplitBy            string // request attribute used as the bucket key
+}
+
+// Variant is an upstream version receiving a weighted share of a route
+type Variant struct {
+	Name   string
+	URL    string
+	Weight int
+}
+
+// Route is a compiled route
+type Route struct {
+	PathPrefix         string
+	ExpectContentTypes []string
+	Variants           []Variant
+	SplitBy            string
+
+	totalWeight int
+}
+
+// Table matches request paths to routes by longest prefix, on whole path
+// segments
+type Table struct {
+	routes []*Route
+}
+
+// NewTable creates a route table
+func NewTable(configs []Config) *Table {
+	t := &Table{routes: make([]*Route, 0, len(configs))}
+	for _, cfg := range configs {
+		types := make([]string, 0, len(cfg.ExpectContentTypes))
+		for _, ct := range cfg.ExpectContentTypes {
+			types = append(types, strings.ToLower(strings.TrimSpace(ct)))
+		}
+		r := &Route{
+			PathPrefix:         cfg.PathPrefix,
+			ExpectContentTypes: types,
+			Variants:           cfg.Variants,
+			SplitBy:            cfg.SplitBy,
+		}
+		for _, v := range cfg.Variants {
+			r.totalWeight += max(v.Weight, 0)
+		}
+		t.routes = append(t.routes, r)
+	}
+
+	// Longest prefix first so the most specific route wins
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].PathPrefix) > len(t.routes[j].PathPrefix)
+	})
+
+	return t
+}
+
+// Match returns the route for a path, or nil if none matches
+func (t *Table) Match(path string) *Route {
+	for _, r := range t.routes {
+		if HasPathPrefix(path, r.PathPrefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// HasPathPrefix reports whether path is prefix or lies below it: "/api"
+// matches "/api" and "/api/users" but not "/apis". A prefix ending in "/"
+// matches every path starting with it.
+func HasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// AcceptsContentType reports whether a response content type satisfies the
+// route's expectations. Routes without expectations accept anything.
+func (r *Route) AcceptsContentType(contentType string) bool {
+	if len(r.ExpectContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, expected := range r.ExpectContentTypes {
+		if expected == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(expected, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Variant returns the variant for a bucket key, or nil if the route does
+// not split traffic. The same key always maps to the same variant; an empty
+// key picks one at random.
+func (r *Route) Variant(key string) *Variant {
+	if r.totalWeight == 0 {
+		return nil
+	}
+
+	var n int
+	if key == "" {
+		n = rand.IntN(r.totalWeight)
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		n = int(h.Sum64() % uint64(r.totalWeight))
+	}
+
+	for i := range r.Variants {
+		v := &r.Variants[i]
+		if v.Weight <= 0 {
+			continue
+		}
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return nil
+}
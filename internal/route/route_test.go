@@ -0,0 +1,120 @@
+package route
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTableMatch(t *testing.T) {
+	table := NewTable([]Config{
+		{PathPrefix: "/api/"},
+		{PathPrefix: "/api/v2/"},
+		{PathPrefix: "/static/"},
+		{PathPrefix: "/files"},
+	})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/users", "/api/"},
+		{"/api/v2/users", "/api/v2/"},
+		{"/static/app.js", "/static/"},
+		{"/other", ""},
+		{"/files", "/files"},
+		{"/files/a.txt", "/files"},
+		{"/filesystem", ""},
+	}
+
+	for _, tt := range tests {
+		r := table.Match(tt.path)
+		got := ""
+		if r != nil {
+			got = r.PathPrefix
+		}
+		if got != tt.want {
+			t.Errorf("Match(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptsContentType(t *testing.T) {
+	r := NewTable([]Config{{
+		PathPrefix:         "/",
+		ExpectContentTypes: []string{"application/json", "Image/*"},
+	}}).Match("/")
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"image/png", true},
+		{"text/html; charset=utf-8", false},
+		{"", false},
+		{"imagefoo/png", false},
+	}
+
+	for _, tt := range tests {
+		if got := r.AcceptsContentType(tt.contentType); got != tt.want {
+			t.Errorf("AcceptsContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+
+	open := &Route{PathPrefix: "/"}
+	if !open.AcceptsContentType("text/html") {
+		t.Error("route without expectations should accept any content type")
+	}
+}
+
+func TestVariantSplitRatio(t *testing.T) {
+	r := NewTable([]Config{{
+		PathPrefix: "/",
+		Variants: []Variant{
+			{Name: "stable", URL: "http://stable:8080", Weight: 90},
+			{Name: "canary", URL: "http://canary:8080", Weight: 10},
+		},
+	}}).Match("/")
+
+	const n = 10000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[r.Variant("user-"+strconv.Itoa(i)).Name]++
+	}
+
+	if canary := counts["canary"]; canary < n*8/100 || canary > n*12/100 {
+		t.Errorf("expected about 10%% canary, got %d of %d", canary, n)
+	}
+	if counts["stable"]+counts["canary"] != n {
+		t.Errorf("unexpected variants %v", counts)
+	}
+}
+
+func TestVariantStickyPerKey(t *testing.T) {
+	r := NewTable([]Config{{
+		PathPrefix: "/",
+		Variants: []Variant{
+			{Name: "a", Weight: 1},
+			{Name: "b", Weight: 1},
+			{Name: "off", Weight: 0},
+		},
+	}}).Match("/")
+
+	for i := 0; i < 100; i++ {
+		key := "user-" + strconv.Itoa(i)
+		first := r.Variant(key)
+		if first.Name == "off" {
+			t.Fatalf("zero-weight variant chosen for %s", key)
+		}
+		for j := 0; j < 5; j++ {
+			if got := r.Variant(key); got != first {
+				t.Fatalf("key %s moved from %s to %s", key, first.Name, got.Name)
+			}
+		}
+	}
+
+	if NewTable([]Config{{PathPrefix: "/"}}).Match("/").Variant("x") != nil {
+		t.Error("expected no variant for a route without a split")
+	}
+}
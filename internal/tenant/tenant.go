@@ -0,0 +1,199 @@
+package tenant
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Tenant ID sources
+const (
+	SourceHeader    = "header"
+	SourceSubdomain = "subdomain"
+	SourceJWT       = "jwt"
+)
+
+// OtherLabel is the metric label used for tenants beyond the label limit
+const OtherLabel = "other"
+
+const maxIDLength = 64
+
+type contextKey struct{}
+
+// Config holds tenant resolver configuration
+type Config struct {
+	Source          string // "header", "subdomain" or "jwt"
+	Header          string // header carrying the tenant ID or the bearer token
+	Claim           string // JWT claim holding the tenant ID
+	BaseDomain      string // domain stripped from the host for subdomain resolution
+	Default         string // tenant used when none can be resolved
+	MaxMetricLabels int    // maximum distinct tenant metric labels
+}
+
+// Resolver extracts tenant IDs from requests
+type Resolver struct {
+	cfg Config
+
+	mu     sync.Mutex
+	labels map[string]struct{}
+}
+
+// NewResolver creates a tenant resolver
+func NewResolver(cfg Config) (*Resolver, error) {
+	switch cfg.Source {
+	case SourceHeader:
+		if cfg.Header == "" {
+			cfg.Header = "X-Tenant-ID"
+		}
+	case SourceJWT:
+		if cfg.Header == "" {
+			cfg.Header = "Authorization"
+		}
+		if cfg.Claim == "" {
+			cfg.Claim = "tenant"
+		}
+	case SourceSubdomain:
+		cfg.BaseDomain = strings.Trim(strings.ToLower(cfg.BaseDomain), ".")
+	default:
+		return nil, fmt.Errorf("unknown tenant source: %q", cfg.Source)
+	}
+
+	if cfg.MaxMetricLabels <= 0 {
+		cfg.MaxMetricLabels = 100
+	}
+
+	return &Resolver{
+		cfg:    cfg,
+		labels: make(map[string]struct{}),
+	}, nil
+}
+
+// Resolve returns the tenant ID for a request, or the configured default
+func (r *Resolver) Resolve(req *http.Request) string {
+	var id string
+	switch r.cfg.Source {
+	case SourceHeader:
+		id = strings.TrimSpace(req.Header.Get(r.cfg.Header))
+	case SourceSubdomain:
+		id = r.fromHost(req.Host)
+	case SourceJWT:
+		id = r.fromJWT(req.Header.Get(r.cfg.Header))
+	}
+
+	if !validID(id) {
+		return r.cfg.Default
+	}
+	return id
+}
+
+// MetricLabel maps a tenant ID to a metric label, keeping the number of
+// distinct labels bounded. Tenants seen after the limit is reached share
+// OtherLabel.
+func (r *Resolver) MetricLabel(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.labels[id]; ok {
+		return id
+	}
+	if len(r.labels) >= r.cfg.MaxMetricLabels {
+		return OtherLabel
+	}
+	r.labels[id] = struct{}{}
+	return id
+}
+
+// fromHost extracts the tenant from the leftmost subdomain
+func (r *Resolver) fromHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if r.cfg.BaseDomain != "" {
+		suffix := "." + r.cfg.BaseDomain
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+		host = strings.TrimSuffix(host, suffix)
+		if i := strings.LastIndexByte(host, '.'); i >= 0 {
+			host = host[i+1:]
+		}
+		return host
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 || net.ParseIP(host) != nil {
+		return ""
+	}
+	return labels[0]
+}
+
+// fromJWT reads the tenant claim from a bearer token. The signature is not
+// verified here; authentication is left to the upstream.
+func (r *Resolver) fromJWT(value string) string {
+	token := strings.TrimSpace(value)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	switch v := claims[r.cfg.Claim].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
+
+// validID restricts tenant IDs to a safe character set so they can be
+// embedded in cache keys, rate-limit keys and log fields
+func validID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a context carrying the tenant ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the tenant ID stored in the context, if any
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
@@ -0,0 +1,124 @@
+package tenant
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveHeader(t *testing.T) {
+	r, err := NewResolver(Config{Source: SourceHeader, Default: "public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "valid tenant", header: "acme", want: "acme"},
+		{name: "trimmed tenant", header: "  acme-2 ", want: "acme-2"},
+		{name: "missing header", header: "", want: "public"},
+		{name: "invalid characters", header: "acme:evil|key", want: "public"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Tenant-ID", tt.header)
+			}
+			if got := r.Resolve(req); got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSubdomain(t *testing.T) {
+	tests := []struct {
+		name       string
+		baseDomain string
+		host       string
+		want       string
+	}{
+		{name: "leftmost label", host: "acme.api.example.com", want: "acme"},
+		{name: "with port", host: "acme.api.example.com:8080", want: "acme"},
+		{name: "apex domain", host: "example.com", want: ""},
+		{name: "ip address", host: "10.0.0.1:8080", want: ""},
+		{name: "base domain", baseDomain: "example.com", host: "acme.example.com", want: "acme"},
+		{name: "nested under base domain", baseDomain: "example.com", host: "www.acme.example.com", want: "acme"},
+		{name: "outside base domain", baseDomain: "example.com", host: "acme.other.org", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver(Config{Source: SourceSubdomain, BaseDomain: tt.baseDomain})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = tt.host
+			if got := r.Resolve(req); got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveJWT(t *testing.T) {
+	r, err := NewResolver(Config{Source: SourceJWT, Claim: "org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1","org":"acme"}`))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer header."+payload+".sig")
+	if got := r.Resolve(req); got != "acme" {
+		t.Errorf("Resolve() = %q, want acme", got)
+	}
+
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	if got := r.Resolve(req); got != "" {
+		t.Errorf("Resolve() = %q, want empty for malformed token", got)
+	}
+}
+
+func TestNewResolverUnknownSource(t *testing.T) {
+	if _, err := NewResolver(Config{Source: "cookie"}); err == nil {
+		t.Error("expected error for unknown source")
+	}
+}
+
+func TestMetricLabelBounded(t *testing.T) {
+	r, err := NewResolver(Config{Source: SourceHeader, MaxMetricLabels: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.MetricLabel("a"); got != "a" {
+		t.Errorf("MetricLabel(a) = %q", got)
+	}
+	if got := r.MetricLabel("b"); got != "b" {
+		t.Errorf("MetricLabel(b) = %q", got)
+	}
+	if got := r.MetricLabel("c"); got != OtherLabel {
+		t.Errorf("MetricLabel(c) = %q, want %q", got, OtherLabel)
+	}
+	if got := r.MetricLabel("a"); got != "a" {
+		t.Errorf("known tenant should keep its label, got %q", got)
+	}
+}
+
+func TestContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != "" {
+		t.Errorf("expected empty tenant, got %q", got)
+	}
+	ctx := NewContext(context.Background(), "acme")
+	if got := FromContext(ctx); got != "acme" {
+		t.Errorf("FromContext() = %q, want acme", got)
+	}
+}
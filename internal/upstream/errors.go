@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ClassifyError maps an error from an upstream round trip to a category
+// operators can act on, telling a slow backend apart from an unreachable
+// one:
+//
+//   - no_backend: every backend is unhealthy or ejected
+//   - canceled: the client went away before the upstream answered
+//   - dns: the backend's host name did not resolve
+//   - dial_timeout: the TCP connection was not established in time
+//   - connection_refused: nothing listens on the backend's port
+//   - tls: the TLS handshake failed or timed out
+//   - response_header_timeout: the backend accepted the request but was too
+//     slow to respond
+//   - connection_reset: the backend closed or reset the connection
+//   - timeout: any other timeout
+//   - other: anything else
+func ClassifyError(err error) string {
+	switch {
+	case errors.Is(err, ErrNoBackend):
+		return "no_backend"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	if isTLSError(err) {
+		return "tls"
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		switch {
+		case opErr.Timeout():
+			return "dial_timeout"
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return "connection_refused"
+		}
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_reset"
+	// net/http does not export its response header timeout error
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return "response_header_timeout"
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return "timeout"
+	}
+	return "other"
+}
+
+// isTLSError reports whether err comes from a failed TLS handshake
+func isTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		// net/http does not export its handshake timeout error either
+		strings.Contains(err.Error(), "TLS handshake timeout")
+}
+
+// isTimeout reports whether any error in err's chain is a timeout
+func isTimeout(err error) bool {
+	var timeoutErr interface{ Timeout() bool }
+	return errors.As(err, &timeoutErr) && timeoutErr.Timeout()
+}
@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// roundTripError sends a GET to rawURL through transport and returns the
+// error, wrapped the way httputil.ReverseProxy receives it
+func roundTripError(t *testing.T, transport http.RoundTripper, rawURL string) error {
+	t.Helper()
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the round trip to fail")
+	}
+	return err
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"no backend", ErrNoBackend, "no_backend"},
+		{"canceled", fmt.Errorf("round trip: %w", context.Canceled), "canceled"},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "backend.invalid", IsNotFound: true}}, "dns"},
+		{"dial timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, "dial_timeout"},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection_refused"},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "connection_reset"},
+		{"closed", &url.Error{Op: "Get", URL: "http://backend", Err: io.EOF}, "connection_reset"},
+		{"deadline", context.DeadlineExceeded, "timeout"},
+		{"other", errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyTransportErrors(t *testing.T) {
+	t.Run("connection refused", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+
+		err = roundTripError(t, &http.Transport{}, "http://"+addr)
+		if got := ClassifyError(err); got != "connection_refused" {
+			t.Errorf("expected connection_refused for %v, got %q", err, got)
+		}
+	})
+
+	t.Run("response header timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer srv.Close()
+		defer close(release)
+
+		err := roundTripError(t, &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond}, srv.URL)
+		if got := ClassifyError(err); got != "response_header_timeout" {
+			t.Errorf("expected response_header_timeout for %v, got %q", err, got)
+		}
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+		srv.StartTLS()
+		defer srv.Close()
+
+		// The transport does not trust the test server's certificate
+		err := roundTripError(t, &http.Transport{}, srv.URL)
+		if got := ClassifyError(err); got != "tls" {
+			t.Errorf("expected tls for %v, got %q", err, got)
+		}
+	})
+
+	t.Run("connection closed", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}))
+		defer srv.Close()
+
+		err := roundTripError(t, &http.Transport{}, srv.URL)
+		if got := ClassifyError(err); got != "connection_reset" {
+			t.Errorf("expected connection_reset for %v, got %q", err, got)
+		}
+	})
+}
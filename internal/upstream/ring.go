@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of virtual nodes per backend. More replicas
+// spread keys more evenly at the cost of a larger ring.
+const ringReplicas = 160
+
+// ring is a consistent-hash ring mapping keys to backends, so adding or
+// removing a backend only remaps the keys that backend owned
+type ring struct {
+	points   []uint64
+	backends []*Backend // backends[i] owns points[i]
+}
+
+// newRing builds a ring over the backends
+func newRing(backends []*Backend) *ring {
+	r := &ring{}
+	type point struct {
+		hash    uint64
+		backend *Backend
+	}
+	points := make([]point, 0, len(backends)*ringReplicas)
+	for _, b := range backends {
+		if b.URL == nil {
+			continue
+		}
+		id := transportKey(b.URL.Scheme, b.URL.Host)
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, point{hash: hashKey(id + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r.points = make([]uint64, len(points))
+	r.backends = make([]*Backend, len(points))
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.backends[i] = p.backend
+	}
+	return r
+}
+
+// lookup returns the first usable backend at or after the key's position
+func (r *ring) lookup(key string) *Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for i := range r.points {
+		b := r.backends[(start+i)%len(r.points)]
+		if b.Usable() {
+			return b
+		}
+	}
+	return nil
+}
+
+// hashKey hashes a key onto the ring. FNV alone clusters keys that differ
+// only in their last bytes, so the result is run through a 64-bit mixer.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
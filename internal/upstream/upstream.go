@@ -0,0 +1,545 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig holds connection pool and timeout settings for a backend
+type TransportConfig struct {
+	Timeout             time.Duration
+	MaxIdleConns        int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+	TLSServerName       string
+	InsecureSkipVerify  bool
+	// TLSSessionCacheSize is the number of TLS sessions kept for
+	// resumption, 0 disables resumption
+	TLSSessionCacheSize int
+	// TLSClientCertFile and TLSClientKeyFile hold the client certificate
+	// presented to backends that require mutual TLS
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	// TLSCAFile is a PEM bundle used instead of the system roots to verify
+	// backend certificates
+	TLSCAFile string
+	// HTTP2 speaks only HTTP/2 to the backend: h2 over TLS and h2c with
+	// prior knowledge over plaintext
+	HTTP2 bool
+	// ExpectContinueTimeout is how long to wait for a 100 Continue before
+	// sending the body of a request with "Expect: 100-continue"
+	ExpectContinueTimeout time.Duration
+}
+
+// BackendConfig describes a single upstream backend
+type BackendConfig struct {
+	URL       string
+	Weight    int // relative share for the weighted strategy, 0 means 1
+	Transport TransportConfig
+}
+
+// Backend is an upstream server with its own connection pool
+type Backend struct {
+	URL       *url.URL
+	Transport *http.Transport
+	Weight    int
+
+	config BackendConfig // settings it was created with
+	active atomic.Int64  // requests currently in flight
+}
+
+// Strategy selects how the pool picks a backend for each request
+type Strategy string
+
+// Load balancing strategies
+const (
+	RoundRobin Strategy = "round_robin"
+	Weighted   Strategy = "weighted"
+	LeastConn  Strategy = "least_conn"
+	IPHash     Strategy = "ip_hash"     // sticky by client IP
+	CookieHash Strategy = "cookie_hash" // sticky by session cookie
+)
+
+// Hashed reports whether the strategy maps request keys to backends on a
+// consistent-hash ring
+func (s Strategy) Hashed() bool {
+	return s == IPHash || s == CookieHash
+}
+
+// ErrNoBackend is returned when no usable backend is available
+var ErrNoBackend = errors.New("no usable upstream backend")
+
+// Pool holds the upstream backends and selects one per request. Backends
+// can be added and removed at runtime.
+type Pool struct {
+	mu       sync.Mutex // serializes Add and Remove
+	state    atomic.Pointer[poolState]
+	next     uint64
+	strategy Strategy
+}
+
+// poolState is an immutable snapshot of the pool's backends
+type poolState struct {
+	backends []*Backend
+	byKey    map[string]*Backend // keyed by scheme://host
+	ring     *ring               // only built for hashed strategies
+}
+
+// NewTransport creates an http.Transport from the given settings. It fails
+// when the client certificate or CA bundle cannot be loaded.
+func NewTransport(cfg TransportConfig) (*http.Transport, error) {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		ExpectContinueTimeout: cfg.ExpectContinueTimeout,
+	}
+
+	// A custom dialer or TLS config otherwise keeps the transport on HTTP/1.1
+	if cfg.HTTP2 {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	if cfg.TLSServerName != "" || cfg.InsecureSkipVerify || cfg.TLSSessionCacheSize > 0 ||
+		cfg.TLSClientCertFile != "" || cfg.TLSCAFile != "" {
+		t.TLSClientConfig = &tls.Config{
+			ServerName:         cfg.TLSServerName,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		}
+		// Resuming sessions skips the full handshake on new connections
+		if cfg.TLSSessionCacheSize > 0 {
+			t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(cfg.TLSSessionCacheSize)
+		}
+		if cfg.TLSClientCertFile != "" || cfg.TLSClientKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+			}
+			t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+		if cfg.TLSCAFile != "" {
+			pem, err := os.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in upstream CA file %q", cfg.TLSCAFile)
+			}
+			t.TLSClientConfig.RootCAs = roots
+		}
+	}
+
+	return t, nil
+}
+
+// NewPool creates a pool with a dedicated transport for each backend. An
+// empty strategy means round-robin.
+func NewPool(configs []BackendConfig, strategy Strategy) (*Pool, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("at least one upstream backend is required")
+	}
+
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, Weighted, LeastConn, IPHash, CookieHash:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+
+	p := &Pool{strategy: strategy}
+	p.state.Store(&poolState{byKey: make(map[string]*Backend)})
+
+	for _, cfg := range configs {
+		if _, err := p.Add(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Add registers a new backend at runtime
+func (p *Pool) Add(cfg BackendConfig) (*Backend, error) {
+	b, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.state.Load()
+	key := transportKey(b.URL.Scheme, b.URL.Host)
+	if _, exists := old.byKey[key]; exists {
+		return nil, fmt.Errorf("duplicate upstream backend %q", cfg.URL)
+	}
+
+	p.store(append(append([]*Backend(nil), old.backends...), b))
+
+	return b, nil
+}
+
+// Update replaces the pool's backends with configs in one step, e.g. when
+// the configuration is reloaded. Backends whose settings are unchanged are
+// kept along with their connections. The others stop receiving requests:
+// those in flight complete on their existing connections, and idle ones
+// are closed.
+func (p *Pool) Update(configs []BackendConfig) error {
+	u, err := p.Prepare(configs)
+	if err != nil {
+		return err
+	}
+	u.Apply()
+	return nil
+}
+
+// PendingUpdate is a validated set of backends waiting to replace those of
+// a pool. Discarding it leaves the pool unchanged.
+type PendingUpdate struct {
+	pool     *Pool
+	backends []*Backend
+}
+
+// Prepare validates configs and creates the backends that Update would
+// switch to without changing the pool, so that several pools can be
+// updated together or not at all
+func (p *Pool) Prepare(configs []BackendConfig) (*PendingUpdate, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("at least one upstream backend is required")
+	}
+
+	old := p.state.Load()
+	backends := make([]*Backend, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		u, err := url.Parse(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream URL %q: %w", cfg.URL, err)
+		}
+		key := transportKey(u.Scheme, u.Host)
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate upstream backend %q", cfg.URL)
+		}
+		seen[key] = true
+
+		if b, ok := old.byKey[key]; ok && b.config == cfg {
+			backends = append(backends, b)
+			continue
+		}
+		b, err := newBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+
+	return &PendingUpdate{pool: p, backends: backends}, nil
+}
+
+// Apply switches the pool to the prepared backends and closes the idle
+// connections of those it no longer uses
+func (u *PendingUpdate) Apply() {
+	p := u.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.state.Load()
+	p.store(u.backends)
+
+	kept := make(map[*Backend]bool, len(u.backends))
+	for _, b := range u.backends {
+		kept[b] = true
+	}
+	for _, b := range old.backends {
+		if !kept[b] && b.Transport != nil {
+			b.Transport.CloseIdleConnections()
+		}
+	}
+}
+
+// newBackend creates a backend with a transport of its own
+func newBackend(cfg BackendConfig) (*Backend, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL %q: %w", cfg.URL, err)
+	}
+	if cfg.Weight < 0 {
+		return nil, fmt.Errorf("negative weight for upstream %q", cfg.URL)
+	}
+	transport, err := NewTransport(cfg.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", cfg.URL, err)
+	}
+	return &Backend{
+		URL:       u,
+		Transport: transport,
+		Weight:    cfg.Weight,
+		config:    cfg,
+	}, nil
+}
+
+// store publishes a new snapshot of the pool's backends
+// (must be called with mu held)
+func (p *Pool) store(backends []*Backend) {
+	next := &poolState{
+		backends: backends,
+		byKey:    make(map[string]*Backend, len(backends)),
+	}
+	for _, b := range backends {
+		if b.URL != nil {
+			next.byKey[transportKey(b.URL.Scheme, b.URL.Host)] = b
+		}
+	}
+	if p.strategy.Hashed() {
+		next.ring = newRing(next.backends)
+	}
+	p.state.Store(next)
+}
+
+// Remove unregisters a backend and closes its idle connections
+func (p *Pool) Remove(b *Backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.state.Load()
+	backends := make([]*Backend, 0, len(old.backends))
+	for _, existing := range old.backends {
+		if existing != b {
+			backends = append(backends, existing)
+		}
+	}
+	p.store(backends)
+
+	if b.Transport != nil {
+		b.Transport.CloseIdleConnections()
+	}
+}
+
+// Next returns the next usable backend according to the pool's strategy,
+// skipping backends whose URL cannot be proxied to. It returns nil if none
+// is usable.
+func (p *Pool) Next() *Backend {
+	backends := p.state.Load().backends
+	switch p.strategy {
+	case Weighted:
+		return p.nextWeighted(backends)
+	case LeastConn:
+		return p.nextLeastConn(backends)
+	default:
+		return p.nextRoundRobin(backends)
+	}
+}
+
+// NextFor returns the backend for a request key. Hashed strategies always
+// map the same key to the same backend while it is usable; other strategies,
+// or an empty key, fall back to Next.
+func (p *Pool) NextFor(key string) *Backend {
+	if key != "" && p.strategy.Hashed() {
+		if r := p.state.Load().ring; r != nil {
+			return r.lookup(key)
+		}
+	}
+	return p.Next()
+}
+
+// Strategy returns the pool's load balancing strategy
+func (p *Pool) Strategy() Strategy {
+	return p.strategy
+}
+
+func (p *Pool) nextRoundRobin(backends []*Backend) *Backend {
+	for range backends {
+		n := atomic.AddUint64(&p.next, 1)
+		b := backends[(n-1)%uint64(len(backends))]
+		if b.Usable() {
+			return b
+		}
+	}
+	return nil
+}
+
+// nextWeighted spreads requests across usable backends in proportion to
+// their weights
+func (p *Pool) nextWeighted(backends []*Backend) *Backend {
+	total := 0
+	for _, b := range backends {
+		if b.Usable() {
+			total += b.weight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := int((atomic.AddUint64(&p.next, 1) - 1) % uint64(total))
+	for _, b := range backends {
+		if !b.Usable() {
+			continue
+		}
+		if n < b.weight() {
+			return b
+		}
+		n -= b.weight()
+	}
+	return nil
+}
+
+// nextLeastConn picks the usable backend with the fewest in-flight
+// requests, rotating the starting point so ties are spread evenly
+func (p *Pool) nextLeastConn(backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	start := atomic.AddUint64(&p.next, 1) - 1
+	var best *Backend
+	for i := range backends {
+		b := backends[(start+uint64(i))%uint64(len(backends))]
+		if b.Usable() && (best == nil || b.Active() < best.Active()) {
+			best = b
+		}
+	}
+	return best
+}
+
+// Backends returns all backends in the pool
+func (p *Pool) Backends() []*Backend {
+	return p.state.Load().backends
+}
+
+// Transports returns the transport for each backend keyed by scheme://host
+func (p *Pool) Transports() map[string]*http.Transport {
+	byKey := p.state.Load().byKey
+	transports := make(map[string]*http.Transport, len(byKey))
+	for k, b := range byKey {
+		transports[k] = b.Transport
+	}
+	return transports
+}
+
+type backendKey struct{}
+
+// WithBackend returns a copy of ctx carrying the backend selected for a
+// request. RoundTrip uses it rather than looking the request's host up
+// again, which could miss if the pool was updated in between.
+func WithBackend(ctx context.Context, b *Backend) context.Context {
+	return context.WithValue(ctx, backendKey{}, b)
+}
+
+// RoundTrip sends the request using the transport of the backend it
+// targets. The backend counts the request as in flight until the response
+// body is closed.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "" {
+		return nil, ErrNoBackend
+	}
+	b, ok := req.Context().Value(backendKey{}).(*Backend)
+	if !ok || b == nil {
+		if b, ok = p.state.Load().byKey[transportKey(req.URL.Scheme, req.URL.Host)]; !ok {
+			return nil, fmt.Errorf("no transport for upstream %s://%s", req.URL.Scheme, req.URL.Host)
+		}
+	}
+
+	b.active.Add(1)
+	resp, err := b.Transport.RoundTrip(req)
+	if err != nil {
+		b.active.Add(-1)
+		return nil, err
+	}
+	tracked := &trackedBody{ReadCloser: resp.Body, backend: b}
+	resp.Body = tracked
+	// A 101 body is the upgraded connection; it must stay writable for the
+	// reverse proxy to copy the client's side of the stream to it
+	if rwc, ok := tracked.ReadCloser.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &trackedConn{trackedBody: tracked, w: rwc}
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections closes idle connections on every backend transport
+func (p *Pool) CloseIdleConnections() {
+	for _, b := range p.state.Load().byKey {
+		b.Transport.CloseIdleConnections()
+	}
+}
+
+// Active returns the number of requests in flight to the backend
+func (b *Backend) Active() int64 {
+	return b.active.Load()
+}
+
+func (b *Backend) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// trackedBody releases the backend's in-flight slot when closed
+type trackedBody struct {
+	io.ReadCloser
+	backend *Backend
+	once    sync.Once
+}
+
+func (t *trackedBody) Close() error {
+	t.once.Do(func() { t.backend.active.Add(-1) })
+	return t.ReadCloser.Close()
+}
+
+// trackedConn is a trackedBody for an upgraded connection
+type trackedConn struct {
+	*trackedBody
+	w io.Writer
+}
+
+func (t *trackedConn) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+// Addr returns the host:port to dial for the backend, with the scheme's
+// default port when its URL has none
+func (b *Backend) Addr() string {
+	if b.URL.Port() != "" {
+		return b.URL.Host
+	}
+	if b.URL.Scheme == "https" {
+		return net.JoinHostPort(b.URL.Hostname(), "443")
+	}
+	return net.JoinHostPort(b.URL.Hostname(), "80")
+}
+
+// Usable reports whether the backend has a URL the proxy can forward to
+func (b *Backend) Usable() bool {
+	if b == nil || b.URL == nil || b.Transport == nil || b.URL.Host == "" {
+		return false
+	}
+	return b.URL.Scheme == "http" || b.URL.Scheme == "https"
+}
+
+func transportKey(scheme, host string) string {
+	return scheme + "://" + host
+}
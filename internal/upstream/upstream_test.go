@@ -0,0 +1,641 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewPoolTransportSettings(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{
+		{
+			URL: "http://fast.internal:8080",
+			Transport: TransportConfig{
+				Timeout:         2 * time.Second,
+				MaxIdleConns:    200,
+				MaxConnsPerHost: 50,
+				IdleConnTimeout: 30 * time.Second,
+			},
+		},
+		{
+			URL: "https://slow.internal:8443",
+			Transport: TransportConfig{
+				Timeout:             30 * time.Second,
+				MaxIdleConns:        10,
+				MaxConnsPerHost:     5,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 15 * time.Second,
+				TLSServerName:       "slow.example.com",
+			},
+		},
+	}, "")
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+
+	transports := pool.Transports()
+	if len(transports) != 2 {
+		t.Fatalf("expected 2 transports, got %d", len(transports))
+	}
+
+	fast := transports["http://fast.internal:8080"]
+	slow := transports["https://slow.internal:8443"]
+	if fast == nil || slow == nil {
+		t.Fatalf("missing transport, got %v", transports)
+	}
+	if fast == slow {
+		t.Fatal("expected backends to have independent transports")
+	}
+
+	if fast.MaxIdleConns != 200 || fast.MaxIdleConnsPerHost != 50 {
+		t.Errorf("fast pool = %d/%d, want 200/50", fast.MaxIdleConns, fast.MaxIdleConnsPerHost)
+	}
+	if fast.ResponseHeaderTimeout != 2*time.Second {
+		t.Errorf("fast timeout = %v, want 2s", fast.ResponseHeaderTimeout)
+	}
+	if fast.TLSClientConfig != nil {
+		t.Error("expected default TLS config for fast backend")
+	}
+
+	if slow.MaxIdleConns != 10 || slow.MaxIdleConnsPerHost != 5 {
+		t.Errorf("slow pool = %d/%d, want 10/5", slow.MaxIdleConns, slow.MaxIdleConnsPerHost)
+	}
+	if slow.ResponseHeaderTimeout != 30*time.Second {
+		t.Errorf("slow timeout = %v, want 30s", slow.ResponseHeaderTimeout)
+	}
+	if slow.TLSHandshakeTimeout != 15*time.Second {
+		t.Errorf("slow TLS handshake timeout = %v, want 15s", slow.TLSHandshakeTimeout)
+	}
+	if slow.TLSClientConfig == nil || slow.TLSClientConfig.ServerName != "slow.example.com" {
+		t.Error("expected TLS server name override for slow backend")
+	}
+}
+
+func TestNewPoolErrors(t *testing.T) {
+	if _, err := NewPool(nil, ""); err == nil {
+		t.Error("expected error for empty pool")
+	}
+	if _, err := NewPool([]BackendConfig{{URL: "http://a:1"}, {URL: "http://a:1"}}, ""); err == nil {
+		t.Error("expected error for duplicate backend")
+	}
+	if _, err := NewPool([]BackendConfig{{URL: "://bad"}}, ""); err == nil {
+		t.Error("expected error for invalid URL")
+	}
+	if _, err := NewPool([]BackendConfig{{URL: "http://a:1", Weight: -1}}, ""); err == nil {
+		t.Error("expected error for negative weight")
+	}
+	if _, err := NewPool([]BackendConfig{{URL: "http://a:1"}}, "random"); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{
+		{URL: "http://a:1"},
+		{URL: "http://b:2"},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{pool.Next().URL.Host, pool.Next().URL.Host, pool.Next().URL.Host}
+	want := []string{"a:1", "b:2", "a:1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Next() #%d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPoolRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	pool, err := NewPool([]BackendConfig{{URL: srv.URL}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.CloseIdleConnections()
+
+	req := httptest.NewRequest("GET", srv.URL+"/", nil)
+	req.RequestURI = ""
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", resp.StatusCode)
+	}
+
+	unknown := httptest.NewRequest("GET", "http://unknown:9/", nil)
+	unknown.RequestURI = ""
+	if _, err := pool.RoundTrip(unknown); err == nil {
+		t.Error("expected error for unknown upstream")
+	}
+}
+
+func TestPoolAddRemove(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{{URL: "http://a:1"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := pool.Add(BackendConfig{URL: "http://b:2"})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if len(pool.Backends()) != 2 || pool.Transports()["http://b:2"] != b.Transport {
+		t.Fatal("expected added backend to be registered with its transport")
+	}
+	if _, err := pool.Add(BackendConfig{URL: "http://b:2"}); err == nil {
+		t.Error("expected error adding duplicate backend")
+	}
+
+	pool.Remove(b)
+	if len(pool.Backends()) != 1 || pool.Transports()["http://b:2"] != nil {
+		t.Error("expected backend to be removed")
+	}
+}
+
+func TestPoolUpdate(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{{URL: "http://a:1"}, {URL: "http://b:2"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := pool.Transports()["http://a:1"]
+	changed := pool.Transports()["http://b:2"]
+
+	if err := pool.Update([]BackendConfig{{URL: "http://a:1"}, {URL: "http://b:2", Weight: 3}, {URL: "http://c:3"}}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	transports := pool.Transports()
+	if len(pool.Backends()) != 3 || transports["http://c:3"] == nil {
+		t.Fatalf("expected the new backend to be registered, got %v", transports)
+	}
+	if transports["http://a:1"] != kept {
+		t.Error("expected an unchanged backend to keep its transport")
+	}
+	if transports["http://b:2"] == changed {
+		t.Error("expected a changed backend to get a new transport")
+	}
+
+	if err := pool.Update([]BackendConfig{{URL: "http://c:3"}}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if b := pool.Next(); len(pool.Backends()) != 1 || b.URL.Host != "c:3" {
+		t.Errorf("expected only the remaining backend to be picked, got %v", b.URL)
+	}
+
+	for _, configs := range [][]BackendConfig{nil, {{URL: "http://a:1"}, {URL: "http://a:1"}}, {{URL: "://bad"}}} {
+		if err := pool.Update(configs); err == nil {
+			t.Errorf("expected error updating to %v", configs)
+		}
+	}
+	if len(pool.Backends()) != 1 {
+		t.Error("expected a failed update to leave the backends unchanged")
+	}
+}
+
+func TestPoolPrepare(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{{URL: "http://a:1"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := pool.Prepare([]BackendConfig{{URL: "http://b:2"}})
+	if err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if b := pool.Next(); b.URL.Host != "a:1" {
+		t.Fatalf("expected Prepare to leave the pool unchanged, got %v", b.URL)
+	}
+	u.Apply()
+	if b := pool.Next(); len(pool.Backends()) != 1 || b.URL.Host != "b:2" {
+		t.Errorf("expected Apply to switch the backends, got %v", b.URL)
+	}
+}
+
+func TestPoolRoundTripUsesSelectedBackend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	pool, err := NewPool([]BackendConfig{{URL: srv.URL}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.Next()
+
+	// The backend is removed between selecting it and the round trip
+	if err := pool.Update([]BackendConfig{{URL: "http://other:1"}}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", srv.URL+"/", nil)
+	req.RequestURI = ""
+	req = req.WithContext(WithBackend(req.Context(), b))
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if b.Active() != 0 {
+		t.Errorf("expected the request to be released, got %d in flight", b.Active())
+	}
+}
+
+func TestPoolSkipsUnusableBackends(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{
+		{URL: "localhost:8080"}, // parses as scheme "localhost"
+		{URL: "http://good:1"},
+		{URL: "http://"},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		b := pool.Next()
+		if b == nil || b.URL.Host != "good:1" {
+			t.Fatalf("Next() = %v, want good backend", b)
+		}
+	}
+
+	bad, err := NewPool([]BackendConfig{{URL: "ftp://files:21"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := bad.Next(); b != nil {
+		t.Errorf("expected no usable backend, got %v", b.URL)
+	}
+
+	req := httptest.NewRequest("GET", "http://placeholder/", nil)
+	req.URL.Host = ""
+	if _, err := bad.RoundTrip(req); err != ErrNoBackend {
+		t.Errorf("expected ErrNoBackend, got %v", err)
+	}
+}
+
+func TestPoolWeighted(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{
+		{URL: "http://a:1", Weight: 3},
+		{URL: "http://b:2", Weight: 1},
+		{URL: "http://c:3"}, // defaults to weight 1
+	}, Weighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 500; i++ {
+		counts[pool.Next().URL.Host]++
+	}
+
+	want := map[string]int{"a:1": 300, "b:2": 100, "c:3": 100}
+	for host, n := range want {
+		if counts[host] != n {
+			t.Errorf("%s got %d requests, want %d (counts %v)", host, counts[host], n, counts)
+		}
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	busy := httptest.NewServer(handler)
+	defer busy.Close()
+	idle := httptest.NewServer(handler)
+	defer idle.Close()
+	defer close(release)
+
+	pool, err := NewPool([]BackendConfig{{URL: busy.URL}, {URL: idle.URL}}, LeastConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.CloseIdleConnections()
+
+	busyBackend := pool.Backends()[0]
+	roundTrip := func(target string) *http.Response {
+		req := httptest.NewRequest("GET", target+"/", nil)
+		req.RequestURI = ""
+		resp, err := pool.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Hold two requests open on the busy backend
+	open := []*http.Response{roundTrip(busy.URL), roundTrip(busy.URL)}
+	if busyBackend.Active() != 2 {
+		t.Fatalf("expected 2 active requests, got %d", busyBackend.Active())
+	}
+
+	for i := 0; i < 4; i++ {
+		if b := pool.Next(); b.URL.Host != strings.TrimPrefix(idle.URL, "http://") {
+			t.Errorf("Next() = %s, want idle backend", b.URL.Host)
+		}
+	}
+
+	// Closing the bodies releases the in-flight slots
+	for _, resp := range open {
+		resp.Body.Close()
+		resp.Body.Close() // double close must not double count
+	}
+	if busyBackend.Active() != 0 {
+		t.Errorf("expected 0 active requests after close, got %d", busyBackend.Active())
+	}
+}
+
+func TestPoolHashStable(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{
+		{URL: "http://a:1"},
+		{URL: "http://b:2"},
+		{URL: "http://c:3"},
+	}, IPHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := "client-" + strconv.Itoa(i)
+		first := pool.NextFor(key)
+		for j := 0; j < 5; j++ {
+			if b := pool.NextFor(key); b != first {
+				t.Fatalf("key %s moved from %s to %s", key, first.URL.Host, b.URL.Host)
+			}
+		}
+		used[first.URL.Host] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("expected keys spread over all backends, got %v", used)
+	}
+}
+
+func TestPoolHashMinimalRemap(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{
+		{URL: "http://a:1"},
+		{URL: "http://b:2"},
+		{URL: "http://c:3"},
+		{URL: "http://d:4"},
+	}, CookieHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keys = 1000
+	before := make([]*Backend, keys)
+	for i := range before {
+		before[i] = pool.NextFor("session-" + strconv.Itoa(i))
+	}
+
+	leaving := pool.Backends()[1]
+	pool.Remove(leaving)
+
+	moved := 0
+	for i, prev := range before {
+		b := pool.NextFor("session-" + strconv.Itoa(i))
+		if b == leaving {
+			t.Fatal("key mapped to removed backend")
+		}
+		if prev != leaving && b != prev {
+			t.Errorf("key session-%d moved from %s to %s although its backend stayed", i, prev.URL.Host, b.URL.Host)
+		}
+		if b != prev {
+			moved++
+		}
+	}
+
+	// Only the keys owned by the removed backend move, roughly a quarter
+	if moved == 0 || moved > keys/2 {
+		t.Errorf("expected about %d keys to move, %d moved", keys/4, moved)
+	}
+}
+
+func TestPoolHashWithoutKeyFallsBack(t *testing.T) {
+	pool, err := NewPool([]BackendConfig{{URL: "http://a:1"}, {URL: "http://b:2"}}, IPHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.NextFor("").URL.Host == pool.NextFor("").URL.Host {
+		t.Error("expected round-robin when no key is available")
+	}
+}
+
+func TestTransportSessionResumption(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// fullHandshakes sends requests over fresh connections and counts the
+	// handshakes that were not resumed
+	fullHandshakes := func(cacheSize int) int32 {
+		tr, err := NewTransport(TransportConfig{InsecureSkipVerify: true, TLSSessionCacheSize: cacheSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var full atomic.Int32
+		tr.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if !cs.DidResume {
+				full.Add(1)
+			}
+			return nil
+		}
+		tr.DisableKeepAlives = true
+		defer tr.CloseIdleConnections()
+
+		client := &http.Client{Transport: tr}
+		for i := 0; i < 5; i++ {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		return full.Load()
+	}
+
+	if got := fullHandshakes(0); got != 5 {
+		t.Errorf("expected 5 full handshakes without a session cache, got %d", got)
+	}
+	if got := fullHandshakes(16); got != 1 {
+		t.Errorf("expected 1 full handshake with a session cache, got %d", got)
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate and key
+// and returns their paths with a pool trusting the certificate
+func writeClientCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wproxy-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestTransportMutualTLS(t *testing.T) {
+	certFile, keyFile, clientCAs := writeClientCertificate(t)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Trust the test server through a CA bundle file
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(cfg TransportConfig) (string, error) {
+		tr, err := NewTransport(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if _, err := get(TransportConfig{TLSCAFile: caFile}); err == nil {
+		t.Error("expected handshake without a client certificate to fail")
+	}
+
+	body, err := get(TransportConfig{TLSCAFile: caFile, TLSClientCertFile: certFile, TLSClientKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("expected mutual TLS handshake to succeed: %v", err)
+	}
+	if body != "wproxy-client" {
+		t.Errorf("expected server to see the client certificate, got %q", body)
+	}
+}
+
+func TestNewTransportRejectsInvalidFiles(t *testing.T) {
+	certFile, keyFile, _ := writeClientCertificate(t)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []TransportConfig{
+		{TLSClientCertFile: certFile},
+		{TLSClientCertFile: certFile, TLSClientKeyFile: missing},
+		{TLSCAFile: missing},
+		{TLSCAFile: keyFile},
+	}
+	for _, cfg := range tests {
+		if _, err := NewTransport(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	h2cSrv := httptest.NewUnstartedServer(handler)
+	h2cSrv.Config.Protocols = new(http.Protocols)
+	h2cSrv.Config.Protocols.SetHTTP1(true)
+	h2cSrv.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cSrv.Start()
+	defer h2cSrv.Close()
+
+	tests := []struct {
+		name  string
+		url   string
+		http2 bool
+		want  string
+	}{
+		{"tls default", tlsSrv.URL, false, "HTTP/1.1"},
+		{"tls h2", tlsSrv.URL, true, "HTTP/2.0"},
+		{"plaintext default", h2cSrv.URL, false, "HTTP/1.1"},
+		{"plaintext h2c", h2cSrv.URL, true, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		tr, err := NewTransport(TransportConfig{InsecureSkipVerify: true, HTTP2: tt.http2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get(tt.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+
+		if resp.Proto != tt.want || string(body) != tt.want {
+			t.Errorf("%s: expected %s, got client %s server %s", tt.name, tt.want, resp.Proto, body)
+		}
+	}
+}